@@ -0,0 +1,57 @@
+package frankenphp
+
+import (
+	"io"
+	"time"
+)
+
+// bodyReader reads the request body for PHP, failing with RequestBodyTimeoutError if the client doesn't send data for the given timeout,
+// so that a stalled upload doesn't block the PHP thread.
+type bodyReader struct {
+	body    io.Reader
+	timeout time.Duration
+	// onTimeout is called once, when the timeout is reached
+	onTimeout func()
+
+	// the pending read writes to buf, not to the buffer of PHP which may be freed before it returns
+	buf     []byte
+	results chan bodyReadResult
+	err     error
+}
+
+type bodyReadResult struct {
+	n   int
+	err error
+}
+
+func newBodyReader(body io.Reader, timeout time.Duration, onTimeout func()) *bodyReader {
+	return &bodyReader{body: body, timeout: timeout, onTimeout: onTimeout, results: make(chan bodyReadResult, 1)}
+}
+
+func (br *bodyReader) Read(p []byte) (int, error) {
+	if br.err != nil {
+		return 0, br.err
+	}
+
+	if cap(br.buf) < len(p) {
+		br.buf = make([]byte, len(p))
+	}
+	buf := br.buf[:len(p)]
+	go func() {
+		n, err := br.body.Read(buf)
+		br.results <- bodyReadResult{n, err}
+	}()
+
+	timer := time.NewTimer(br.timeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-br.results:
+		return copy(p, buf[:res.n]), res.err
+	case <-timer.C:
+		br.err = RequestBodyTimeoutError
+		br.onTimeout()
+
+		return 0, br.err
+	}
+}
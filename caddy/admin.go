@@ -0,0 +1,368 @@
+package caddy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/dunglas/frankenphp"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// adminAPI is a module that provides the /frankenphp/ endpoints of the Caddy admin API.
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.frankenphp",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes returns the routes of the /frankenphp/ endpoints.
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/frankenphp/opcache/reset",
+			Handler: caddy.AdminHandlerFunc(a.handleOpcacheReset),
+		},
+		{
+			Pattern: "/frankenphp/extensions",
+			Handler: caddy.AdminHandlerFunc(a.handleExtensions),
+		},
+		{
+			Pattern: "/frankenphp/stats",
+			Handler: caddy.AdminHandlerFunc(a.handleStats),
+		},
+		{
+			Pattern: "/frankenphp/ini",
+			Handler: caddy.AdminHandlerFunc(a.handleIni),
+		},
+		{
+			Pattern: "/frankenphp/workers",
+			Handler: caddy.AdminHandlerFunc(a.handleWorkers),
+		},
+		{
+			Pattern: "/frankenphp/workers/",
+			Handler: caddy.AdminHandlerFunc(a.handleWorkerRecycle),
+		},
+	}
+}
+
+// handleOpcacheReset invalidates the opcode cache, typically after a deployment.
+func (adminAPI) handleOpcacheReset(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	threads, err := frankenphp.ResetOpcache()
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	return json.NewEncoder(w).Encode(struct {
+		Threads int `json:"threads"`
+	}{threads})
+}
+
+// handleExtensions lists the PHP extensions loaded by the embedded interpreter, and the PHP version.
+func (adminAPI) handleExtensions(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	extensions := frankenphp.LoadedExtensions()
+	if extensions == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("unable to list the loaded extensions"),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	return json.NewEncoder(w).Encode(struct {
+		PHPVersion string   `json:"php_version"`
+		Extensions []string `json:"extensions"`
+	}{frankenphp.Version().Version, extensions})
+}
+
+// handleStats returns the number of requests handled by PHP and the statistics of the workers, such as the number of requests waiting for an instance.
+func (adminAPI) handleStats(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	return json.NewEncoder(w).Encode(struct {
+		TotalRequests uint64        `json:"total_requests"`
+		Workers       []workerStats `json:"workers"`
+	}{frankenphp.TotalRequests(), readWorkerStats()})
+}
+
+// handleIni changes the php.ini directives that can be changed at runtime for all the following requests, without restarting the workers.
+// The body is a JSON object mapping the names of the directives to their values.
+func (adminAPI) handleIni(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	var directives map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&directives); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("invalid body, expected an object mapping php.ini directives to their values: %w", err),
+		}
+	}
+
+	if err := frankenphp.ApplyIni(directives); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, frankenphp.IniNotChangeableError) {
+			status = http.StatusBadRequest
+		}
+
+		return caddy.APIError{
+			HTTPStatus: status,
+			Err:        err,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	return json.NewEncoder(w).Encode(struct {
+		Applied map[string]string `json:"applied"`
+	}{directives})
+}
+
+// workerInfo describes a worker started by the running app.
+type workerInfo struct {
+	// Name is the base name of the worker script, it identifies the worker in the recycle endpoint if unambiguous
+	Name     string `json:"name"`
+	FileName string `json:"file_name"`
+	// Num is the configured number of instances, standby instances excluded
+	Num    int  `json:"num"`
+	Daemon bool `json:"daemon"`
+	// Status is "ready" when all the instances are ready to handle requests, "starting" otherwise; daemons are always "running"
+	Status         string `json:"status"`
+	ReadyInstances int    `json:"ready_instances"`
+	Instances      int    `json:"instances"`
+}
+
+// workerReadiness is the readiness of a worker once recycled.
+type workerReadiness struct {
+	FileName       string `json:"file_name"`
+	Ready          bool   `json:"ready"`
+	ReadyInstances int    `json:"ready_instances"`
+	Instances      int    `json:"instances"`
+}
+
+// handleWorkers lists the workers started by the running app (GET /frankenphp/workers).
+func (adminAPI) handleWorkers(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	workerFileNamesMu.RLock()
+	workers := make([]workerInfo, 0, len(workerFileNames))
+	for _, fileName := range workerFileNames {
+		daemon := slices.Contains(daemonFileNames, fileName)
+		ready, instances := frankenphp.WorkerReadiness(fileName)
+
+		status := "starting"
+		switch {
+		case daemon:
+			status = "running"
+		case ready >= instances:
+			status = "ready"
+		}
+
+		workers = append(workers, workerInfo{
+			Name:           filepath.Base(fileName),
+			FileName:       fileName,
+			Num:            workerNums[fileName],
+			Daemon:         daemon,
+			Status:         status,
+			ReadyInstances: ready,
+			Instances:      instances,
+		})
+	}
+	workerFileNamesMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	return json.NewEncoder(w).Encode(struct {
+		Workers []workerInfo `json:"workers"`
+	}{workers})
+}
+
+// workerRecycleTimeout is how long the recycle endpoints wait for the new instances of the workers to be ready.
+const workerRecycleTimeout = 30 * time.Second
+
+// recycleWorker recycles the worker fileName and returns its readiness, reporting whether it has been reached before ctx is done.
+func recycleWorker(ctx context.Context, fileName string) (workerReadiness, bool, error) {
+	inTime := true
+	if err := frankenphp.RecycleWorker(ctx, fileName); err != nil {
+		if !errors.Is(err, context.DeadlineExceeded) {
+			return workerReadiness{}, false, err
+		}
+
+		inTime = false
+	}
+
+	ready, instances := frankenphp.WorkerReadiness(fileName)
+
+	return workerReadiness{fileName, ready >= instances, ready, instances}, inTime, nil
+}
+
+// handleWorkersRecycle gracefully recycles the instances of all the workers concurrently (POST /frankenphp/workers/recycle), e.g. after a deployment,
+// and returns their readiness once the new instances are ready. If the new instances of a worker aren't ready in time, a 202 status is returned instead of 200.
+func (adminAPI) handleWorkersRecycle(w http.ResponseWriter, r *http.Request) error {
+	workerFileNamesMu.RLock()
+	fileNames := slices.Clone(workerFileNames)
+	workerFileNamesMu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(r.Context(), workerRecycleTimeout)
+	defer cancel()
+
+	var (
+		wg      sync.WaitGroup
+		workers = make([]workerReadiness, len(fileNames))
+		inTime  = make([]bool, len(fileNames))
+		errs    = make([]error, len(fileNames))
+	)
+	wg.Add(len(fileNames))
+	for i, fileName := range fileNames {
+		go func(i int, fileName string) {
+			defer wg.Done()
+			workers[i], inTime[i], errs[i] = recycleWorker(ctx, fileName)
+		}(i, fileName)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+
+	status := http.StatusOK
+	if slices.Contains(inTime, false) {
+		status = http.StatusAccepted
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	return json.NewEncoder(w).Encode(struct {
+		Workers []workerReadiness `json:"workers"`
+	}{workers})
+}
+
+// handleWorkerRecycle gracefully recycles the instances of a single worker (POST /frankenphp/workers/{name}/recycle), e.g. after a partial deployment,
+// and returns its readiness once the new instances are ready. The name is the file name of the worker as configured (URL-encoded), or its base name.
+// If the new instances aren't ready in time, a 202 status is returned instead of 200.
+// POST /frankenphp/workers/recycle recycles all the workers.
+func (a adminAPI) handleWorkerRecycle(w http.ResponseWriter, r *http.Request) error {
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/frankenphp/workers/")
+	if path == "recycle" {
+		if r.Method != http.MethodPost {
+			return caddy.APIError{
+				HTTPStatus: http.StatusMethodNotAllowed,
+				Err:        fmt.Errorf("method not allowed"),
+			}
+		}
+
+		return a.handleWorkersRecycle(w, r)
+	}
+
+	name, ok := strings.CutSuffix(path, "/recycle")
+	if !ok || name == "" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("not found"),
+		}
+	}
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	name, err := url.PathUnescape(name)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("invalid worker name: %w", err),
+		}
+	}
+
+	fileName, err := findWorkerFileName(name)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        err,
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), workerRecycleTimeout)
+	defer cancel()
+
+	readiness, inTime, err := recycleWorker(ctx, fileName)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+
+	status := http.StatusOK
+	if !inTime {
+		status = http.StatusAccepted
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	return json.NewEncoder(w).Encode(readiness)
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
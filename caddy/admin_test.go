@@ -0,0 +1,512 @@
+package caddy_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddytest"
+)
+
+func TestAdminOpcacheReset(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, "caddyfile")
+
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:2999/frankenphp/opcache/reset", nil)
+	tester.AssertResponseCode(req, http.StatusMethodNotAllowed)
+
+	resp, err := http.Post("http://localhost:2999/frankenphp/opcache/reset", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		// opcache may not be enabled in the test environment
+		if !strings.Contains(string(body), "opcache is not enabled") {
+			t.Errorf("unexpected response %d: %s", resp.StatusCode, body)
+		}
+
+		return
+	}
+
+	var result struct {
+		Threads int `json:"threads"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Threads <= 0 {
+		t.Errorf("expected at least one thread to be reset, got %d", result.Threads)
+	}
+}
+
+func TestAdminExtensions(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, "caddyfile")
+
+	resp, err := http.Get("http://localhost:2999/frankenphp/extensions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code %d", resp.StatusCode)
+	}
+
+	var result struct {
+		PHPVersion string   `json:"php_version"`
+		Extensions []string `json:"extensions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	if result.PHPVersion == "" {
+		t.Error("expected the PHP version to be set")
+	}
+	if !slices.Contains(result.Extensions, "Core") {
+		t.Errorf("expected the Core extension to be loaded, got %v", result.Extensions)
+	}
+}
+
+func TestAdminStats(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp {
+				worker {
+					file ../testdata/sleep.php
+					num 1
+					queue_size 1
+				}
+			}
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, "caddyfile")
+
+	// The first request is handled by the only instance, the second one is queued
+	var wg sync.WaitGroup
+	wg.Add(2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			defer wg.Done()
+			tester.AssertGetResponse("http://localhost:9080/sleep.php?sleep=1000", http.StatusOK, "slept for 1000 ms")
+		}()
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	resp, err := http.Get("http://localhost:2999/frankenphp/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Workers []struct {
+			FileName   string `json:"file_name"`
+			QueueDepth int    `json:"queue_depth"`
+		} `json:"workers"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Workers) != 1 || result.Workers[0].FileName != "../testdata/sleep.php" || result.Workers[0].QueueDepth != 1 {
+		t.Errorf("unexpected stats %v", result)
+	}
+
+	metrics, err := http.Get("http://localhost:2999/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer metrics.Body.Close()
+
+	body, _ := io.ReadAll(metrics.Body)
+	if !strings.Contains(string(body), `frankenphp_worker_queue_depth{worker="../testdata/sleep.php"} 1`) {
+		t.Errorf("the queue depth isn't exposed in the metrics: %s", body)
+	}
+
+	// The queue is full
+	tester.AssertGetResponse("http://localhost:9080/sleep.php", http.StatusServiceUnavailable, "")
+
+	wg.Wait()
+}
+
+func TestAdminTotalRequests(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, "caddyfile")
+
+	totalRequests := func() uint64 {
+		resp, err := http.Get("http://localhost:2999/frankenphp/stats")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var result struct {
+			TotalRequests uint64 `json:"total_requests"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+
+		return result.TotalRequests
+	}
+
+	before := totalRequests()
+	for i := 0; i < 3; i++ {
+		tester.AssertGetResponse(fmt.Sprintf("http://localhost:9080/index.php?i=%d", i), http.StatusOK, fmt.Sprintf("I am by birth a Genevese (%d)", i))
+	}
+	if after := totalRequests(); after != before+3 {
+		t.Errorf("expected %d total requests, got %d", before+3, after)
+	}
+
+	metrics, err := http.Get("http://localhost:2999/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer metrics.Body.Close()
+
+	body, _ := io.ReadAll(metrics.Body)
+	if !strings.Contains(string(body), fmt.Sprintf("frankenphp_requests_total %d", before+3)) {
+		t.Errorf("the total requests aren't exposed in the metrics: %s", body)
+	}
+}
+
+func TestAdminIni(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp {
+				worker ../testdata/ini.php 1
+			}
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, "caddyfile")
+
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:2999/frankenphp/ini", nil)
+	tester.AssertResponseCode(req, http.StatusMethodNotAllowed)
+
+	tester.AssertGetResponse("http://localhost:9080/ini.php?name=precision", http.StatusOK, "14")
+
+	resp, err := http.Post("http://localhost:2999/frankenphp/ini", "application/json", strings.NewReader(`{"precision": "10"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+
+	// the worker isn't restarted
+	tester.AssertGetResponse("http://localhost:9080/ini.php?name=precision", http.StatusOK, "10")
+
+	resp, err = http.Post("http://localhost:2999/frankenphp/ini", "application/json", strings.NewReader(`{"extension_dir": "/tmp"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "extension_dir") {
+		t.Errorf("unexpected response %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestAdminWorkerRecycle(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp {
+				worker ../testdata/worker-instance.php 1
+				worker ../testdata/worker.php 1
+			}
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, "caddyfile")
+
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:2999/frankenphp/workers/worker-instance.php/recycle", nil)
+	tester.AssertResponseCode(req, http.StatusMethodNotAllowed)
+
+	get := func(url string) string {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+
+		return string(body)
+	}
+
+	instance := get("http://localhost:9080/worker-instance.php")
+	if body := get("http://localhost:9080/worker.php"); !strings.Contains(body, "Requests handled: 0") {
+		t.Fatalf("unexpected response: %s", body)
+	}
+
+	resp, err := http.Post("http://localhost:2999/frankenphp/workers/worker-instance.php/recycle", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		FileName       string `json:"file_name"`
+		Ready          bool   `json:"ready"`
+		ReadyInstances int    `json:"ready_instances"`
+		Instances      int    `json:"instances"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || result.FileName != "../testdata/worker-instance.php" || !result.Ready || result.ReadyInstances != 1 || result.Instances != 1 {
+		t.Errorf("unexpected response %d: %+v", resp.StatusCode, result)
+	}
+
+	// only the recycled worker loses its state
+	if get("http://localhost:9080/worker-instance.php") == instance {
+		t.Error("the worker hasn't been recycled")
+	}
+	if body := get("http://localhost:9080/worker.php"); !strings.Contains(body, "Requests handled: 1") {
+		t.Errorf("the other worker has been recycled: %s", body)
+	}
+
+	resp, err = http.Post("http://localhost:2999/frankenphp/workers/unknown.php/recycle", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected status %d", resp.StatusCode)
+	}
+}
+
+func TestAdminWorkers(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp {
+				worker ../testdata/worker-instance.php 2
+				worker ../testdata/worker.php 1
+			}
+		}
+		`, "caddyfile")
+
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost:2999/frankenphp/workers", nil)
+	tester.AssertResponseCode(req, http.StatusMethodNotAllowed)
+
+	resp, err := http.Get("http://localhost:2999/frankenphp/workers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("unexpected Content-Type %q", ct)
+	}
+
+	type worker struct {
+		Name           string `json:"name"`
+		FileName       string `json:"file_name"`
+		Num            int    `json:"num"`
+		Daemon         bool   `json:"daemon"`
+		Status         string `json:"status"`
+		ReadyInstances int    `json:"ready_instances"`
+		Instances      int    `json:"instances"`
+	}
+	var result struct {
+		Workers []worker `json:"workers"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []worker{
+		{"worker-instance.php", "../testdata/worker-instance.php", 2, false, "ready", 2, 2},
+		{"worker.php", "../testdata/worker.php", 1, false, "ready", 1, 1},
+	}
+	if !slices.Equal(result.Workers, expected) {
+		t.Errorf("unexpected workers: %+v", result.Workers)
+	}
+}
+
+func TestAdminWorkersRecycle(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp {
+				worker ../testdata/worker-instance.php 1
+				worker ../testdata/worker.php 1
+			}
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, "caddyfile")
+
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:2999/frankenphp/workers/recycle", nil)
+	tester.AssertResponseCode(req, http.StatusMethodNotAllowed)
+
+	get := func(url string) string {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+
+		return string(body)
+	}
+
+	instance := get("http://localhost:9080/worker-instance.php")
+	if body := get("http://localhost:9080/worker.php"); !strings.Contains(body, "Requests handled: 0") {
+		t.Fatalf("unexpected response: %s", body)
+	}
+
+	resp, err := http.Post("http://localhost:2999/frankenphp/workers/recycle", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	type readiness struct {
+		FileName       string `json:"file_name"`
+		Ready          bool   `json:"ready"`
+		ReadyInstances int    `json:"ready_instances"`
+		Instances      int    `json:"instances"`
+	}
+	var result struct {
+		Workers []readiness `json:"workers"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []readiness{
+		{"../testdata/worker-instance.php", true, 1, 1},
+		{"../testdata/worker.php", true, 1, 1},
+	}
+	if resp.StatusCode != http.StatusOK || !slices.Equal(result.Workers, expected) {
+		t.Errorf("unexpected response %d: %+v", resp.StatusCode, result.Workers)
+	}
+
+	// all the workers lose their state
+	if get("http://localhost:9080/worker-instance.php") == instance {
+		t.Error("the worker-instance.php worker hasn't been recycled")
+	}
+	if body := get("http://localhost:9080/worker.php"); !strings.Contains(body, "Requests handled: 0") {
+		t.Errorf("the worker.php worker hasn't been recycled: %s", body)
+	}
+}
@@ -0,0 +1,144 @@
+package caddy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// The strategies of the response_buffering option.
+const (
+	// responseBufferingFull buffers the whole responses, they are sent with a Content-Length header and the flushes of PHP are ignored
+	responseBufferingFull = "full"
+	// responseBufferingStreaming flushes the responses after every write
+	responseBufferingStreaming = "streaming"
+	// responseBufferingAuto streams the responses of the streaming media types, and buffers the small responses not declaring their length
+	responseBufferingAuto = "auto"
+)
+
+// autoBufferingLimit is the size up to which the responses not declaring their length are buffered by the auto strategy.
+const autoBufferingLimit = 64 << 10
+
+// autoStreamTypes are the media types of the responses always streamed by the auto strategy.
+var autoStreamTypes = []string{"text/event-stream", "application/x-ndjson", "application/stream+json", "multipart/x-mixed-replace"}
+
+// validateResponseBuffering checks the value of the response_buffering option.
+func validateResponseBuffering(v string) error {
+	switch v {
+	case "", responseBufferingFull, responseBufferingStreaming, responseBufferingAuto:
+		return nil
+	}
+
+	return fmt.Errorf(`response_buffering: invalid value %q, must be "full", "streaming" or "auto"`, v)
+}
+
+// bufferingWriter applies the response buffering strategy. The responses having one of the StreamContentTypes are always streamed.
+type bufferingWriter struct {
+	responseWrapper
+	strategy    string
+	streamTypes []string
+	method      string
+
+	buf       bytes.Buffer
+	limit     int
+	buffering bool
+	stream    bool
+}
+
+func (bw *bufferingWriter) WriteHeader(status int) {
+	if !bw.final(status) {
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(bw.Header().Get("Content-Type"))
+	switch {
+	case slices.Contains(bw.streamTypes, mediaType), bw.strategy == responseBufferingStreaming:
+		bw.stream = true
+	case bw.method == http.MethodHead || status == http.StatusNoContent || status == http.StatusNotModified:
+	case bw.strategy == responseBufferingFull:
+		bw.buffering, bw.limit = true, -1
+	case slices.Contains(autoStreamTypes, mediaType):
+		bw.stream = true
+	case bw.Header().Get("Content-Length") == "":
+		bw.buffering, bw.limit = true, autoBufferingLimit
+	}
+
+	if bw.buffering {
+		return
+	}
+
+	bw.ResponseWriterWrapper.WriteHeader(status)
+	if bw.stream {
+		_ = bw.responseWrapper.FlushError()
+	}
+}
+
+func (bw *bufferingWriter) Write(d []byte) (int, error) {
+	bw.writeStatus()
+
+	if bw.buffering {
+		n, _ := bw.buf.Write(d)
+		if bw.limit >= 0 && bw.buf.Len() > bw.limit {
+			return n, bw.release()
+		}
+
+		return n, nil
+	}
+
+	n, err := bw.ResponseWriterWrapper.Write(d)
+	if err != nil || !bw.stream {
+		return n, err
+	}
+
+	return n, bw.responseWrapper.FlushError()
+}
+
+// release sends the buffered beginning of the response, the rest of the response isn't buffered.
+func (bw *bufferingWriter) release() error {
+	bw.buffering = false
+	bw.ResponseWriterWrapper.WriteHeader(bw.status)
+	_, err := bw.ResponseWriterWrapper.Write(bw.buf.Bytes())
+	bw.buf = bytes.Buffer{}
+
+	return err
+}
+
+// FlushError is ignored by the full strategy, the auto strategy stops buffering the response.
+func (bw *bufferingWriter) FlushError() error {
+	if bw.status == 0 || (bw.buffering && bw.limit < 0) {
+		return nil
+	}
+	if bw.buffering {
+		if err := bw.release(); err != nil {
+			return err
+		}
+	}
+
+	return bw.responseWrapper.FlushError()
+}
+
+// finish sends the buffered response with its length.
+func (bw *bufferingWriter) finish() error {
+	if !bw.buffering {
+		return nil
+	}
+
+	bw.buffering = false
+	if bw.Header().Get("Content-Length") == "" {
+		bw.Header().Set("Content-Length", strconv.Itoa(bw.buf.Len()))
+	}
+	bw.ResponseWriterWrapper.WriteHeader(bw.status)
+	_, err := bw.ResponseWriterWrapper.Write(bw.buf.Bytes())
+
+	return err
+}
+
+// Interface guards
+var (
+	_ http.ResponseWriter = (*bufferingWriter)(nil)
+	_ io.ReaderFrom       = (*bufferingWriter)(nil)
+)
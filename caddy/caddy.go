@@ -4,25 +4,57 @@
 package caddy
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"hash"
+	"html"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/mail"
+	"os"
+	"os/exec"
+	"os/user"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/encode"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/fileserver"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/rewrite"
 	"github.com/dunglas/frankenphp"
+	"github.com/dustin/go-humanize"
 	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
 )
 
 const defaultDocumentRoot = "public"
 
+// bootingRetryAfter is the delay, in seconds, after which the clients served the booting response should retry
+const bootingRetryAfter = 5
+
+// defaultNumSelector is the environment variable selecting the number of workers to start in the num_by_env tables
+const defaultNumSelector = "APP_ENV"
+
 func init() {
 	caddy.RegisterModule(FrankenPHPApp{})
 	caddy.RegisterModule(FrankenPHPModule{})
@@ -37,21 +69,239 @@ var mainPHPInterpreterKey mainPHPinterpreterKeyType
 
 var phpInterpreter = caddy.NewUsagePool()
 
-type phpInterpreterDestructor struct{}
+type phpInterpreterDestructor struct {
+	gracePeriod caddy.Duration
+}
 
-func (phpInterpreterDestructor) Destruct() error {
-	frankenphp.Shutdown()
+func (d phpInterpreterDestructor) Destruct() error {
+	shutdown(d.gracePeriod)
 
 	return nil
 }
 
+// shutdown stops the PHP interpreter once the in-flight PHP requests are finished.
+// When the grace period is exceeded, the remaining requests are aborted.
+// A zero grace period means waiting forever.
+func shutdown(gracePeriod caddy.Duration) {
+	if gracePeriod > 0 {
+		// the timer may fire after the interpreter has been restarted by a reload:
+		// only the requests of the interpreter being stopped are aborted
+		abortRequests := frankenphp.RequestsAborter()
+		timer := time.AfterFunc(time.Duration(gracePeriod), func() {
+			caddy.Log().Warn("grace period exceeded, aborting in-flight PHP requests", zap.Duration("grace_period", time.Duration(gracePeriod)))
+			abortRequests()
+		})
+		defer timer.Stop()
+	}
+
+	frankenphp.Shutdown()
+}
+
 type workerConfig struct {
 	// FileName sets the path to the worker script.
 	FileName string `json:"file_name,omitempty"`
 	// Num sets the number of workers to start.
 	Num int `json:"num,omitempty"`
-	// Env sets an extra environment variable to the given value. Can be specified more than once for multiple environment variables.
+	// NumPerCPU sets the number of workers to start per available CPU. When set, the number of workers is computed when the app starts and overrides Num.
+	NumPerCPU int `json:"num_per_cpu,omitempty"`
+	// NumByEnv sets the number of workers to start depending on the value of the environment variable set by the num_selector global option, with the same syntax as the `num` subdirective (e.g. `8`, `auto` or `2x`).
+	// The `default` entry is used when no entry matches. When set, the number of workers is resolved when the app is provisioned and overrides Num and NumPerCPU.
+	NumByEnv map[string]string `json:"num_by_env,omitempty"`
+	// Env sets an extra environment variable to the given value, it has priority over the env of the php handlers for the requests handled by the worker. Can be specified more than once for multiple environment variables.
 	Env map[string]string `json:"env,omitempty"`
+	// RestartBackoffMin and RestartBackoffMax configure the delay before restarting a crashed worker, doubling after each successive crash. Default: restart immediately.
+	RestartBackoffMin caddy.Duration `json:"restart_backoff_min,omitempty"`
+	RestartBackoffMax caddy.Duration `json:"restart_backoff_max,omitempty"`
+	// IdleTimeout stops the instances that didn't handle any request for this duration, they are started again on demand. Default: never stop idle instances.
+	IdleTimeout caddy.Duration `json:"idle_timeout,omitempty"`
+	// Min sets the number of instances kept running when IdleTimeout is set.
+	Min int `json:"min,omitempty"`
+	// MaxLifetime gracefully recycles the instances running for this duration, staggered over an extra 10%, e.g. to pick up rotated secrets. Default: never recycle.
+	MaxLifetime caddy.Duration `json:"max_lifetime,omitempty"`
+	// QueueSize caps the number of requests waiting for an instance of the worker, the requests beyond are rejected with a 503 error. Default: unlimited.
+	QueueSize int `json:"queue_size,omitempty"`
+	// RunAs sets the user and optionally the group ("user[:group]", names or IDs) used by the worker to access the filesystem. Linux only.
+	RunAs string `json:"run_as,omitempty"`
+	// ShutdownScript sets a script executed by every instance when it stops, because it is recycled or the app is stopping, e.g. to close connections cleanly. The global variables of the worker are available.
+	ShutdownScript string `json:"shutdown_script,omitempty"`
+	// StickyBy binds the requests having the same value for the StickyKey cookie or header (`cookie` or `header`) to the same instance, e.g. to improve the hit rate of in-memory caches. The requests without it are handled by any instance.
+	StickyBy  string `json:"sticky_by,omitempty"`
+	StickyKey string `json:"sticky_key,omitempty"`
+	// Dispatch sets how the requests are assigned to the instances: `round_robin` assigns them in turn, `random` to a random instance, `least_busy` to the instance having the fewest requests being handled or waiting for it. The requests bound by StickyBy aren't affected. Default: the requests are handled by the first available instance.
+	Dispatch string `json:"dispatch,omitempty"`
+	// RetryOnRestart retries up to this number of times the GET and HEAD requests whose instance stops before responding, e.g. because it is recycled. Their responses are buffered until complete or flushed by PHP. Default: never retry.
+	RetryOnRestart int `json:"retry_on_restart,omitempty"`
+	// WarmupRequest sets the path of a synthetic GET request handled by every instance as soon as it is ready, before any other request, e.g. to warm the JIT and the caches. Its failures are logged, or prevent the server from starting if WarmupFatal is set.
+	WarmupRequest string `json:"warmup_request,omitempty"`
+	WarmupFatal   bool   `json:"warmup_fatal,omitempty"`
+	// Standby sets the number of standby instances started in addition to Num: they don't handle requests until an active instance crashes, then one of them takes over. Can't be used with StickyBy nor Dispatch.
+	Standby int `json:"standby,omitempty"`
+	// Daemon runs the worker as a daemon, e.g. a queue consumer: it doesn't handle HTTP requests (they get a 404 error), and it is restarted every time it exits. Can't be used with Standby, StickyBy, Dispatch, IdleTimeout nor WarmupRequest.
+	Daemon bool `json:"daemon,omitempty"`
+	// EmbeddedApp sets the name of the embedded app the relative paths of the worker are resolved against. Default: the embedded app itself.
+	EmbeddedApp string `json:"embedded_app,omitempty"`
+}
+
+// embeddedAppPath returns the path of the embedded app with the given name, or of the embedded app itself if name is empty.
+// The path is empty if there is no embedded app.
+func embeddedAppPath(name string) (string, error) {
+	if name == "" {
+		return frankenphp.EmbeddedAppPath, nil
+	}
+
+	if p, ok := frankenphp.EmbeddedAppPaths[name]; ok {
+		return p, nil
+	}
+
+	return "", fmt.Errorf("unknown embedded app %q", name)
+}
+
+// features returns the options of the worker restricting the ones it can be combined with,
+// validated the same way when the configuration is loaded and when the workers start.
+func (wc *workerConfig) features() frankenphp.WorkerFeatures {
+	return frankenphp.WorkerFeatures{
+		Standby:       wc.Standby,
+		StickyBy:      wc.StickyBy,
+		Dispatch:      wc.Dispatch,
+		Daemon:        wc.Daemon,
+		IdleTimeout:   time.Duration(wc.IdleTimeout),
+		WarmupRequest: wc.WarmupRequest,
+	}
+}
+
+// resolveEmbeddedApp resolves the relative paths of the worker against its embedded app, if any.
+func (wc *workerConfig) resolveEmbeddedApp() error {
+	appPath, err := embeddedAppPath(wc.EmbeddedApp)
+	if err != nil || appPath == "" {
+		return err
+	}
+
+	if filepath.IsLocal(wc.FileName) {
+		wc.FileName = filepath.Join(appPath, wc.FileName)
+	}
+	if wc.ShutdownScript != "" && filepath.IsLocal(wc.ShutdownScript) {
+		wc.ShutdownScript = filepath.Join(appPath, wc.ShutdownScript)
+	}
+
+	return nil
+}
+
+// parseNum parses the number of workers to start: an integer,
+// "auto" (one worker per CPU) or "<n>x" (n workers per CPU). It replaces the number previously set, if any.
+func (wc *workerConfig) parseNum(v string) error {
+	if v == "auto" {
+		wc.Num, wc.NumPerCPU = 0, 1
+
+		return nil
+	}
+
+	if m, ok := strings.CutSuffix(v, "x"); ok {
+		n, err := strconv.Atoi(m)
+		if err != nil {
+			return err
+		}
+		if n <= 0 {
+			return errors.New("the multiplier must be positive")
+		}
+
+		wc.Num, wc.NumPerCPU = 0, n
+
+		return nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return err
+	}
+
+	wc.Num, wc.NumPerCPU = n, 0
+
+	return nil
+}
+
+// resolveNumByEnv sets the number of workers to start using the entry of NumByEnv matching the value of the selector environment variable,
+// or its default entry.
+func (wc *workerConfig) resolveNumByEnv(selector string) error {
+	if len(wc.NumByEnv) == 0 {
+		return nil
+	}
+
+	value := os.Getenv(selector)
+	num, ok := wc.NumByEnv[value]
+	if !ok {
+		if num, ok = wc.NumByEnv["default"]; !ok {
+			return fmt.Errorf("no num entry matching %s=%q and no default entry", selector, value)
+		}
+	}
+
+	if err := wc.parseNum(num); err != nil {
+		return fmt.Errorf("invalid num %q: %w", num, err)
+	}
+
+	return nil
+}
+
+// loadWorkerConfigs reads a JSON array of worker configurations from a file.
+func loadWorkerConfigs(path string) ([]workerConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+
+	var workers []workerConfig
+	if err := decoder.Decode(&workers); err != nil {
+		return nil, err
+	}
+
+	for i, wc := range workers {
+		if wc.FileName == "" {
+			return nil, fmt.Errorf(`worker %d: the "file_name" property must be specified`, i)
+		}
+		if wc.Num < 0 || wc.NumPerCPU < 0 {
+			return nil, fmt.Errorf("worker %d: the number of workers must be positive", i)
+		}
+		for env, num := range wc.NumByEnv {
+			if err := (&workerConfig{}).parseNum(num); err != nil {
+				return nil, fmt.Errorf("worker %d: invalid num for %q: %w", i, env, err)
+			}
+		}
+		if wc.RestartBackoffMin < 0 || (wc.RestartBackoffMin > 0 && wc.RestartBackoffMax < wc.RestartBackoffMin) {
+			return nil, fmt.Errorf("worker %d: invalid restart backoff", i)
+		}
+		if wc.IdleTimeout < 0 || wc.Min < 0 {
+			return nil, fmt.Errorf("worker %d: invalid idle timeout", i)
+		}
+		if wc.MaxLifetime < 0 {
+			return nil, fmt.Errorf("worker %d: invalid max lifetime", i)
+		}
+		if wc.QueueSize < 0 {
+			return nil, fmt.Errorf("worker %d: invalid queue size", i)
+		}
+		if (wc.StickyBy != "" && wc.StickyBy != "cookie" && wc.StickyBy != "header") || (wc.StickyBy == "") != (wc.StickyKey == "") {
+			return nil, fmt.Errorf("worker %d: invalid sticky_by", i)
+		}
+		switch wc.Dispatch {
+		case "", "round_robin", "least_busy", "random":
+		default:
+			return nil, fmt.Errorf(`worker %d: invalid dispatch %q, must be "round_robin", "least_busy" or "random"`, i, wc.Dispatch)
+		}
+		if wc.Standby < 0 {
+			return nil, fmt.Errorf("worker %d: invalid standby", i)
+		}
+		if err := wc.features().Validate(); err != nil {
+			return nil, fmt.Errorf("worker %d: %w", i, err)
+		}
+
+		if err := workers[i].resolveEmbeddedApp(); err != nil {
+			return nil, fmt.Errorf("worker %d: %w", i, err)
+		}
+	}
+
+	return workers, nil
 }
 
 type FrankenPHPApp struct {
@@ -59,23 +309,253 @@ type FrankenPHPApp struct {
 	NumThreads int `json:"num_threads,omitempty"`
 	// Workers configures the worker scripts to start.
 	Workers []workerConfig `json:"workers,omitempty"`
+	// Env sets a default environment variable for all the php handlers. Values set by the handlers have priority. Can be specified more than once for multiple environment variables.
+	Env map[string]string `json:"env,omitempty"`
+	// GracePeriod sets how long to wait for in-flight PHP requests to finish before shutting down or restarting the PHP interpreter. Default: wait forever.
+	GracePeriod caddy.Duration `json:"grace_period,omitempty"`
+	// OpcacheStatsInterval enables logging the opcache statistics (hit rate, memory usage, interned strings buffer saturation) at the given interval.
+	OpcacheStatsInterval caddy.Duration `json:"opcache_stats_interval,omitempty"`
+	// MaxConcurrentRequests caps the number of PHP requests handled simultaneously across all the php handlers, the requests passed to an external interpreter (php_binary) aren't counted nor limited, a warning is logged for such handlers. Default: unlimited.
+	MaxConcurrentRequests int `json:"max_concurrent_requests,omitempty"`
+	// InsufficientThreads sets what happens when NumThreads doesn't leave a thread for the requests not handled by workers: `error` refuses to start, `auto` increases NumThreads. Default: `error`.
+	InsufficientThreads string `json:"insufficient_threads,omitempty"`
+	// LogMessages sets the format and the verbosity of the lifecycle log lines of FrankenPHP (start, stop, reload): `verbose` decorates them, `quiet` logs plain messages without the decorative ones, `json` logs stable messages with an `event` field. Default: `verbose`.
+	LogMessages string `json:"log_messages,omitempty"`
+	// ReservedThreads sets the number of threads never assigned to workers, so that the requests not handled by workers always have capacity. Default: 1.
+	ReservedThreads int `json:"reserved_threads,omitempty"`
+	// WarmupParallelism bounds the number of worker instances booting concurrently. Default: all the instances boot concurrently.
+	WarmupParallelism int `json:"warmup_parallelism,omitempty"`
+	// QueueTimeout sets how long a request waits for a free slot when MaxConcurrentRequests is reached before a 503 is returned. Default: wait forever.
+	QueueTimeout caddy.Duration `json:"queue_timeout,omitempty"`
+	// IniFile sets the path of the php.ini file to load instead of the default one.
+	IniFile string `json:"ini_file,omitempty"`
+	// Timezone sets the default timezone of PHP (the `date.timezone` php.ini directive), a name of the tz database such as `Europe/Paris`. The `-d` flags of PHPArgs take precedence.
+	Timezone string `json:"timezone,omitempty"`
+	// PHPArgs passes command line flags to PHP, as with the PHP CLI. Only `-c <path>` and `-d key[=value]` are supported.
+	PHPArgs []string `json:"php_args,omitempty"`
+	// Defaults sets default options for all the php handlers, the handlers setting them explicitly take precedence.
+	Defaults *ModuleDefaults `json:"defaults,omitempty"`
+	// NumSelector sets the environment variable selecting the entry of the num_by_env tables of the workers. Default: `APP_ENV`.
+	NumSelector string `json:"num_selector,omitempty"`
+	// StrictEnv logs a warning for every environment variable overridden with a different value by a layer of higher precedence
+	// (global `env` < `defaults` < handler `env` < worker `env`).
+	StrictEnv bool `json:"strict_env,omitempty"`
+	// ResponseBuffering sets the default response buffering strategy of the php handlers not setting one: `full`, `streaming` or `auto`. Default: the responses are sent as PHP flushes them.
+	ResponseBuffering string `json:"response_buffering,omitempty"`
+	// AllowedRoots lists the directories the document roots of the php handlers must be in, once their symbolic links are evaluated. The roots depending on the request are checked for every request, a 403 error is returned for the ones outside. Default: any root is allowed.
+	AllowedRoots []string `json:"allowed_roots,omitempty"`
+	// GracefulSignals lists the signals (`SIGHUP`, `SIGUSR1` or `SIGUSR2`) stopping the process once the in-flight PHP requests are finished, within the grace period.
+	GracefulSignals []string `json:"graceful_signals,omitempty"`
+	// ImmediateSignals lists the signals (`SIGHUP`, `SIGUSR1` or `SIGUSR2`) stopping the process immediately, aborting the in-flight PHP requests.
+	ImmediateSignals []string `json:"immediate_signals,omitempty"`
+
+	stopOpcacheStats chan struct{}
+	signalHandler    *signalHandler
+	allowedRoots     []string
+}
+
+// ModuleDefaults are the default options of the php handlers.
+type ModuleDefaults struct {
+	// Env sets default environment variables, the ones set by the handlers have priority. They also have priority over the `env` global option.
+	Env map[string]string `json:"env,omitempty"`
+	// SplitPath sets the default substrings for splitting the URI into two parts, see FrankenPHPModule.SplitPath.
+	SplitPath []string `json:"split_path,omitempty"`
+	// ResolveRootSymlink enables resolving the `root` directory by default, the handlers can disable it with `resolve_root_symlink false`.
+	ResolveRootSymlink bool `json:"resolve_root_symlink,omitempty"`
 }
 
 // CaddyModule returns the Caddy module information.
-func (a FrankenPHPApp) CaddyModule() caddy.ModuleInfo {
+func (FrankenPHPApp) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
 		ID:  "frankenphp",
-		New: func() caddy.Module { return &a },
+		New: func() caddy.Module { return new(FrankenPHPApp) },
+	}
+}
+
+// postMaxSize is the post_max_size php.ini directive of the embedded interpreter, in bytes.
+var postMaxSize atomic.Int64
+
+// Provision sets up the app.
+func (f *FrankenPHPApp) Provision(ctx caddy.Context) error {
+	switch f.InsufficientThreads {
+	case "", "error", "auto":
+	default:
+		return fmt.Errorf(`insufficient_threads: invalid value %q, must be "error" or "auto"`, f.InsufficientThreads)
+	}
+
+	if _, err := parseLogMessages(f.LogMessages); err != nil {
+		return err
+	}
+
+	if err := validateResponseBuffering(f.ResponseBuffering); err != nil {
+		return err
+	}
+
+	if f.Timezone != "" {
+		if _, err := time.LoadLocation(f.Timezone); err != nil || f.Timezone == "Local" {
+			return fmt.Errorf("timezone: invalid value %q, must be a name of the tz database such as Europe/Paris", f.Timezone)
+		}
+	}
+
+	if f.StrictEnv && f.Defaults != nil {
+		warnEnvConflicts(ctx.Logger(), "env", f.Env, "defaults", f.Defaults.Env)
+	}
+
+	if len(f.AllowedRoots) > 0 {
+		allowedRoots, err := resolveAllowedRoots(f.AllowedRoots)
+		if err != nil {
+			return err
+		}
+		f.allowedRoots = allowedRoots
+	}
+
+	for i, name := range f.GracefulSignals {
+		sig, err := parseSignal(name)
+		if err != nil {
+			return fmt.Errorf("graceful_signal: %w", err)
+		}
+		f.GracefulSignals[i] = sig
+	}
+	for i, name := range f.ImmediateSignals {
+		sig, err := parseSignal(name)
+		if err != nil {
+			return fmt.Errorf("immediate_signal: %w", err)
+		}
+		if slices.Contains(f.GracefulSignals, sig) {
+			return fmt.Errorf("%s can't be both a graceful and an immediate signal", sig)
+		}
+		f.ImmediateSignals[i] = sig
+	}
+
+	selector := f.NumSelector
+	if selector == "" {
+		selector = defaultNumSelector
+	}
+	for i := range f.Workers {
+		if err := f.Workers[i].resolveNumByEnv(selector); err != nil {
+			return fmt.Errorf("worker %s: %w", f.Workers[i].FileName, err)
+		}
+		if err := f.Workers[i].features().Validate(); err != nil {
+			return fmt.Errorf("worker %s: %w", f.Workers[i].FileName, err)
+		}
+	}
+
+	if f.NumThreads <= 0 {
+		return nil
 	}
+
+	var numWorkers int
+	for _, w := range f.Workers {
+		switch {
+		case w.NumPerCPU > 0:
+			numWorkers += w.NumPerCPU * runtime.NumCPU()
+		case w.Num > 0:
+			numWorkers += w.Num
+		default:
+			// the default of frankenphp.Init
+			numWorkers += runtime.GOMAXPROCS(0) * 2
+		}
+		numWorkers += w.Standby
+	}
+
+	// workers hold their thread, the reserved ones must be left to handle the other requests
+	reservedThreads := max(f.ReservedThreads, 1)
+	if f.NumThreads >= numWorkers+reservedThreads {
+		return nil
+	}
+	if f.InsufficientThreads != "auto" {
+		return fmt.Errorf("num_threads (%d) must be greater than the number of workers (%d) to leave the reserved threads (%d), increase it or set insufficient_threads to auto", f.NumThreads, numWorkers, reservedThreads)
+	}
+
+	ctx.Logger().Warn("not enough threads for the workers, increasing num_threads", zap.Int("num_threads", numWorkers+reservedThreads), zap.Int("workers", numWorkers), zap.Int("reserved_threads", reservedThreads))
+	f.NumThreads = numWorkers + reservedThreads
+
+	return nil
 }
 
 func (f *FrankenPHPApp) Start() error {
 	repl := caddy.NewReplacer()
 	logger := caddy.Log()
 
-	opts := []frankenphp.Option{frankenphp.WithNumThreads(f.NumThreads), frankenphp.WithLogger(logger)}
-	for _, w := range f.Workers {
-		opts = append(opts, frankenphp.WithWorkers(repl.ReplaceKnown(w.FileName, ""), w.Num, w.Env))
+	logMessages, err := parseLogMessages(f.LogMessages)
+	if err != nil {
+		return err
+	}
+
+	opts := []frankenphp.Option{
+		frankenphp.WithNumThreads(f.NumThreads),
+		frankenphp.WithLogger(logger),
+		frankenphp.WithLogMessages(logMessages),
+		frankenphp.WithMaxConcurrentRequests(f.MaxConcurrentRequests, time.Duration(f.QueueTimeout)),
+		frankenphp.WithWarmupParallelism(f.WarmupParallelism),
+	}
+	if f.ReservedThreads > 0 {
+		opts = append(opts, frankenphp.WithReservedThreads(f.ReservedThreads))
+	}
+	if f.IniFile != "" {
+		opts = append(opts, frankenphp.WithIniFile(repl.ReplaceKnown(f.IniFile, "")))
+	}
+	if f.Timezone != "" {
+		opts = append(opts, frankenphp.WithTimezone(f.Timezone))
+	}
+	if len(f.PHPArgs) > 0 {
+		opts = append(opts, frankenphp.WithPhpFlags(f.PHPArgs...))
+	}
+	workerFileNames := make([]string, 0, len(f.Workers))
+	workerNums := make(map[string]int, len(f.Workers))
+	var daemonFileNames []string
+	for i, w := range f.Workers {
+		if w.NumPerCPU > 0 {
+			w.Num = w.NumPerCPU * runtime.NumCPU()
+			f.Workers[i].Num = w.Num
+		}
+
+		fileName := repl.ReplaceKnown(w.FileName, "")
+		opts = append(opts, frankenphp.WithWorkers(fileName, w.Num, w.Env))
+		workerFileNames = append(workerFileNames, fileName)
+		workerNums[fileName] = w.Num
+		if w.RestartBackoffMin > 0 {
+			opts = append(opts, frankenphp.WithWorkerRestartBackoff(fileName, time.Duration(w.RestartBackoffMin), time.Duration(w.RestartBackoffMax)))
+		}
+		if w.IdleTimeout > 0 {
+			opts = append(opts, frankenphp.WithWorkerIdleTimeout(fileName, time.Duration(w.IdleTimeout), w.Min))
+		}
+		if w.MaxLifetime > 0 {
+			opts = append(opts, frankenphp.WithWorkerMaxLifetime(fileName, time.Duration(w.MaxLifetime)))
+		}
+		if w.QueueSize > 0 {
+			opts = append(opts, frankenphp.WithWorkerQueueSize(fileName, w.QueueSize))
+		}
+		if w.ShutdownScript != "" {
+			opts = append(opts, frankenphp.WithWorkerShutdownScript(fileName, repl.ReplaceKnown(w.ShutdownScript, "")))
+		}
+		if w.StickyBy != "" {
+			opts = append(opts, frankenphp.WithWorkerStickyBy(fileName, w.StickyBy, w.StickyKey))
+		}
+		if w.Dispatch != "" {
+			opts = append(opts, frankenphp.WithWorkerDispatch(fileName, w.Dispatch))
+		}
+		if w.RetryOnRestart > 0 {
+			opts = append(opts, frankenphp.WithWorkerRetryOnRestart(fileName, w.RetryOnRestart))
+		}
+		if w.Standby > 0 {
+			opts = append(opts, frankenphp.WithWorkerStandby(fileName, w.Standby))
+		}
+		if w.Daemon {
+			opts = append(opts, frankenphp.WithWorkerDaemon(fileName))
+			daemonFileNames = append(daemonFileNames, fileName)
+		}
+		if w.WarmupRequest != "" {
+			opts = append(opts, frankenphp.WithWorkerWarmupRequest(fileName, w.WarmupRequest, w.WarmupFatal))
+		}
+		if w.RunAs != "" {
+			uid, gid, err := lookupCredentials(w.RunAs)
+			if err != nil {
+				return fmt.Errorf("workers %q: %w", fileName, err)
+			}
+
+			opts = append(opts, frankenphp.WithWorkerRunAs(fileName, uid, gid))
+		}
 	}
 
 	_, loaded, err := phpInterpreter.LoadOrNew(mainPHPInterpreterKey, func() (caddy.Destructor, error) {
@@ -83,24 +563,106 @@ func (f *FrankenPHPApp) Start() error {
 			return nil, err
 		}
 
-		return phpInterpreterDestructor{}, nil
+		return phpInterpreterDestructor{f.GracePeriod}, nil
 	})
 	if err != nil {
 		return err
 	}
 
 	if loaded {
-		frankenphp.Shutdown()
+		shutdown(f.GracePeriod)
 		if err := frankenphp.Init(opts...); err != nil {
 			return err
 		}
+
+		frankenphp.LogLifecycle(logger, "reload")
+	}
+
+	setWorkerFileNames(workerFileNames, daemonFileNames, workerNums)
+
+	if size, err := frankenphp.PostMaxSize(); err != nil {
+		logger.Warn("unable to read post_max_size, oversized form data won't be rejected", zap.Error(err))
+	} else {
+		postMaxSize.Store(size)
+	}
+
+	if f.OpcacheStatsInterval > 0 {
+		f.stopOpcacheStats = make(chan struct{})
+		go logOpcacheStats(logger, time.Duration(f.OpcacheStatsInterval), f.stopOpcacheStats)
+	}
+
+	if len(f.GracefulSignals) > 0 || len(f.ImmediateSignals) > 0 {
+		f.signalHandler = newSignalHandler(f.GracefulSignals, f.ImmediateSignals)
+		f.signalHandler.start(logger)
 	}
 
 	return nil
 }
 
-func (*FrankenPHPApp) Stop() error {
-	caddy.Log().Info("FrankenPHP stopped 🐘")
+// parseLogMessages parses the log_messages option.
+func parseLogMessages(v string) (frankenphp.LogMessages, error) {
+	switch v {
+	case "", "verbose":
+		return frankenphp.LogMessagesVerbose, nil
+	case "quiet":
+		return frankenphp.LogMessagesQuiet, nil
+	case "json":
+		return frankenphp.LogMessagesJSON, nil
+	}
+
+	return 0, fmt.Errorf(`log_messages: invalid value %q, must be "verbose", "quiet" or "json"`, v)
+}
+
+// logOpcacheStats periodically logs the opcache statistics until stop is closed.
+func logOpcacheStats(logger *zap.Logger, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		stats, err := frankenphp.ReadOpcacheStats()
+		if err != nil {
+			logger.Warn("unable to read opcache stats", zap.Error(err))
+
+			continue
+		}
+
+		logger.Info("opcache stats",
+			zap.Bool("enabled", stats.Enabled),
+			zap.Float64("hit_rate", stats.HitRate),
+			zap.Int("cached_scripts", stats.CachedScripts),
+			zap.Bool("cache_full", stats.CacheFull),
+			zap.Int("used_memory", stats.UsedMemory),
+			zap.Int("free_memory", stats.FreeMemory),
+			zap.Int("wasted_memory", stats.WastedMemory),
+			zap.Float64("interned_strings_saturation", stats.InternedStringsSaturation()),
+		)
+	}
+}
+
+func (f *FrankenPHPApp) Stop() error {
+	if f.stopOpcacheStats != nil {
+		close(f.stopOpcacheStats)
+		f.stopOpcacheStats = nil
+	}
+
+	if f.signalHandler != nil {
+		f.signalHandler.close()
+		f.signalHandler = nil
+	}
+
+	// The interpreter is shared between configs: it is only shut down
+	// (after the in-flight requests are drained) when no config uses it anymore
+	if _, err := phpInterpreter.Delete(mainPHPInterpreterKey); err != nil {
+		return err
+	}
+
+	frankenphp.LogLifecycle(caddy.Log(), "stop")
 
 	return nil
 }
@@ -115,192 +677,2516 @@ func (f *FrankenPHPApp) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 					return d.ArgErr()
 				}
 
-				v, err := strconv.Atoi(d.Val())
-				if err != nil {
-					return err
+				v, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return err
+				}
+
+				f.NumThreads = v
+
+			case "grace_period":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+
+				v, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return err
+				}
+
+				f.GracePeriod = caddy.Duration(v)
+
+			case "graceful_signal":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				for _, name := range args {
+					if _, err := parseSignal(name); err != nil {
+						return d.Errf("graceful_signal: %v", err)
+					}
+				}
+				f.GracefulSignals = append(f.GracefulSignals, args...)
+
+			case "immediate_signal":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				for _, name := range args {
+					if _, err := parseSignal(name); err != nil {
+						return d.Errf("immediate_signal: %v", err)
+					}
+				}
+				f.ImmediateSignals = append(f.ImmediateSignals, args...)
+
+			case "opcache_stats_interval":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+
+				v, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return err
+				}
+
+				f.OpcacheStatsInterval = caddy.Duration(v)
+
+			case "reserved_threads":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+
+				v, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return err
+				}
+				if v < 1 {
+					return d.Errf("reserved_threads must be at least 1, got %d", v)
+				}
+
+				f.ReservedThreads = v
+
+			case "warmup_parallelism":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+
+				v, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return err
+				}
+				if v < 0 {
+					return d.Errf("warmup_parallelism must be positive, got %d", v)
+				}
+
+				f.WarmupParallelism = v
+
+			case "log_messages":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if _, err := parseLogMessages(d.Val()); err != nil {
+					return d.Err(err.Error())
+				}
+
+				f.LogMessages = d.Val()
+
+			case "insufficient_threads":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+
+				switch d.Val() {
+				case "error", "auto":
+					f.InsufficientThreads = d.Val()
+				default:
+					return d.Errf(`invalid insufficient_threads %q, must be "error" or "auto"`, d.Val())
+				}
+
+			case "ini_file":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+
+				f.IniFile = d.Val()
+				if frankenphp.EmbeddedAppPath != "" && filepath.IsLocal(f.IniFile) {
+					f.IniFile = filepath.Join(frankenphp.EmbeddedAppPath, f.IniFile)
+				}
+
+			case "timezone":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+
+				f.Timezone = d.Val()
+
+			case "num_selector":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+
+				f.NumSelector = d.Val()
+
+			case "strict_env":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+				f.StrictEnv = true
+
+			case "response_buffering":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if err := validateResponseBuffering(d.Val()); err != nil {
+					return d.Err(err.Error())
+				}
+
+				f.ResponseBuffering = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "allowed_roots":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+
+				f.AllowedRoots = append(f.AllowedRoots, args...)
+
+			case "php_args":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+
+				f.PHPArgs = append(f.PHPArgs, args...)
+
+			case "max_concurrent_requests":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+
+				v, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return err
+				}
+
+				f.MaxConcurrentRequests = v
+
+			case "queue_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+
+				v, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return err
+				}
+
+				f.QueueTimeout = caddy.Duration(v)
+
+			case "worker":
+				wc := workerConfig{}
+				if d.NextArg() {
+					wc.FileName = d.Val()
+				}
+
+				if d.NextArg() {
+					if err := wc.parseNum(d.Val()); err != nil {
+						return d.Errf("invalid worker num %q: %v", d.Val(), err)
+					}
+				}
+
+				for d.NextBlock(1) {
+					v := d.Val()
+					switch v {
+					case "file":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						wc.FileName = d.Val()
+					case "num":
+						if d.NextArg() {
+							if err := wc.parseNum(d.Val()); err != nil {
+								return d.Errf("invalid worker num %q: %v", d.Val(), err)
+							}
+
+							break
+						}
+
+						// a table of numbers of workers by environment
+						for d.NextBlock(2) {
+							env := d.Val()
+							args := d.RemainingArgs()
+							if len(args) != 1 {
+								return d.ArgErr()
+							}
+							if err := (&workerConfig{}).parseNum(args[0]); err != nil {
+								return d.Errf("invalid worker num %q for %q: %v", args[0], env, err)
+							}
+
+							if wc.NumByEnv == nil {
+								wc.NumByEnv = make(map[string]string)
+							}
+							wc.NumByEnv[env] = args[0]
+						}
+						if len(wc.NumByEnv) == 0 {
+							return d.ArgErr()
+						}
+					case "env":
+						args := d.RemainingArgs()
+						if len(args) != 2 {
+							return d.ArgErr()
+						}
+						if wc.Env == nil {
+							wc.Env = make(map[string]string)
+						}
+						wc.Env[args[0]] = args[1]
+					case "restart_backoff":
+						args := d.RemainingArgs()
+						if len(args) != 2 {
+							return d.ArgErr()
+						}
+
+						minDelay, err := caddy.ParseDuration(args[0])
+						if err != nil {
+							return d.Errf("invalid restart_backoff min %q: %v", args[0], err)
+						}
+						maxDelay, err := caddy.ParseDuration(args[1])
+						if err != nil {
+							return d.Errf("invalid restart_backoff max %q: %v", args[1], err)
+						}
+						if minDelay <= 0 || maxDelay < minDelay {
+							return d.Errf("invalid restart_backoff: min must be positive and lower than max")
+						}
+
+						wc.RestartBackoffMin = caddy.Duration(minDelay)
+						wc.RestartBackoffMax = caddy.Duration(maxDelay)
+					case "idle_timeout":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+
+						v, err := caddy.ParseDuration(d.Val())
+						if err != nil {
+							return d.Errf("invalid idle_timeout %q: %v", d.Val(), err)
+						}
+						if v <= 0 {
+							return d.Errf("invalid idle_timeout %q: must be positive", d.Val())
+						}
+
+						wc.IdleTimeout = caddy.Duration(v)
+					case "max_lifetime":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+
+						v, err := caddy.ParseDuration(d.Val())
+						if err != nil {
+							return d.Errf("invalid max_lifetime %q: %v", d.Val(), err)
+						}
+						if v <= 0 {
+							return d.Errf("invalid max_lifetime %q: must be positive", d.Val())
+						}
+
+						wc.MaxLifetime = caddy.Duration(v)
+					case "min":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+
+						v, err := strconv.Atoi(d.Val())
+						if err != nil {
+							return err
+						}
+						if v < 0 {
+							return d.Errf("invalid min %q: must be positive", d.Val())
+						}
+
+						wc.Min = v
+					case "run_as":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+
+						wc.RunAs = d.Val()
+					case "queue_size":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+
+						v, err := strconv.Atoi(d.Val())
+						if err != nil {
+							return err
+						}
+						if v < 0 {
+							return d.Errf("invalid queue_size %q: must be positive", d.Val())
+						}
+
+						wc.QueueSize = v
+					case "standby":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+
+						v, err := strconv.Atoi(d.Val())
+						if err != nil {
+							return err
+						}
+						if v < 0 {
+							return d.Errf("invalid standby %q: must be positive", d.Val())
+						}
+
+						wc.Standby = v
+					case "daemon":
+						if d.NextArg() {
+							return d.ArgErr()
+						}
+
+						wc.Daemon = true
+					case "shutdown":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+
+						wc.ShutdownScript = d.Val()
+					case "sticky_by":
+						args := d.RemainingArgs()
+						if len(args) != 2 {
+							return d.ArgErr()
+						}
+						if args[0] != "cookie" && args[0] != "header" {
+							return d.Errf(`invalid sticky_by %q, must be "cookie" or "header"`, args[0])
+						}
+
+						wc.StickyBy, wc.StickyKey = args[0], args[1]
+					case "dispatch":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						switch d.Val() {
+						case "round_robin", "least_busy", "random":
+							wc.Dispatch = d.Val()
+						default:
+							return d.Errf(`invalid dispatch %q, must be "round_robin", "least_busy" or "random"`, d.Val())
+						}
+						if d.NextArg() {
+							return d.ArgErr()
+						}
+					case "retry_on_restart":
+						wc.RetryOnRestart = 1
+						if d.NextArg() {
+							v, err := strconv.Atoi(d.Val())
+							if err != nil {
+								return err
+							}
+							if v <= 0 {
+								return d.Errf("invalid retry_on_restart %q: must be positive", d.Val())
+							}
+
+							wc.RetryOnRestart = v
+						}
+						if d.NextArg() {
+							return d.ArgErr()
+						}
+					case "warmup_request":
+						args := d.RemainingArgs()
+						if len(args) == 0 || len(args) > 2 {
+							return d.ArgErr()
+						}
+						if !strings.HasPrefix(args[0], "/") {
+							return d.Errf("invalid warmup_request %q: must be an absolute path", args[0])
+						}
+						if len(args) == 2 && args[1] != "fatal" {
+							return d.Errf(`invalid warmup_request flag %q, must be "fatal"`, args[1])
+						}
+
+						wc.WarmupRequest, wc.WarmupFatal = args[0], len(args) == 2
+					case "embedded_app":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						wc.EmbeddedApp = d.Val()
+					}
+
+					if wc.FileName == "" {
+						return errors.New(`The "file" argument must be specified`)
+					}
+					if err := wc.features().Validate(); err != nil {
+						return d.Err(err.Error())
+					}
+
+					if err := wc.resolveEmbeddedApp(); err != nil {
+						return d.Err(err.Error())
+					}
+				}
+
+				f.Workers = append(f.Workers, wc)
+
+			case "workers_from":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+
+				workers, err := loadWorkerConfigs(d.Val())
+				if err != nil {
+					return d.Errf("invalid workers file %q: %v", d.Val(), err)
+				}
+
+				f.Workers = append(f.Workers, workers...)
+
+			case "env":
+				if f.Env == nil {
+					f.Env = make(map[string]string)
+				}
+
+				args := d.RemainingArgs()
+				if len(args) == 2 {
+					f.Env[args[0]] = args[1]
+
+					break
+				}
+				if len(args) != 0 {
+					return d.ArgErr()
+				}
+
+				for d.NextBlock(1) {
+					k := d.Val()
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					f.Env[k] = d.Val()
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				}
+
+			case "defaults":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if f.Defaults == nil {
+					f.Defaults = &ModuleDefaults{}
+				}
+
+				for d.NextBlock(1) {
+					switch d.Val() {
+					case "env":
+						args := d.RemainingArgs()
+						if len(args) != 2 {
+							return d.ArgErr()
+						}
+						if f.Defaults.Env == nil {
+							f.Defaults.Env = make(map[string]string)
+						}
+						f.Defaults.Env[args[0]] = args[1]
+					case "split":
+						f.Defaults.SplitPath = d.RemainingArgs()
+						if len(f.Defaults.SplitPath) == 0 {
+							return d.ArgErr()
+						}
+					case "resolve_root_symlink":
+						if d.NextArg() {
+							return d.ArgErr()
+						}
+						f.Defaults.ResolveRootSymlink = true
+					default:
+						return d.Errf("unknown defaults subdirective %q, only env, split and resolve_root_symlink are supported", d.Val())
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func parseGlobalOption(d *caddyfile.Dispenser, _ interface{}) (interface{}, error) {
+	app := &FrankenPHPApp{}
+	if err := app.UnmarshalCaddyfile(d); err != nil {
+		return nil, err
+	}
+
+	// tell Caddyfile adapter that this is the JSON for an app
+	return httpcaddyfile.App{
+		Name:  "frankenphp",
+		Value: caddyconfig.JSON(app, nil),
+	}, nil
+}
+
+type FrankenPHPModule struct {
+	// Root sets the root folder to the site. Default: `root` directive, or the path of the public directory of the embed app it exists.
+	Root string `json:"root,omitempty"`
+	// SplitPath sets the substrings for splitting the URI into two parts. The first matching substring will be used to split the "path info" from the path. The first piece is suffixed with the matching substring and will be assumed as the actual resource (CGI script) name. The second piece will be set to PATH_INFO for the CGI script to use. Default: `.php`.
+	SplitPath []string `json:"split_path,omitempty"`
+	// Index sets the script executed for the requests targeting a directory (e.g. `index.php`). Default: directories aren't executed.
+	Index string `json:"index,omitempty"`
+	// EmbeddedApp sets the name of the embedded app serving the requests: the root is resolved against it. Default: the embedded app itself.
+	EmbeddedApp string `json:"embedded_app,omitempty"`
+	// ResolveRootSymlink enables resolving the `root` directory to its actual value by evaluating a symbolic link, if one exists. Default: the `defaults` of the frankenphp app, disabled otherwise.
+	ResolveRootSymlink *bool `json:"resolve_root_symlink,omitempty"`
+	// Version sets the version of the app (e.g. its build SHA), exposed to PHP as the APP_VERSION variable. FRANKENPHP_VERSION is always set.
+	Version string `json:"version,omitempty"`
+	// ExposeMtime exposes the modification time of the executed script to PHP as the SCRIPT_MTIME variable (a Unix timestamp), and its ETag, computed as by the file server, as SCRIPT_ETAG, e.g. to implement conditional responses.
+	ExposeMtime bool `json:"expose_mtime,omitempty"`
+	// RequestIDHeader sets the name of a header containing the ID of the request (the `{http.request.uuid}` placeholder, also exposed to PHP as REQUEST_ID): it is added to the request, replacing the value sent by the client, and to the response.
+	RequestIDHeader string `json:"request_id_header,omitempty"`
+	// DocumentRootEnv overrides the value of the DOCUMENT_ROOT CGI variable, without changing the directory the scripts are read from. Default: the root.
+	DocumentRootEnv string `json:"document_root_env,omitempty"`
+	// ScriptNamePrefix prepends a base path (e.g. `/app`) to the SCRIPT_NAME and PHP_SELF CGI variables, for apps behind a proxy stripping it from the path, so that they generate correct URLs.
+	ScriptNamePrefix string `json:"script_name_prefix,omitempty"`
+	// UploadTmpDir sets the directory where PHP stores uploaded files (the `upload_tmp_dir` php.ini directive). Relative paths are resolved against the root. The directory is created if it doesn't exist. Default: the system's temporary directory.
+	UploadTmpDir string `json:"upload_tmp_dir,omitempty"`
+	// AutoPrepend sets a file to include before every script (the `auto_prepend_file` php.ini directive). Relative paths are resolved against the root.
+	AutoPrepend string `json:"auto_prepend,omitempty"`
+	// AutoAppend sets a file to include after every script (the `auto_append_file` php.ini directive). Relative paths are resolved against the root.
+	AutoAppend string `json:"auto_append,omitempty"`
+	// PHPBinary sets the path to an external PHP interpreter supporting the CGI protocol (e.g. php-cgi) to use instead of the embedded one, for instance to run a different PHP version.
+	PHPBinary string `json:"php_binary,omitempty"`
+	// Hide is a list of files or folders that must not be executed, with the same syntax as the `hide` option of the file_server directive.
+	Hide []string `json:"hide,omitempty"`
+	// ForwardHeaders restricts the request headers passed to PHP (as HTTP_* variables and through apache_request_headers()) to the listed ones. Default: all the headers are passed.
+	ForwardHeaders []string `json:"forward_headers,omitempty"`
+	// HideHeaders lists request headers never passed to PHP, for instance the ones that could be spoofed by clients (e.g. `X-Accel-Redirect`).
+	HideHeaders []string `json:"hide_headers,omitempty"`
+	// MissingScript sets how requests for PHP scripts that don't exist are handled: `404` or `500` to return the corresponding error without invoking PHP, or `pass` to let PHP handle them. Default: `404`.
+	MissingScript string `json:"missing_script,omitempty"`
+	// ErrorFormat sets how the errors occurring before PHP is invoked (e.g. a missing script or an invalid root) are rendered: `json`, `html` or `plain`. Only the status and its text are sent. Default: the errors are returned to Caddy, which renders them using `handle_errors` if any.
+	ErrorFormat string `json:"error_format,omitempty"`
+	// RateLimitEvents and RateLimitWindow limit the number of requests each client (identified by its IP address) can make: up to RateLimitEvents per RateLimitWindow. The requests beyond are rejected with a 429 error. Default: unlimited.
+	RateLimitEvents int            `json:"rate_limit_events,omitempty"`
+	RateLimitWindow caddy.Duration `json:"rate_limit_window,omitempty"`
+	// AllowedMethods rejects the requests using other HTTP methods with a 405 error, having an `Allow` header listing the allowed methods, before invoking PHP. Default: all the methods are allowed.
+	AllowedMethods []string `json:"allowed_methods,omitempty"`
+	// RequireHeaders rejects the requests not having all the given headers with the given values (placeholders are supported) before invoking PHP: with a 401 error if a header is missing, a 403 error if its value doesn't match.
+	RequireHeaders map[string]string `json:"require_headers,omitempty"`
+	// ExpectContinue sets how the requests with an `Expect: 100-continue` header are handled: `auto` sends the 100 Continue response when PHP starts reading the body, `reject` returns a 417 error without invoking PHP. Default: `auto`.
+	ExpectContinue string `json:"expect_continue,omitempty"`
+	// MaxRequestBody sets the maximum size of the request bodies in bytes, larger requests are rejected with a 413 error. Form data larger than the post_max_size php.ini directive is also rejected. Default: unlimited.
+	MaxRequestBody int64 `json:"max_request_body,omitempty"`
+	// DecompressRequest decodes the gzip and deflate encoded request bodies (`Content-Encoding` header) before invoking PHP, and updates `CONTENT_LENGTH` accordingly. The bodies are decoded in memory, the ones larger than MaxDecompressedBody once decoded are rejected with a 413 error, other encodings with a 415 error.
+	DecompressRequest bool `json:"decompress_request,omitempty"`
+	// MaxDecompressedBody sets the maximum size of the decoded request bodies in bytes when DecompressRequest is set. Default: 10MiB.
+	MaxDecompressedBody int64 `json:"max_decompressed_body,omitempty"`
+	// RequestTrailers exposes the trailers sent by the clients after the request bodies (e.g. by gRPC-Web clients) to PHP as HTTP_TRAILER_<NAME> variables. As they are only received after the body, the bodies of the requests declaring trailers (`Trailer` header) are read in memory before invoking PHP, the ones larger than MaxTrailersBody are rejected with a 413 error.
+	RequestTrailers bool `json:"request_trailers,omitempty"`
+	// MaxTrailersBody sets the maximum size of the bodies of the requests declaring trailers in bytes when RequestTrailers is set. Default: 10MiB.
+	MaxTrailersBody int64 `json:"max_trailers_body,omitempty"`
+	// MaxResponseBytes sets the maximum size of the bodies of the PHP responses in bytes, the larger responses are logged. The responses having one of the StreamContentTypes aren't limited. Default: unlimited.
+	MaxResponseBytes int64 `json:"max_response_bytes,omitempty"`
+	// AbortLargeResponses returns a 500 error instead of the responses larger than MaxResponseBytes. The responses are buffered up to the limit.
+	AbortLargeResponses bool `json:"abort_large_responses,omitempty"`
+	// ServerAdmin sets the email address of the server administrator, exposed in the SERVER_ADMIN variable and in the SERVER_SIGNATURE variable, as with Apache.
+	ServerAdmin string `json:"server_admin,omitempty"`
+	// MaxRequestHeaderBytes sets the maximum total size of the request headers (names and values) in bytes, larger requests are rejected with a 431 error before invoking PHP. Default: unlimited.
+	MaxRequestHeaderBytes int64 `json:"max_request_header_bytes,omitempty"`
+	// ScriptStatCacheTTL caches the results of the checks of the existence of the scripts (stat calls) for this duration, to avoid hitting slow filesystems for every request. The changes to the filesystem (e.g. a script created or removed) are only noticed once the cached results expire. Default: no cache.
+	ScriptStatCacheTTL caddy.Duration `json:"script_stat_cache_ttl,omitempty"`
+	// SlowLog logs, at the WARN level, the PHP requests taking longer than the given duration, with their script name and duration. Default: disabled.
+	SlowLog caddy.Duration `json:"slow_log,omitempty"`
+	// BodyReadTimeout sets the maximum time to wait for data from the client when PHP reads the request body. When it is reached, the script is aborted as if the client disconnected, and a 408 error is returned instead of its response. Default: no timeout.
+	BodyReadTimeout caddy.Duration `json:"body_read_timeout,omitempty"`
+	// RequestTimeout sets the maximum duration of the whole request, including reading its body, executing PHP and writing the response. When it is reached, the script is aborted as if the client disconnected, and a 504 error is returned if the response hasn't been started yet, otherwise it is truncated. Unlike the max_execution_time php.ini directive, the time spent waiting for the client is counted. Default: no timeout.
+	RequestTimeout caddy.Duration `json:"request_timeout,omitempty"`
+	// CORS answers the CORS preflight requests without invoking PHP, and adds the CORS headers to the responses of the cross-origin requests.
+	CORS *CORSConfig `json:"cors,omitempty"`
+	// HTTPSOnly refuses to execute PHP for requests not received over TLS, directly or through a trusted proxy: `redirect` redirects them to HTTPS, `reject` returns a 403 error.
+	HTTPSOnly string `json:"https_only,omitempty"`
+	// StrictPHPExistence returns a 404 error for requests targeting a PHP script that doesn't exist, instead of letting them fall through to the front controller after a rewrite (e.g. by php_server).
+	StrictPHPExistence bool `json:"strict_php_existence,omitempty"`
+	// EmitEvents emits a `frankenphp` event through the Caddy events app when a PHP request completes, with the script name, status, duration and worker.
+	EmitEvents bool `json:"emit_events,omitempty"`
+	// DisableKeepAlive closes the client connection after every PHP response.
+	DisableKeepAlive bool `json:"disable_keepalive,omitempty"`
+	// KeepAliveTimeout hints HTTP/1 clients how long idle connections are kept open, using the `Keep-Alive` response header. The idle timeout itself is configured at the server level.
+	KeepAliveTimeout caddy.Duration `json:"keepalive_timeout,omitempty"`
+	// RemoveResponseHeaders removes the given headers from the responses generated by PHP (e.g. `X-Powered-By`). Can be specified more than once for multiple headers.
+	RemoveResponseHeaders []string `json:"remove_response_headers,omitempty"`
+	// SetResponseHeaders sets the given headers on the responses generated by PHP, overriding the values set by PHP. Can be specified more than once for multiple headers.
+	SetResponseHeaders map[string]string `json:"set_response_headers,omitempty"`
+	// CookieDefaults adds the configured attributes (e.g. `Secure`, `SameSite`) to the cookies set by PHP, unless they set them explicitly.
+	CookieDefaults *CookieDefaultsConfig `json:"cookie_defaults,omitempty"`
+	// ResponseBuffering sets the response buffering strategy: `full` buffers the whole responses and sends them with a Content-Length header, ignoring the flushes of PHP; `streaming` flushes the responses after every write; `auto` streams the responses of the streaming media types (e.g. `text/event-stream` and `application/x-ndjson`) and buffers up to 64 KiB the responses not declaring their length. The responses having one of the StreamContentTypes are always streamed. Default: the global `response_buffering` option.
+	ResponseBuffering string `json:"response_buffering,omitempty"`
+	// StreamContentTypes lists the media types of the responses that are streamed to the client: they are flushed after every write instead of being buffered (e.g. `text/event-stream`).
+	StreamContentTypes []string `json:"stream_content_types,omitempty"`
+	// PreserveHeaderCase preserves the exact case of the names of the response headers set by PHP, for legacy clients sensitive to it. Non-standard, only HTTP/1 responses are affected.
+	PreserveHeaderCase bool `json:"preserve_header_case,omitempty"`
+	// Compress compresses the responses with the given encoding (`gzip`, `zstd`, or `br` if a brotli encoder module is available) when the client accepts it. The responses already encoded, by PHP or by the `encode` handler, are left untouched. Default: `off`.
+	Compress string `json:"compress,omitempty"`
+	// Precompressed serves the Brotli-compressed `<path>.br` file next to the path of GET and HEAD requests in the root, typically written by a worker caching its pages, instead of executing PHP when it exists and the client accepts Brotli.
+	Precompressed bool `json:"precompressed,omitempty"`
+	// BootingResponse is the path of a static file served with a 503 error and a `Retry-After` header, instead of an error, to the requests received while the workers are booting (e.g. during a reload). Relative paths are resolved from the current directory.
+	BootingResponse string `json:"booting_response,omitempty"`
+	// FixContentLength checks that the Content-Length header set by PHP matches the length of the body: the header is fixed if the body is shorter, and the response is sent chunked if it is longer. A warning is logged in both cases. The responses declaring more than 1 MiB aren't checked.
+	FixContentLength bool `json:"fix_content_length,omitempty"`
+	// Coalesce serves the identical concurrent GET and HEAD requests with a single PHP execution, sharing its response. The requests are identical when their method, URI and the Accept, Accept-Encoding, Accept-Language, Authorization and Cookie headers are the same. The shared responses are sent once complete, they are never streamed.
+	Coalesce bool `json:"coalesce,omitempty"`
+	// HeadOptimization sets how the HEAD requests are handled: `discard` runs PHP, discards the body and sends the headers once PHP is done, with a Content-Length header matching the discarded body if PHP didn't set one; `cache` also answers them without invoking PHP with the headers of a recent successful GET response to the same request, for HeadCacheTTL; `off` passes the response of PHP as is. Default: `discard`.
+	HeadOptimization string `json:"head_optimization,omitempty"`
+	// HeadCacheTTL is how long the headers of a GET response answer the HEAD requests with HeadOptimization `cache`. Default: 10s.
+	HeadCacheTTL caddy.Duration `json:"head_cache_ttl,omitempty"`
+	// Profiling adds the CPU time used by PHP and the peak memory it allocated to the response headers (`X-PHP-CPU-Time`, in seconds, and `X-PHP-Alloc`, in bytes), as measured when PHP sends them, and the final values to the access logs (`php_cpu_time` and `php_alloc`).
+	Profiling bool `json:"profiling,omitempty"`
+	// ChecksumTrailer computes the SHA-256 checksum of the bodies of the chunked responses while they are streamed, and sends it in the `X-Checksum-SHA256` trailer, hex-encoded. Only the clients accepting trailers (sending the `TE: trailers` header) get it.
+	ChecksumTrailer bool `json:"checksum_trailer,omitempty"`
+	// Env sets an extra environment variable to the given value. Can be specified more than once for multiple environment variables.
+	Env       map[string]string `json:"env,omitempty"`
+	globalEnv map[string]string
+	// staticEnv and dynamicEnv are the merged global and handler env, split between the values without placeholders, copied as is, and the other ones
+	staticEnv  map[string]string
+	dynamicEnv map[string]string
+	// bootingResponse is the content of the BootingResponse file, and bootingContentType its media type
+	bootingResponse    []byte
+	bootingContentType string
+	// allowedRoots are the resolved AllowedRoots of the app
+	allowedRoots []string
+	// uploadTmpDir is the resolved UploadTmpDir, when it can be resolved at provision time
+	uploadTmpDir  string
+	rateLimiter   *rateLimiter
+	statCache     *statCache
+	headCache     *headCache
+	coalesceGroup *singleflight.Group
+	encoder       *encode.Encode
+	logger        *zap.Logger
+	ctx           caddy.Context
+	events        *caddyevents.App
+}
+
+// CaddyModule returns the Caddy module information.
+func (FrankenPHPModule) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.php",
+		New: func() caddy.Module { return new(FrankenPHPModule) },
+	}
+}
+
+// Provision sets up the module.
+func (f *FrankenPHPModule) Provision(ctx caddy.Context) error {
+	f.logger = ctx.Logger(f)
+
+	app, err := ctx.App("frankenphp")
+	if err != nil {
+		return err
+	}
+	f.globalEnv = app.(*FrankenPHPApp).Env
+
+	if f.ResponseBuffering == "" {
+		f.ResponseBuffering = app.(*FrankenPHPApp).ResponseBuffering
+	}
+
+	// the options set by the handler take precedence over the defaults
+	if defaults := app.(*FrankenPHPApp).Defaults; defaults != nil {
+		if len(defaults.Env) > 0 {
+			globalEnv := make(map[string]string, len(f.globalEnv)+len(defaults.Env))
+			for k, v := range f.globalEnv {
+				globalEnv[k] = v
+			}
+			for k, v := range defaults.Env {
+				globalEnv[k] = v
+			}
+			f.globalEnv = globalEnv
+		}
+
+		if len(f.SplitPath) == 0 {
+			f.SplitPath = append([]string{}, defaults.SplitPath...)
+		}
+
+		if f.ResolveRootSymlink == nil && defaults.ResolveRootSymlink {
+			resolve := true
+			f.ResolveRootSymlink = &resolve
+		}
+	}
+
+	if f.EmitEvents {
+		eventsApp, err := ctx.App("events")
+		if err != nil {
+			return err
+		}
+
+		f.ctx = ctx
+		f.events = eventsApp.(*caddyevents.App)
+	}
+
+	appPath, err := embeddedAppPath(f.EmbeddedApp)
+	if err != nil {
+		return err
+	}
+
+	if f.Root == "" {
+		if appPath == "" {
+			f.Root = "{http.vars.root}"
+		} else {
+			f.Root = filepath.Join(appPath, defaultDocumentRoot)
+			resolve := false
+			f.ResolveRootSymlink = &resolve
+		}
+	} else {
+		if appPath != "" && filepath.IsLocal(f.Root) {
+			f.Root = filepath.Join(appPath, f.Root)
+		}
+	}
+
+	// the roots depending on the request are checked for every request
+	if f.allowedRoots = app.(*FrankenPHPApp).allowedRoots; f.allowedRoots != nil && !strings.Contains(f.Root, "{") {
+		if err := checkAllowedRoot(f.Root, f.allowedRoots); err != nil {
+			return err
+		}
+	}
+
+	if app := app.(*FrankenPHPApp); app.StrictEnv {
+		warnEnvConflicts(f.logger, "global env", f.globalEnv, "handler env", f.Env)
+
+		handlerEnv := make(map[string]string, len(f.globalEnv)+len(f.Env))
+		for k, v := range f.globalEnv {
+			handlerEnv[k] = v
+		}
+		for k, v := range f.Env {
+			handlerEnv[k] = v
+		}
+		for _, w := range app.Workers {
+			if workerServedBy(w.FileName, f.Root) {
+				warnEnvConflicts(f.logger.With(zap.String("worker", w.FileName)), "handler env", handlerEnv, "worker env", w.Env)
+			}
+		}
+	}
+
+	f.staticEnv, f.dynamicEnv = splitEnv(f.globalEnv, f.Env)
+
+	if len(f.SplitPath) == 0 {
+		f.SplitPath = []string{".php"}
+	} else {
+		splitPath, err := normalizeSplitPath(f.SplitPath, f.logger)
+		if err != nil {
+			return err
+		}
+		f.SplitPath = splitPath
+	}
+
+	switch f.MissingScript {
+	case "", "404", "500", "pass":
+	default:
+		return fmt.Errorf(`missing_script: invalid value %q, must be "404", "500" or "pass"`, f.MissingScript)
+	}
+
+	// the methods are case-sensitive, but the standard ones are always uppercase
+	for i, method := range f.AllowedMethods {
+		f.AllowedMethods[i] = strings.ToUpper(method)
+	}
+
+	if err := validateResponseBuffering(f.ResponseBuffering); err != nil {
+		return err
+	}
+
+	switch f.ErrorFormat {
+	case "", "json", "html", "plain":
+	default:
+		return fmt.Errorf(`error_format: invalid value %q, must be "json", "html" or "plain"`, f.ErrorFormat)
+	}
+
+	if f.RateLimitEvents < 0 || f.RateLimitWindow < 0 || (f.RateLimitEvents > 0) != (f.RateLimitWindow > 0) {
+		return errors.New("rate_limit: the number of events and the window must be positive")
+	}
+	if f.RateLimitEvents > 0 {
+		f.rateLimiter = newRateLimiter(f.RateLimitEvents, time.Duration(f.RateLimitWindow), maxRateLimitedClients)
+	}
+
+	if f.ScriptStatCacheTTL < 0 {
+		return errors.New("script_stat_cache_ttl: the duration must be positive")
+	}
+	if f.ScriptStatCacheTTL > 0 {
+		f.statCache = newStatCache(time.Duration(f.ScriptStatCacheTTL), maxStatCacheEntries)
+	}
+
+	if f.Coalesce {
+		f.coalesceGroup = new(singleflight.Group)
+	}
+
+	switch f.HeadOptimization {
+	case "", "discard", "off":
+	case "cache":
+		if f.HeadCacheTTL < 0 {
+			return errors.New("head_cache_ttl: the duration must be positive")
+		}
+		if f.HeadCacheTTL == 0 {
+			f.HeadCacheTTL = caddy.Duration(defaultHeadCacheTTL)
+		}
+		f.headCache = newHeadCache(time.Duration(f.HeadCacheTTL))
+	default:
+		return fmt.Errorf(`head_optimization: invalid value %q, must be "discard", "cache" or "off"`, f.HeadOptimization)
+	}
+
+	switch f.Compress {
+	case "", "off":
+	case "gzip", "zstd", "br":
+		// the encoders are Caddy modules, br requires a Caddy build including a brotli encoder
+		f.encoder = &encode.Encode{EncodingsRaw: caddy.ModuleMap{f.Compress: json.RawMessage("{}")}}
+		if err := f.encoder.Provision(ctx); err != nil {
+			return fmt.Errorf("compress: %w", err)
+		}
+	default:
+		return fmt.Errorf(`compress: invalid value %q, must be "gzip", "zstd", "br" or "off"`, f.Compress)
+	}
+
+	if f.CORS != nil {
+		if err := f.CORS.validate(); err != nil {
+			return err
+		}
+	}
+
+	if f.CookieDefaults != nil {
+		if err := f.CookieDefaults.validate(); err != nil {
+			return err
+		}
+	}
+
+	switch f.ExpectContinue {
+	case "", "auto", "reject":
+	default:
+		return fmt.Errorf(`expect_continue: invalid value %q, must be "auto" or "reject"`, f.ExpectContinue)
+	}
+
+	switch f.HTTPSOnly {
+	case "", "redirect", "reject":
+	default:
+		return fmt.Errorf(`https_only: invalid value %q, must be "redirect" or "reject"`, f.HTTPSOnly)
+	}
+
+	if f.PHPBinary != "" {
+		binary, err := exec.LookPath(f.PHPBinary)
+		if err != nil {
+			return fmt.Errorf("php_binary: %w", err)
+		}
+		f.PHPBinary = binary
+
+		// the external interpreter has its own processes, the slots of max_concurrent_requests don't apply to it
+		if limit := app.(*FrankenPHPApp).MaxConcurrentRequests; limit > 0 {
+			f.logger.Warn("max_concurrent_requests doesn't apply to php_binary, the requests passed to the external interpreter aren't limited", zap.Int("max_concurrent_requests", limit), zap.String("php_binary", f.PHPBinary))
+		}
+	}
+
+	// the Keep-Alive header only supports whole seconds, a 0 timeout would make clients drop idle connections immediately
+	if f.KeepAliveTimeout != 0 && time.Duration(f.KeepAliveTimeout) < time.Second {
+		return fmt.Errorf("keepalive: the timeout must be at least 1s, got %s", time.Duration(f.KeepAliveTimeout))
+	}
+
+	if f.BootingResponse != "" {
+		if f.bootingResponse, err = os.ReadFile(f.BootingResponse); err != nil {
+			return fmt.Errorf("booting_response: %w", err)
+		}
+
+		if f.bootingContentType = mime.TypeByExtension(filepath.Ext(f.BootingResponse)); f.bootingContentType == "" {
+			f.bootingContentType = "text/html; charset=utf-8"
+		}
+	}
+
+	// resolve and create the upload directory once if it doesn't depend on the request
+	if f.UploadTmpDir != "" && !strings.Contains(f.UploadTmpDir, "{") && (filepath.IsAbs(f.UploadTmpDir) || !strings.Contains(f.Root, "{")) {
+		uploadTmpDir, err := resolveRootPath(f.Root, f.UploadTmpDir)
+		if err != nil {
+			return fmt.Errorf("upload_tmp_dir: %w", err)
+		}
+
+		if err := os.MkdirAll(uploadTmpDir, 0700); err != nil {
+			return fmt.Errorf("upload_tmp_dir: %w", err)
+		}
+
+		f.uploadTmpDir = uploadTmpDir
+	}
+
+	// as the file server does, transform the static paths to hide into absolute paths
+	for i, h := range f.Hide {
+		if !strings.Contains(h, "{") && strings.Contains(h, string(filepath.Separator)) {
+			if abs, err := filepath.Abs(h); err == nil {
+				f.Hide[i] = abs
+			}
+		}
+	}
+
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+// TODO: Expose TLS versions as env vars, as Apache's mod_ssl: https://github.com/caddyserver/caddy/blob/master/modules/caddyhttp/reverseproxy/fastcgi/fastcgi.go#L298
+func (f FrankenPHPModule) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	// the requests received while the workers boot, e.g. during a reload, can't be handled by PHP yet
+	if f.bootingResponse != nil && !frankenphp.WorkersReady() {
+		h := w.Header()
+		h.Set("Content-Type", f.bootingContentType)
+		h.Set("Cache-Control", "no-store")
+		h.Set("Retry-After", strconv.Itoa(bootingRetryAfter))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write(f.bootingResponse)
+		f.shortCircuit(r, http.StatusServiceUnavailable, "booting")
+
+		return nil
+	}
+
+	if f.ErrorFormat == "" {
+		return f.serve(w, r)
+	}
+
+	sw := &statusWriter{}
+	sw.wrap(sw, w)
+	err := f.serve(sw, r)
+	// once a response has been started, by PHP or by the handler, the error can't be rendered anymore
+	if err == nil || sw.status != 0 {
+		return err
+	}
+
+	return f.writeHandlerError(w, err)
+}
+
+func (f FrankenPHPModule) serve(w http.ResponseWriter, r *http.Request) error {
+	if f.RequestTimeout > 0 {
+		return f.serveWithTimeout(w, r)
+	}
+
+	return f.serveEncoded(w, r)
+}
+
+// serveWithTimeout aborts the request when RequestTimeout is reached: reading the body fails, and PHP is interrupted as if the client disconnected.
+// A 504 error is returned if the response hasn't been started yet, the response is truncated otherwise.
+func (f FrankenPHPModule) serveWithTimeout(w http.ResponseWriter, r *http.Request) error {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(f.RequestTimeout))
+	defer cancel()
+
+	tw := &timeoutWriter{}
+	tw.wrap(tw, w)
+	stop := context.AfterFunc(ctx, func() {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			tw.timeout()
+		}
+	})
+	defer stop()
+
+	err := f.serveEncoded(tw, r.WithContext(ctx))
+	if tw.discarded() {
+		return caddyhttp.Error(http.StatusGatewayTimeout, fmt.Errorf("request_timeout (%s) reached", time.Duration(f.RequestTimeout)))
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		f.logger.Warn("request_timeout reached after the response started, it has been truncated", zap.Duration("request_timeout", time.Duration(f.RequestTimeout)), zap.String("uri", r.RequestURI))
+	}
+
+	return err
+}
+
+func (f FrankenPHPModule) serveEncoded(w http.ResponseWriter, r *http.Request) error {
+	// the response is compressed last, after the other writers
+	if f.encoder != nil {
+		return f.encoder.ServeHTTP(w, r, caddyhttp.HandlerFunc(f.serveHTTP))
+	}
+
+	return f.serveHTTP(w, r)
+}
+
+// shortCircuit records why a request is answered without invoking PHP: the php_outcome and php_reason fields are added
+// to its access log entry, and it is logged at the debug level.
+func (f FrankenPHPModule) shortCircuit(r *http.Request, status int, reason string) {
+	if extra, ok := r.Context().Value(caddyhttp.ExtraLogFieldsCtxKey).(*caddyhttp.ExtraLogFields); ok {
+		extra.Add(zap.String("php_outcome", "short_circuited"))
+		extra.Add(zap.String("php_reason", reason))
+	}
+
+	f.logger.Debug("request answered without invoking PHP", zap.Int("status", status), zap.String("reason", reason), zap.String("method", r.Method), zap.String("uri", r.RequestURI))
+}
+
+func (f FrankenPHPModule) serveHTTP(w http.ResponseWriter, r *http.Request) error {
+	origReq := r.Context().Value(caddyhttp.OriginalRequestCtxKey).(http.Request)
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+
+	if f.HTTPSOnly != "" && !isSecure(r) {
+		if f.HTTPSOnly == "reject" {
+			f.shortCircuit(r, http.StatusForbidden, "https_only")
+
+			return caddyhttp.Error(http.StatusForbidden, errors.New("PHP is only executed over HTTPS"))
+		}
+
+		http.Redirect(w, r, "https://"+repl.ReplaceKnown("{http.request.host}", "")+origReq.URL.RequestURI(), http.StatusPermanentRedirect)
+		f.shortCircuit(r, http.StatusPermanentRedirect, "https_only")
+
+		return nil
+	}
+
+	if f.CORS != nil && f.CORS.handle(w, r) {
+		f.shortCircuit(r, http.StatusNoContent, "cors_preflight")
+
+		return nil
+	}
+
+	if len(f.AllowedMethods) > 0 && !slices.Contains(f.AllowedMethods, r.Method) {
+		w.Header().Set("Allow", strings.Join(f.AllowedMethods, ", "))
+		f.shortCircuit(r, http.StatusMethodNotAllowed, "method_not_allowed")
+
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+
+	if f.rateLimiter != nil {
+		client, _ := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string)
+		if ok, retryAfter := f.rateLimiter.allow(client, time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			f.shortCircuit(r, http.StatusTooManyRequests, "rate_limit")
+
+			return caddyhttp.Error(http.StatusTooManyRequests, errors.New("rate limit exceeded"))
+		}
+	}
+
+	for name, value := range f.RequireHeaders {
+		v, ok := r.Header[http.CanonicalHeaderKey(name)]
+		if !ok {
+			f.shortCircuit(r, http.StatusUnauthorized, "require_header")
+
+			return caddyhttp.Error(http.StatusUnauthorized, fmt.Errorf("missing required header %s", name))
+		}
+		if len(v) != 1 || subtle.ConstantTimeCompare([]byte(v[0]), []byte(repl.ReplaceKnown(value, ""))) != 1 {
+			f.shortCircuit(r, http.StatusForbidden, "require_header")
+
+			return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("invalid value for required header %s", name))
+		}
+	}
+
+	// with auto, the 100 Continue response is sent by the HTTP server on the first read of the body
+	if f.ExpectContinue == "reject" && strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+		f.shortCircuit(r, http.StatusExpectationFailed, "expect_continue")
+
+		return caddyhttp.Error(http.StatusExpectationFailed, errors.New("100-continue expectations are rejected"))
+	}
+
+	// the limits apply to the decoded body
+	if f.DecompressRequest {
+		maxSize := f.MaxDecompressedBody
+		if maxSize <= 0 {
+			maxSize = defaultMaxDecompressedBody
+		}
+		if err := decompressRequest(r, maxSize); err != nil {
+			return err
+		}
+	}
+
+	var trailers http.Header
+	if f.RequestTrailers {
+		maxSize := f.MaxTrailersBody
+		if maxSize <= 0 {
+			maxSize = defaultMaxTrailersBody
+		}
+
+		var err error
+		if trailers, err = readRequestTrailers(r, maxSize); err != nil {
+			return err
+		}
+	}
+
+	// chunked requests, having no Content-Length, are not checked
+	if limit := f.requestBodyLimit(r); limit > 0 && r.ContentLength > limit {
+		f.writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body too large: %d bytes, the limit is %d bytes.", r.ContentLength, limit))
+		f.shortCircuit(r, http.StatusRequestEntityTooLarge, "request_body_too_large")
+
+		return nil
+	}
+
+	if f.MaxRequestHeaderBytes > 0 {
+		if size := requestHeaderSize(r.Header); size > f.MaxRequestHeaderBytes {
+			f.writeError(w, http.StatusRequestHeaderFieldsTooLarge, fmt.Sprintf("Request header fields too large: %d bytes, the limit is %d bytes.", size, f.MaxRequestHeaderBytes))
+			f.shortCircuit(r, http.StatusRequestHeaderFieldsTooLarge, "request_headers_too_large")
+
+			return nil
+		}
+	}
+
+	documentRoot := repl.ReplaceKnown(f.Root, "")
+	if f.allowedRoots != nil && strings.Contains(f.Root, "{") {
+		if err := checkAllowedRoot(documentRoot, f.allowedRoots); err != nil {
+			f.shortCircuit(r, http.StatusForbidden, "allowed_roots")
+
+			return caddyhttp.Error(http.StatusForbidden, err)
+		}
+	}
+
+	// the ID is generated once per request, other placeholders (e.g. in logs) get the same value
+	requestID := repl.ReplaceKnown("{http.request.uuid}", "")
+	if f.RequestIDHeader != "" {
+		r.Header.Set(f.RequestIDHeader, requestID)
+		w.Header().Set(f.RequestIDHeader, requestID)
+	}
+
+	// the map is only used while the request is handled, ServeHTTP waits for PHP to be done
+	env := getEnvMap()
+	defer putEnvMap(env)
+
+	env["REQUEST_URI"] = origReq.URL.RequestURI()
+	env["REQUEST_ID"] = requestID
+	if trusted, _ := caddyhttp.GetVar(r.Context(), caddyhttp.TrustedProxyVarKey).(bool); trusted {
+		setForwardedEnv(env, r)
+	}
+	if f.ServerAdmin != "" {
+		env["SERVER_ADMIN"] = f.ServerAdmin
+	}
+	env["SERVER_SIGNATURE"] = serverSignature(r, env, f.ServerAdmin)
+	env["FRANKENPHP_VERSION"] = frankenphpVersion()
+	if f.Version != "" {
+		env["APP_VERSION"] = repl.ReplaceKnown(f.Version, "")
+	}
+	for k, v := range f.staticEnv {
+		env[k] = v
+	}
+	for k, v := range f.dynamicEnv {
+		env[k] = replaceEnv(repl, v)
+	}
+	if f.DocumentRootEnv != "" {
+		env["DOCUMENT_ROOT"] = repl.ReplaceKnown(f.DocumentRootEnv, "")
+	}
+	for field, values := range trailers {
+		if !f.forwardsHeader(field) {
+			continue
+		}
+		k := trailerVariableName(field)
+		if _, ok := env[k]; !ok {
+			env[k] = strings.Join(values, ", ")
+		}
+	}
+
+	phpIni := make(map[string]string)
+	if f.uploadTmpDir != "" {
+		phpIni["upload_tmp_dir"] = f.uploadTmpDir
+	} else if f.UploadTmpDir != "" {
+		uploadTmpDir, err := resolveRootPath(documentRoot, repl.ReplaceKnown(f.UploadTmpDir, ""))
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(uploadTmpDir, 0700); err != nil {
+			return err
+		}
+
+		phpIni["upload_tmp_dir"] = uploadTmpDir
+	}
+	if f.AutoPrepend != "" {
+		autoPrepend, err := resolveRootPath(documentRoot, repl.ReplaceKnown(f.AutoPrepend, ""))
+		if err != nil {
+			return err
+		}
+
+		phpIni["auto_prepend_file"] = autoPrepend
+	}
+	if f.AutoAppend != "" {
+		autoAppend, err := resolveRootPath(documentRoot, repl.ReplaceKnown(f.AutoAppend, ""))
+		if err != nil {
+			return err
+		}
+
+		phpIni["auto_append_file"] = autoAppend
+	}
+
+	if f.Index != "" {
+		if indexPath := f.indexPath(documentRoot, r.URL.Path); indexPath != "" {
+			r.URL.Path = indexPath
+			r.URL.RawPath = ""
+		}
+	}
+
+	fr, err := frankenphp.NewRequestWithContext(
+		r,
+		frankenphp.WithRequestDocumentRoot(documentRoot, f.ResolveRootSymlink != nil && *f.ResolveRootSymlink),
+		frankenphp.WithRequestSplitPath(f.SplitPath),
+		frankenphp.WithRequestEnv(env),
+		frankenphp.WithRequestPHPIni(phpIni),
+		frankenphp.WithRequestPreserveHeaderCase(f.PreserveHeaderCase),
+		frankenphp.WithRequestPrecompressed(f.Precompressed),
+		frankenphp.WithRequestForwardedHeaders(f.ForwardHeaders, f.HideHeaders),
+		frankenphp.WithRequestBodyReadTimeout(time.Duration(f.BodyReadTimeout)),
+	)
+
+	if err != nil {
+		return err
+	}
+
+	fc, _ := frankenphp.FromContext(fr.Context())
+
+	// the script name is only known once the path is split, env is still read by ServeHTTP;
+	// as for the other variables, the values set explicitly with env have priority
+	if f.ScriptNamePrefix != "" {
+		if _, ok := env["SCRIPT_NAME"]; !ok {
+			env["SCRIPT_NAME"] = f.ScriptNamePrefix + fc.ScriptName()
+		}
+		if _, ok := env["PHP_SELF"]; !ok {
+			env["PHP_SELF"] = f.ScriptNamePrefix + fr.URL.Path
+		}
+	}
+
+	// the request may have been rewritten to the front controller, check the script originally requested
+	if f.StrictPHPExistence {
+		if script := requestedScript(f.SplitPath, origReq.URL.Path); script != "" {
+			if _, err := f.stat(caddyhttp.SanitizedPathJoin(documentRoot, script)); errors.Is(err, os.ErrNotExist) {
+				f.shortCircuit(r, http.StatusNotFound, "missing_script")
+
+				return caddyhttp.Error(http.StatusNotFound, err)
+			}
+		}
+	}
+
+	// only the executed script is checked, not the PATH_INFO
+	if len(f.Hide) > 0 {
+		hide := make([]string, len(f.Hide))
+		for i, h := range f.Hide {
+			hide[i] = repl.ReplaceKnown(h, "")
+		}
+
+		if fileHidden(fc.ScriptFilename(), hide) {
+			f.shortCircuit(r, http.StatusNotFound, "hidden_script")
+
+			return caddyhttp.Error(http.StatusNotFound, nil)
+		}
+	}
+
+	if f.MissingScript != "pass" {
+		// a directory can't be executed either
+		fi, err := f.stat(fc.ScriptFilename())
+		if err == nil && fi.IsDir() {
+			err = fmt.Errorf("%s is a directory: %w", fc.ScriptFilename(), os.ErrNotExist)
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			if f.MissingScript == "500" {
+				f.shortCircuit(r, http.StatusInternalServerError, "missing_script")
+
+				return caddyhttp.Error(http.StatusInternalServerError, err)
+			}
+
+			f.shortCircuit(r, http.StatusNotFound, "missing_script")
+
+			return caddyhttp.Error(http.StatusNotFound, err)
+		}
+	}
+
+	if f.ExposeMtime {
+		if fi, err := f.stat(fc.ScriptFilename()); err == nil && !fi.IsDir() {
+			if _, ok := env["SCRIPT_MTIME"]; !ok {
+				env["SCRIPT_MTIME"] = strconv.FormatInt(fi.ModTime().Unix(), 10)
+			}
+			if _, ok := env["SCRIPT_ETAG"]; !ok {
+				env["SCRIPT_ETAG"] = fileETag(fi)
+			}
+		}
+	}
+
+	if f.DisableKeepAlive {
+		w.Header().Set("Connection", "close")
+	} else if f.KeepAliveTimeout > 0 && r.ProtoMajor == 1 {
+		w.Header().Set("Keep-Alive", "timeout="+strconv.Itoa(int(time.Duration(f.KeepAliveTimeout).Seconds())))
+	}
+
+	// the responses to HEAD requests never have a body, their headers may be cached from a GET response
+	var (
+		hw      *headWriter
+		hr      *headRecorder
+		headKey string
+	)
+	switch {
+	case r.Method == http.MethodHead && f.HeadOptimization != "off":
+		if f.headCache != nil {
+			headKey = headCacheKey(r, origReq.URL.RequestURI())
+			if header, ok := f.headCache.get(headKey, time.Now()); ok {
+				// the headers specific to this request, e.g. the request ID, take precedence
+				h := w.Header()
+				for k, v := range header {
+					if _, ok := h[k]; !ok {
+						h[k] = slices.Clone(v)
+					}
+				}
+				w.WriteHeader(http.StatusOK)
+				f.shortCircuit(r, http.StatusOK, "head_cache")
+
+				return nil
+			}
+		}
+
+		hw = &headWriter{}
+		hw.wrap(hw, w)
+		w = hw
+	case r.Method == http.MethodGet && f.headCache != nil:
+		headKey = headCacheKey(r, origReq.URL.RequestURI())
+		hr = &headRecorder{}
+		hr.wrap(hr, w)
+		w = hr
+	}
+
+	// the checksum is computed last, on the body sent to the client
+	var cw *checksumWriter
+	if f.ChecksumTrailer && acceptsTrailers(r) {
+		cw = &checksumWriter{method: r.Method}
+		cw.wrap(cw, w)
+		w = cw
+	}
+
+	var lw *responseLimitWriter
+	if f.MaxResponseBytes > 0 {
+		lw = &responseLimitWriter{
+			limit:       f.MaxResponseBytes,
+			abort:       f.AbortLargeResponses,
+			streamTypes: f.StreamContentTypes,
+			logger:      f.logger.With(zap.String("script_name", fc.ScriptName()), zap.String("uri", origReq.URL.RequestURI())),
+		}
+		lw.wrap(lw, w)
+		w = lw
+	}
+
+	if len(f.RemoveResponseHeaders) > 0 || len(f.SetResponseHeaders) > 0 || f.CookieDefaults != nil {
+		rhw := &responseHeadersWriter{
+			replacer:       repl,
+			remove:         f.RemoveResponseHeaders,
+			set:            f.SetResponseHeaders,
+			cookieDefaults: f.CookieDefaults,
+		}
+		rhw.wrap(rhw, w)
+		w = rhw
+	}
+
+	// the resources used by external interpreters aren't known
+	profiling := f.Profiling && f.PHPBinary == ""
+	if profiling {
+		pw := &profilingWriter{fc: fc}
+		pw.wrap(pw, w)
+		w = pw
+	}
+
+	var bw *bufferingWriter
+	if f.ResponseBuffering != "" {
+		bw = &bufferingWriter{
+			strategy:    f.ResponseBuffering,
+			streamTypes: f.StreamContentTypes,
+			method:      r.Method,
+		}
+		bw.wrap(bw, w)
+		w = bw
+	}
+
+	if len(f.StreamContentTypes) > 0 {
+		stw := &streamWriter{mediaTypes: f.StreamContentTypes}
+		stw.wrap(stw, w)
+		w = stw
+	}
+
+	var tw *transformWriter
+	if hasResponseTransformers() {
+		tw = &transformWriter{}
+		tw.wrap(tw, w)
+		w = tw
+	}
+
+	var sw *statusWriter
+	if f.events != nil {
+		sw = &statusWriter{}
+		sw.wrap(sw, w)
+		w = sw
+	}
+
+	// the Content-Length set by PHP is checked first, before the other writers rely on it
+	var clw *contentLengthWriter
+	if f.FixContentLength {
+		clw = &contentLengthWriter{
+			logger: f.logger.With(zap.String("script_name", fc.ScriptName()), zap.String("uri", origReq.URL.RequestURI())),
+			method: r.Method,
+		}
+		clw.wrap(clw, w)
+		w = clw
+	}
+
+	serve := func(w http.ResponseWriter) error {
+		if f.PHPBinary != "" {
+			return f.serveExternal(w, r, documentRoot, fc.ScriptName(), fc.ScriptFilename(), env)
+		}
+
+		return frankenphp.ServeHTTP(w, fr)
+	}
+
+	if extra, ok := r.Context().Value(caddyhttp.ExtraLogFieldsCtxKey).(*caddyhttp.ExtraLogFields); ok {
+		extra.Add(zap.String("php_outcome", "executed"))
+	}
+
+	start := time.Now()
+	if f.coalesceGroup != nil && frankenphp.IsIdempotent(r.Method) {
+		var (
+			cr     any
+			leader bool
+		)
+		cr, err, _ = f.coalesceGroup.Do(coalesceKey(r, origReq.URL.RequestURI()), func() (any, error) {
+			leader = true
+			cr := newCoalescedResponse()
+
+			return cr, serve(cr)
+		})
+		switch {
+		case err == nil && (leader || isShareable(cr.(*coalescedResponse).header)):
+			err = cr.(*coalescedResponse).writeTo(w)
+		case err == nil:
+			// the response is specific to the client it was generated for (e.g. it starts a session), PHP is executed again
+			err = serve(w)
+		}
+	} else {
+		err = serve(w)
+	}
+	if err != nil {
+		if errors.Is(err, frankenphp.QueueTimeoutError) || errors.Is(err, frankenphp.WorkerQueueFullError) || errors.Is(err, frankenphp.NotRunningError) {
+			return caddyhttp.Error(http.StatusServiceUnavailable, err)
+		}
+		if errors.Is(err, frankenphp.RequestBodyTimeoutError) {
+			return caddyhttp.Error(http.StatusRequestTimeout, err)
+		}
+		if errors.Is(err, frankenphp.DaemonWorkerError) {
+			return caddyhttp.Error(http.StatusNotFound, err)
+		}
+
+		return err
+	}
+
+	if f.SlowLog > 0 {
+		if duration := time.Since(start); duration > time.Duration(f.SlowLog) {
+			f.logger.Warn("slow PHP request",
+				zap.String("script_name", fc.ScriptName()),
+				zap.String("script_filename", fc.ScriptFilename()),
+				zap.String("uri", origReq.URL.RequestURI()),
+				zap.Duration("duration", duration),
+				zap.String("worker", fc.Worker()),
+			)
+		}
+	}
+
+	if clw != nil {
+		if err := clw.finish(); err != nil {
+			return err
+		}
+	}
+
+	if tw != nil {
+		if err := tw.finish(); err != nil {
+			return err
+		}
+	}
+
+	if bw != nil {
+		if err := bw.finish(); err != nil {
+			return err
+		}
+	}
+
+	if lw != nil {
+		if err := lw.finish(); err != nil {
+			return err
+		}
+	}
+
+	if cw != nil {
+		cw.finish()
+	}
+
+	if hw != nil {
+		hw.finish()
+	}
+
+	if hr != nil {
+		if header, ok := hr.cacheableHeader(); ok {
+			f.headCache.set(headKey, header, time.Now())
+		}
+	}
+
+	if profiling {
+		if extra, ok := r.Context().Value(caddyhttp.ExtraLogFieldsCtxKey).(*caddyhttp.ExtraLogFields); ok {
+			extra.Add(zap.Float64("php_cpu_time", fc.CPUTime().Seconds()))
+			extra.Add(zap.Uint64("php_alloc", fc.MemoryPeak()))
+		}
+	}
+
+	if f.events != nil {
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+
+		f.events.Emit(f.ctx, "frankenphp", map[string]any{
+			"script_name":     fc.ScriptName(),
+			"script_filename": fc.ScriptFilename(),
+			"status":          sw.status,
+			"duration":        time.Since(start).Seconds(),
+			"worker":          fc.Worker(),
+		})
+	}
+
+	return nil
+}
+
+// statusWriter records the status code of the response.
+type statusWriter struct {
+	responseWrapper
+}
+
+// responseHeadersWriter removes and sets the configured headers, and adds the default cookie attributes,
+// after PHP sent its headers, but before they are written to the client.
+type responseHeadersWriter struct {
+	responseWrapper
+	replacer       *caddy.Replacer
+	remove         []string
+	set            map[string]string
+	cookieDefaults *CookieDefaultsConfig
+}
+
+func (rhw *responseHeadersWriter) WriteHeader(status int) {
+	if rhw.status != 0 {
+		return
+	}
+
+	// the informational responses are affected too
+	h := rhw.ResponseWriterWrapper.Header()
+	for _, k := range rhw.remove {
+		h.Del(k)
+	}
+	for k, v := range rhw.set {
+		h.Set(k, rhw.replacer.ReplaceKnown(v, ""))
+	}
+	if rhw.cookieDefaults != nil {
+		rhw.cookieDefaults.apply(h)
+	}
+
+	rhw.responseWrapper.WriteHeader(status)
+}
+
+// profilingWriter adds the resources used by PHP so far to the response headers.
+type profilingWriter struct {
+	responseWrapper
+	fc *frankenphp.FrankenPHPContext
+}
+
+func (pw *profilingWriter) WriteHeader(status int) {
+	if pw.final(status) {
+		h := pw.ResponseWriterWrapper.Header()
+		h.Set("X-PHP-CPU-Time", strconv.FormatFloat(pw.fc.CPUTime().Seconds(), 'f', 6, 64))
+		h.Set("X-PHP-Alloc", strconv.FormatUint(pw.fc.MemoryPeak(), 10))
+
+		pw.ResponseWriterWrapper.WriteHeader(status)
+	}
+}
+
+// checksumTrailer is the name of the trailer containing the checksum of the response body.
+const checksumTrailer = "X-Checksum-SHA256"
+
+// acceptsTrailers reports whether the client accepts trailers in the response.
+func acceptsTrailers(r *http.Request) bool {
+	if !r.ProtoAtLeast(1, 1) {
+		return false
+	}
+
+	for _, v := range r.Header.Values("TE") {
+		for _, te := range strings.Split(v, ",") {
+			if te, _, _ := strings.Cut(te, ";"); strings.EqualFold(strings.TrimSpace(te), "trailers") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// checksumWriter computes the checksum of the body of chunked responses, sent as a trailer when finish is called.
+type checksumWriter struct {
+	responseWrapper
+	method string
+	hash   hash.Hash
+}
+
+func (cw *checksumWriter) WriteHeader(status int) {
+	if !cw.final(status) {
+		return
+	}
+
+	// the responses with a known length aren't chunked
+	h := cw.ResponseWriterWrapper.Header()
+	if cw.method != http.MethodHead && status != http.StatusNoContent && status != http.StatusNotModified && h.Get("Content-Length") == "" {
+		h.Add("Trailer", checksumTrailer)
+		cw.hash = sha256.New()
+	}
+
+	cw.ResponseWriterWrapper.WriteHeader(status)
+}
+
+func (cw *checksumWriter) Write(d []byte) (int, error) {
+	n, err := cw.responseWrapper.Write(d)
+	if cw.hash != nil {
+		cw.hash.Write(d[:n])
+	}
+
+	return n, err
+}
+
+// finish sets the checksum trailer, once the whole body has been written.
+func (cw *checksumWriter) finish() {
+	if cw.hash != nil {
+		cw.ResponseWriterWrapper.Header().Set(checksumTrailer, hex.EncodeToString(cw.hash.Sum(nil)))
+	}
+}
+
+// frankenphpVersion returns the version of FrankenPHP, as set at build time in the Caddy version (see the Dockerfile),
+// or as recorded in the build information of the binary.
+var frankenphpVersion = sync.OnceValue(func() string {
+	if v, ok := strings.CutPrefix(caddy.CustomVersion, "FrankenPHP "); ok {
+		if fields := strings.Fields(v); len(fields) > 0 {
+			return fields[0]
+		}
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range bi.Deps {
+			// the version of a replaced module is meaningless
+			if dep.Path == "github.com/dunglas/frankenphp" && dep.Replace == nil {
+				return dep.Version
+			}
+		}
+	}
+
+	return "dev"
+})
+
+// requestBodyLimit returns the maximum size of the body of r in bytes, 0 means unlimited.
+// PHP silently ignores the form data larger than post_max_size, leading to confusing responses, so it is enforced beforehand.
+func (f FrankenPHPModule) requestBodyLimit(r *http.Request) int64 {
+	limit := f.MaxRequestBody
+	if f.PHPBinary != "" || r.Method != http.MethodPost {
+		return limit
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" && mediaType != "multipart/form-data" {
+		return limit
+	}
+
+	if size := postMaxSize.Load(); size > 0 && (limit == 0 || size < limit) {
+		limit = size
+	}
+
+	return limit
+}
+
+// requestHeaderSize returns the total size of the names and values of the request headers, as exposed to PHP.
+func requestHeaderSize(h http.Header) int64 {
+	var size int64
+	for k, v := range h {
+		for _, vv := range v {
+			size += int64(len(k) + len(vv))
+		}
+	}
+
+	return size
+}
+
+// isSecure reports whether the request has been received over TLS,
+// directly or through a trusted proxy setting the Forwarded or X-Forwarded-Proto header.
+func isSecure(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+
+	trusted, _ := caddyhttp.GetVar(r.Context(), caddyhttp.TrustedProxyVarKey).(bool)
+
+	return trusted && forwardedProto(r.Header, parseForwarded(r.Header)) == "https"
+}
+
+// forwardedProto returns the scheme forwarded by the proxy, the proto parameter of the Forwarded header has priority over X-Forwarded-Proto.
+func forwardedProto(h http.Header, forwarded map[string]string) string {
+	if proto, ok := forwarded["proto"]; ok {
+		return strings.ToLower(proto)
+	}
+
+	return strings.ToLower(firstForwardedValue(h, "X-Forwarded-Proto"))
+}
+
+// setForwardedEnv sets the REMOTE_ADDR, HTTPS, REQUEST_SCHEME, SERVER_NAME and SERVER_PORT variables according to
+// the Forwarded (RFC 7239), X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Port headers. The parameters of the
+// Forwarded header have priority over the corresponding X-Forwarded-* headers, X-Forwarded-Port is ignored when the
+// Forwarded header has a host parameter. They must only be used for requests received from a trusted proxy, invalid values are ignored.
+func setForwardedEnv(env map[string]string, r *http.Request) {
+	forwarded := parseForwarded(r.Header)
+
+	if ip := forwardedIP(forwarded["for"]); ip != "" {
+		env["REMOTE_ADDR"] = ip
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	switch proto := forwardedProto(r.Header, forwarded); proto {
+	case "https":
+		env["HTTPS"] = "on"
+		fallthrough
+	case "http":
+		scheme = proto
+		env["REQUEST_SCHEME"] = proto
+	}
+
+	host, forwardedHost := forwarded["host"]
+	if !forwardedHost {
+		host = firstForwardedValue(r.Header, "X-Forwarded-Host")
+	}
+
+	var port string
+	if host != "" && !strings.ContainsAny(host, " \t/\\?#@") {
+		h, p, err := net.SplitHostPort(host)
+		if err != nil {
+			h = host
+		}
+		if h != "" {
+			env["SERVER_NAME"] = h
+			port = p
+		}
+	}
+	if p := firstForwardedValue(r.Header, "X-Forwarded-Port"); p != "" && !forwardedHost {
+		port = p
+	}
+
+	if port == "" {
+		// the default port of the forwarded scheme
+		if _, ok := env["REQUEST_SCHEME"]; !ok {
+			return
+		}
+
+		port = "80"
+		if scheme == "https" {
+			port = "443"
+		}
+	}
+	if n, err := strconv.Atoi(port); err == nil && n > 0 && n <= 65535 {
+		env["SERVER_PORT"] = port
+	}
+}
+
+// parseForwarded returns the parameters of the element of the Forwarded header (RFC 7239) set by the closest client, by lowercase name.
+// Quoted values are unquoted. It returns nil if the header is missing or malformed.
+func parseForwarded(h http.Header) map[string]string {
+	v := h.Get("Forwarded")
+	if v == "" {
+		return nil
+	}
+
+	params := make(map[string]string, 4)
+	for {
+		// the pairs are separated by semicolons, and the elements by commas
+		end, quoted := -1, false
+		for i := 0; i < len(v) && end == -1; i++ {
+			switch c := v[i]; {
+			case c == '\\' && quoted:
+				i++
+			case c == '"':
+				quoted = !quoted
+			case (c == ';' || c == ',') && !quoted:
+				end = i
+			}
+		}
+
+		pair := v
+		if end != -1 {
+			pair = v[:end]
+		}
+
+		name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || name == "" || strings.ContainsAny(name, " \t\"") {
+			return nil
+		}
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = unquoteForwarded(value[1 : len(value)-1])
+		}
+		params[strings.ToLower(name)] = value
+
+		if end == -1 || v[end] == ',' {
+			return params
+		}
+		v = v[end+1:]
+	}
+}
+
+// unquoteForwarded removes the backslashes escaping the characters of a quoted string.
+func unquoteForwarded(v string) string {
+	if !strings.Contains(v, "\\") {
+		return v
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] == '\\' && i+1 < len(v) {
+			i++
+		}
+		b.WriteByte(v[i])
+	}
+
+	return b.String()
+}
+
+// forwardedIP returns the IP address of the "for" parameter of the Forwarded header, without the port,
+// or an empty string if it isn't an IP address (e.g. "unknown" or an obfuscated identifier).
+func forwardedIP(node string) string {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	node = strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+
+	if ip := net.ParseIP(node); ip != nil {
+		return ip.String()
+	}
+
+	return ""
+}
+
+// serverSignature returns the footer line that can be added to server-generated pages, in the format of the SERVER_SIGNATURE variable of Apache.
+// The server name links to the email address of the administrator, if any.
+func serverSignature(r *http.Request, env map[string]string, serverAdmin string) string {
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if h, ok := env["SERVER_NAME"]; ok {
+		host = h
+	}
+	if p, ok := env["SERVER_PORT"]; ok {
+		port = p
+	}
+	if port == "" {
+		port = "80"
+		if r.TLS != nil {
+			port = "443"
+		}
+	}
+
+	host = html.EscapeString(host)
+	if serverAdmin != "" {
+		host = fmt.Sprintf(`<a href="mailto:%s">%s</a>`, html.EscapeString(serverAdmin), host)
+	}
+
+	return fmt.Sprintf("<address>FrankenPHP Server at %s Port %s</address>\n", host, html.EscapeString(port))
+}
+
+// firstForwardedValue returns the value set by the closest client, in a header possibly containing a comma-separated list of values.
+func firstForwardedValue(h http.Header, name string) string {
+	v, _, _ := strings.Cut(h.Get(name), ",")
+
+	return strings.TrimSpace(v)
+}
+
+// streamWriter flushes the responses having one of the given media types after every write,
+// so they are sent to the client incrementally instead of being buffered.
+type streamWriter struct {
+	responseWrapper
+	mediaTypes []string
+	stream     bool
+}
+
+func (sw *streamWriter) WriteHeader(status int) {
+	if !sw.final(status) {
+		return
+	}
+
+	if mediaType, _, err := mime.ParseMediaType(sw.Header().Get("Content-Type")); err == nil {
+		sw.stream = slices.Contains(sw.mediaTypes, mediaType)
+	}
+
+	sw.ResponseWriterWrapper.WriteHeader(status)
+}
+
+func (sw *streamWriter) Write(d []byte) (int, error) {
+	n, err := sw.responseWrapper.Write(d)
+	if err != nil || !sw.stream {
+		return n, err
+	}
+
+	return n, sw.FlushError()
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+func (f *FrankenPHPModule) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "root":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				f.Root = d.Val()
+
+			case "split":
+				f.SplitPath = d.RemainingArgs()
+				if len(f.SplitPath) == 0 {
+					return d.ArgErr()
+				}
+
+			case "env":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				if f.Env == nil {
+					f.Env = make(map[string]string)
+				}
+				f.Env[args[0]] = args[1]
+
+			case "request_id_header":
+				f.RequestIDHeader = "X-Request-Id"
+				if d.NextArg() {
+					f.RequestIDHeader = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "document_root_env":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				f.DocumentRootEnv = d.Val()
+
+			case "script_name_prefix":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+
+				prefix := strings.TrimSuffix(d.Val(), "/")
+				if !strings.HasPrefix(prefix, "/") {
+					return d.Errf("invalid script_name_prefix %q: must start with / and not be the root", d.Val())
+				}
+				f.ScriptNamePrefix = prefix
+
+			case "rate_limit":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+
+				events, err := strconv.Atoi(args[0])
+				if err != nil || events <= 0 {
+					return d.Errf("invalid rate_limit events %q: must be a positive integer", args[0])
+				}
+				window, err := caddy.ParseDuration(args[1])
+				if err != nil || window <= 0 {
+					return d.Errf("invalid rate_limit window %q: must be a positive duration", args[1])
+				}
+
+				f.RateLimitEvents = events
+				f.RateLimitWindow = caddy.Duration(window)
+
+			case "allowed_methods":
+				methods := d.RemainingArgs()
+				if len(methods) == 0 {
+					return d.ArgErr()
+				}
+				f.AllowedMethods = append(f.AllowedMethods, methods...)
+
+			case "require_header":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				if f.RequireHeaders == nil {
+					f.RequireHeaders = make(map[string]string)
+				}
+				f.RequireHeaders[args[0]] = args[1]
+
+			case "max_request_body":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+
+				size, err := humanize.ParseBytes(d.Val())
+				if err != nil {
+					return d.Errf("invalid max_request_body %q: %v", d.Val(), err)
+				}
+				f.MaxRequestBody = int64(size)
+
+			case "decompress_request":
+				f.DecompressRequest = true
+				if d.NextArg() {
+					size, err := humanize.ParseBytes(d.Val())
+					if err != nil {
+						return d.Errf("invalid decompress_request max size %q: %v", d.Val(), err)
+					}
+					if size == 0 {
+						return d.Errf("invalid decompress_request max size %q: must be positive", d.Val())
+					}
+					f.MaxDecompressedBody = int64(size)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "request_trailers":
+				f.RequestTrailers = true
+				if d.NextArg() {
+					size, err := humanize.ParseBytes(d.Val())
+					if err != nil {
+						return d.Errf("invalid request_trailers max body size %q: %v", d.Val(), err)
+					}
+					if size == 0 {
+						return d.Errf("invalid request_trailers max body size %q: must be positive", d.Val())
+					}
+					f.MaxTrailersBody = int64(size)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "max_response_bytes":
+				args := d.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return d.ArgErr()
+				}
+
+				size, err := humanize.ParseBytes(args[0])
+				if err != nil || size == 0 {
+					return d.Errf("invalid max_response_bytes %q: must be a positive size", args[0])
+				}
+				f.MaxResponseBytes = int64(size)
+
+				if len(args) == 2 {
+					if args[1] != "abort" {
+						return d.Errf(`invalid max_response_bytes flag %q, must be "abort"`, args[1])
+					}
+					f.AbortLargeResponses = true
+				}
+
+			case "server_admin":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+
+				if addr, err := mail.ParseAddress(d.Val()); err != nil || addr.Address != d.Val() {
+					return d.Errf("invalid server_admin %q: must be an email address", d.Val())
+				}
+				f.ServerAdmin = d.Val()
+
+			case "max_request_header_bytes":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+
+				size, err := humanize.ParseBytes(d.Val())
+				if err != nil {
+					return d.Errf("invalid max_request_header_bytes %q: %v", d.Val(), err)
+				}
+				f.MaxRequestHeaderBytes = int64(size)
+
+			case "body_read_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+
+				v, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid body_read_timeout %q: %v", d.Val(), err)
+				}
+				if v <= 0 {
+					return d.Errf("invalid body_read_timeout %q: the timeout must be positive", d.Val())
+				}
+				f.BodyReadTimeout = caddy.Duration(v)
+
+			case "request_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+
+				v, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid request_timeout %q: %v", d.Val(), err)
+				}
+				if v <= 0 {
+					return d.Errf("invalid request_timeout %q: the timeout must be positive", d.Val())
+				}
+				f.RequestTimeout = caddy.Duration(v)
+
+			case "slow_log":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+
+				v, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid slow_log %q: %v", d.Val(), err)
+				}
+				if v <= 0 {
+					return d.Errf("invalid slow_log %q: the threshold must be positive", d.Val())
+				}
+				f.SlowLog = caddy.Duration(v)
+
+			case "script_stat_cache_ttl":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+
+				v, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid script_stat_cache_ttl %q: %v", d.Val(), err)
+				}
+				if v <= 0 {
+					return d.Errf("invalid script_stat_cache_ttl %q: the duration must be positive", d.Val())
+				}
+				f.ScriptStatCacheTTL = caddy.Duration(v)
+
+			case "version":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				f.Version = d.Val()
+
+			case "expose_mtime":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				f.ExposeMtime = true
+
+			case "upload_tmp_dir":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				f.UploadTmpDir = d.Val()
+
+			case "auto_prepend":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				f.AutoPrepend = d.Val()
+
+			case "auto_append":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				f.AutoAppend = d.Val()
+
+			case "php_binary":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				f.PHPBinary = d.Val()
+
+			case "hide":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				f.Hide = append(f.Hide, args...)
+
+			case "forward_headers":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				f.ForwardHeaders = append(f.ForwardHeaders, args...)
+
+			case "hide_headers":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				f.HideHeaders = append(f.HideHeaders, args...)
+
+			case "missing_script":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+
+				switch d.Val() {
+				case "404", "500", "pass":
+					f.MissingScript = d.Val()
+				default:
+					return d.Errf(`invalid missing_script %q, must be "404", "500" or "pass"`, d.Val())
+				}
+
+			case "error_format":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+
+				switch d.Val() {
+				case "json", "html", "plain":
+					f.ErrorFormat = d.Val()
+				default:
+					return d.Errf(`invalid error_format %q, must be "json", "html" or "plain"`, d.Val())
 				}
 
-				f.NumThreads = v
-
-			case "worker":
-				wc := workerConfig{}
+			case "cors":
 				if d.NextArg() {
-					wc.FileName = d.Val()
+					return d.ArgErr()
 				}
-
-				if d.NextArg() {
-					v, err := strconv.Atoi(d.Val())
-					if err != nil {
-						return err
-					}
-
-					wc.Num = v
+				if f.CORS == nil {
+					f.CORS = &CORSConfig{}
 				}
 
 				for d.NextBlock(1) {
-					v := d.Val()
-					switch v {
-					case "file":
-						if !d.NextArg() {
+					switch d.Val() {
+					case "origins":
+						args := d.RemainingArgs()
+						if len(args) == 0 {
 							return d.ArgErr()
 						}
-						wc.FileName = d.Val()
-					case "num":
-						if !d.NextArg() {
+						f.CORS.AllowOrigins = append(f.CORS.AllowOrigins, args...)
+					case "methods":
+						args := d.RemainingArgs()
+						if len(args) == 0 {
 							return d.ArgErr()
 						}
-
-						v, err := strconv.Atoi(d.Val())
-						if err != nil {
-							return err
+						for _, arg := range args {
+							f.CORS.AllowMethods = append(f.CORS.AllowMethods, strings.ToUpper(arg))
 						}
-
-						wc.Num = v
-					case "env":
+					case "headers":
 						args := d.RemainingArgs()
-						if len(args) != 2 {
+						if len(args) == 0 {
 							return d.ArgErr()
 						}
-						if wc.Env == nil {
-							wc.Env = make(map[string]string)
+						f.CORS.AllowHeaders = append(f.CORS.AllowHeaders, args...)
+					case "credentials":
+						if d.NextArg() {
+							return d.ArgErr()
 						}
-						wc.Env[args[0]] = args[1]
+						f.CORS.AllowCredentials = true
+					case "max_age":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						v, err := caddy.ParseDuration(d.Val())
+						if err != nil || v <= 0 {
+							return d.Errf("invalid cors max_age %q: must be a positive duration", d.Val())
+						}
+						f.CORS.MaxAge = caddy.Duration(v)
+					default:
+						return d.Errf("unknown cors subdirective %q, only origins, methods, headers, credentials and max_age are supported", d.Val())
 					}
+				}
+				if len(f.CORS.AllowOrigins) == 0 {
+					return d.Err("cors: at least one origin must be allowed")
+				}
 
-					if wc.FileName == "" {
-						return errors.New(`The "file" argument must be specified`)
-					}
+			case "expect_continue":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+
+				switch d.Val() {
+				case "auto", "reject":
+					f.ExpectContinue = d.Val()
+				default:
+					return d.Errf(`invalid expect_continue %q, must be "auto" or "reject"`, d.Val())
+				}
 
-					if frankenphp.EmbeddedAppPath != "" && filepath.IsLocal(wc.FileName) {
-						wc.FileName = filepath.Join(frankenphp.EmbeddedAppPath, wc.FileName)
+			case "https_only":
+				f.HTTPSOnly = "redirect"
+				if d.NextArg() {
+					switch d.Val() {
+					case "redirect", "reject":
+						f.HTTPSOnly = d.Val()
+					default:
+						return d.Errf(`invalid https_only %q, must be "redirect" or "reject"`, d.Val())
 					}
 				}
 
-				f.Workers = append(f.Workers, wc)
-			}
-		}
-	}
+			case "head_optimization":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				switch d.Val() {
+				case "discard", "off":
+					f.HeadOptimization = d.Val()
+				case "cache":
+					f.HeadOptimization = d.Val()
+					if d.NextArg() {
+						v, err := caddy.ParseDuration(d.Val())
+						if err != nil {
+							return d.Errf("invalid head_optimization cache TTL %q: %v", d.Val(), err)
+						}
+						if v <= 0 {
+							return d.Errf("invalid head_optimization cache TTL %q: the duration must be positive", d.Val())
+						}
+						f.HeadCacheTTL = caddy.Duration(v)
+					}
+				default:
+					return d.Errf(`invalid head_optimization %q, must be "discard", "cache" or "off"`, d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
 
-	return nil
-}
+			case "preserve_header_case":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				f.PreserveHeaderCase = true
 
-func parseGlobalOption(d *caddyfile.Dispenser, _ interface{}) (interface{}, error) {
-	app := &FrankenPHPApp{}
-	if err := app.UnmarshalCaddyfile(d); err != nil {
-		return nil, err
-	}
+			case "compress":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
 
-	// tell Caddyfile adapter that this is the JSON for an app
-	return httpcaddyfile.App{
-		Name:  "frankenphp",
-		Value: caddyconfig.JSON(app, nil),
-	}, nil
-}
+				switch d.Val() {
+				case "gzip", "zstd", "br", "off":
+					f.Compress = d.Val()
+				default:
+					return d.Errf(`invalid compress %q, must be "gzip", "zstd", "br" or "off"`, d.Val())
+				}
 
-type FrankenPHPModule struct {
-	// Root sets the root folder to the site. Default: `root` directive, or the path of the public directory of the embed app it exists.
-	Root string `json:"root,omitempty"`
-	// SplitPath sets the substrings for splitting the URI into two parts. The first matching substring will be used to split the "path info" from the path. The first piece is suffixed with the matching substring and will be assumed as the actual resource (CGI script) name. The second piece will be set to PATH_INFO for the CGI script to use. Default: `.php`.
-	SplitPath []string `json:"split_path,omitempty"`
-	// ResolveRootSymlink enables resolving the `root` directory to its actual value by evaluating a symbolic link, if one exists.
-	ResolveRootSymlink bool `json:"resolve_root_symlink,omitempty"`
-	// Env sets an extra environment variable to the given value. Can be specified more than once for multiple environment variables.
-	Env    map[string]string `json:"env,omitempty"`
-	logger *zap.Logger
-}
+			case "precompressed":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				f.Precompressed = true
 
-// CaddyModule returns the Caddy module information.
-func (FrankenPHPModule) CaddyModule() caddy.ModuleInfo {
-	return caddy.ModuleInfo{
-		ID:  "http.handlers.php",
-		New: func() caddy.Module { return new(FrankenPHPModule) },
-	}
-}
+			case "booting_response":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				f.BootingResponse = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
 
-// Provision sets up the module.
-func (f *FrankenPHPModule) Provision(ctx caddy.Context) error {
-	f.logger = ctx.Logger(f)
+			case "fix_content_length":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				f.FixContentLength = true
 
-	if f.Root == "" {
-		if frankenphp.EmbeddedAppPath == "" {
-			f.Root = "{http.vars.root}"
-		} else {
-			f.Root = filepath.Join(frankenphp.EmbeddedAppPath, defaultDocumentRoot)
-			f.ResolveRootSymlink = false
-		}
-	} else {
-		if frankenphp.EmbeddedAppPath != "" && filepath.IsLocal(f.Root) {
-			f.Root = filepath.Join(frankenphp.EmbeddedAppPath, f.Root)
-		}
-	}
+			case "coalesce":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				f.Coalesce = true
 
-	if len(f.SplitPath) == 0 {
-		f.SplitPath = []string{".php"}
-	}
+			case "profiling":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				f.Profiling = true
 
-	return nil
-}
+			case "checksum_trailer":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				f.ChecksumTrailer = true
 
-// ServeHTTP implements caddyhttp.MiddlewareHandler.
-// TODO: Expose TLS versions as env vars, as Apache's mod_ssl: https://github.com/caddyserver/caddy/blob/master/modules/caddyhttp/reverseproxy/fastcgi/fastcgi.go#L298
-func (f FrankenPHPModule) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
-	origReq := r.Context().Value(caddyhttp.OriginalRequestCtxKey).(http.Request)
-	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+			case "strict_php_existence":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				f.StrictPHPExistence = true
 
-	documentRoot := repl.ReplaceKnown(f.Root, "")
+			case "emit_events":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				f.EmitEvents = true
 
-	env := make(map[string]string, len(f.Env)+1)
-	env["REQUEST_URI"] = origReq.URL.RequestURI()
-	for k, v := range f.Env {
-		env[k] = repl.ReplaceKnown(v, "")
-	}
+			case "response_buffering":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if err := validateResponseBuffering(d.Val()); err != nil {
+					return d.Err(err.Error())
+				}
+				f.ResponseBuffering = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
 
-	fr, err := frankenphp.NewRequestWithContext(
-		r,
-		frankenphp.WithRequestDocumentRoot(documentRoot, f.ResolveRootSymlink),
-		frankenphp.WithRequestSplitPath(f.SplitPath),
-		frankenphp.WithRequestEnv(env),
-	)
+			case "stream_content_types":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
 
-	if err != nil {
-		return err
-	}
+				for _, arg := range args {
+					mediaType, _, err := mime.ParseMediaType(arg)
+					if err != nil {
+						return d.Errf("invalid stream_content_types %q: %v", arg, err)
+					}
 
-	return frankenphp.ServeHTTP(w, fr)
-}
+					f.StreamContentTypes = append(f.StreamContentTypes, mediaType)
+				}
 
-// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
-func (f *FrankenPHPModule) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	for d.Next() {
-		for d.NextBlock(0) {
-			switch d.Val() {
-			case "root":
+			case "keepalive":
 				if !d.NextArg() {
 					return d.ArgErr()
 				}
-				f.Root = d.Val()
 
-			case "split":
-				f.SplitPath = d.RemainingArgs()
-				if len(f.SplitPath) == 0 {
+				if d.Val() == "off" {
+					f.DisableKeepAlive = true
+
+					break
+				}
+
+				v, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid keepalive %q: %v", d.Val(), err)
+				}
+				if v < time.Second {
+					return d.Errf("invalid keepalive %q: the timeout must be at least 1s", d.Val())
+				}
+				f.KeepAliveTimeout = caddy.Duration(v)
+
+			case "remove_response_header":
+				if !d.NextArg() {
 					return d.ArgErr()
 				}
+				f.RemoveResponseHeaders = append(f.RemoveResponseHeaders, d.Val())
 
-			case "env":
+			case "set_response_header":
 				args := d.RemainingArgs()
 				if len(args) != 2 {
 					return d.ArgErr()
 				}
-				if f.Env == nil {
-					f.Env = make(map[string]string)
+				if f.SetResponseHeaders == nil {
+					f.SetResponseHeaders = make(map[string]string)
 				}
-				f.Env[args[0]] = args[1]
+				f.SetResponseHeaders[args[0]] = args[1]
+
+			case "cookie_defaults":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if f.CookieDefaults == nil {
+					f.CookieDefaults = &CookieDefaultsConfig{}
+				}
+
+				for d.NextBlock(1) {
+					switch d.Val() {
+					case "secure":
+						if d.NextArg() {
+							return d.ArgErr()
+						}
+						f.CookieDefaults.Secure = true
+					case "http_only":
+						if d.NextArg() {
+							return d.ArgErr()
+						}
+						f.CookieDefaults.HTTPOnly = true
+					case "same_site":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						switch strings.ToLower(d.Val()) {
+						case "lax":
+							f.CookieDefaults.SameSite = "Lax"
+						case "strict":
+							f.CookieDefaults.SameSite = "Strict"
+						case "none":
+							f.CookieDefaults.SameSite = "None"
+						default:
+							return d.Errf(`invalid cookie_defaults same_site %q, must be "lax", "strict" or "none"`, d.Val())
+						}
+					default:
+						return d.Errf("unknown cookie_defaults subdirective %q, only secure, http_only and same_site are supported", d.Val())
+					}
+				}
+				if err := f.CookieDefaults.validate(); err != nil {
+					return d.Err(err.Error())
+				}
+
+			case "index":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				f.Index = d.Val()
+
+			case "embedded_app":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				f.EmbeddedApp = d.Val()
 
 			case "resolve_root_symlink":
+				resolve := true
+				if d.NextArg() {
+					v, err := strconv.ParseBool(d.Val())
+					if err != nil {
+						return d.Errf("invalid resolve_root_symlink %q: must be true or false", d.Val())
+					}
+					resolve = v
+				}
 				if d.NextArg() {
 					return d.ArgErr()
 				}
-				f.ResolveRootSymlink = true
+				f.ResolveRootSymlink = &resolve
 			}
 		}
 	}
@@ -316,6 +3202,35 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 	return m, err
 }
 
+// phpServerPreset contains the defaults of php_server suited to a given framework.
+type phpServerPreset struct {
+	// indexFile is the index file for the try_files rewrites.
+	indexFile string
+	// directoryIndex is true if the index file of the requested directory must be tried before the one at the root.
+	directoryIndex bool
+	// hide is the list of files and folders never served.
+	hide []string
+}
+
+// phpServerPresets are the presets available with the preset subdirective of php_server.
+var phpServerPresets = map[string]phpServerPreset{
+	"laravel": {
+		indexFile:      "index.php",
+		directoryIndex: true,
+		hide:           []string{".env", ".git", ".htaccess"},
+	},
+	"symfony": {
+		// all requests go through the front controller
+		indexFile: "index.php",
+		hide:      []string{".env", ".git"},
+	},
+	"wordpress": {
+		indexFile:      "index.php",
+		directoryIndex: true,
+		hide:           []string{".git", ".htaccess", "wp-config.php"},
+	},
+}
+
 // parsePhpServer parses the php_server directive, which has a similar syntax
 // to the php_fastcgi directive. A line such as this:
 //
@@ -328,7 +3243,7 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 //		    file {path}/index.php
 //		    not path */
 //		}
-//		redir @canonicalPath {path}/ 308
+//		redir @canonicalPath {path}/ 308 # the query string is preserved
 //
 //		# If the requested file does not exist, try index files
 //		@indexFiles file {
@@ -348,6 +3263,58 @@ func parsePhpServer(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error)
 		return nil, h.ArgErr()
 	}
 
+	// if the user specified a matcher token, use that
+	// matcher in a route that wraps both of our routes;
+	// either way, strip the matcher token and pass
+	// the remaining tokens to the unmarshaler so that
+	// we can gain the rest of the directive syntax
+	userMatcherSet, err := h.ExtractMatcherSet()
+	if err != nil {
+		return nil, err
+	}
+
+	// make a new dispenser from the remaining tokens so that we
+	// can reset the dispenser back to this point for the
+	// php unmarshaler to read from it as well
+	routes, err := phpServerRoutes(h, h.NewFromNextSegment(), true)
+	if err != nil {
+		return nil, err
+	}
+
+	subroute := caddyhttp.Subroute{
+		Routes: routes,
+	}
+
+	// the user's matcher is a prerequisite for ours, so
+	// wrap ours in a subroute and return that
+	if userMatcherSet != nil {
+		return []httpcaddyfile.ConfigValue{
+			{
+				Class: "route",
+				Value: caddyhttp.Route{
+					MatcherSetsRaw: []caddy.ModuleMap{userMatcherSet},
+					HandlersRaw:    []json.RawMessage{caddyconfig.JSONModuleObject(subroute, "handler", "subroute", nil)},
+				},
+			},
+		}, nil
+	}
+
+	// otherwise, return the literal subroute instead of
+	// individual routes, to ensure they stay together and
+	// are treated as a single unit, without necessarily
+	// creating an actual subroute in the output
+	return []httpcaddyfile.ConfigValue{
+		{
+			Class: "route",
+			Value: subroute,
+		},
+	}, nil
+}
+
+// phpServerRoutes returns the routes of a php_server block, or of one of its handle sub-blocks if allowHandle is false.
+func phpServerRoutes(h httpcaddyfile.Helper, dispenser *caddyfile.Dispenser, allowHandle bool) (caddyhttp.RouteList, error) {
+	var err error
+
 	// set up FrankenPHP
 	phpsrv := FrankenPHPModule{}
 
@@ -364,20 +3331,21 @@ func parsePhpServer(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error)
 	// set up for explicitly overriding try_files
 	tryFiles := []string{}
 
-	// if the user specified a matcher token, use that
-	// matcher in a route that wraps both of our routes;
-	// either way, strip the matcher token and pass
-	// the remaining tokens to the unmarshaler so that
-	// we can gain the rest of the directive syntax
-	userMatcherSet, err := h.ExtractMatcherSet()
-	if err != nil {
-		return nil, err
-	}
+	// set up the extension groups handled by dedicated php handlers
+	splitHandlers := []caddyfile.Segment{}
 
-	// make a new dispenser from the remaining tokens so that we
-	// can reset the dispenser back to this point for the
-	// php unmarshaler to read from it as well
-	dispenser := h.NewFromNextSegment()
+	// keep the query string when redirecting to the canonical path
+	redirPreserveQuery := true
+
+	// set up the worker exporting the routes rewritten to the index file
+	routesFrom := ""
+
+	// set up the framework preset, explicit subdirectives take precedence
+	var preset *phpServerPreset
+	indexSet := false
+
+	// set up the path prefixes served with their own root and options
+	handleSegments := []caddyfile.Segment{}
 
 	// read the subdirectives that we allow as overrides to
 	// the php_server shortcut
@@ -402,12 +3370,22 @@ func parsePhpServer(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error)
 				fsrv.Root = phpsrv.Root
 				dispenser.DeleteN(2)
 
+			case "embedded_app":
+				if !dispenser.NextArg() {
+					return nil, dispenser.ArgErr()
+				}
+				phpsrv.EmbeddedApp = dispenser.Val()
+				dispenser.DeleteN(2)
+
 			case "split":
 				extensions = dispenser.RemainingArgs()
 				dispenser.DeleteN(len(extensions) + 1)
 				if len(extensions) == 0 {
 					return nil, dispenser.ArgErr()
 				}
+				if extensions, err = normalizeSplitPath(extensions, caddy.Log()); err != nil {
+					return nil, dispenser.Err(err.Error())
+				}
 
 			case "index":
 				args := dispenser.RemainingArgs()
@@ -416,6 +3394,7 @@ func parsePhpServer(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error)
 					return nil, dispenser.ArgErr()
 				}
 				indexFile = args[0]
+				indexSet = true
 
 			case "try_files":
 				args := dispenser.RemainingArgs()
@@ -425,6 +3404,42 @@ func parsePhpServer(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error)
 				}
 				tryFiles = args
 
+			case "split_handler":
+				// the php options of the block are
+				// unmarshaled later in a dedicated handler
+				segment := dispenser.NextSegment()
+				dispenser.DeleteN(len(segment))
+				splitHandlers = append(splitHandlers, segment)
+
+			case "hide":
+				args := dispenser.RemainingArgs()
+				dispenser.DeleteN(len(args) + 1)
+				if len(args) == 0 {
+					return nil, dispenser.ArgErr()
+				}
+				fsrv.Hide = append(fsrv.Hide, args...)
+				phpsrv.Hide = append(phpsrv.Hide, args...)
+
+			case "preset":
+				args := dispenser.RemainingArgs()
+				dispenser.DeleteN(len(args) + 1)
+				if len(args) != 1 {
+					return nil, dispenser.ArgErr()
+				}
+				p, ok := phpServerPresets[args[0]]
+				if !ok {
+					return nil, dispenser.Errf("unknown preset %q", args[0])
+				}
+				preset = &p
+
+			case "redir_preserve_query":
+				args := dispenser.RemainingArgs()
+				dispenser.DeleteN(len(args) + 1)
+				if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+					return nil, dispenser.ArgErr()
+				}
+				redirPreserveQuery = args[0] == "on"
+
 			case "file_server":
 				args := dispenser.RemainingArgs()
 				dispenser.DeleteN(len(args) + 1)
@@ -432,6 +3447,36 @@ func parsePhpServer(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error)
 					return nil, dispenser.ArgErr()
 				}
 				disableFsrv = true
+
+			case "browse":
+				// directory listings are disabled by default,
+				// an optional template file customizes them
+				args := dispenser.RemainingArgs()
+				dispenser.DeleteN(len(args) + 1)
+				if len(args) > 1 {
+					return nil, dispenser.ArgErr()
+				}
+				fsrv.Browse = &fileserver.Browse{}
+				if len(args) == 1 {
+					fsrv.Browse.TemplateFile = args[0]
+				}
+
+			case "handle":
+				// the block is parsed later as a nested php_server
+				segment := dispenser.NextSegment()
+				dispenser.DeleteN(len(segment))
+				if !allowHandle {
+					return nil, dispenser.Err("handle blocks can't be nested")
+				}
+				handleSegments = append(handleSegments, segment)
+
+			case "routes_from":
+				args := dispenser.RemainingArgs()
+				dispenser.DeleteN(len(args) + 1)
+				if len(args) != 1 {
+					return nil, dispenser.ArgErr()
+				}
+				routesFrom = args[0]
 			}
 		}
 	}
@@ -440,23 +3485,74 @@ func parsePhpServer(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error)
 	// unmarshaler can read it from the start
 	dispenser.Reset()
 
-	if frankenphp.EmbeddedAppPath != "" {
+	if disableFsrv && fsrv.Browse != nil {
+		return nil, dispenser.Err("browse can't be used with file_server off")
+	}
+
+	if preset != nil {
+		if !indexSet {
+			indexFile = preset.indexFile
+		}
+		if len(fsrv.Hide) == 0 {
+			fsrv.Hide = append([]string{}, preset.hide...)
+			phpsrv.Hide = append([]string{}, preset.hide...)
+		}
+	}
+
+	appPath, err := embeddedAppPath(phpsrv.EmbeddedApp)
+	if err != nil {
+		return nil, h.Err(err.Error())
+	}
+	if appPath != "" {
 		if phpsrv.Root == "" {
-			phpsrv.Root = filepath.Join(frankenphp.EmbeddedAppPath, defaultDocumentRoot)
+			phpsrv.Root = filepath.Join(appPath, defaultDocumentRoot)
 			fsrv.Root = phpsrv.Root
-			phpsrv.ResolveRootSymlink = false
+			resolve := false
+			phpsrv.ResolveRootSymlink = &resolve
 		} else if filepath.IsLocal(fsrv.Root) {
-			phpsrv.Root = filepath.Join(frankenphp.EmbeddedAppPath, phpsrv.Root)
+			phpsrv.Root = filepath.Join(appPath, phpsrv.Root)
 			fsrv.Root = phpsrv.Root
 		}
+		if routesFrom != "" && filepath.IsLocal(routesFrom) {
+			routesFrom = filepath.Join(appPath, routesFrom)
+		}
 	}
 
-	// set up a route list that we'll append to
+	// set up a route list that we'll append to,
+	// starting with the path prefixes having their own root
 	routes := caddyhttp.RouteList{}
+	if !allowHandle && fsrv.Root != "" {
+		// in handle blocks, the root of the site is overridden
+		// for the file matchers, as the root directive would do
+		routes = append(routes, caddyhttp.Route{
+			HandlersRaw: []json.RawMessage{caddyconfig.JSONModuleObject(caddyhttp.VarsMiddleware{"root": fsrv.Root}, "handler", "vars", nil)},
+		})
+	}
+	for _, segment := range handleSegments {
+		route, err := parsePhpServerHandle(h, segment)
+		if err != nil {
+			return nil, err
+		}
+
+		routes = append(routes, route)
+	}
 
 	// set the list of allowed path segments on which to split
 	phpsrv.SplitPath = extensions
 
+	// set up the php handlers dedicated to other extension groups
+	splitExtensions := append([]string{}, extensions...)
+	splitRoutes := caddyhttp.RouteList{}
+	for _, segment := range splitHandlers {
+		route, exts, err := parseSplitHandler(h, segment, phpsrv)
+		if err != nil {
+			return nil, err
+		}
+
+		splitExtensions = append(splitExtensions, exts...)
+		splitRoutes = append(splitRoutes, route)
+	}
+
 	// if the index is turned off, we skip the redirect and try_files
 	if indexFile != "off" {
 		// route to redirect to canonical path if index PHP file
@@ -481,27 +3577,61 @@ func parsePhpServer(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error)
 			HandlersRaw:    []json.RawMessage{caddyconfig.JSONModuleObject(redirHandler, "handler", "static_response", nil)},
 		}
 
+		// route to redirect to canonical path while keeping the query string,
+		// it must be evaluated before the one without query string
+		if redirPreserveQuery {
+			queryRedirMatcherSet := caddy.ModuleMap{
+				"expression": h.JSON(caddyhttp.MatchExpression{Expr: "{http.request.orig_uri.query} != ''"}),
+			}
+			for k, v := range redirMatcherSet {
+				queryRedirMatcherSet[k] = v
+			}
+			queryRedirHandler := caddyhttp.StaticResponse{
+				StatusCode: caddyhttp.WeakString(strconv.Itoa(http.StatusPermanentRedirect)),
+				Headers:    http.Header{"Location": []string{"{http.request.orig_uri.path}/?{http.request.orig_uri.query}"}},
+			}
+			routes = append(routes, caddyhttp.Route{
+				MatcherSetsRaw: []caddy.ModuleMap{queryRedirMatcherSet},
+				HandlersRaw:    []json.RawMessage{caddyconfig.JSONModuleObject(queryRedirHandler, "handler", "static_response", nil)},
+			})
+		}
+
 		// if tryFiles wasn't overridden, use a reasonable default
 		if len(tryFiles) == 0 {
-			tryFiles = []string{"{http.request.uri.path}", "{http.request.uri.path}/" + indexFile, indexFile}
+			tryFiles = []string{"{http.request.uri.path}"}
+			if preset == nil || preset.directoryIndex {
+				tryFiles = append(tryFiles, "{http.request.uri.path}/"+indexFile)
+			}
+			tryFiles = append(tryFiles, indexFile)
 		}
 
+		routes = append(routes, redirRoute)
+
 		// route to rewrite to PHP index file
-		rewriteMatcherSet := caddy.ModuleMap{
-			"file": h.JSON(fileserver.MatchFile{
-				TryFiles:  tryFiles,
-				SplitPath: extensions,
-			}),
-		}
-		rewriteHandler := rewrite.Rewrite{
-			URI: "{http.matchers.file.relative}",
-		}
-		rewriteRoute := caddyhttp.Route{
-			MatcherSetsRaw: []caddy.ModuleMap{rewriteMatcherSet},
-			HandlersRaw:    []json.RawMessage{caddyconfig.JSONModuleObject(rewriteHandler, "handler", "rewrite", nil)},
+		if routesFrom == "" {
+			routes = append(routes, tryFilesRoutes(h, tryFiles, splitExtensions)...)
+		} else {
+			if slices.ContainsFunc(tryFiles, func(f string) bool { return strings.Contains(f, "?") }) {
+				return nil, h.Err("routes_from can't be used with try_files entries having a query string")
+			}
+
+			rewriteMatcherSets, err := routesMatcherSets(h, routesFrom, tryFiles, splitExtensions)
+			if err != nil {
+				return nil, err
+			}
+
+			rewriteHandler := rewrite.Rewrite{
+				URI: "{http.matchers.file.relative}",
+			}
+			routes = append(routes, caddyhttp.Route{
+				MatcherSetsRaw: rewriteMatcherSets,
+				HandlersRaw:    []json.RawMessage{caddyconfig.JSONModuleObject(rewriteHandler, "handler", "rewrite", nil)},
+			})
 		}
+	}
 
-		routes = append(routes, redirRoute, rewriteRoute)
+	if routesFrom != "" && indexFile == "off" {
+		return nil, h.Err("routes_from can't be used when the index is off")
 	}
 
 	// route to actually pass requests to PHP files;
@@ -528,6 +3658,7 @@ func parsePhpServer(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error)
 		MatcherSetsRaw: []caddy.ModuleMap{phpMatcherSet},
 		HandlersRaw:    []json.RawMessage{caddyconfig.JSONModuleObject(phpsrv, "handler", "php", nil)},
 	}
+	routes = append(routes, splitRoutes...)
 	routes = append(routes, phpRoute)
 
 	// create the file server route
@@ -539,40 +3670,356 @@ func parsePhpServer(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error)
 		routes = append(routes, fileRoute)
 	}
 
+	return routes, nil
+}
+
+// parsePhpServerHandle parses a handle sub-block of php_server:
+//
+//	handle <path_prefix> {
+//		# php_server options
+//	}
+//
+// and returns a route serving the requests under this path prefix with the options of the block, such as its own root.
+// As with the handle_path directive, the prefix is stripped from the path before looking for files in the root,
+// but PHP still gets the original REQUEST_URI.
+func parsePhpServerHandle(h httpcaddyfile.Helper, segment caddyfile.Segment) (caddyhttp.Route, error) {
+	d := caddyfile.NewDispenser(segment)
+	d.Next() // consume the subdirective name
+
+	if !d.NextArg() {
+		return caddyhttp.Route{}, d.ArgErr()
+	}
+	prefix := strings.TrimSuffix(d.Val(), "/")
+	if !strings.HasPrefix(prefix, "/") || prefix == "" {
+		return caddyhttp.Route{}, d.Errf("invalid handle path prefix %q: must start with / and not be the root", d.Val())
+	}
+	if d.NextArg() {
+		return caddyhttp.Route{}, d.ArgErr()
+	}
+
+	// the block is parsed as if it was a php_server directive without arguments
+	tokens := append([]caddyfile.Token{segment[0]}, segment[2:]...)
+	routes, err := phpServerRoutes(h, caddyfile.NewDispenser(tokens), false)
+	if err != nil {
+		return caddyhttp.Route{}, err
+	}
+
+	stripHandler := rewrite.Rewrite{
+		StripPathPrefix: prefix,
+	}
 	subroute := caddyhttp.Subroute{
 		Routes: routes,
 	}
 
-	// the user's matcher is a prerequisite for ours, so
-	// wrap ours in a subroute and return that
-	if userMatcherSet != nil {
-		return []httpcaddyfile.ConfigValue{
+	return caddyhttp.Route{
+		MatcherSetsRaw: []caddy.ModuleMap{
 			{
-				Class: "route",
-				Value: caddyhttp.Route{
-					MatcherSetsRaw: []caddy.ModuleMap{userMatcherSet},
-					HandlersRaw:    []json.RawMessage{caddyconfig.JSONModuleObject(subroute, "handler", "subroute", nil)},
-				},
+				"path": h.JSON(caddyhttp.MatchPath{prefix, prefix + "/*"}),
 			},
-		}, nil
-	}
-
-	// otherwise, return the literal subroute instead of
-	// individual routes, to ensure they stay together and
-	// are treated as a single unit, without necessarily
-	// creating an actual subroute in the output
-	return []httpcaddyfile.ConfigValue{
-		{
-			Class: "route",
-			Value: subroute,
 		},
+		HandlersRaw: []json.RawMessage{
+			caddyconfig.JSONModuleObject(stripHandler, "handler", "rewrite", nil),
+			caddyconfig.JSONModuleObject(subroute, "handler", "subroute", nil),
+		},
+		Terminal: true,
 	}, nil
 }
 
+// routeParamRegexp matches the parameters of the exported route paths, e.g. {id}.
+var routeParamRegexp = regexp.MustCompile(`\{[^}]*\}`)
+
+// tryFilesRoutes returns the routes rewriting the requests to the first existing file of tryFiles.
+// As with the try_files directive, the query string of an entry (e.g. `index.php?{query}&p={path}`) replaces the one
+// of the request, the requests rewritten to entries without a query string keep theirs.
+func tryFilesRoutes(h httpcaddyfile.Helper, tryFiles, splitPath []string) caddyhttp.RouteList {
+	var routes caddyhttp.RouteList
+	makeRoute := func(try []string, query string) {
+		rewriteHandler := rewrite.Rewrite{
+			URI: "{http.matchers.file.relative}" + query,
+		}
+		routes = append(routes, caddyhttp.Route{
+			MatcherSetsRaw: []caddy.ModuleMap{{
+				"file": h.JSON(fileserver.MatchFile{
+					TryFiles:  try,
+					SplitPath: splitPath,
+				}),
+			}},
+			HandlersRaw: []json.RawMessage{caddyconfig.JSONModuleObject(rewriteHandler, "handler", "rewrite", nil)},
+		})
+	}
+
+	// consecutive entries without a query string are tried by the same matcher
+	var try []string
+	for _, f := range tryFiles {
+		file, query, ok := strings.Cut(f, "?")
+		if !ok {
+			try = append(try, f)
+
+			continue
+		}
+
+		if len(try) > 0 {
+			makeRoute(try, "")
+			try = nil
+		}
+		makeRoute([]string{file}, "?"+query)
+	}
+	if len(try) > 0 {
+		makeRoute(try, "")
+	}
+
+	// only the first matching rewrite is performed
+	if len(routes) > 1 {
+		for i := range routes {
+			routes[i].Group = "php_server_try_files"
+		}
+	}
+
+	return routes
+}
+
+// routesMatcherSets returns the matcher sets of the rewrite route of php_server when routes_from is used:
+// the existing files are still rewritten, but only the routes exported by the worker fall back to the last try_files entry (the index file).
+func routesMatcherSets(h httpcaddyfile.Helper, worker string, tryFiles, splitPath []string) ([]caddy.ModuleMap, error) {
+	routes, err := frankenphp.ExportRoutes(worker)
+	if err != nil {
+		return nil, h.Errf("routes_from: %v", err)
+	}
+
+	var matcherSets []caddy.ModuleMap
+	if len(tryFiles) > 1 {
+		matcherSets = append(matcherSets, caddy.ModuleMap{
+			"file": h.JSON(fileserver.MatchFile{
+				TryFiles:  tryFiles[:len(tryFiles)-1],
+				SplitPath: splitPath,
+			}),
+		})
+	}
+
+	for _, r := range routes {
+		if !strings.HasPrefix(r.Path, "/") {
+			return nil, h.Errf("routes_from: invalid route path %q", r.Path)
+		}
+
+		matcherSet := caddy.ModuleMap{
+			"file": h.JSON(fileserver.MatchFile{
+				TryFiles:  tryFiles,
+				SplitPath: splitPath,
+			}),
+			"path": h.JSON(caddyhttp.MatchPath{routeParamRegexp.ReplaceAllString(r.Path, "*")}),
+		}
+		if len(r.Methods) > 0 {
+			methods := make(caddyhttp.MatchMethod, len(r.Methods))
+			for i, m := range r.Methods {
+				methods[i] = strings.ToUpper(m)
+			}
+			matcherSet["method"] = h.JSON(methods)
+		}
+
+		matcherSets = append(matcherSets, matcherSet)
+	}
+
+	// an empty list of matcher sets would match all the requests
+	if len(matcherSets) == 0 {
+		return nil, h.Errf("routes_from: %s doesn't export any route", worker)
+	}
+
+	return matcherSets, nil
+}
+
+// parseSplitHandler parses a split_handler subdirective of php_server:
+//
+//	split_handler <extensions...> {
+//		# php directive options
+//	}
+//
+// and returns a route passing the requests for files with these extensions
+// to a dedicated php handler, along with the extensions.
+func parseSplitHandler(h httpcaddyfile.Helper, segment caddyfile.Segment, phpsrv FrankenPHPModule) (caddyhttp.Route, []string, error) {
+	d := caddyfile.NewDispenser(segment)
+	d.Next() // consume the subdirective name
+
+	extensions := d.RemainingArgs()
+	if len(extensions) == 0 {
+		return caddyhttp.Route{}, nil, d.ArgErr()
+	}
+	// the stripped tokens below are counted before the normalization
+	nbExtensions := len(extensions)
+	extensions, err := normalizeSplitPath(extensions, caddy.Log())
+	if err != nil {
+		return caddyhttp.Route{}, nil, d.Err(err.Error())
+	}
+
+	// the handler inherits the root and the hidden files of php_server,
+	// the other options are read from the block
+	handler := FrankenPHPModule{
+		Root:               phpsrv.Root,
+		ResolveRootSymlink: phpsrv.ResolveRootSymlink,
+		Hide:               append([]string{}, phpsrv.Hide...),
+	}
+
+	// strip the extensions so the php unmarshaler only sees the block
+	d = caddyfile.NewDispenser(append(caddyfile.Segment{segment[0]}, segment[nbExtensions+1:]...))
+	if err := handler.UnmarshalCaddyfile(d); err != nil {
+		return caddyhttp.Route{}, nil, err
+	}
+	handler.SplitPath = extensions
+
+	pathList := []string{}
+	for _, ext := range extensions {
+		pathList = append(pathList, "*"+ext)
+	}
+
+	return caddyhttp.Route{
+		MatcherSetsRaw: []caddy.ModuleMap{{"path": h.JSON(pathList)}},
+		HandlersRaw:    []json.RawMessage{caddyconfig.JSONModuleObject(handler, "handler", "php", nil)},
+	}, extensions, nil
+}
+
+// lookupCredentials resolves "user[:group]", where user and group are names or numeric IDs.
+// When the group is omitted, the primary group of the user is used.
+func lookupCredentials(runAs string) (uid, gid int, err error) {
+	userName, groupName, hasGroup := strings.Cut(runAs, ":")
+
+	u, err := user.Lookup(userName)
+	if err != nil {
+		if u, err = user.LookupId(userName); err != nil {
+			return 0, 0, fmt.Errorf("unknown user %q", userName)
+		}
+	}
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return 0, 0, err
+	}
+
+	gidStr := u.Gid
+	if hasGroup {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return 0, 0, fmt.Errorf("unknown group %q", groupName)
+			}
+		}
+		gidStr = g.Gid
+	}
+	if gid, err = strconv.Atoi(gidStr); err != nil {
+		return 0, 0, err
+	}
+
+	return uid, gid, nil
+}
+
+// normalizeSplitPath ensures the split_path entries start with a dot (e.g. "php" becomes ".php"),
+// a common mistake silently preventing the path from being split. Empty entries and entries containing spaces are rejected.
+func normalizeSplitPath(splitPath []string, logger *zap.Logger) ([]string, error) {
+	normalized := make([]string, len(splitPath))
+	for i, split := range splitPath {
+		if strings.TrimSpace(split) == "" || strings.ContainsAny(split, " \t\r\n") {
+			return nil, fmt.Errorf("invalid split_path entry %q", split)
+		}
+
+		if !strings.HasPrefix(split, ".") {
+			logger.Warn("split_path entries must start with a dot, adding it", zap.String("split_path", split))
+			split = "." + split
+		}
+
+		normalized[i] = split
+	}
+
+	return normalized, nil
+}
+
+// fileHidden returns true if filename is hidden according to the hide list,
+// the matching rules are the same as the ones of the file server.
+func fileHidden(filename string, hide []string) bool {
+	sep := string(filepath.Separator)
+
+	var components []string
+	for _, h := range hide {
+		if !strings.Contains(h, sep) {
+			// a name without separator hides any file or folder with that name
+			if len(components) == 0 {
+				components = strings.Split(filename, sep)
+			}
+			for _, c := range components {
+				if hidden, _ := filepath.Match(h, c); hidden {
+					return true
+				}
+			}
+		} else if strings.HasPrefix(filename, h) {
+			// "/foo" hides "/foo/bar" but not "/foobar"
+			if strings.HasPrefix(strings.TrimPrefix(filename, h), sep) {
+				return true
+			}
+		}
+
+		if hidden, _ := filepath.Match(h, filename); hidden {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fileETag computes the ETag of a file the same way as the file server, from its modification time and size.
+func fileETag(fi os.FileInfo) string {
+	return `"` + strconv.FormatInt(fi.ModTime().UnixNano(), 36) + strconv.FormatInt(fi.Size(), 36) + `"`
+}
+
+// stat returns the result of os.Stat for the given path, from the cache if ScriptStatCacheTTL is set.
+func (f FrankenPHPModule) stat(path string) (os.FileInfo, error) {
+	if f.statCache != nil {
+		return f.statCache.stat(path)
+	}
+
+	return os.Stat(path)
+}
+
+// indexPath returns the path of the index script for the requests targeting a directory, or an empty string for the other requests.
+func (f FrankenPHPModule) indexPath(documentRoot, path string) string {
+	if requestedScript(f.SplitPath, path) != "" {
+		return ""
+	}
+
+	if !strings.HasSuffix(path, "/") {
+		fi, err := f.stat(caddyhttp.SanitizedPathJoin(documentRoot, path))
+		if err != nil || !fi.IsDir() {
+			return ""
+		}
+		path += "/"
+	}
+
+	return path + f.Index
+}
+
+// requestedScript returns the path of the PHP script targeted by path, the same way
+// as the embedded interpreter splits it, or an empty string if path doesn't target a script.
+func requestedScript(splitPath []string, path string) string {
+	lowerPath := strings.ToLower(path)
+	for _, split := range splitPath {
+		if idx := strings.Index(lowerPath, strings.ToLower(split)); idx > -1 {
+			return path[:idx+len(split)]
+		}
+	}
+
+	return ""
+}
+
+// resolveRootPath returns the absolute path of p, relative paths are resolved against the document root.
+func resolveRootPath(documentRoot, p string) (string, error) {
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(documentRoot, p)
+	}
+
+	return filepath.Abs(p)
+}
+
 // Interface guards
 var (
 	_ caddy.App                   = (*FrankenPHPApp)(nil)
+	_ caddy.Provisioner           = (*FrankenPHPApp)(nil)
 	_ caddy.Provisioner           = (*FrankenPHPModule)(nil)
 	_ caddyhttp.MiddlewareHandler = (*FrankenPHPModule)(nil)
 	_ caddyfile.Unmarshaler       = (*FrankenPHPModule)(nil)
+	_ http.ResponseWriter         = (*responseHeadersWriter)(nil)
+	_ http.ResponseWriter         = (*statusWriter)(nil)
 )
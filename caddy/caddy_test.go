@@ -1,14 +1,38 @@
 package caddy_test
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
+	"time"
 
+	caddy2 "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddytest"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"github.com/dunglas/frankenphp"
+	"github.com/dunglas/frankenphp/caddy"
 )
 
 func TestPHP(t *testing.T) {
@@ -137,7 +161,696 @@ func TestEnv(t *testing.T) {
 		}
 		`, "caddyfile")
 
-	tester.AssertGetResponse("http://localhost:9080/env.php", http.StatusOK, "bazbar")
+	tester.AssertGetResponse("http://localhost:9080/env.php", http.StatusOK, "barbar")
+}
+
+func TestEnvPrecedence(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp {
+				strict_env
+				env GLOBAL global
+				env DEFAULTS global
+				env HANDLER global
+				env WORKER global
+				defaults {
+					env DEFAULTS defaults
+					env HANDLER defaults
+					env WORKER defaults
+				}
+				worker {
+					file ../testdata/env-var.php
+					num 1
+					env WORKER worker
+				}
+			}
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					env HANDLER handler
+					env WORKER handler
+				}
+			}
+		}
+		`, "caddyfile")
+
+	for name, expected := range map[string]string{
+		"GLOBAL":   "global",
+		"DEFAULTS": "defaults",
+		"HANDLER":  "handler",
+		"WORKER":   "worker",
+	} {
+		tester.AssertGetResponse("http://localhost:9080/env-var.php?name="+name, http.StatusOK, expected)
+	}
+}
+
+func TestEnvPerRequest(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					env STATIC static
+					env VALUE "{http.request.header.X-Value}"
+				}
+			}
+		}
+		`, "caddyfile")
+
+	// the values of a request never leak into the other ones
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/env-var.php?name=VALUE", nil)
+			expected := ""
+			if i%2 == 0 {
+				expected = strconv.Itoa(i)
+				req.Header.Set("X-Value", expected)
+			}
+			tester.AssertResponse(req, http.StatusOK, expected)
+		}(i)
+	}
+	wg.Wait()
+
+	tester.AssertGetResponse("http://localhost:9080/env-var.php?name=STATIC", http.StatusOK, "static")
+	tester.AssertGetResponse("http://localhost:9080/env-var.php?name=REQUEST_URI", http.StatusOK, "/env-var.php?name=REQUEST_URI")
+}
+
+func TestEnvInterpolation(t *testing.T) {
+	t.Setenv("FRANKENPHP_TEST_DB_HOST", "db.example.com")
+	t.Setenv("FRANKENPHP_TEST_EMPTY", "")
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					env DB_DSN "mysql:host={env.FRANKENPHP_TEST_DB_HOST};dbname=app"
+					env DB_PORT "{env.FRANKENPHP_TEST_DB_PORT:-3306}"
+					env DB_USER "{env.FRANKENPHP_TEST_EMPTY:-app}"
+					env DB_REPLICA "{env.FRANKENPHP_TEST_DB_REPLICA:-{env.FRANKENPHP_TEST_DB_HOST}:{env.FRANKENPHP_TEST_DB_PORT:-3306}}"
+					env SERVER "{env.FRANKENPHP_TEST_SERVER:-{http.request.host}}"
+					env UNKNOWN "{unknown}"
+				}
+			}
+		}
+		`, "caddyfile")
+
+	for name, expected := range map[string]string{
+		"DB_DSN":     "mysql:host=db.example.com;dbname=app",
+		"DB_PORT":    "3306",
+		"DB_USER":    "app",
+		"DB_REPLICA": "db.example.com:3306",
+		"SERVER":     "localhost",
+		"UNKNOWN":    "{unknown}",
+	} {
+		tester.AssertGetResponse("http://localhost:9080/env-var.php?name="+name, http.StatusOK, expected)
+	}
+}
+
+func TestServerAdmin(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route /admin/* {
+				uri strip_prefix /admin
+				php {
+					root ../testdata
+					server_admin webmaster@example.com
+				}
+			}
+
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, "caddyfile")
+
+	tester.AssertGetResponse("http://localhost:9080/admin/env-var.php?name=SERVER_ADMIN", http.StatusOK, "webmaster@example.com")
+	tester.AssertGetResponse("http://localhost:9080/admin/env-var.php?name=SERVER_SIGNATURE", http.StatusOK, "<address>FrankenPHP Server at <a href=\"mailto:webmaster@example.com\">localhost</a> Port 9080</address>\n")
+
+	tester.AssertGetResponse("http://localhost:9080/env-var.php?name=SERVER_ADMIN", http.StatusOK, "missing")
+	tester.AssertGetResponse("http://localhost:9080/env-var.php?name=SERVER_SIGNATURE", http.StatusOK, "<address>FrankenPHP Server at localhost Port 9080</address>\n")
+}
+
+func TestScriptNamePrefix(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route /app/* {
+				uri strip_prefix /app
+				php {
+					root ../testdata
+					script_name_prefix /app/
+				}
+			}
+
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, "caddyfile")
+
+	tester.AssertGetResponse("http://localhost:9080/app/env-var.php?name=SCRIPT_NAME", http.StatusOK, "/app/env-var.php")
+	tester.AssertGetResponse("http://localhost:9080/app/env-var.php/foo?name=PHP_SELF", http.StatusOK, "/app/env-var.php/foo")
+	tester.AssertGetResponse("http://localhost:9080/app/env-var.php/foo?name=PATH_INFO", http.StatusOK, "/foo")
+
+	tester.AssertGetResponse("http://localhost:9080/env-var.php?name=SCRIPT_NAME", http.StatusOK, "/env-var.php")
+	tester.AssertGetResponse("http://localhost:9080/env-var.php/foo?name=PHP_SELF", http.StatusOK, "/env-var.php/foo")
+}
+
+func TestParseScriptNamePrefix(t *testing.T) {
+	f := &caddy.FrankenPHPModule{}
+	if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\nscript_name_prefix /app/\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if f.ScriptNamePrefix != "/app" {
+		t.Errorf("unexpected script_name_prefix: %q", f.ScriptNamePrefix)
+	}
+
+	for _, input := range []string{"script_name_prefix", "script_name_prefix /", "script_name_prefix app"} {
+		f := &caddy.FrankenPHPModule{}
+		if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\n" + input + "\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestParseServerAdmin(t *testing.T) {
+	f := &caddy.FrankenPHPModule{}
+	if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\nserver_admin webmaster@example.com\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if f.ServerAdmin != "webmaster@example.com" {
+		t.Errorf("unexpected server_admin: %q", f.ServerAdmin)
+	}
+
+	for _, input := range []string{"server_admin", "server_admin webmaster", "server_admin \"Webmaster <webmaster@example.com>\""} {
+		f := &caddy.FrankenPHPModule{}
+		if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\n" + input + "\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestEmbeddedApps(t *testing.T) {
+	dir := t.TempDir()
+	apps := map[string]string{}
+	for _, name := range []string{"admin", "blog"} {
+		apps[name] = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Join(apps[name], "public"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(apps[name], "public", "index.php"), []byte("<?php echo 'I am the "+name+" app';"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	embeddedAppPaths := frankenphp.EmbeddedAppPaths
+	frankenphp.EmbeddedAppPaths = apps
+	t.Cleanup(func() { frankenphp.EmbeddedAppPaths = embeddedAppPaths })
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route /admin/* {
+				uri strip_prefix /admin
+				php {
+					embedded_app admin
+				}
+			}
+
+			route /blog/* {
+				uri strip_prefix /blog
+				php {
+					embedded_app blog
+				}
+			}
+		}
+		`, "caddyfile")
+
+	tester.AssertGetResponse("http://localhost:9080/admin/index.php", http.StatusOK, "I am the admin app")
+	tester.AssertGetResponse("http://localhost:9080/blog/index.php", http.StatusOK, "I am the blog app")
+}
+
+func TestParseEmbeddedApp(t *testing.T) {
+	embeddedAppPaths := frankenphp.EmbeddedAppPaths
+	frankenphp.EmbeddedAppPaths = map[string]string{"admin": "/opt/admin"}
+	t.Cleanup(func() { frankenphp.EmbeddedAppPaths = embeddedAppPaths })
+
+	app := &caddy.FrankenPHPApp{}
+	if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker {\nfile worker.php\nshutdown shutdown.php\nembedded_app admin\n}\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if w := app.Workers[0]; w.FileName != filepath.Join("/opt/admin", "worker.php") || w.ShutdownScript != filepath.Join("/opt/admin", "shutdown.php") {
+		t.Errorf("the paths of the worker aren't resolved against the embedded app: %q %q", w.FileName, w.ShutdownScript)
+	}
+
+	if err := (&caddy.FrankenPHPApp{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker {\nfile worker.php\nembedded_app blog\n}\n}")); err == nil {
+		t.Error("expected an error for an unknown embedded app")
+	}
+
+	f := &caddy.FrankenPHPModule{}
+	if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\nembedded_app admin\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if f.EmbeddedApp != "admin" {
+		t.Errorf("unexpected embedded_app: %q", f.EmbeddedApp)
+	}
+}
+
+func TestModuleDefaults(t *testing.T) {
+	testDataDir, err := filepath.EvalSymlinks("../testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDataDir, _ = filepath.Abs(testDataDir)
+	root := filepath.Join(t.TempDir(), "root")
+	if err := os.Symlink(testDataDir, root); err != nil {
+		t.Fatal(err)
+	}
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(fmt.Sprintf(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp {
+				env FOO global
+				env QUX global
+				defaults {
+					env FOO default
+					env BAR default
+					resolve_root_symlink
+				}
+			}
+		}
+
+		localhost:9080 {
+			route /override/* {
+				uri strip_prefix /override
+				php {
+					root %[1]s
+					env BAR handler
+					resolve_root_symlink false
+				}
+			}
+
+			route {
+				php {
+					root %[1]s
+				}
+			}
+		}
+		`, root), "caddyfile")
+
+	for prefix, expected := range map[string]map[string]string{
+		"":          {"FOO": "default", "BAR": "default", "QUX": "global", "DOCUMENT_ROOT": testDataDir},
+		"/override": {"FOO": "default", "BAR": "handler", "QUX": "global", "DOCUMENT_ROOT": root},
+	} {
+		for name, value := range expected {
+			tester.AssertGetResponse("http://localhost:9080"+prefix+"/env-var.php?name="+name, http.StatusOK, value)
+		}
+	}
+}
+
+func TestParseStrictEnv(t *testing.T) {
+	app := &caddy.FrankenPHPApp{}
+	if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nstrict_env\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if !app.StrictEnv {
+		t.Error("strict_env should be enabled")
+	}
+
+	app = &caddy.FrankenPHPApp{}
+	if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nstrict_env true\n}")); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestParseModuleDefaults(t *testing.T) {
+	app := &caddy.FrankenPHPApp{}
+	if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\ndefaults {\nenv FOO bar\nsplit .php .phtml\nresolve_root_symlink\n}\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if d := app.Defaults; d == nil || d.Env["FOO"] != "bar" || !slices.Equal(d.SplitPath, []string{".php", ".phtml"}) || !d.ResolveRootSymlink {
+		t.Errorf("unexpected defaults: %+v", d)
+	}
+
+	for _, input := range []string{"defaults foo {\n}", "defaults {\nenv FOO\n}", "defaults {\nsplit\n}", "defaults {\nresolve_root_symlink on\n}", "defaults {\nroot /var/www\n}"} {
+		app := &caddy.FrankenPHPApp{}
+		if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\n" + input + "\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+
+	for input, expected := range map[string]bool{"resolve_root_symlink": true, "resolve_root_symlink true": true, "resolve_root_symlink false": false} {
+		f := &caddy.FrankenPHPModule{}
+		if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\n" + input + "\n}")); err != nil {
+			t.Errorf("%q: unexpected error: %v", input, err)
+
+			continue
+		}
+		if f.ResolveRootSymlink == nil || *f.ResolveRootSymlink != expected {
+			t.Errorf("%q: unexpected resolve_root_symlink: %v", input, f.ResolveRootSymlink)
+		}
+	}
+	if err := (&caddy.FrankenPHPModule{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\nresolve_root_symlink foo\n}")); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestProfiling(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route /profiled/* {
+				uri strip_prefix /profiled
+				php {
+					root ../testdata
+					profiling
+				}
+			}
+
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, "caddyfile")
+
+	req, _ := http.NewRequest("GET", "http://localhost:9080/profiled/cpu.php?ms=100&alloc=4194304", nil)
+	resp := tester.AssertResponseCode(req, http.StatusOK)
+	cpuTime, err := strconv.ParseFloat(resp.Header.Get("X-PHP-CPU-Time"), 64)
+	if err != nil || cpuTime < 0.05 || cpuTime > 10 {
+		t.Errorf("unexpected X-PHP-CPU-Time header: %q", resp.Header.Get("X-PHP-CPU-Time"))
+	}
+	alloc, err := strconv.ParseUint(resp.Header.Get("X-PHP-Alloc"), 10, 64)
+	if err != nil || alloc < 4194304 {
+		t.Errorf("unexpected X-PHP-Alloc header: %q", resp.Header.Get("X-PHP-Alloc"))
+	}
+
+	resp, _ = tester.AssertGetResponse("http://localhost:9080/cpu.php", http.StatusOK, "0 iterations, 0 bytes allocated")
+	if resp.Header.Get("X-PHP-CPU-Time") != "" || resp.Header.Get("X-PHP-Alloc") != "" {
+		t.Errorf("unexpected profiling headers: %v", resp.Header)
+	}
+}
+
+func TestParseProfiling(t *testing.T) {
+	f := &caddy.FrankenPHPModule{}
+	if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\nprofiling\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if !f.Profiling {
+		t.Error("profiling isn't enabled")
+	}
+
+	if err := (&caddy.FrankenPHPModule{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\nprofiling on\n}")); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestChecksumTrailer(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					checksum_trailer
+				}
+			}
+		}
+		`, "caddyfile")
+
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/index.php?i=0", nil)
+	req.Header.Set("TE", "trailers")
+	resp, body := tester.AssertResponse(req, http.StatusOK, "I am by birth a Genevese (0)")
+
+	sum := sha256.Sum256([]byte(body))
+	if v := resp.Trailer.Get("X-Checksum-SHA256"); v != hex.EncodeToString(sum[:]) {
+		t.Errorf("unexpected checksum trailer %q", v)
+	}
+
+	// clients not accepting trailers don't get it
+	resp, _ = tester.AssertGetResponse("http://localhost:9080/index.php?i=1", http.StatusOK, "I am by birth a Genevese (1)")
+	if len(resp.Trailer) != 0 || resp.Header.Get("Trailer") != "" {
+		t.Errorf("unexpected trailers %v", resp.Trailer)
+	}
+}
+
+func TestParseChecksumTrailer(t *testing.T) {
+	f := &caddy.FrankenPHPModule{}
+	if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\nchecksum_trailer\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if !f.ChecksumTrailer {
+		t.Error("checksum_trailer isn't enabled")
+	}
+
+	if err := (&caddy.FrankenPHPModule{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\nchecksum_trailer sha1\n}")); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	for name, tc := range map[string]struct {
+		trustedProxies string
+		expected       map[string]string
+	}{
+		"trusted": {
+			trustedProxies: "127.0.0.1/32 ::1/128",
+			expected: map[string]string{
+				"HTTPS":          "on",
+				"REQUEST_SCHEME": "https",
+				"SERVER_NAME":    "example.com",
+				"SERVER_PORT":    "8443",
+			},
+		},
+		"untrusted": {
+			trustedProxies: "192.0.2.0/24",
+			expected: map[string]string{
+				"HTTPS":          "missing",
+				"REQUEST_SCHEME": "http",
+				"SERVER_NAME":    "localhost",
+				"SERVER_PORT":    "9080",
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tester := caddytest.NewTester(t)
+			tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			servers {
+				trusted_proxies static `+tc.trustedProxies+`
+			}
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, "caddyfile")
+
+			for variable, expected := range tc.expected {
+				req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/env-var.php?name="+variable, nil)
+				req.Header.Set("X-Forwarded-Proto", "https")
+				req.Header.Set("X-Forwarded-Host", "example.com:8443")
+				tester.AssertResponse(req, http.StatusOK, expected)
+			}
+		})
+	}
+}
+
+func TestTrustedProxiesForwarded(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			servers {
+				trusted_proxies static private_ranges
+			}
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, "caddyfile")
+
+	for variable, expected := range map[string]string{
+		"REMOTE_ADDR":    "2001:db8:cafe::17",
+		"HTTPS":          "on",
+		"REQUEST_SCHEME": "https",
+		"SERVER_NAME":    "example.com",
+		"SERVER_PORT":    "8443",
+	} {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/env-var.php?name="+variable, nil)
+		req.Header.Set("Forwarded", `For="[2001:db8:cafe::17]:4711";proto=https;host="example.com:8443", for=192.0.2.43`)
+		// the Forwarded header has priority
+		req.Header.Set("X-Forwarded-Proto", "http")
+		req.Header.Set("X-Forwarded-Host", "other.example.com")
+		req.Header.Set("X-Forwarded-Port", "8080")
+		tester.AssertResponse(req, http.StatusOK, expected)
+	}
+
+	// the X-Forwarded-* headers are used for the parameters missing from the Forwarded header
+	for variable, expected := range map[string]string{
+		"HTTPS":          "on",
+		"REQUEST_SCHEME": "https",
+		"SERVER_NAME":    "other.example.com",
+		"SERVER_PORT":    "8080",
+	} {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/env-var.php?name="+variable, nil)
+		req.Header.Set("Forwarded", "for=_hidden;proto=https")
+		req.Header.Set("X-Forwarded-Host", "other.example.com")
+		req.Header.Set("X-Forwarded-Port", "8080")
+		tester.AssertResponse(req, http.StatusOK, expected)
+	}
+}
+
+func TestTrustedProxiesInvalidHeaders(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			servers {
+				trusted_proxies static private_ranges
+			}
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, "caddyfile")
+
+	for variable, expected := range map[string]string{
+		"HTTPS":          "missing",
+		"REQUEST_SCHEME": "http",
+		"SERVER_NAME":    "localhost",
+		"SERVER_PORT":    "9080",
+	} {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/env-var.php?name="+variable, nil)
+		req.Header.Set("X-Forwarded-Proto", "gopher")
+		req.Header.Set("X-Forwarded-Host", "evil.example.com/path")
+		req.Header.Set("X-Forwarded-Port", "99999")
+		tester.AssertResponse(req, http.StatusOK, expected)
+	}
 }
 
 func TestPHPServerDirective(t *testing.T) {
@@ -150,21 +863,3525 @@ func TestPHPServerDirective(t *testing.T) {
 			https_port 9443
 
 			frankenphp
-			order php_server before reverse_proxy
+			order php_server before reverse_proxy
+		}
+
+		localhost:9080 {
+			root * ../testdata
+			php_server
+		}
+		`, "caddyfile")
+
+	tester.AssertGetResponse("http://localhost:9080", http.StatusOK, "I am by birth a Genevese (i not set)")
+	tester.AssertGetResponse("http://localhost:9080/hello.txt", http.StatusOK, "Hello")
+	tester.AssertGetResponse("http://localhost:9080/not-found.txt", http.StatusOK, "I am by birth a Genevese (i not set)")
+}
+
+func TestPHPServerDirectiveDisableFileServer(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+			order php_server before respond
+		}
+
+		localhost:9080 {
+			root * ../testdata
+			php_server {
+				file_server off
+			}
+			respond "Not found" 404
+		}
+		`, "caddyfile")
+
+	tester.AssertGetResponse("http://localhost:9080", http.StatusOK, "I am by birth a Genevese (i not set)")
+	tester.AssertGetResponse("http://localhost:9080/hello.txt", http.StatusNotFound, "Not found")
+}
+
+func TestGlobalEnv(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp {
+				env FOO foo
+			}
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, "caddyfile")
+
+	tester.AssertGetResponse("http://localhost:9080/global-env.php", http.StatusOK, "foo,")
+}
+
+func TestGlobalEnvOverride(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp {
+				env FOO foo
+			}
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					env FOO baz
+				}
+			}
+		}
+		`, "caddyfile")
+
+	tester.AssertGetResponse("http://localhost:9080/global-env.php", http.StatusOK, "baz,")
+}
+
+func TestGlobalEnvMerge(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp {
+				env {
+					FOO foo
+					BAR bar
+				}
+			}
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					env BAR baz
+				}
+			}
+		}
+		`, "caddyfile")
+
+	tester.AssertGetResponse("http://localhost:9080/global-env.php", http.StatusOK, "foo,baz")
+}
+
+func TestUploadTmpDir(t *testing.T) {
+	uploadTmpDir, _ := filepath.Abs("../testdata/uploads-tmp")
+	defer os.RemoveAll(uploadTmpDir)
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					upload_tmp_dir uploads-tmp
+				}
+			}
+		}
+		`, "caddyfile")
+
+	// the directory is created when the config is loaded, not on every request
+	if _, err := os.Stat(uploadTmpDir); err != nil {
+		t.Errorf("expected %s to be created at provision time: %v", uploadTmpDir, err)
+	}
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	fw, _ := mw.CreateFormFile("file", "hello.txt")
+	fw.Write([]byte("Hello"))
+	mw.Close()
+
+	tester.AssertPostResponseBody(
+		"http://localhost:9080/upload.php",
+		[]string{"Content-Type: " + mw.FormDataContentType()},
+		body,
+		http.StatusOK,
+		uploadTmpDir+" exists",
+	)
+}
+
+func TestResponseHeaders(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					remove_response_header X-Powered-By
+					set_response_header X-Frame-Options DENY
+					set_response_header X-Content-Type-Options nosniff
+				}
+			}
+		}
+		`, "caddyfile")
+
+	resp, _ := tester.AssertGetResponse("http://localhost:9080/response-headers.php", http.StatusOK, "Hello")
+	if v := resp.Header.Values("X-Powered-By"); len(v) != 0 {
+		t.Errorf("X-Powered-By header must be removed, got %q", v)
+	}
+	if v := resp.Header.Values("X-Frame-Options"); len(v) != 1 || v[0] != "DENY" {
+		t.Errorf(`X-Frame-Options header must be "DENY", got %q`, v)
+	}
+	if v := resp.Header.Get("X-Content-Type-Options"); v != "nosniff" {
+		t.Errorf(`X-Content-Type-Options header must be "nosniff", got %q`, v)
+	}
+}
+
+func TestWorkerNumAuto(t *testing.T) {
+	var wg sync.WaitGroup
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp {
+				worker {
+					file ../testdata/index.php
+					num auto
+				}
+			}
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, "caddyfile")
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			tester.AssertGetResponse(fmt.Sprintf("http://localhost:9080/index.php?i=%d", i), http.StatusOK, fmt.Sprintf("I am by birth a Genevese (%d)", i))
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestParseWorkerNum(t *testing.T) {
+	for input, expected := range map[string][2]int{
+		"worker index.php 3":                    {3, 0},
+		"worker index.php auto":                 {0, 1},
+		"worker index.php 4x":                   {0, 4},
+		"worker {\nfile index.php\nnum 5\n}":    {5, 0},
+		"worker {\nfile index.php\nnum auto\n}": {0, 1},
+		"worker {\nfile index.php\nnum 2x\n}":   {0, 2},
+		// the last num wins
+		"worker {\nfile index.php\nnum auto\nnum 4\n}": {4, 0},
+		"worker {\nfile index.php\nnum 4\nnum 2x\n}":   {0, 2},
+	} {
+		app := &caddy.FrankenPHPApp{}
+		if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\n" + input + "\n}")); err != nil {
+			t.Errorf("%q: unexpected error: %v", input, err)
+
+			continue
+		}
+
+		if w := app.Workers[0]; w.Num != expected[0] || w.NumPerCPU != expected[1] {
+			t.Errorf("%q: expected num %d and num per CPU %d, got %d and %d", input, expected[0], expected[1], w.Num, w.NumPerCPU)
+		}
+	}
+
+	for _, input := range []string{"foo", "x", "0x", "-2x", "2.5x", "auto2"} {
+		app := &caddy.FrankenPHPApp{}
+		if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker index.php " + input + "\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestWorkerNumByEnv(t *testing.T) {
+	const worker = "worker {\nfile index.php\nnum {\nprod 8\nstaging 2x\ndefault 1\n}\n}"
+
+	for env, expected := range map[string][2]int{
+		"prod":    {8, 0},
+		"staging": {0, 2},
+		"dev":     {1, 0},
+		"":        {1, 0},
+	} {
+		t.Setenv("APP_ENV", env)
+
+		app := &caddy.FrankenPHPApp{}
+		if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\n" + worker + "\n}")); err != nil {
+			t.Fatal(err)
+		}
+		if err := app.Provision(caddy2.Context{}); err != nil {
+			t.Fatalf("%q: %v", env, err)
+		}
+
+		if w := app.Workers[0]; w.Num != expected[0] || w.NumPerCPU != expected[1] {
+			t.Errorf("%q: expected num %d and num per CPU %d, got %d and %d", env, expected[0], expected[1], w.Num, w.NumPerCPU)
+		}
+	}
+
+	// the selector can be changed
+	t.Setenv("APP_ENV", "prod")
+	t.Setenv("DEPLOY_ENV", "staging")
+	app := &caddy.FrankenPHPApp{}
+	if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nnum_selector DEPLOY_ENV\n" + worker + "\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Provision(caddy2.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	if w := app.Workers[0]; w.NumPerCPU != 2 {
+		t.Errorf("expected 2 workers per CPU, got %d", w.NumPerCPU)
+	}
+
+	// without default entry, an environment must match
+	app = &caddy.FrankenPHPApp{}
+	if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker {\nfile index.php\nnum {\nstaging 2\n}\n}\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Provision(caddy2.Context{}); err == nil {
+		t.Error("expected an error")
+	}
+
+	for _, input := range []string{"num {\n}", "num {\nprod\n}", "num {\nprod foo\n}", "num {\nprod 1 2\n}"} {
+		app := &caddy.FrankenPHPApp{}
+		if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker {\nfile index.php\n" + input + "\n}\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestParseWorkerRestartBackoff(t *testing.T) {
+	app := &caddy.FrankenPHPApp{}
+	if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker {\nfile index.php\nrestart_backoff 100ms 5s\n}\n}")); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := app.Workers[0]; time.Duration(w.RestartBackoffMin) != 100*time.Millisecond || time.Duration(w.RestartBackoffMax) != 5*time.Second {
+		t.Errorf("unexpected restart backoff: %v %v", w.RestartBackoffMin, w.RestartBackoffMax)
+	}
+
+	for _, input := range []string{"1s", "foo 1s", "1s foo", "0 1s", "2s 1s"} {
+		app := &caddy.FrankenPHPApp{}
+		if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker {\nfile index.php\nrestart_backoff " + input + "\n}\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestParseWorkerIdleTimeout(t *testing.T) {
+	app := &caddy.FrankenPHPApp{}
+	if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker {\nfile index.php\nidle_timeout 5m\nmin 1\n}\n}")); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := app.Workers[0]; time.Duration(w.IdleTimeout) != 5*time.Minute || w.Min != 1 {
+		t.Errorf("unexpected idle timeout: %v %d", w.IdleTimeout, w.Min)
+	}
+
+	for _, input := range []string{"idle_timeout", "idle_timeout 0", "idle_timeout foo", "min -1"} {
+		app := &caddy.FrankenPHPApp{}
+		if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker {\nfile index.php\n" + input + "\n}\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestParseWorkerMaxLifetime(t *testing.T) {
+	app := &caddy.FrankenPHPApp{}
+	if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker {\nfile index.php\nmax_lifetime 24h\n}\n}")); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := app.Workers[0]; time.Duration(w.MaxLifetime) != 24*time.Hour {
+		t.Errorf("unexpected max lifetime: %v", w.MaxLifetime)
+	}
+
+	for _, input := range []string{"max_lifetime", "max_lifetime 0", "max_lifetime foo"} {
+		app := &caddy.FrankenPHPApp{}
+		if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker {\nfile index.php\n" + input + "\n}\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestParseWorkerRunAs(t *testing.T) {
+	app := &caddy.FrankenPHPApp{}
+	if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker {\nfile index.php\nrun_as www-data:www-data\n}\n}")); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := app.Workers[0]; w.RunAs != "www-data:www-data" {
+		t.Errorf("unexpected run_as: %q", w.RunAs)
+	}
+
+	app = &caddy.FrankenPHPApp{}
+	if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker {\nfile index.php\nrun_as\n}\n}")); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestParseIniFileAndPHPArgs(t *testing.T) {
+	app := &caddy.FrankenPHPApp{}
+	if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nini_file /etc/php/alternate.ini\nphp_args -d precision=10 -dmemory_limit=1G\n}")); err != nil {
+		t.Fatal(err)
+	}
+
+	if app.IniFile != "/etc/php/alternate.ini" {
+		t.Errorf("unexpected ini_file: %q", app.IniFile)
+	}
+	if !slices.Equal(app.PHPArgs, []string{"-d", "precision=10", "-dmemory_limit=1G"}) {
+		t.Errorf("unexpected php_args: %v", app.PHPArgs)
+	}
+
+	for _, input := range []string{"ini_file", "php_args"} {
+		app := &caddy.FrankenPHPApp{}
+		if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\n" + input + "\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestGracefulSignal(t *testing.T) {
+	// the server runs in a subprocess, as the signal terminates it
+	if os.Getenv("FRANKENPHP_TEST_SIGNAL_SERVER") == "1" {
+		tester := caddytest.NewTester(t)
+		tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp {
+				graceful_signal SIGUSR2
+			}
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, "caddyfile")
+
+		fmt.Println("ready")
+		select {}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=^TestGracefulSignal$")
+	cmd.Env = append(os.Environ(), "FRANKENPHP_TEST_SIGNAL_SERVER=1")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() && scanner.Text() != "ready" {
+	}
+	go io.Copy(io.Discard, stdout)
+
+	type result struct {
+		status int
+		body   string
+		err    error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://localhost:9080/sleep.php?sleep=1000")
+		if err != nil {
+			results <- result{err: err}
+
+			return
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		results <- result{resp.StatusCode, string(body), err}
+	}()
+
+	// the request is in-flight when the signal is received
+	time.Sleep(200 * time.Millisecond)
+	if err := cmd.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-results
+	if res.err != nil || res.status != http.StatusOK || res.body != "slept for 1000 ms" {
+		t.Errorf("the in-flight request hasn't been completed: %d %q %v", res.status, res.body, res.err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("the server hasn't exited gracefully: %v", err)
+	}
+}
+
+func TestParseSignals(t *testing.T) {
+	app := &caddy.FrankenPHPApp{}
+	if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\ngraceful_signal SIGHUP usr2\nimmediate_signal USR1\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Provision(caddy2.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(app.GracefulSignals, []string{"SIGHUP", "SIGUSR2"}) || !slices.Equal(app.ImmediateSignals, []string{"SIGUSR1"}) {
+		t.Errorf("unexpected signals: %v %v", app.GracefulSignals, app.ImmediateSignals)
+	}
+
+	for _, input := range []string{"graceful_signal", "immediate_signal", "graceful_signal SIGKILL"} {
+		if err := (&caddy.FrankenPHPApp{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\n" + input + "\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+
+	// the signals handled by Caddy are rejected explicitly
+	for _, input := range []string{"graceful_signal SIGQUIT", "graceful_signal TERM", "immediate_signal SIGINT"} {
+		if err := (&caddy.FrankenPHPApp{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\n" + input + "\n}")); err == nil || !strings.Contains(err.Error(), "already handled by Caddy") {
+			t.Errorf("%q: expected an explicit error, got %v", input, err)
+		}
+	}
+
+	for _, app := range []*caddy.FrankenPHPApp{
+		{GracefulSignals: []string{"SIGKILL"}},
+		{GracefulSignals: []string{"SIGTERM"}},
+		{GracefulSignals: []string{"SIGUSR2"}, ImmediateSignals: []string{"USR2"}},
+	} {
+		if err := app.Provision(caddy2.Context{}); err == nil {
+			t.Errorf("%v %v: expected an error", app.GracefulSignals, app.ImmediateSignals)
+		}
+	}
+}
+
+func TestParseWorkerShutdown(t *testing.T) {
+	app := &caddy.FrankenPHPApp{}
+	if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker {\nfile index.php\nshutdown shutdown.php\n}\n}")); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := app.Workers[0]; w.ShutdownScript != "shutdown.php" {
+		t.Errorf("unexpected shutdown script: %q", w.ShutdownScript)
+	}
+
+	app = &caddy.FrankenPHPApp{}
+	if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker {\nfile index.php\nshutdown\n}\n}")); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestParseWorkerStickyBy(t *testing.T) {
+	app := &caddy.FrankenPHPApp{}
+	if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker {\nfile index.php\nsticky_by cookie PHPSESSID\n}\n}")); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := app.Workers[0]; w.StickyBy != "cookie" || w.StickyKey != "PHPSESSID" {
+		t.Errorf("unexpected sticky_by: %q %q", w.StickyBy, w.StickyKey)
+	}
+
+	for _, input := range []string{"sticky_by", "sticky_by cookie", "sticky_by query foo", "sticky_by header X-Foo bar"} {
+		app := &caddy.FrankenPHPApp{}
+		if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker {\nfile index.php\n" + input + "\n}\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestParseWorkerRetryOnRestart(t *testing.T) {
+	for input, expected := range map[string]int{"": 0, "retry_on_restart": 1, "retry_on_restart 3": 3} {
+		app := &caddy.FrankenPHPApp{}
+		if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker {\nfile index.php\n" + input + "\n}\n}")); err != nil {
+			t.Fatal(err)
+		}
+
+		if w := app.Workers[0]; w.RetryOnRestart != expected {
+			t.Errorf("%q: unexpected retry_on_restart: %d", input, w.RetryOnRestart)
+		}
+	}
+
+	for _, input := range []string{"retry_on_restart 0", "retry_on_restart -1", "retry_on_restart foo", "retry_on_restart 1 2"} {
+		app := &caddy.FrankenPHPApp{}
+		if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker {\nfile index.php\n" + input + "\n}\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestParseWorkerWarmupRequest(t *testing.T) {
+	app := &caddy.FrankenPHPApp{}
+	if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker {\nfile index.php\nwarmup_request /warmup?full=1 fatal\n}\n}")); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := app.Workers[0]; w.WarmupRequest != "/warmup?full=1" || !w.WarmupFatal {
+		t.Errorf("unexpected warmup_request: %q %v", w.WarmupRequest, w.WarmupFatal)
+	}
+
+	for _, input := range []string{"warmup_request", "warmup_request warmup", "warmup_request /warmup foo", "warmup_request /warmup fatal foo"} {
+		app := &caddy.FrankenPHPApp{}
+		if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker {\nfile index.php\n" + input + "\n}\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestParseWorkerStandby(t *testing.T) {
+	app := &caddy.FrankenPHPApp{}
+	if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker {\nfile index.php\nnum 2\nstandby 1\n}\n}")); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := app.Workers[0]; w.Standby != 1 {
+		t.Errorf("unexpected standby: %d", w.Standby)
+	}
+
+	for _, input := range []string{"standby", "standby -1", "standby foo", "standby 1\nsticky_by cookie PHPSESSID", "standby 1\ndispatch round_robin"} {
+		app := &caddy.FrankenPHPApp{}
+		if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker {\nfile index.php\n" + input + "\n}\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestParseWorkerDaemon(t *testing.T) {
+	app := &caddy.FrankenPHPApp{}
+	if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker {\nfile consumer.php\ndaemon\n}\n}")); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := app.Workers[0]; !w.Daemon {
+		t.Error("expected a daemon worker")
+	}
+
+	for _, input := range []string{"daemon foo", "daemon\nstandby 1", "daemon\nidle_timeout 1m", "daemon\nwarmup_request /warmup", "daemon\ndispatch round_robin"} {
+		app := &caddy.FrankenPHPApp{}
+		if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker {\nfile consumer.php\n" + input + "\n}\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestParseWorkerQueueSize(t *testing.T) {
+	app := &caddy.FrankenPHPApp{}
+	if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker {\nfile index.php\nqueue_size 10\n}\n}")); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := app.Workers[0]; w.QueueSize != 10 {
+		t.Errorf("unexpected queue size: %d", w.QueueSize)
+	}
+
+	for _, input := range []string{"queue_size", "queue_size -1", "queue_size foo"} {
+		app := &caddy.FrankenPHPApp{}
+		if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworker {\nfile index.php\n" + input + "\n}\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestParseWarmupParallelism(t *testing.T) {
+	app := &caddy.FrankenPHPApp{}
+	if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nwarmup_parallelism 4\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if app.WarmupParallelism != 4 {
+		t.Errorf("unexpected warmup parallelism: %d", app.WarmupParallelism)
+	}
+
+	for _, input := range []string{"", "-1", "foo"} {
+		app := &caddy.FrankenPHPApp{}
+		if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nwarmup_parallelism " + input + "\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestOpcacheStatsInterval(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "caddy.log")
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+			log {
+				output file `+logFile+`
+			}
+
+			frankenphp {
+				opcache_stats_interval 50ms
+			}
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, "caddyfile")
+
+	tester.AssertGetResponse("http://localhost:9080/index.php?i=0", http.StatusOK, "I am by birth a Genevese (0)")
+
+	for i := 0; i < 20; i++ {
+		logs, _ := os.ReadFile(logFile)
+		if bytes.Contains(logs, []byte("opcache stats")) {
+			return
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Error("no opcache stats have been logged")
+}
+
+// adaptHandlers adapts the given Caddyfile and returns the handlers of the given type of the resulting JSON config.
+func adaptHandlers(t *testing.T, rawConfig, handler string) []map[string]any {
+	t.Helper()
+
+	return adaptObjects(t, rawConfig, func(v map[string]any) bool {
+		return v["handler"] == handler
+	})
+}
+
+// adaptObjects adapts the Caddyfile and returns the JSON objects matching the given function.
+func adaptObjects(t *testing.T, rawConfig string, match func(map[string]any) bool) []map[string]any {
+	t.Helper()
+
+	cfgAdapter := caddyconfig.GetAdapter("caddyfile")
+	result, _, err := cfgAdapter.Adapt([]byte(rawConfig), map[string]any{"filename": "Caddyfile"})
+	if err != nil {
+		t.Fatalf("unable to adapt the Caddyfile: %v", err)
+	}
+
+	var config any
+	if err := json.Unmarshal(result, &config); err != nil {
+		t.Fatal(err)
+	}
+
+	return findObjects(config, match)
+}
+
+// findObjects returns the JSON objects nested in v matching the given function.
+func findObjects(v any, match func(map[string]any) bool) []map[string]any {
+	var objects []map[string]any
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			if match(v) {
+				objects = append(objects, v)
+			}
+			for _, c := range v {
+				walk(c)
+			}
+		case []any:
+			for _, c := range v {
+				walk(c)
+			}
+		}
+	}
+	walk(v)
+
+	return objects
+}
+
+func TestPHPServerDirectiveSplitHandler(t *testing.T) {
+	handlers := adaptHandlers(t, `
+		{
+			order php_server before file_server
+		}
+
+		localhost:9080 {
+			php_server {
+				root ../testdata
+				split .php
+				split_handler .phps {
+					env SOURCE 1
+				}
+			}
+		}
+		`, "php")
+
+	if len(handlers) != 2 {
+		t.Fatalf("expected 2 php handlers, got %d", len(handlers))
+	}
+
+	splits := map[string]map[string]any{}
+	for _, h := range handlers {
+		split, _ := json.Marshal(h["split_path"])
+		splits[string(split)] = h
+	}
+
+	if _, ok := splits[`[".php"]`]; !ok {
+		t.Errorf("no php handler for .php files: %v", handlers)
+	}
+	if h, ok := splits[`[".phps"]`]; !ok {
+		t.Errorf("no php handler for .phps files: %v", handlers)
+	} else if env, _ := h["env"].(map[string]any); env["SOURCE"] != "1" || h["root"] != "../testdata" {
+		t.Errorf("the .phps handler is not configured properly: %v", h)
+	}
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp {
+				max_concurrent_requests 1
+				queue_timeout 10ms
+			}
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, "caddyfile")
+
+	served := make(chan struct{})
+	go func() {
+		tester.AssertGetResponse("http://localhost:9080/sleep.php?sleep=500", http.StatusOK, "slept for 500 ms")
+		close(served)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	tester.AssertGetResponse("http://localhost:9080/index.php", http.StatusServiceUnavailable, "")
+
+	<-served
+}
+
+func TestAutoPrependAppend(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp {
+				num_threads 1
+			}
+		}
+
+		localhost:9080 {
+			route /without/* {
+				uri strip_prefix /without
+				php {
+					root ../testdata
+				}
+			}
+
+			route {
+				php {
+					root ../testdata
+					auto_prepend prepend.php
+					auto_append append.php
+				}
+			}
+		}
+		`, "caddyfile")
+
+	for i := 0; i < 2; i++ {
+		tester.AssertGetResponse("http://localhost:9080/auto-prepend.php", http.StatusOK, "prepended appended")
+
+		// the settings must not leak to the next request handled by the same thread
+		tester.AssertGetResponse("http://localhost:9080/without/auto-prepend.php", http.StatusOK, "not prepended")
+	}
+}
+
+func TestResponseBuffering(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp {
+				response_buffering full
+			}
+		}
+
+		localhost:9080 {
+			route /streaming/* {
+				uri strip_prefix /streaming
+				php {
+					root ../testdata
+					response_buffering streaming
+				}
+			}
+
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, "caddyfile")
+
+	// the global default applies: the flush is ignored and the length of the response is known
+	resp, _ := tester.AssertGetResponse("http://localhost:9080/flush.php?i=full", http.StatusOK, "Hello full")
+	if resp.ContentLength != 10 {
+		t.Errorf("full: unexpected Content-Length: %d", resp.ContentLength)
+	}
+
+	// the strategy of the handler takes precedence
+	resp, _ = tester.AssertGetResponse("http://localhost:9080/streaming/flush.php?i=streaming", http.StatusOK, "Hello streaming")
+	if resp.ContentLength != -1 {
+		t.Errorf("streaming: unexpected Content-Length: %d", resp.ContentLength)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route /off/* {
+				uri strip_prefix /off
+				php {
+					root ../testdata
+					keepalive off
+				}
+			}
+
+			route {
+				php {
+					root ../testdata
+					keepalive 30s
+				}
+			}
+		}
+		`, "caddyfile")
+
+	resp, _ := tester.AssertGetResponse("http://localhost:9080/off/index.php?i=0", http.StatusOK, "I am by birth a Genevese (0)")
+	if !resp.Close {
+		t.Error("expected the connection to be closed")
+	}
+
+	resp, _ = tester.AssertGetResponse("http://localhost:9080/index.php?i=1", http.StatusOK, "I am by birth a Genevese (1)")
+	if resp.Close {
+		t.Error("expected the connection to be kept alive")
+	}
+	if v := resp.Header.Get("Keep-Alive"); v != "timeout=30" {
+		t.Errorf(`expected "Keep-Alive: timeout=30", got %q`, v)
+	}
+}
+
+func TestStreamContentTypes(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					stream_content_types text/event-stream application/x-ndjson
+				}
+			}
+		}
+		`, "caddyfile")
+
+	receivedFile := filepath.Join(t.TempDir(), "received")
+	resp, err := tester.Client.Get("http://localhost:9080/stream.php?file=" + url.QueryEscape(receivedFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// the script waits for the first line to be received before sending the second one
+	body := bufio.NewReader(resp.Body)
+	if line, _ := body.ReadString('\n'); line != "first\n" {
+		t.Fatalf("unexpected first line %q", line)
+	}
+	if err := os.WriteFile(receivedFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if line, _ := body.ReadString('\n'); line != "second\n" {
+		t.Errorf("the response hasn't been streamed, got %q", line)
+	}
+}
+
+func TestGracePeriodReload(t *testing.T) {
+	config := func(env string) string {
+		return `
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp {
+				grace_period 300ms
+			}
+		}
+
+		localhost:9080 {
+			php_server {
+				root ../testdata
+				env RELOAD ` + env + `
+			}
+		}
+		`
+	}
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(config("0"), "caddyfile")
+
+	// the request outlives the grace period
+	resp, err := tester.Client.Get("http://localhost:9080/grace-period.php")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body := bufio.NewReader(resp.Body)
+	if line, _ := body.ReadString('\n'); line != "started\n" {
+		t.Fatalf("unexpected first line %q", line)
+	}
+
+	// the reload returns once the in-flight request has been aborted
+	tester.InitServer(config("1"), "caddyfile")
+
+	if rest, _ := io.ReadAll(body); string(rest) == "not aborted" {
+		t.Error("the request exceeding the grace period hasn't been aborted")
+	}
+
+	// the requests handled after the reload aren't aborted
+	tester.AssertGetResponse("http://localhost:9080/grace-period.php?timeout=0.5", http.StatusOK, "started\nnot aborted")
+}
+
+func TestParseKeepAlive(t *testing.T) {
+	f := &caddy.FrankenPHPModule{}
+	if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\nkeepalive 1500ms\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(f.KeepAliveTimeout) != 1500*time.Millisecond {
+		t.Errorf("unexpected keepalive timeout: %v", f.KeepAliveTimeout)
+	}
+
+	// Keep-Alive: timeout=0 would tell clients to drop idle connections immediately
+	for _, input := range []string{"500ms", "0", "foo"} {
+		f := &caddy.FrankenPHPModule{}
+		if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\nkeepalive " + input + "\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestWorkersFrom(t *testing.T) {
+	workersFile := filepath.Join(t.TempDir(), "workers.json")
+	if err := os.WriteFile(workersFile, []byte(`[
+		{"file_name": "../testdata/index.php", "num": 2},
+		{"file_name": "../testdata/worker.php", "num": 1, "env": {"FOO": "bar"}}
+	]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(fmt.Sprintf(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp {
+				workers_from %s
+			}
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, workersFile), "caddyfile")
+
+	tester.AssertGetResponse("http://localhost:9080/index.php?i=0", http.StatusOK, "I am by birth a Genevese (0)")
+
+	// worker.php only outputs something when it runs as a worker
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/worker.php", nil)
+	resp := tester.AssertResponseCode(req, http.StatusOK)
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "Requests handled: 0") {
+		t.Errorf("expected worker.php to be started as a worker, got %q", body)
+	}
+}
+
+func TestWorkersFromInvalid(t *testing.T) {
+	for _, content := range []string{
+		`{"file_name": "index.php"}`,
+		`[{"num": 2}]`,
+		`[{"file_name": "index.php", "num": -1}]`,
+		`[{"file_name": "index.php", "unknown": true}]`,
+	} {
+		workersFile := filepath.Join(t.TempDir(), "workers.json")
+		if err := os.WriteFile(workersFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		app := &caddy.FrankenPHPApp{}
+		if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nworkers_from " + workersFile + "\n}")); err == nil {
+			t.Errorf("%s: expected an error", content)
+		}
+	}
+}
+
+func TestPHPServerDirectiveHide(t *testing.T) {
+	config := `
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+		}
+
+		localhost:9080 {
+			php_server {
+				root ../testdata
+				hide .env .private
+			}
+		}
+		`
+
+	fileServers := adaptHandlers(t, config, "file_server")
+	if len(fileServers) != 1 {
+		t.Fatalf("expected 1 file_server handler, got %d", len(fileServers))
+	}
+	if hide, _ := json.Marshal(fileServers[0]["hide"]); string(hide) != `[".env",".private"]` {
+		t.Errorf("unexpected file_server hide list: %s", hide)
+	}
+
+	phpHandlers := adaptHandlers(t, config, "php")
+	if len(phpHandlers) != 1 {
+		t.Fatalf("expected 1 php handler, got %d", len(phpHandlers))
+	}
+	if hide, _ := json.Marshal(phpHandlers[0]["hide"]); string(hide) != `[".env",".private"]` {
+		t.Errorf("unexpected php hide list: %s", hide)
+	}
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(config, "caddyfile")
+
+	tester.AssertGetResponse("http://localhost:9080/.env", http.StatusNotFound, "")
+	tester.AssertGetResponse("http://localhost:9080/.private/secret.php", http.StatusNotFound, "")
+	tester.AssertGetResponse("http://localhost:9080/index.php?i=0", http.StatusOK, "I am by birth a Genevese (0)")
+}
+
+func TestHidePathInfo(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					hide .env .private
+				}
+			}
+		}
+		`, "caddyfile")
+
+	tester.AssertGetResponse("http://localhost:9080/.private/secret.php", http.StatusNotFound, "")
+	// hidden names in the PATH_INFO don't prevent the script from being executed
+	tester.AssertGetResponse("http://localhost:9080/index.php/.env?i=0", http.StatusOK, "I am by birth a Genevese (0)")
+}
+
+func TestPHPBinary(t *testing.T) {
+	// max_concurrent_requests only applies to the embedded interpreter, it doesn't prevent using an external one
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp {
+				max_concurrent_requests 1
+			}
+		}
+
+		localhost:9080 {
+			route /legacy/* {
+				uri strip_prefix /legacy
+				php {
+					root ../testdata
+					php_binary ../testdata/php-cgi-stub.sh
+					env FOO bar
+					remove_response_header X-Powered-By
+					set_response_header X-Frame-Options DENY
+				}
+			}
+
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, "caddyfile")
+
+	resp, _ := tester.AssertGetResponse("http://localhost:9080/legacy/index.php/foo", http.StatusOK, "/index.php executed by the stub (path info: /foo, env: bar)")
+	if resp.Header.Get("X-Interpreter") != "stub" {
+		t.Error("the request has not been handled by the external interpreter")
+	}
+	// the response headers options also apply to the external interpreter
+	if v := resp.Header.Values("X-Powered-By"); len(v) != 0 {
+		t.Errorf("X-Powered-By header must be removed, got %q", v)
+	}
+	if resp.Header.Get("X-Frame-Options") != "DENY" {
+		t.Errorf("X-Frame-Options header must be set, got %q", resp.Header.Get("X-Frame-Options"))
+	}
+
+	tester.AssertGetResponse("http://localhost:9080/legacy/not-found.php", http.StatusNotFound, "")
+
+	// the other routes still use the embedded interpreter
+	tester.AssertGetResponse("http://localhost:9080/index.php?i=0", http.StatusOK, "I am by birth a Genevese (0)")
+}
+
+// eventRecorder is an events handler collecting the events it receives.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []caddyevents.Event
+}
+
+func (r *eventRecorder) Handle(_ context.Context, e caddyevents.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events = append(r.events, e)
+
+	return nil
+}
+
+func TestEmitEvents(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp {
+				worker ../testdata/index.php 1
+			}
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					emit_events
+				}
+			}
+		}
+		`, "caddyfile")
+
+	eventsApp, err := caddy2.ActiveContext().App("events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &eventRecorder{}
+	if err := eventsApp.(*caddyevents.App).On("frankenphp", recorder); err != nil {
+		t.Fatal(err)
+	}
+
+	tester.AssertGetResponse("http://localhost:9080/index.php?i=0", http.StatusOK, "I am by birth a Genevese (0)")
+	tester.AssertGetResponse("http://localhost:9080/echo.php", http.StatusOK, "")
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+
+	if len(recorder.events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(recorder.events))
+	}
+
+	workerPath, _ := filepath.Abs("../testdata/index.php")
+	for i, expected := range []struct {
+		scriptName string
+		status     int
+		worker     string
+	}{
+		{"/index.php", http.StatusOK, workerPath},
+		{"/echo.php", http.StatusOK, ""},
+	} {
+		data := recorder.events[i].Data
+		if data["script_name"] != expected.scriptName || data["status"] != expected.status || data["worker"] != expected.worker {
+			t.Errorf("unexpected event data: %v", data)
+		}
+		if d, _ := data["duration"].(float64); d <= 0 {
+			t.Errorf("unexpected duration: %v", data["duration"])
+		}
+	}
+}
+
+func TestScriptStatCache(t *testing.T) {
+	root := t.TempDir()
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root `+root+`
+					script_stat_cache_ttl 500ms
+				}
+			}
+		}
+		`, "caddyfile")
+
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/cached.php", nil)
+	tester.AssertResponseCode(req, http.StatusNotFound)
+
+	// the result of the first stat is reused: the script created meanwhile isn't seen until it expires
+	if err := os.WriteFile(filepath.Join(root, "cached.php"), []byte("<?php echo 'cached';"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	req, _ = http.NewRequest(http.MethodGet, "http://localhost:9080/cached.php", nil)
+	tester.AssertResponseCode(req, http.StatusNotFound)
+
+	time.Sleep(600 * time.Millisecond)
+	tester.AssertGetResponse("http://localhost:9080/cached.php", http.StatusOK, "cached")
+}
+
+func TestParseScriptStatCacheTTL(t *testing.T) {
+	for _, input := range []string{"script_stat_cache_ttl", "script_stat_cache_ttl 0", "script_stat_cache_ttl foo"} {
+		f := &caddy.FrankenPHPModule{}
+		if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\n" + input + "\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestErrorFormat(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route /json/* {
+				uri strip_prefix /json
+				php {
+					root ../testdata/not-found
+					resolve_root_symlink
+					error_format json
+				}
+			}
+
+			route /html/* {
+				uri strip_prefix /html
+				php {
+					root ../testdata
+					error_format html
+				}
+			}
+
+			route {
+				php {
+					root ../testdata
+					error_format plain
+				}
+			}
+		}
+		`, "caddyfile")
+
+	// the root can't be resolved
+	resp, _ := tester.AssertGetResponse("http://localhost:9080/json/index.php", http.StatusInternalServerError, `{"status":500,"error":"Internal Server Error"}`+"\n")
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("unexpected Content-Type: %q", ct)
+	}
+
+	resp, _ = tester.AssertGetResponse("http://localhost:9080/html/not-found.php", http.StatusNotFound, "<!DOCTYPE html>\n<html><head><title>404 Not Found</title></head><body><h1>404 Not Found</h1><p>Not Found</p></body></html>\n")
+	if ct := resp.Header.Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("unexpected Content-Type: %q", ct)
+	}
+
+	tester.AssertGetResponse("http://localhost:9080/not-found.php", http.StatusNotFound, "404 Not Found\n")
+
+	// the responses of PHP are untouched
+	tester.AssertGetResponse("http://localhost:9080/env-var.php?name=NOT_SET", http.StatusOK, "missing")
+}
+
+func TestParseErrorFormat(t *testing.T) {
+	f := &caddy.FrankenPHPModule{}
+	if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\nerror_format json\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if f.ErrorFormat != "json" {
+		t.Errorf("unexpected error format: %q", f.ErrorFormat)
+	}
+
+	for _, input := range []string{"error_format", "error_format xml", "error_format json html"} {
+		f := &caddy.FrankenPHPModule{}
+		if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\n" + input + "\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestMissingScript(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route /error/* {
+				uri strip_prefix /error
+				php {
+					root ../testdata
+					missing_script 500
+				}
+			}
+
+			route /pass/* {
+				uri strip_prefix /pass
+				php {
+					root ../testdata
+					missing_script pass
+					auto_prepend pass-prepend.php
+				}
+			}
+
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, "caddyfile")
+
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/not-found.php", nil)
+	tester.AssertResponseCode(req, http.StatusNotFound)
+
+	// directories aren't scripts
+	req, _ = http.NewRequest(http.MethodGet, "http://localhost:9080/", nil)
+	tester.AssertResponseCode(req, http.StatusNotFound)
+
+	req, _ = http.NewRequest(http.MethodGet, "http://localhost:9080/error/not-found.php", nil)
+	tester.AssertResponseCode(req, http.StatusInternalServerError)
+
+	// the request is passed to PHP, the status code depends on the display_errors setting
+	resp, err := http.Get("http://localhost:9080/pass/not-found.php")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "handled by PHP") {
+		t.Errorf("expected the request to be handled by PHP, got %q", body)
+	}
+
+	tester.AssertGetResponse("http://localhost:9080/index.php?i=0", http.StatusOK, "I am by birth a Genevese (0)")
+}
+
+func TestDocumentRootEnv(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route /virtual/* {
+				uri strip_prefix /virtual
+				php {
+					root ../testdata
+					document_root_env /var/www/virtual
+				}
+			}
+
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, "caddyfile")
+
+	tester.AssertGetResponse("http://localhost:9080/virtual/document-root.php", http.StatusOK, "/var/www/virtual")
+
+	root, _ := filepath.Abs("../testdata")
+	tester.AssertGetResponse("http://localhost:9080/document-root.php", http.StatusOK, root)
+}
+
+func TestPHPServerDirectivePreset(t *testing.T) {
+	for _, tc := range []struct {
+		preset, overrides, tryFiles, hide string
+	}{
+		{
+			preset:   "laravel",
+			tryFiles: `["{http.request.uri.path}","{http.request.uri.path}/index.php","index.php"]`,
+			hide:     `[".env",".git",".htaccess"]`,
+		},
+		{
+			preset:   "symfony",
+			tryFiles: `["{http.request.uri.path}","index.php"]`,
+			hide:     `[".env",".git"]`,
+		},
+		{
+			preset:   "wordpress",
+			tryFiles: `["{http.request.uri.path}","{http.request.uri.path}/index.php","index.php"]`,
+			hide:     `[".git",".htaccess","wp-config.php"]`,
+		},
+		{
+			preset:    "symfony",
+			overrides: "index app.php\n hide .secret",
+			tryFiles:  `["{http.request.uri.path}","app.php"]`,
+			hide:      `[".secret"]`,
+		},
+	} {
+		t.Run(tc.preset, func(t *testing.T) {
+			config := fmt.Sprintf(`
+				{
+					skip_install_trust
+					admin localhost:2999
+					http_port 9080
+					https_port 9443
+				}
+
+				localhost:9080 {
+					php_server {
+						root ../testdata
+						preset %s
+						%s
+					}
+				}
+				`, tc.preset, tc.overrides)
+
+			rewrites := adaptObjects(t, config, func(v map[string]any) bool {
+				file, ok := v["file"].(map[string]any)
+
+				return ok && file["split_path"] != nil
+			})
+			if len(rewrites) != 1 {
+				t.Fatalf("expected 1 try_files matcher, got %d", len(rewrites))
+			}
+			if tryFiles, _ := json.Marshal(rewrites[0]["file"].(map[string]any)["try_files"]); string(tryFiles) != tc.tryFiles {
+				t.Errorf("unexpected try_files: %s", tryFiles)
+			}
+
+			for _, handler := range []string{"file_server", "php"} {
+				handlers := adaptHandlers(t, config, handler)
+				if len(handlers) != 1 {
+					t.Fatalf("expected 1 %s handler, got %d", handler, len(handlers))
+				}
+				if hide, _ := json.Marshal(handlers[0]["hide"]); string(hide) != tc.hide {
+					t.Errorf("unexpected %s hide list: %s", handler, hide)
+				}
+			}
+		})
+	}
+}
+
+func TestPHPServerDirectiveRedirectPreservesQuery(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			php_server {
+				root ..
+			}
+		}
+		`, "caddyfile")
+
+	tester.AssertRedirect("http://localhost:9080/testdata?foo=bar&baz=1", "http://localhost:9080/testdata/?foo=bar&baz=1", http.StatusPermanentRedirect)
+	tester.AssertRedirect("http://localhost:9080/testdata", "http://localhost:9080/testdata/", http.StatusPermanentRedirect)
+}
+
+func TestPHPServerDirectiveRedirectPreserveQueryOff(t *testing.T) {
+	redirects := adaptHandlers(t, `
+		localhost:9080 {
+			php_server {
+				redir_preserve_query off
+			}
+		}
+		`, "static_response")
+	if len(redirects) != 1 {
+		t.Fatalf("expected 1 redirect, got %d", len(redirects))
+	}
+	if location, _ := json.Marshal(redirects[0]["headers"]); string(location) != `{"Location":["{http.request.orig_uri.path}/"]}` {
+		t.Errorf("unexpected redirect location: %s", location)
+	}
+}
+
+func TestStrictPHPExistence(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			php_server {
+				root ../testdata
+				strict_php_existence
+			}
+		}
+		`, "caddyfile")
+
+	tester.AssertGetResponse("http://localhost:9080/index.php?i=0", http.StatusOK, "I am by birth a Genevese (0)")
+
+	// without the option, the request would be handled by index.php
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/missing.php", nil)
+	tester.AssertResponseCode(req, http.StatusNotFound)
+
+	tester.AssertGetResponse("http://localhost:9080/not-found.txt", http.StatusOK, "I am by birth a Genevese (i not set)")
+}
+
+func TestExposeMtime(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					expose_mtime
+				}
+			}
+		}
+		`, "caddyfile")
+
+	fi, err := os.Stat("../testdata/script-mtime.php")
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := `"` + strconv.FormatInt(fi.ModTime().UnixNano(), 36) + strconv.FormatInt(fi.Size(), 36) + `"`
+
+	tester.AssertGetResponse("http://localhost:9080/script-mtime.php", http.StatusOK, strconv.FormatInt(fi.ModTime().Unix(), 10)+"\n"+etag)
+}
+
+func TestPHPServerDirectiveBrowse(t *testing.T) {
+	handlers := adaptHandlers(t, `
+		localhost:9080 {
+			php_server {
+				root ../testdata
+			}
+		}
+		`, "file_server")
+	if len(handlers) != 1 || handlers[0]["browse"] != nil {
+		t.Errorf("unexpected file_server handlers: %v", handlers)
+	}
+
+	handlers = adaptHandlers(t, `
+		localhost:9080 {
+			php_server {
+				root ../testdata
+				browse
+			}
+		}
+		`, "file_server")
+	if len(handlers) != 1 || handlers[0]["browse"] == nil {
+		t.Errorf("unexpected file_server handlers: %v", handlers)
+	}
+
+	handlers = adaptHandlers(t, `
+		localhost:9080 {
+			php_server {
+				root ../testdata
+				browse listing.html
+			}
+		}
+		`, "file_server")
+	if browse, _ := handlers[0]["browse"].(map[string]any); browse["template_file"] != "listing.html" {
+		t.Errorf("unexpected file_server handlers: %v", handlers)
+	}
+
+	cfgAdapter := caddyconfig.GetAdapter("caddyfile")
+	if _, _, err := cfgAdapter.Adapt([]byte("localhost:9080 {\nphp_server {\nbrowse\nfile_server off\n}\n}"), map[string]any{"filename": "Caddyfile"}); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestPHPServerDirectiveUnknownPreset(t *testing.T) {
+	cfgAdapter := caddyconfig.GetAdapter("caddyfile")
+	_, _, err := cfgAdapter.Adapt([]byte(`
+		localhost:9080 {
+			php_server {
+				preset drupal
+			}
+		}
+		`), map[string]any{"filename": "Caddyfile"})
+	if err == nil || !strings.Contains(err.Error(), `unknown preset "drupal"`) {
+		t.Errorf("expected an unknown preset error, got %v", err)
+	}
+}
+
+func TestPHPServerDirectiveSplitNormalization(t *testing.T) {
+	handlers := adaptHandlers(t, `
+		localhost:9080 {
+			php_server {
+				root ../testdata
+				split php
+			}
+		}
+		`, "php")
+
+	if len(handlers) != 1 {
+		t.Fatalf("expected 1 php handler, got %d", len(handlers))
+	}
+	if split, _ := json.Marshal(handlers[0]["split_path"]); string(split) != `[".php"]` {
+		t.Errorf("the split path is not normalized: %s", split)
+	}
+
+	files := adaptObjects(t, `
+		localhost:9080 {
+			php_server {
+				root ../testdata
+				split php
+			}
+		}
+		`, func(m map[string]any) bool {
+		_, ok := m["split_path"]
+		return ok && m["try_files"] != nil
+	})
+	for _, f := range files {
+		if split, _ := json.Marshal(f["split_path"]); string(split) != `[".php"]` {
+			t.Errorf("the split path of the file matcher is not normalized: %s", split)
+		}
+	}
+}
+
+func TestPHPServerDirectiveInvalidSplit(t *testing.T) {
+	cfgAdapter := caddyconfig.GetAdapter("caddyfile")
+	for _, split := range []string{`""`, `".p hp"`} {
+		_, _, err := cfgAdapter.Adapt([]byte(`
+		localhost:9080 {
+			php_server {
+				split `+split+`
+			}
+		}
+		`), map[string]any{"filename": "Caddyfile"})
+		if err == nil || !strings.Contains(err.Error(), "invalid split_path entry") {
+			t.Errorf("%s: expected an invalid split_path error, got %v", split, err)
+		}
+	}
+}
+
+func TestHTTPSOnly(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			servers {
+				trusted_proxies static private_ranges
+			}
+
+			frankenphp
+		}
+
+		http://localhost:9080 {
+			route /reject/* {
+				uri strip_prefix /reject
+				php {
+					root ../testdata
+					https_only reject
+				}
+			}
+
+			route {
+				php {
+					root ../testdata
+					https_only
+				}
+			}
+		}
+
+		https://localhost:9443 {
+			route {
+				php {
+					root ../testdata
+					https_only reject
+				}
+			}
+		}
+		`, "caddyfile")
+
+	tester.AssertGetResponse("http://localhost:9080/reject/index.php?i=0", http.StatusForbidden, "")
+	tester.AssertRedirect("http://localhost:9080/index.php?i=0", "https://localhost/index.php?i=0", http.StatusPermanentRedirect)
+
+	tester.AssertGetResponse("https://localhost:9443/index.php?i=1", http.StatusOK, "I am by birth a Genevese (1)")
+
+	// the request has been received over TLS by a trusted proxy
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/reject/index.php?i=2", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	tester.AssertResponse(req, http.StatusOK, "I am by birth a Genevese (2)")
+}
+
+func TestAllowedMethods(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					allowed_methods GET head
+				}
+			}
+		}
+		`, "caddyfile")
+
+	tester.AssertGetResponse("http://localhost:9080/index.php?i=0", http.StatusOK, "I am by birth a Genevese (0)")
+
+	req, _ := http.NewRequest(http.MethodHead, "http://localhost:9080/index.php?i=0", nil)
+	tester.AssertResponseCode(req, http.StatusOK)
+
+	for _, method := range []string{http.MethodPost, http.MethodDelete} {
+		req, _ := http.NewRequest(method, "http://localhost:9080/index.php?i=0", nil)
+		resp := tester.AssertResponseCode(req, http.StatusMethodNotAllowed)
+		if allow := resp.Header.Get("Allow"); allow != "GET, HEAD" {
+			t.Errorf("%s: unexpected Allow header: %q", method, allow)
+		}
+	}
+}
+
+func TestFixContentLength(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					fix_content_length
+				}
+			}
+		}
+		`, "caddyfile")
+
+	// understated: the response is sent chunked
+	resp, _ := tester.AssertGetResponse("http://localhost:9080/content-length.php?length=5", http.StatusOK, "hello world")
+	if cl := resp.Header.Get("Content-Length"); cl != "" {
+		t.Errorf("understated: unexpected Content-Length header: %q", cl)
+	}
+
+	// overstated: the header is fixed
+	resp, _ = tester.AssertGetResponse("http://localhost:9080/content-length.php?length=20", http.StatusOK, "hello world")
+	if cl := resp.Header.Get("Content-Length"); cl != "11" {
+		t.Errorf("overstated: unexpected Content-Length header: %q", cl)
+	}
+
+	resp, _ = tester.AssertGetResponse("http://localhost:9080/content-length.php?length=11", http.StatusOK, "hello world")
+	if cl := resp.Header.Get("Content-Length"); cl != "11" {
+		t.Errorf("exact: unexpected Content-Length header: %q", cl)
+	}
+}
+
+func TestRequireHeader(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "s3cr3t")
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					require_header X-Admin-Token {env.ADMIN_TOKEN}
+					require_header X-Tenant acme
+				}
+			}
+		}
+		`, "caddyfile")
+
+	for name, tc := range map[string]struct {
+		headers map[string]string
+		status  int
+	}{
+		"allowed":       {map[string]string{"X-Admin-Token": "s3cr3t", "X-Tenant": "acme"}, http.StatusOK},
+		"missing":       {map[string]string{"X-Tenant": "acme"}, http.StatusUnauthorized},
+		"invalid value": {map[string]string{"X-Admin-Token": "guess", "X-Tenant": "acme"}, http.StatusForbidden},
+		"partial":       {map[string]string{"X-Admin-Token": "s3cr3t"}, http.StatusUnauthorized},
+	} {
+		t.Run(name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/index.php?i=0", nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+
+			if tc.status == http.StatusOK {
+				tester.AssertResponse(req, http.StatusOK, "I am by birth a Genevese (0)")
+			} else {
+				tester.AssertResponseCode(req, tc.status)
+			}
+		})
+	}
+}
+
+func TestParseRequireHeader(t *testing.T) {
+	f := &caddy.FrankenPHPModule{}
+	if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\nrequire_header X-Token foo\nrequire_header X-Tenant bar\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.RequireHeaders) != 2 || f.RequireHeaders["X-Token"] != "foo" || f.RequireHeaders["X-Tenant"] != "bar" {
+		t.Errorf("unexpected required headers: %v", f.RequireHeaders)
+	}
+
+	for _, input := range []string{"require_header", "require_header X-Token", "require_header X-Token foo bar"} {
+		if err := (&caddy.FrankenPHPModule{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\n" + input + "\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestParseHTTPSOnly(t *testing.T) {
+	for input, expected := range map[string]string{"https_only": "redirect", "https_only redirect": "redirect", "https_only reject": "reject"} {
+		f := &caddy.FrankenPHPModule{}
+		if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\n" + input + "\n}")); err != nil {
+			t.Fatal(err)
+		}
+		if f.HTTPSOnly != expected {
+			t.Errorf("%q: expected %q, got %q", input, expected, f.HTTPSOnly)
+		}
+	}
+
+	f := &caddy.FrankenPHPModule{}
+	if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\nhttps_only foo\n}")); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestCORS(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					cors {
+						origins https://example.com
+						methods GET POST PUT
+						headers Content-Type Authorization
+						credentials
+						max_age 1h
+					}
+				}
+			}
+		}
+		`, "caddyfile")
+
+	// the preflight request is answered without invoking PHP
+	req, _ := http.NewRequest(http.MethodOptions, "http://localhost:9080/index.php?i=0", nil)
+	req.Header.Set("Origin", "https://example.com")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	resp := tester.AssertResponseCode(req, http.StatusNoContent)
+	for name, expected := range map[string]string{
+		"Access-Control-Allow-Origin":      "https://example.com",
+		"Access-Control-Allow-Methods":     "GET, POST, PUT",
+		"Access-Control-Allow-Headers":     "Content-Type, Authorization",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Max-Age":           "3600",
+	} {
+		if v := resp.Header.Get(name); v != expected {
+			t.Errorf("%s: expected %q, got %q", name, expected, v)
+		}
+	}
+	if body, _ := io.ReadAll(resp.Body); len(body) != 0 {
+		t.Errorf("unexpected preflight response body: %s", body)
+	}
+
+	// the actual request is handled by PHP
+	req, _ = http.NewRequest(http.MethodGet, "http://localhost:9080/index.php?i=1", nil)
+	req.Header.Set("Origin", "https://example.com")
+	resp, _ = tester.AssertResponse(req, http.StatusOK, "I am by birth a Genevese (1)")
+	if v := resp.Header.Get("Access-Control-Allow-Origin"); v != "https://example.com" {
+		t.Errorf("unexpected Access-Control-Allow-Origin header %q", v)
+	}
+	if v := resp.Header.Get("Access-Control-Allow-Credentials"); v != "true" {
+		t.Errorf("unexpected Access-Control-Allow-Credentials header %q", v)
+	}
+	if !slices.Contains(resp.Header.Values("Vary"), "Origin") {
+		t.Errorf("expected the response to vary by origin, got %v", resp.Header.Values("Vary"))
+	}
+
+	// the other origins get no CORS headers
+	req, _ = http.NewRequest(http.MethodGet, "http://localhost:9080/index.php?i=2", nil)
+	req.Header.Set("Origin", "https://evil.example")
+	resp, _ = tester.AssertResponse(req, http.StatusOK, "I am by birth a Genevese (2)")
+	if v := resp.Header.Get("Access-Control-Allow-Origin"); v != "" {
+		t.Errorf("unexpected Access-Control-Allow-Origin header %q", v)
+	}
+}
+
+func TestParseCORS(t *testing.T) {
+	f := &caddy.FrankenPHPModule{}
+	if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\ncors {\norigins https://a.example https://b.example\nmethods get post\nmax_age 10m\n}\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(f.CORS.AllowOrigins, []string{"https://a.example", "https://b.example"}) || !slices.Equal(f.CORS.AllowMethods, []string{"GET", "POST"}) || time.Duration(f.CORS.MaxAge) != 10*time.Minute {
+		t.Errorf("unexpected cors config: %+v", f.CORS)
+	}
+
+	for _, input := range []string{"cors", "cors {\nmethods GET\n}", "cors {\norigins *\nmax_age foo\n}", "cors {\norigins *\nfoo\n}", "cors foo {\norigins *\n}"} {
+		f := &caddy.FrankenPHPModule{}
+		if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\n" + input + "\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestCookieDefaults(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					cookie_defaults {
+						secure
+						http_only
+						same_site lax
+					}
+				}
+			}
+		}
+		`, "caddyfile")
+
+	resp, _ := tester.AssertGetResponse("http://localhost:9080/set-cookies.php", http.StatusOK, "Cookies set")
+	cookies := resp.Header.Values("Set-Cookie")
+	if len(cookies) != 3 {
+		t.Fatalf("expected 3 cookies, got %v", cookies)
+	}
+
+	expected := []string{
+		"plain=a; Secure; HttpOnly; SameSite=Lax",
+		// the explicit SameSite attribute isn't clobbered
+		"explicit=b; SameSite=Strict; Secure; HttpOnly",
+		// the explicit HttpOnly attribute isn't duplicated
+		"raw=c; path=/; httponly; Secure; SameSite=Lax",
+	}
+	for i, cookie := range cookies {
+		if cookie != expected[i] {
+			t.Errorf("expected cookie %q, got %q", expected[i], cookie)
+		}
+	}
+}
+
+func TestParseCookieDefaults(t *testing.T) {
+	f := &caddy.FrankenPHPModule{}
+	if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\ncookie_defaults {\nsecure\nsame_site None\n}\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if *f.CookieDefaults != (caddy.CookieDefaultsConfig{Secure: true, SameSite: "None"}) {
+		t.Errorf("unexpected cookie_defaults config: %+v", f.CookieDefaults)
+	}
+
+	for _, input := range []string{"cookie_defaults", "cookie_defaults {\nsame_site none\n}", "cookie_defaults {\nsame_site foo\n}", "cookie_defaults {\nsecure foo\n}", "cookie_defaults {\nfoo\n}", "cookie_defaults foo {\nsecure\n}"} {
+		f := &caddy.FrankenPHPModule{}
+		if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\n" + input + "\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	t.Setenv("APP_SHA", "abc123")
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					version {env.APP_SHA}
+				}
+			}
+		}
+		`, "caddyfile")
+
+	tester.AssertGetResponse("http://localhost:9080/build-info.php", http.StatusOK, "has version\nabc123")
+}
+
+func TestInsufficientThreads(t *testing.T) {
+	validate := func(policy string) error {
+		cfgAdapter := caddyconfig.GetAdapter("caddyfile")
+		result, _, err := cfgAdapter.Adapt([]byte(`
+		{
+			frankenphp {
+				num_threads 2
+				`+policy+`
+				worker ../testdata/index.php 2
+			}
+		}
+		`), map[string]any{"filename": "Caddyfile"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var config caddy2.Config
+		if err := json.Unmarshal(result, &config); err != nil {
+			t.Fatal(err)
+		}
+
+		return caddy2.Validate(&config)
+	}
+
+	for _, policy := range []string{"", "insufficient_threads error"} {
+		if err := validate(policy); err == nil || !strings.Contains(err.Error(), "num_threads (2) must be greater than the number of workers (2)") {
+			t.Errorf("%q: expected an error, got %v", policy, err)
+		}
+	}
+
+	if err := validate("insufficient_threads auto"); err != nil {
+		t.Errorf("expected the number of threads to be increased, got %v", err)
+	}
+}
+
+func TestAllowedRoots(t *testing.T) {
+	base := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Mkdir(filepath.Join(base, "app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(base, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	validate := func(root string) error {
+		cfgAdapter := caddyconfig.GetAdapter("caddyfile")
+		result, _, err := cfgAdapter.Adapt([]byte(`
+		{
+			http_port 9080
+
+			frankenphp {
+				allowed_roots `+base+`
+			}
+		}
+
+		http://localhost:9080 {
+			php {
+				root `+root+`
+			}
+		}
+		`), map[string]any{"filename": "Caddyfile"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var config caddy2.Config
+		if err := json.Unmarshal(result, &config); err != nil {
+			t.Fatal(err)
+		}
+
+		return caddy2.Validate(&config)
+	}
+
+	if err := validate(filepath.Join(base, "app")); err != nil {
+		t.Errorf("allowed root: unexpected error: %v", err)
+	}
+
+	if err := validate(base + "/app/../../" + filepath.Base(outside)); err == nil || !strings.Contains(err.Error(), "outside the allowed roots") {
+		t.Errorf("escaping root: expected an error, got %v", err)
+	}
+
+	if err := validate(filepath.Join(base, "link")); err == nil || !strings.Contains(err.Error(), "outside the allowed roots") {
+		t.Errorf("symlink escaping root: expected an error, got %v", err)
+	}
+}
+
+func TestParseLogMessages(t *testing.T) {
+	app := &caddy.FrankenPHPApp{}
+	if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\nlog_messages json\n}")); err != nil {
+		t.Fatal(err)
+	}
+
+	if app.LogMessages != "json" {
+		t.Errorf("unexpected log_messages: %q", app.LogMessages)
+	}
+
+	for _, input := range []string{"log_messages", "log_messages silent"} {
+		app := &caddy.FrankenPHPApp{}
+		if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\n" + input + "\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestReservedThreads(t *testing.T) {
+	validate := func(numThreads int) error {
+		cfgAdapter := caddyconfig.GetAdapter("caddyfile")
+		result, _, err := cfgAdapter.Adapt([]byte(`
+		{
+			frankenphp {
+				num_threads `+strconv.Itoa(numThreads)+`
+				reserved_threads 2
+				worker ../testdata/index.php 2
+			}
+		}
+		`), map[string]any{"filename": "Caddyfile"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var config caddy2.Config
+		if err := json.Unmarshal(result, &config); err != nil {
+			t.Fatal(err)
+		}
+
+		return caddy2.Validate(&config)
+	}
+
+	if err := validate(3); err == nil || !strings.Contains(err.Error(), "to leave the reserved threads (2)") {
+		t.Errorf("expected an error, got %v", err)
+	}
+	if err := validate(4); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for _, input := range []string{"reserved_threads", "reserved_threads 0", "reserved_threads foo"} {
+		app := &caddy.FrankenPHPApp{}
+		if err := app.UnmarshalCaddyfile(caddyfile.NewTestDispenser("frankenphp {\n" + input + "\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestTimezone(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp {
+				timezone America/New_York
+			}
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, "caddyfile")
+
+	tester.AssertGetResponse("http://localhost:9080/timezone.php", http.StatusOK, "America/New_York")
+}
+
+func TestTimezoneInvalid(t *testing.T) {
+	cfgAdapter := caddyconfig.GetAdapter("caddyfile")
+	result, _, err := cfgAdapter.Adapt([]byte(`
+		{
+			frankenphp {
+				timezone Mars/Olympus_Mons
+			}
+		}
+		`), map[string]any{"filename": "Caddyfile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var config caddy2.Config
+	if err := json.Unmarshal(result, &config); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := caddy2.Validate(&config); err == nil || !strings.Contains(err.Error(), `timezone: invalid value "Mars/Olympus_Mons"`) {
+		t.Errorf("expected an error, got %v", err)
+	}
+}
+
+func TestRequestTrailers(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					request_trailers 1KiB
+				}
+			}
+		}
+		`, "caddyfile")
+
+	// the client sends the trailers after a chunked body
+	post := func(uri, body string) *http.Request {
+		req, _ := http.NewRequest(http.MethodPost, uri, io.MultiReader(strings.NewReader(body)))
+		req.Trailer = http.Header{"X-Checksum": {"abc"}}
+
+		return req
+	}
+
+	tester.AssertResponse(post("http://localhost:9080/env-var.php?name=HTTP_TRAILER_X_CHECKSUM", "foo"), http.StatusOK, "abc")
+	tester.AssertResponse(post("http://localhost:9080/input.php", "hello trailers"), http.StatusOK, "hello trailers")
+
+	tester.AssertResponseCode(post("http://localhost:9080/input.php", strings.Repeat("a", 1025)), http.StatusRequestEntityTooLarge)
+
+	// the requests without trailers are streamed as usual
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost:9080/env-var.php?name=HTTP_TRAILER_X_CHECKSUM", strings.NewReader("foo"))
+	tester.AssertResponse(req, http.StatusOK, "missing")
+}
+
+func TestDecompressRequest(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					decompress_request 1KiB
+				}
+			}
+		}
+		`, "caddyfile")
+
+	post := func(uri, encoding string, body string) *http.Request {
+		var buf bytes.Buffer
+		var zw io.WriteCloser
+		switch encoding {
+		case "gzip":
+			zw = gzip.NewWriter(&buf)
+		case "deflate":
+			zw = zlib.NewWriter(&buf)
+		}
+		zw.Write([]byte(body))
+		zw.Close()
+
+		req, _ := http.NewRequest(http.MethodPost, uri, &buf)
+		req.Header.Set("Content-Encoding", encoding)
+
+		return req
+	}
+
+	tester.AssertResponse(post("http://localhost:9080/input.php", "gzip", "hello gzip"), http.StatusOK, "hello gzip")
+	tester.AssertResponse(post("http://localhost:9080/input.php", "deflate", "hello deflate"), http.StatusOK, "hello deflate")
+	tester.AssertResponse(post("http://localhost:9080/env-var.php?name=CONTENT_LENGTH", "gzip", strings.Repeat("a", 1000)), http.StatusOK, "1000")
+	tester.AssertResponse(post("http://localhost:9080/env-var.php?name=HTTP_CONTENT_ENCODING", "gzip", "foo"), http.StatusOK, "missing")
+
+	// decompression bombs are rejected
+	tester.AssertResponseCode(post("http://localhost:9080/input.php", "gzip", strings.Repeat("a", 1025)), http.StatusRequestEntityTooLarge)
+
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost:9080/input.php", strings.NewReader("not gzip"))
+	req.Header.Set("Content-Encoding", "gzip")
+	tester.AssertResponseCode(req, http.StatusBadRequest)
+
+	req, _ = http.NewRequest(http.MethodPost, "http://localhost:9080/input.php", strings.NewReader("foo"))
+	req.Header.Set("Content-Encoding", "compress")
+	tester.AssertResponseCode(req, http.StatusUnsupportedMediaType)
+
+	// the bodies not encoded are left untouched
+	req, _ = http.NewRequest(http.MethodPost, "http://localhost:9080/input.php", strings.NewReader("plain"))
+	tester.AssertResponse(req, http.StatusOK, "plain")
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route /limited/* {
+				uri strip_prefix /limited
+				php {
+					root ../testdata
+					max_request_body 1KiB
+				}
+			}
+
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, "caddyfile")
+
+	post := func(uri, contentType string, size int) *http.Request {
+		req, _ := http.NewRequest(http.MethodPost, uri, strings.NewReader(strings.Repeat("a", size)))
+		req.Header.Set("Content-Type", contentType)
+
+		return req
+	}
+
+	// the default value of post_max_size is 8M
+	const postMaxSize = 8 * 1024 * 1024
+	tester.AssertResponseCode(post("http://localhost:9080/input.php", "application/x-www-form-urlencoded", postMaxSize), http.StatusOK)
+	tester.AssertResponse(
+		post("http://localhost:9080/input.php", "application/x-www-form-urlencoded", postMaxSize+1),
+		http.StatusRequestEntityTooLarge,
+		fmt.Sprintf("Request body too large: %d bytes, the limit is %d bytes.\n", postMaxSize+1, postMaxSize),
+	)
+	// post_max_size only applies to form data
+	tester.AssertResponseCode(post("http://localhost:9080/input.php", "application/octet-stream", postMaxSize+1), http.StatusOK)
+
+	tester.AssertResponseCode(post("http://localhost:9080/limited/input.php", "application/octet-stream", 1024), http.StatusOK)
+	tester.AssertResponseCode(post("http://localhost:9080/limited/input.php", "application/octet-stream", 1025), http.StatusRequestEntityTooLarge)
+}
+
+func TestRequestHeaderLimit(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					max_request_header_bytes 100
+				}
+			}
+		}
+		`, "caddyfile")
+
+	get := func(padding int) *http.Request {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/index.php", nil)
+		// 10 + 4 + 15 + 8 bytes, the remaining ones are filled by X-Padding (9 bytes + its value)
+		req.Header.Set("User-Agent", "test")
+		req.Header.Set("Accept-Encoding", "identity")
+		req.Header.Set("X-Padding", strings.Repeat("a", padding))
+
+		return req
+	}
+
+	tester.AssertResponseCode(get(53), http.StatusOK)
+	tester.AssertResponseCode(get(54), http.StatusOK)
+	tester.AssertResponse(get(55), http.StatusRequestHeaderFieldsTooLarge, "Request header fields too large: 101 bytes, the limit is 100 bytes.\n")
+}
+
+func TestParseMaxRequestHeaderBytes(t *testing.T) {
+	f := &caddy.FrankenPHPModule{}
+	if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\nmax_request_header_bytes 16KiB\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if f.MaxRequestHeaderBytes != 16*1024 {
+		t.Errorf("unexpected max_request_header_bytes: %d", f.MaxRequestHeaderBytes)
+	}
+
+	for _, input := range []string{"max_request_header_bytes", "max_request_header_bytes foo"} {
+		f := &caddy.FrankenPHPModule{}
+		if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\n" + input + "\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestSlowLog(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "caddy.log")
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+			log {
+				output file `+logFile+`
+			}
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					slow_log 200ms
+				}
+			}
+		}
+		`, "caddyfile")
+
+	tester.AssertGetResponse("http://localhost:9080/sleep.php?sleep=0", http.StatusOK, "slept for 0 ms")
+	tester.AssertGetResponse("http://localhost:9080/sleep.php?sleep=500", http.StatusOK, "slept for 500 ms")
+
+	for i := 0; i < 20; i++ {
+		logs, _ := os.ReadFile(logFile)
+		if n := bytes.Count(logs, []byte("slow PHP request")); n > 0 {
+			if n != 1 {
+				t.Errorf("expected 1 slow request to be logged, got %d", n)
+			}
+			if !bytes.Contains(logs, []byte(`"script_name":"/sleep.php"`)) || !bytes.Contains(logs, []byte(`"level":"warn"`)) {
+				t.Errorf("unexpected slow request log: %s", logs)
+			}
+
+			return
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Error("the slow request hasn't been logged")
+}
+
+func TestParseSlowLog(t *testing.T) {
+	f := &caddy.FrankenPHPModule{}
+	if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\nslow_log 1s\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(f.SlowLog) != time.Second {
+		t.Errorf("unexpected slow_log: %v", f.SlowLog)
+	}
+
+	for _, input := range []string{"slow_log", "slow_log foo", "slow_log 0s"} {
+		f := &caddy.FrankenPHPModule{}
+		if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\n" + input + "\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestBodyReadTimeout(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					body_read_timeout 100ms
+				}
+			}
+		}
+		`, "caddyfile")
+
+	// the client sends the beginning of the body, then stalls
+	conn, err := net.Dial("tcp", "localhost:9080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte("POST /input.php HTTP/1.1\r\nHost: localhost:9080\r\nContent-Type: application/octet-stream\r\nContent-Length: 100\r\n\r\nfoo=")); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Foo") != "" {
+		t.Error("the response of PHP hasn't been discarded")
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost:9080/input.php", strings.NewReader("bar"))
+	tester.AssertResponse(req, http.StatusOK, "bar")
+}
+
+func TestBootingResponse(t *testing.T) {
+	const config = `
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp {
+				worker {
+					file ../testdata/worker-slow-boot.php
+					num 1
+					env GENERATION %d
+				}
+			}
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					booting_response ../testdata/booting.html
+				}
+			}
+		}
+		`
+
+	placeholder, err := os.ReadFile("../testdata/booting.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(fmt.Sprintf(config, 1), "caddyfile")
+	tester.AssertGetResponse("http://localhost:9080/worker-slow-boot.php", http.StatusOK, "booted")
+
+	// reloading the config boots the worker again
+	reloaded := make(chan error, 1)
+	go func() {
+		resp, err := http.Post("http://localhost:2999/load", "text/caddyfile", strings.NewReader(fmt.Sprintf(config, 2)))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+			}
+		}
+		reloaded <- err
+	}()
+
+	var booting bool
+	for done := false; !done; {
+		select {
+		case err := <-reloaded:
+			if err != nil {
+				t.Fatal(err)
+			}
+			done = true
+		default:
+		}
+
+		resp, err := http.Get("http://localhost:9080/worker-slow-boot.php")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusServiceUnavailable && string(body) == string(placeholder):
+			booting = true
+			if resp.Header.Get("Retry-After") == "" {
+				t.Error("missing Retry-After header")
+			}
+		case resp.StatusCode != http.StatusOK || string(body) != "booted":
+			t.Fatalf("unexpected response: %d %q", resp.StatusCode, body)
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if !booting {
+		t.Error("the booting response hasn't been served")
+	}
+	tester.AssertGetResponse("http://localhost:9080/worker-slow-boot.php", http.StatusOK, "booted")
+}
+
+func TestRequestTimeout(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					request_timeout 1s
+				}
+			}
+		}
+		`, "caddyfile")
+
+	// neither reading the body nor executing the script exceed the timeout, but together they do
+	conn, err := net.Dial("tcp", "localhost:9080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte("POST /slow-input.php?sleep=700 HTTP/1.1\r\nHost: localhost:9080\r\nContent-Type: application/octet-stream\r\nContent-Length: 6\r\n\r\nfoo")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(700 * time.Millisecond)
+	if _, err := conn.Write([]byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Foo") != "" {
+		t.Error("the response of PHP hasn't been discarded")
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost:9080/slow-input.php?sleep=100", strings.NewReader("foobar"))
+	tester.AssertResponse(req, http.StatusOK, "foobar")
+}
+
+func TestParseRequestTimeout(t *testing.T) {
+	f := &caddy.FrankenPHPModule{}
+	if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\nrequest_timeout 30s\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(f.RequestTimeout) != 30*time.Second {
+		t.Errorf("unexpected request timeout: %v", f.RequestTimeout)
+	}
+
+	for _, input := range []string{"request_timeout", "request_timeout foo", "request_timeout 0", "request_timeout -1s"} {
+		f := &caddy.FrankenPHPModule{}
+		if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\n" + input + "\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route /abort/* {
+				uri strip_prefix /abort
+				php {
+					root ../testdata
+					max_response_bytes 2KiB abort
+				}
+			}
+
+			route {
+				php {
+					root ../testdata
+					max_response_bytes 2KiB
+				}
+			}
+		}
+		`, "caddyfile")
+
+	tester.AssertGetResponse("http://localhost:9080/abort/index.php?i=0", http.StatusOK, "I am by birth a Genevese (0)")
+	tester.AssertGetResponse("http://localhost:9080/abort/large-response.php", http.StatusInternalServerError, "")
+
+	// without abort, the response is only logged
+	tester.AssertGetResponse("http://localhost:9080/large-response.php", http.StatusOK, strings.Repeat("Hey\n", 1024))
+}
+
+func TestParseMaxResponseBytes(t *testing.T) {
+	f := &caddy.FrankenPHPModule{}
+	if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\nmax_response_bytes 10MB abort\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if f.MaxResponseBytes != 10_000_000 || !f.AbortLargeResponses {
+		t.Errorf("unexpected max_response_bytes: %d %t", f.MaxResponseBytes, f.AbortLargeResponses)
+	}
+
+	for _, input := range []string{"max_response_bytes", "max_response_bytes foo", "max_response_bytes 0", "max_response_bytes 1MB truncate", "max_response_bytes 1MB abort foo"} {
+		if err := (&caddy.FrankenPHPModule{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\n" + input + "\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route /reject/* {
+				uri strip_prefix /reject
+				php {
+					root ../testdata
+					expect_continue reject
+				}
+			}
+
+			route {
+				php {
+					root ../testdata
+					expect_continue auto
+				}
+			}
+		}
+		`, "caddyfile")
+
+	sendHeaders := func(path string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", "localhost:9080")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Write([]byte("POST " + path + " HTTP/1.1\r\nHost: localhost:9080\r\nContent-Type: application/octet-stream\r\nContent-Length: 3\r\nExpect: 100-continue\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+
+		return conn, bufio.NewReader(conn)
+	}
+
+	// the client waits for the 100 Continue response before sending the body
+	conn, br := sendHeaders("/input.php")
+	defer conn.Close()
+
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusContinue {
+		t.Fatalf("expected a 100 Continue response, got %d", resp.StatusCode)
+	}
+
+	if _, err := conn.Write([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "foo" {
+		t.Errorf("unexpected response %d: %s", resp.StatusCode, body)
+	}
+
+	// the expectation is rejected without waiting for the body
+	conn, br = sendHeaders("/reject/input.php")
+	defer conn.Close()
+
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusExpectationFailed {
+		t.Errorf("expected a 417 error, got %d", resp.StatusCode)
+	}
+}
+
+func TestParseExpectContinue(t *testing.T) {
+	for _, v := range []string{"auto", "reject"} {
+		f := &caddy.FrankenPHPModule{}
+		if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\nexpect_continue " + v + "\n}")); err != nil {
+			t.Fatal(err)
+		}
+		if f.ExpectContinue != v {
+			t.Errorf("expected %q, got %q", v, f.ExpectContinue)
+		}
+	}
+
+	for _, input := range []string{"expect_continue", "expect_continue foo"} {
+		if err := (&caddy.FrankenPHPModule{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\n" + input + "\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestParseBodyReadTimeout(t *testing.T) {
+	f := &caddy.FrankenPHPModule{}
+	if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\nbody_read_timeout 30s\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(f.BodyReadTimeout) != 30*time.Second {
+		t.Errorf("unexpected body_read_timeout: %v", f.BodyReadTimeout)
+	}
+
+	for _, input := range []string{"body_read_timeout", "body_read_timeout foo", "body_read_timeout 0s"} {
+		f := &caddy.FrankenPHPModule{}
+		if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\n" + input + "\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					index script-name.php
+				}
+			}
+		}
+		`, "caddyfile")
+
+	tester.AssertGetResponse("http://localhost:9080/", http.StatusOK, "/script-name.php")
+
+	// the requests targeting scripts are unchanged
+	tester.AssertGetResponse("http://localhost:9080/script-name.php/path", http.StatusOK, "/script-name.php")
+}
+
+func TestHeadOptimization(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route /cache/* {
+				uri strip_prefix /cache
+				php {
+					root ../testdata
+					head_optimization cache 1m
+				}
+			}
+
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, "caddyfile")
+
+	head := func(url string) *http.Response {
+		req, _ := http.NewRequest(http.MethodHead, url, nil)
+		resp := tester.AssertResponseCode(req, http.StatusOK)
+
+		body, _ := io.ReadAll(resp.Body)
+		if len(body) != 0 {
+			t.Errorf("%s: unexpected body %q", url, body)
+		}
+		if resp.ContentLength != 11 {
+			t.Errorf("%s: unexpected Content-Length %d", url, resp.ContentLength)
+		}
+
+		return resp
+	}
+
+	// PHP is executed, its body discarded
+	resp := head("http://localhost:9080/head.php")
+	if resp.Header.Get("X-Generation") == "" {
+		t.Error("the headers set by PHP are missing")
+	}
+
+	// the headers of the GET response are reused
+	resp, _ = tester.AssertGetResponse("http://localhost:9080/cache/head.php", http.StatusOK, "hello world")
+	generation := resp.Header.Get("X-Generation")
+	if resp = head("http://localhost:9080/cache/head.php"); resp.Header.Get("X-Generation") != generation {
+		t.Errorf("the cached headers haven't been used: %q instead of %q", resp.Header.Get("X-Generation"), generation)
+	}
+}
+
+func TestParseHeadOptimization(t *testing.T) {
+	f := &caddy.FrankenPHPModule{}
+	if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\nhead_optimization cache 30s\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if f.HeadOptimization != "cache" || time.Duration(f.HeadCacheTTL) != 30*time.Second {
+		t.Errorf("unexpected head_optimization: %q %s", f.HeadOptimization, time.Duration(f.HeadCacheTTL))
+	}
+
+	for _, input := range []string{"head_optimization", "head_optimization skip", "head_optimization off 30s", "head_optimization cache -1s"} {
+		f := &caddy.FrankenPHPModule{}
+		if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\n" + input + "\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					coalesce
+				}
+			}
+		}
+		`, "caddyfile")
+
+	file := filepath.Join(t.TempDir(), "executions")
+	u := "http://localhost:9080/coalesce.php?file=" + url.QueryEscape(file)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tester.AssertGetResponse(u, http.StatusOK, "executed")
+		}()
+	}
+	wg.Wait()
+
+	if executions, _ := os.ReadFile(file); string(executions) != "x" {
+		t.Errorf("PHP must be executed once, got %d executions", len(executions))
+	}
+
+	// the responses aren't cached
+	tester.AssertGetResponse(u, http.StatusOK, "executed")
+	// non-idempotent requests are never coalesced
+	tester.AssertPostResponseBody(u, nil, &bytes.Buffer{}, http.StatusOK, "executed")
+
+	if executions, _ := os.ReadFile(file); string(executions) != "xxx" {
+		t.Errorf("PHP must be executed 3 times, got %d executions", len(executions))
+	}
+}
+
+func TestCoalesceSession(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					coalesce
+				}
+			}
+		}
+		`, "caddyfile")
+
+	file := filepath.Join(t.TempDir(), "executions")
+	u := "http://localhost:9080/coalesce.php?session=1&file=" + url.QueryEscape(file)
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		cookies = make(map[string]bool)
+	)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// without cookie jar, the clients are anonymous
+			resp, err := http.Get(u)
+			if err != nil {
+				t.Error(err)
+
+				return
+			}
+			resp.Body.Close()
+
+			mu.Lock()
+			cookies[resp.Header.Get("Set-Cookie")] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// responses starting a session are never shared
+	if len(cookies) != 5 {
+		t.Errorf("every client must get its own session, got %d distinct cookies", len(cookies))
+	}
+	if executions, _ := os.ReadFile(file); string(executions) != "xxxxx" {
+		t.Errorf("PHP must be executed 5 times, got %d executions", len(executions))
+	}
+}
+
+func TestHideHeaders(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					hide_headers X-Accel-Redirect
+				}
+			}
+		}
+		`, "caddyfile")
+
+	for name, expected := range map[string]string{"X_ACCEL_REDIRECT": "missing", "X_FOO": "bar"} {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/request-header.php?name="+name, nil)
+		req.Header.Set("X-Accel-Redirect", "/secret")
+		req.Header.Set("X-Foo", "bar")
+
+		tester.AssertResponse(req, http.StatusOK, expected)
+	}
+}
+
+func TestParseForwardHeaders(t *testing.T) {
+	f := &caddy.FrankenPHPModule{}
+	if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\nforward_headers Accept Cookie\nhide_headers X-Accel-Redirect\n}")); err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(f.ForwardHeaders, []string{"Accept", "Cookie"}) || !slices.Equal(f.HideHeaders, []string{"X-Accel-Redirect"}) {
+		t.Errorf("unexpected headers: %v %v", f.ForwardHeaders, f.HideHeaders)
+	}
+
+	for _, input := range []string{"forward_headers", "hide_headers"} {
+		f := &caddy.FrankenPHPModule{}
+		if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\n" + input + "\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestPHPServerQueryString(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
 		}
 
 		localhost:9080 {
-			root * ../testdata
-			php_server
+			php_server /rewritten/* {
+				root ../testdata
+				try_files {path} index.php?{query}&i=rewritten
+			}
+
+			php_server {
+				root ../testdata
+			}
 		}
 		`, "caddyfile")
 
-	tester.AssertGetResponse("http://localhost:9080", http.StatusOK, "I am by birth a Genevese (i not set)")
+	// the front controller gets the query string of the request
+	tester.AssertGetResponse("http://localhost:9080/some/route?i=42", http.StatusOK, "I am by birth a Genevese (42)")
+
+	// the query string of the try_files entry replaces the one of the request
+	tester.AssertGetResponse("http://localhost:9080/rewritten/route?i=42", http.StatusOK, "I am by birth a Genevese (rewritten)")
+}
+
+func TestPHPServerHandle(t *testing.T) {
+	routes := adaptObjects(t, `
+		localhost:9080 {
+			php_server {
+				root ../testdata
+				handle /blog {
+					root /var/www/wordpress
+					preset wordpress
+				}
+				handle /shop/ {
+					root /var/www/laravel/public
+					index app.php
+				}
+			}
+		}
+		`, func(v map[string]any) bool {
+		return v["terminal"] == true
+	})
+
+	if len(routes) != 2 {
+		t.Fatalf("expected 2 routes, got %d", len(routes))
+	}
+	for i, expected := range []struct{ prefix, root, index string }{
+		{"/blog", "/var/www/wordpress", "index.php"},
+		{"/shop", "/var/www/laravel/public", "app.php"},
+	} {
+		route := routes[i]
+		if paths := fmt.Sprint(route["match"].([]any)[0].(map[string]any)["path"]); paths != "["+expected.prefix+" "+expected.prefix+"/*]" {
+			t.Errorf("%s: unexpected path matcher: %s", expected.prefix, paths)
+		}
+
+		rewrites := findObjects(route, func(v map[string]any) bool {
+			return v["handler"] == "rewrite" && v["strip_path_prefix"] != nil
+		})
+		if len(rewrites) != 1 || rewrites[0]["strip_path_prefix"] != expected.prefix {
+			t.Errorf("%s: unexpected prefix stripping: %v", expected.prefix, rewrites)
+		}
+
+		phpHandlers := findObjects(route, func(v map[string]any) bool {
+			return v["handler"] == "php"
+		})
+		if len(phpHandlers) != 1 || phpHandlers[0]["root"] != expected.root {
+			t.Errorf("%s: unexpected php handlers: %v", expected.prefix, phpHandlers)
+		}
+
+		vars := findObjects(route, func(v map[string]any) bool {
+			return v["handler"] == "vars"
+		})
+		if len(vars) != 1 || vars[0]["root"] != expected.root {
+			t.Errorf("%s: unexpected root: %v", expected.prefix, vars)
+		}
+
+		files := findObjects(route, func(v map[string]any) bool {
+			_, ok := v["try_files"]
+
+			return ok
+		})
+		if len(files) == 0 || !strings.Contains(fmt.Sprint(files[0]["try_files"]), expected.index) {
+			t.Errorf("%s: unexpected file matchers: %v", expected.prefix, files)
+		}
+	}
+
+	// the requests not matching a prefix are served by the enclosing block
+	phpHandlers := adaptHandlers(t, `
+		localhost:9080 {
+			php_server {
+				root ../testdata
+				handle /blog {
+					root /var/www/wordpress
+				}
+			}
+		}
+		`, "php")
+	if len(phpHandlers) != 2 || phpHandlers[1]["root"] != "../testdata" {
+		t.Errorf("unexpected php handlers: %v", phpHandlers)
+	}
+}
+
+func TestPHPServerHandleInvalid(t *testing.T) {
+	for _, input := range []string{
+		"php_server {\nhandle {\nroot /var/www\n}\n}",
+		"php_server {\nhandle / {\nroot /var/www\n}\n}",
+		"php_server {\nhandle blog {\nroot /var/www\n}\n}",
+		"php_server {\nhandle /blog /shop {\nroot /var/www\n}\n}",
+		"php_server {\nhandle /blog {\nhandle /admin {\nroot /var/www\n}\n}\n}",
+	} {
+		cfgAdapter := caddyconfig.GetAdapter("caddyfile")
+		if _, _, err := cfgAdapter.Adapt([]byte("localhost:9080 {\n"+input+"\n}"), map[string]any{"filename": "Caddyfile"}); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestPHPServerRoutesFrom(t *testing.T) {
+	pathMatchers := adaptObjects(t, `
+		localhost:9080 {
+			php_server {
+				root ../testdata
+				routes_from ../testdata/routes.php
+			}
+		}
+		`, func(v map[string]any) bool {
+		_, ok := v["path"].([]any)
+
+		return ok && v["file"] != nil
+	})
+
+	var paths []string
+	for _, m := range pathMatchers {
+		paths = append(paths, m["path"].([]any)[0].(string))
+	}
+	if !slices.Equal(paths, []string{"/users/*", "/login", "/assets/*"}) {
+		t.Errorf("unexpected path matchers: %v", paths)
+	}
+	if fmt.Sprint(pathMatchers[1]["method"]) != "[GET POST]" {
+		t.Errorf("unexpected method matcher: %v", pathMatchers[1]["method"])
+	}
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			php_server {
+				root ../testdata
+				routes_from ../testdata/routes.php
+			}
+		}
+		`, "caddyfile")
+
+	tester.AssertGetResponse("http://localhost:9080/users/1", http.StatusOK, "I am by birth a Genevese (i not set)")
+	tester.AssertGetResponse("http://localhost:9080/not-a-route", http.StatusNotFound, "")
+	// the existing files are still served
 	tester.AssertGetResponse("http://localhost:9080/hello.txt", http.StatusOK, "Hello")
-	tester.AssertGetResponse("http://localhost:9080/not-found.txt", http.StatusOK, "I am by birth a Genevese (i not set)")
 }
 
-func TestPHPServerDirectiveDisableFileServer(t *testing.T) {
+func TestPHPServerRoutesFromEmbeddedApp(t *testing.T) {
+	dir := t.TempDir()
+	app := filepath.Join(dir, "shop")
+	if err := os.MkdirAll(filepath.Join(app, "public"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(app, "public", "index.php"), []byte("<?php echo 'I am the shop app';"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(app, "routes.php"), []byte("<?php function frankenphp_routes(): array { return [['path' => '/products/{id}']]; }"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	embeddedAppPath, embeddedAppPaths := frankenphp.EmbeddedAppPath, frankenphp.EmbeddedAppPaths
+	frankenphp.EmbeddedAppPath, frankenphp.EmbeddedAppPaths = dir, map[string]string{"shop": app}
+	t.Cleanup(func() { frankenphp.EmbeddedAppPath, frankenphp.EmbeddedAppPaths = embeddedAppPath, embeddedAppPaths })
+
+	// the routes are exported when the configuration is adapted, before the app is served
 	tester := caddytest.NewTester(t)
 	tester.InitServer(`
 		{
@@ -174,18 +4391,304 @@ func TestPHPServerDirectiveDisableFileServer(t *testing.T) {
 			https_port 9443
 
 			frankenphp
-			order php_server before respond
 		}
 
 		localhost:9080 {
-			root * ../testdata
 			php_server {
-				file_server off
+				embedded_app shop
+				routes_from routes.php
 			}
-			respond "Not found" 404
 		}
 		`, "caddyfile")
 
-	tester.AssertGetResponse("http://localhost:9080", http.StatusOK, "I am by birth a Genevese (i not set)")
-	tester.AssertGetResponse("http://localhost:9080/hello.txt", http.StatusNotFound, "Not found")
+	tester.AssertGetResponse("http://localhost:9080/products/1", http.StatusOK, "I am the shop app")
+	tester.AssertGetResponse("http://localhost:9080/not-a-route", http.StatusNotFound, "")
+}
+
+func TestCompress(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					compress gzip
+				}
+			}
+		}
+		`, "caddyfile")
+
+	// large-response.php is compressed, compressed.php is already compressed by PHP
+	for _, script := range []string{"large-response.php", "compressed.php"} {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/"+script, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+
+		resp := tester.AssertResponseCode(req, http.StatusOK)
+		if resp.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("%s: unexpected Content-Encoding %q", script, resp.Header.Get("Content-Encoding"))
+		}
+
+		gr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(gr)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != strings.Repeat("Hey\n", 1024) {
+			t.Errorf("%s: the response must be compressed once", script)
+		}
+	}
+
+	// the clients not accepting compressed responses get them uncompressed
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/large-response.php", nil)
+	req.Header.Set("Accept-Encoding", "identity")
+	if resp, _ := tester.AssertResponse(req, http.StatusOK, strings.Repeat("Hey\n", 1024)); resp.Header.Get("Content-Encoding") != "" {
+		t.Errorf("unexpected Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestParseCompress(t *testing.T) {
+	f := &caddy.FrankenPHPModule{}
+	if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\ncompress zstd\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if f.Compress != "zstd" {
+		t.Errorf("unexpected compress: %q", f.Compress)
+	}
+
+	for _, input := range []string{"compress", "compress deflate"} {
+		f := &caddy.FrankenPHPModule{}
+		if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\n" + input + "\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "access.log")
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			log {
+				output file `+logFile+`
+				format json
+			}
+
+			route {
+				php {
+					root ../testdata
+					request_id_header
+				}
+			}
+		}
+		`, "caddyfile")
+
+	for _, name := range []string{"REQUEST_ID", "HTTP_X_REQUEST_ID"} {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/env-var.php?name="+name, nil)
+		req.Header.Set("X-Request-Id", "spoofed")
+
+		resp := tester.AssertResponseCode(req, http.StatusOK)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		requestID := string(body)
+		if requestID == "" || requestID == "spoofed" {
+			t.Fatalf("%s: unexpected request ID %q", name, requestID)
+		}
+		if resp.Header.Get("X-Request-Id") != requestID {
+			t.Errorf("%s: the response header %q doesn't match the request ID %q", name, resp.Header.Get("X-Request-Id"), requestID)
+		}
+
+		// the request headers are logged by Caddy
+		var logs []byte
+		for i := 0; i < 50 && !bytes.Contains(logs, []byte(`"X-Request-Id":["`+requestID+`"]`)); i++ {
+			time.Sleep(10 * time.Millisecond)
+			logs, _ = os.ReadFile(logFile)
+		}
+		if !bytes.Contains(logs, []byte(`"X-Request-Id":["`+requestID+`"]`)) {
+			t.Errorf("%s: the request ID %q isn't logged: %s", name, requestID, logs)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					rate_limit 2 1s
+				}
+			}
+		}
+		`, "caddyfile")
+
+	tester.AssertGetResponse("http://localhost:9080/index.php?i=0", http.StatusOK, "I am by birth a Genevese (0)")
+	tester.AssertGetResponse("http://localhost:9080/index.php?i=1", http.StatusOK, "I am by birth a Genevese (1)")
+
+	resp, _ := tester.AssertGetResponse("http://localhost:9080/index.php?i=2", http.StatusTooManyRequests, "")
+	if v := resp.Header.Get("Retry-After"); v != "1" {
+		t.Errorf(`expected "Retry-After: 1", got %q`, v)
+	}
+
+	// the bucket is refilled after the window
+	time.Sleep(time.Second)
+	tester.AssertGetResponse("http://localhost:9080/index.php?i=3", http.StatusOK, "I am by birth a Genevese (3)")
+}
+
+func TestShortCircuitAccessLog(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "access.log")
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			log {
+				output file `+logFile+`
+				format json
+			}
+
+			route {
+				php {
+					root ../testdata
+					rate_limit 1 1m
+				}
+			}
+		}
+		`, "caddyfile")
+
+	tester.AssertGetResponse("http://localhost:9080/index.php?i=0", http.StatusOK, "I am by birth a Genevese (0)")
+	tester.AssertGetResponse("http://localhost:9080/index.php?i=1", http.StatusTooManyRequests, "")
+
+	// the access log entry is written once the response has been sent
+	var entries []map[string]any
+	for deadline := time.Now().Add(2 * time.Second); len(entries) < 2 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		data, _ := os.ReadFile(logFile)
+
+		entries = entries[:0]
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var entry map[string]any
+			if json.Unmarshal([]byte(line), &entry) == nil {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 access log entries, got %d", len(entries))
+	}
+	if entries[0]["status"] != float64(http.StatusOK) || entries[0]["php_outcome"] != "executed" {
+		t.Errorf("unexpected access log entry for the executed request: %v", entries[0])
+	}
+	if entries[1]["status"] != float64(http.StatusTooManyRequests) || entries[1]["php_outcome"] != "short_circuited" || entries[1]["php_reason"] != "rate_limit" {
+		t.Errorf("unexpected access log entry for the rate limited request: %v", entries[1])
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	f := &caddy.FrankenPHPModule{}
+	if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\nrate_limit 10 1m\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if f.RateLimitEvents != 10 || time.Duration(f.RateLimitWindow) != time.Minute {
+		t.Errorf("unexpected rate limit: %d %v", f.RateLimitEvents, f.RateLimitWindow)
+	}
+
+	for _, input := range []string{"10", "0 1m", "10 0", "foo 1m", "10 foo"} {
+		f := &caddy.FrankenPHPModule{}
+		if err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("php {\nrate_limit " + input + "\n}")); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func BenchmarkEnv(b *testing.B) {
+	// most env values are static, a few of them contain placeholders
+	var globalEnv, handlerEnv strings.Builder
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&globalEnv, "env GLOBAL_%d value%d\n", i, i)
+		fmt.Fprintf(&handlerEnv, "env HANDLER_%d value%d\n", i, i)
+	}
+	handlerEnv.WriteString("env HOST {http.request.host}\nenv DB_PORT {env.FRANKENPHP_BENCH_DB_PORT:-3306}\n")
+
+	cfg, _, err := caddyconfig.GetAdapter("caddyfile").Adapt([]byte(fmt.Sprintf(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp {
+				%s
+			}
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+					%s
+				}
+			}
+		}
+		`, globalEnv.String(), handlerEnv.String())), map[string]any{"filename": "Caddyfile"})
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := caddy2.Load(cfg, true); err != nil {
+		b.Fatal(err)
+	}
+	defer caddy2.Stop()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		resp, err := http.Get("http://localhost:9080/env-var.php?name=HOST")
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
 }
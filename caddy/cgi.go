@@ -0,0 +1,69 @@
+package caddy
+
+import (
+	"net/http"
+	"net/http/cgi"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// serveExternal passes the request to the external PHP interpreter configured with php_binary
+// (e.g. the php-cgi binary of another PHP version), using the CGI protocol.
+//
+// The options specific to the embedded interpreter (workers, php.ini overrides...) don't apply.
+func (f FrankenPHPModule) serveExternal(w http.ResponseWriter, r *http.Request, documentRoot, scriptName, scriptFilename string, env map[string]string) error {
+	documentRoot, err := filepath.Abs(documentRoot)
+	if err != nil {
+		return err
+	}
+
+	h := cgi.Handler{
+		Path: f.PHPBinary,
+		// SCRIPT_NAME is set to Root, and PATH_INFO to the rest of the path
+		Root:   scriptName,
+		Dir:    documentRoot,
+		Logger: zap.NewStdLog(f.logger),
+		Env: []string{
+			"SCRIPT_FILENAME=" + scriptFilename,
+			"DOCUMENT_ROOT=" + documentRoot,
+			// required by php-cgi when cgi.force_redirect is enabled
+			"REDIRECT_STATUS=200",
+		},
+	}
+	for k, v := range env {
+		h.Env = append(h.Env, k+"="+v)
+	}
+
+	if len(f.ForwardHeaders) > 0 || len(f.HideHeaders) > 0 {
+		r = r.Clone(r.Context())
+		for field := range r.Header {
+			if !f.forwardsHeader(field) {
+				r.Header.Del(field)
+			}
+		}
+	}
+
+	h.ServeHTTP(w, r)
+
+	return nil
+}
+
+var headerNameReplacer = strings.NewReplacer(" ", "_", "-", "_")
+
+// forwardsHeader reports whether the given request header is passed to PHP.
+// Headers are compared by CGI variable name: X-Foo and X_Foo both become HTTP_X_FOO.
+func (f FrankenPHPModule) forwardsHeader(field string) bool {
+	name := headerNameReplacer.Replace(strings.ToUpper(field))
+	matches := func(h string) bool {
+		return headerNameReplacer.Replace(strings.ToUpper(h)) == name
+	}
+
+	if slices.ContainsFunc(f.HideHeaders, matches) {
+		return false
+	}
+
+	return len(f.ForwardHeaders) == 0 || slices.ContainsFunc(f.ForwardHeaders, matches)
+}
@@ -0,0 +1,88 @@
+package caddy
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+)
+
+// coalescedHeaders are the request headers that may change the response, in addition to the method and the URI.
+// Requests differing by one of them are never coalesced.
+var coalescedHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language", "Authorization", "Cookie"}
+
+// coalesceKey returns the key identifying the requests sharing the same response.
+// requestURI is the URI originally requested, r may have been rewritten.
+func coalesceKey(r *http.Request, requestURI string) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte(' ')
+	b.WriteString(r.Host)
+	b.WriteString(requestURI)
+	b.WriteByte(' ')
+	b.WriteString(r.URL.Path)
+	for _, h := range coalescedHeaders {
+		b.WriteByte('\n')
+		b.WriteString(strings.Join(r.Header.Values(h), ","))
+	}
+
+	return b.String()
+}
+
+// isShareable reports whether a response having the given headers can be sent to other clients than the one it was generated for:
+// it doesn't set cookies (e.g. a new session ID) and doesn't forbid shared caching.
+func isShareable(h http.Header) bool {
+	if len(h.Values("Set-Cookie")) > 0 {
+		return false
+	}
+
+	cacheControl := strings.ToLower(strings.Join(h.Values("Cache-Control"), ","))
+
+	return !strings.Contains(cacheControl, "no-store") && !strings.Contains(cacheControl, "private")
+}
+
+// coalescedResponse buffers a response to send it to all the coalesced requests.
+type coalescedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newCoalescedResponse() *coalescedResponse {
+	return &coalescedResponse{header: make(http.Header)}
+}
+
+func (cr *coalescedResponse) Header() http.Header {
+	return cr.header
+}
+
+func (cr *coalescedResponse) WriteHeader(status int) {
+	if cr.status == 0 && !isInformational(status) {
+		cr.status = status
+	}
+}
+
+func (cr *coalescedResponse) Write(b []byte) (int, error) {
+	if cr.status == 0 {
+		cr.status = http.StatusOK
+	}
+
+	return cr.body.Write(b)
+}
+
+// Flush is a no-op: the response is sent once complete.
+func (cr *coalescedResponse) Flush() {}
+
+// writeTo sends a copy of the response to w.
+func (cr *coalescedResponse) writeTo(w http.ResponseWriter) error {
+	for k, v := range cr.header {
+		w.Header()[k] = append(w.Header()[k], v...)
+	}
+
+	if cr.status != 0 {
+		w.WriteHeader(cr.status)
+	}
+
+	_, err := w.Write(cr.body.Bytes())
+
+	return err
+}
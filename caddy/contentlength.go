@@ -0,0 +1,115 @@
+package caddy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// maxFixedContentLength is the largest Content-Length declared by PHP for which the response is buffered to be checked,
+// the larger responses are streamed with the declared length.
+const maxFixedContentLength = 1 << 20
+
+// contentLengthWriter ensures the Content-Length header set by PHP matches the length of the body.
+// The responses are buffered up to the declared length: the header is fixed if the body is shorter,
+// and the response is streamed without it, chunked, as soon as the body is longer or is flushed.
+type contentLengthWriter struct {
+	responseWrapper
+	logger *zap.Logger
+	method string
+
+	declared  int64
+	buf       bytes.Buffer
+	written   int64
+	buffering bool
+}
+
+func (cw *contentLengthWriter) WriteHeader(status int) {
+	if !cw.final(status) {
+		return
+	}
+
+	declared, err := strconv.ParseInt(cw.Header().Get("Content-Length"), 10, 64)
+	// the responses to HEAD requests and without body legitimately have a Content-Length not matching their body
+	if err != nil || declared < 0 || declared > maxFixedContentLength || cw.method == http.MethodHead || status == http.StatusNoContent || status == http.StatusNotModified {
+		cw.declared = -1
+		cw.ResponseWriterWrapper.WriteHeader(status)
+
+		return
+	}
+
+	cw.Header().Del("Content-Length")
+	cw.declared = declared
+	cw.buffering = true
+}
+
+func (cw *contentLengthWriter) Write(d []byte) (int, error) {
+	cw.writeStatus()
+
+	cw.written += int64(len(d))
+	if !cw.buffering {
+		return cw.ResponseWriterWrapper.Write(d)
+	}
+
+	n, _ := cw.buf.Write(d)
+	if cw.written > cw.declared {
+		cw.logger.Warn("the Content-Length set by PHP is lower than the length of the body, sending it chunked", zap.Int64("content_length", cw.declared))
+
+		if err := cw.stream(); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// stream sends the buffered beginning of the body without Content-Length, the rest of the response isn't buffered.
+func (cw *contentLengthWriter) stream() error {
+	cw.buffering = false
+	cw.ResponseWriterWrapper.WriteHeader(cw.status)
+	_, err := cw.ResponseWriterWrapper.Write(cw.buf.Bytes())
+	cw.buf = bytes.Buffer{}
+
+	return err
+}
+
+// FlushError streams the response, its length can't be checked anymore.
+func (cw *contentLengthWriter) FlushError() error {
+	if cw.status == 0 {
+		return nil
+	}
+	if cw.buffering {
+		if err := cw.stream(); err != nil {
+			return err
+		}
+	}
+
+	return cw.responseWrapper.FlushError()
+}
+
+// finish writes the buffered response with the actual Content-Length.
+func (cw *contentLengthWriter) finish() error {
+	if !cw.buffering {
+		return nil
+	}
+
+	if cw.written != cw.declared {
+		cw.logger.Warn("the Content-Length set by PHP is greater than the length of the body, fixing it", zap.Int64("content_length", cw.declared), zap.Int64("body_length", cw.written))
+	}
+
+	cw.buffering = false
+	cw.Header().Set("Content-Length", strconv.FormatInt(cw.written, 10))
+	cw.ResponseWriterWrapper.WriteHeader(cw.status)
+	_, err := cw.ResponseWriterWrapper.Write(cw.buf.Bytes())
+
+	return err
+}
+
+// Interface guards
+var (
+	_ http.ResponseWriter = (*contentLengthWriter)(nil)
+	_ io.ReaderFrom       = (*contentLengthWriter)(nil)
+)
@@ -0,0 +1,81 @@
+package caddy
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// CookieDefaultsConfig configures the attributes added to the cookies set by PHP when they don't set them explicitly.
+type CookieDefaultsConfig struct {
+	// Secure adds the `Secure` attribute.
+	Secure bool `json:"secure,omitempty"`
+	// HTTPOnly adds the `HttpOnly` attribute.
+	HTTPOnly bool `json:"http_only,omitempty"`
+	// SameSite adds the `SameSite` attribute with the given value: `Lax`, `Strict` or `None`. `None` requires Secure.
+	SameSite string `json:"same_site,omitempty"`
+}
+
+func (c *CookieDefaultsConfig) validate() error {
+	switch c.SameSite {
+	case "", "Lax", "Strict":
+	case "None":
+		if !c.Secure {
+			return errors.New("cookie_defaults: same_site None requires secure")
+		}
+	default:
+		return errors.New(`cookie_defaults: same_site must be "Lax", "Strict" or "None"`)
+	}
+
+	if !c.Secure && !c.HTTPOnly && c.SameSite == "" {
+		return errors.New("cookie_defaults: at least one attribute must be set")
+	}
+
+	return nil
+}
+
+// apply adds the missing attributes to every Set-Cookie header.
+func (c *CookieDefaultsConfig) apply(h http.Header) {
+	cookies := h.Values("Set-Cookie")
+	for i, cookie := range cookies {
+		cookies[i] = c.applyCookie(cookie)
+	}
+}
+
+// applyCookie adds the missing attributes to the value of a Set-Cookie header.
+// The attributes set explicitly, whatever their case and value, are kept untouched.
+func (c *CookieDefaultsConfig) applyCookie(cookie string) string {
+	if strings.TrimSpace(cookie) == "" {
+		return cookie
+	}
+
+	var secure, httpOnly, sameSite bool
+
+	// the first part is the name and the value of the cookie, they can't contain semicolons
+	parts := strings.Split(cookie, ";")
+	for _, part := range parts[1:] {
+		name, _, _ := strings.Cut(part, "=")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "secure":
+			secure = true
+		case "httponly":
+			httpOnly = true
+		case "samesite":
+			sameSite = true
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(strings.TrimRight(cookie, "; "))
+	if c.Secure && !secure {
+		b.WriteString("; Secure")
+	}
+	if c.HTTPOnly && !httpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	if c.SameSite != "" && !sameSite {
+		b.WriteString("; SameSite=" + c.SameSite)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,108 @@
+package caddy
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// defaultCORSMethods are the methods allowed in cross-origin requests when none are configured, the CORS-safelisted ones.
+var defaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+
+// CORSConfig configures the Cross-Origin Resource Sharing headers of the php handler.
+type CORSConfig struct {
+	// AllowOrigins lists the origins allowed to make cross-origin requests (e.g. `https://example.com`), `*` allows all the origins.
+	AllowOrigins []string `json:"allow_origins,omitempty"`
+	// AllowMethods lists the methods allowed in cross-origin requests. Default: GET, HEAD and POST.
+	AllowMethods []string `json:"allow_methods,omitempty"`
+	// AllowHeaders lists the request headers allowed in cross-origin requests, `*` allows all the headers.
+	AllowHeaders []string `json:"allow_headers,omitempty"`
+	// AllowCredentials allows the cross-origin requests to include credentials (e.g. cookies). It can't be used when all the origins are allowed.
+	AllowCredentials bool `json:"allow_credentials,omitempty"`
+	// MaxAge sets how long the results of the preflight requests can be cached by the clients. Default: the clients' default.
+	MaxAge caddy.Duration `json:"max_age,omitempty"`
+}
+
+func (c *CORSConfig) validate() error {
+	if len(c.AllowOrigins) == 0 {
+		return errors.New("cors: at least one origin must be allowed")
+	}
+	if c.AllowCredentials && slices.Contains(c.AllowOrigins, "*") {
+		return errors.New("cors: credentials can't be allowed for all the origins")
+	}
+	if c.MaxAge < 0 {
+		return errors.New("cors: max_age must be positive")
+	}
+
+	return nil
+}
+
+// allowedOrigin returns the value of the Access-Control-Allow-Origin header for the given origin,
+// or an empty string if it isn't allowed.
+func (c *CORSConfig) allowedOrigin(origin string) string {
+	for _, o := range c.AllowOrigins {
+		if o == "*" {
+			return "*"
+		}
+		if strings.EqualFold(o, origin) {
+			return origin
+		}
+	}
+
+	return ""
+}
+
+// handle adds the CORS headers to the response of a cross-origin request, and answers the preflight requests.
+// It reports whether the request has been answered, in which case PHP must not be invoked.
+func (c *CORSConfig) handle(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	if preflight {
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+	}
+
+	allowedOrigin := c.allowedOrigin(origin)
+	if allowedOrigin != "" {
+		h.Set("Access-Control-Allow-Origin", allowedOrigin)
+		if c.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+	}
+
+	if !preflight {
+		return false
+	}
+
+	// the clients reject the preflight responses without the CORS headers
+	if allowedOrigin != "" {
+		methods := c.AllowMethods
+		if len(methods) == 0 {
+			methods = defaultCORSMethods
+		}
+		h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+
+		if len(c.AllowHeaders) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowHeaders, ", "))
+		}
+		if c.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(time.Duration(c.MaxAge)/time.Second)))
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return true
+}
@@ -0,0 +1,56 @@
+package caddy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// defaultMaxDecompressedBody is the default maximum size of the decompressed request bodies, in bytes.
+const defaultMaxDecompressedBody = 10 << 20
+
+// decompressRequest replaces the gzip or deflate encoded body of r by its decoded content, and updates the Content-Length header accordingly.
+// The body is decoded in memory, up to maxSize bytes: the larger bodies (e.g. decompression bombs) are rejected with a 413 error.
+func decompressRequest(r *http.Request, maxSize int64) error {
+	var newReader func(io.Reader) (io.ReadCloser, error)
+	switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return nil
+	case "gzip", "x-gzip":
+		newReader = func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) }
+	case "deflate":
+		newReader = zlib.NewReader
+	default:
+		return caddyhttp.Error(http.StatusUnsupportedMediaType, fmt.Errorf("unsupported request content encoding %q", encoding))
+	}
+
+	zr, err := newReader(r.Body)
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid encoded request body: %w", err))
+	}
+	defer zr.Close()
+
+	body, err := io.ReadAll(io.LimitReader(zr, maxSize+1))
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid encoded request body: %w", err))
+	}
+	if int64(len(body)) > maxSize {
+		return caddyhttp.Error(http.StatusRequestEntityTooLarge, errors.New("the decompressed request body exceeds the limit"))
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.TransferEncoding = nil
+	r.Header.Del("Content-Encoding")
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package caddy
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// envDefaultSeparator separates the name of a placeholder from its default value, as in {env.DB_HOST:-localhost}.
+const envDefaultSeparator = ":-"
+
+// replaceEnv replaces the placeholders of an env value, like caddy.Replacer.ReplaceKnown,
+// but also supports default values used when the placeholder is unknown or empty (e.g. {env.DB_HOST:-localhost}),
+// and placeholders nested in names and default values (e.g. {env.DB_HOST:-{env.DEFAULT_HOST}}).
+func replaceEnv(repl *caddy.Replacer, input string) string {
+	if !strings.Contains(input, "{") {
+		return input
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(input))
+
+	for i := 0; i < len(input); i++ {
+		c := input[i]
+
+		// escaped braces are kept as is
+		if c == '\\' && i+1 < len(input) && (input[i+1] == '{' || input[i+1] == '}') {
+			sb.WriteString(input[i : i+2])
+			i++
+
+			continue
+		}
+
+		if c != '{' {
+			sb.WriteByte(c)
+
+			continue
+		}
+
+		end := closingBrace(input, i)
+		if end < 0 {
+			// unclosed placeholder
+			sb.WriteString(input[i:])
+
+			break
+		}
+
+		sb.WriteString(replacePlaceholder(repl, input[i+1:end]))
+		i = end
+	}
+
+	// let the replacer unescape the braces and handle the placeholders the loop didn't
+	return repl.ReplaceKnown(sb.String(), "")
+}
+
+// replacePlaceholder returns the value of the placeholder having the given content, without the braces.
+// Unknown placeholders without default value are returned unchanged, escaped to not be replaced again.
+func replacePlaceholder(repl *caddy.Replacer, placeholder string) string {
+	name, def, hasDefault := strings.Cut(placeholder, envDefaultSeparator)
+	name = replaceEnv(repl, name)
+
+	if val, found := repl.Get(name); found {
+		if s := caddy.ToString(val); s != "" || !hasDefault {
+			return escapeBraces(s)
+		}
+	}
+	if hasDefault {
+		return escapeBraces(replaceEnv(repl, def))
+	}
+
+	return escapeBraces("{" + name + "}")
+}
+
+// closingBrace returns the index of the brace closing the one at start, taking nested braces into account, or -1.
+func closingBrace(input string, start int) int {
+	depth := 0
+	for i := start; i < len(input); i++ {
+		switch {
+		case input[i] == '\\' && i+1 < len(input) && (input[i+1] == '{' || input[i+1] == '}'):
+			i++
+		case input[i] == '{':
+			depth++
+		case input[i] == '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+var braceEscaper = strings.NewReplacer("{", `\{`, "}", `\}`)
+
+// escapeBraces prevents the final ReplaceKnown call from interpreting the braces of already replaced values.
+func escapeBraces(s string) string {
+	return braceEscaper.Replace(s)
+}
+
+// warnEnvConflicts logs the environment variables of the lower precedence layer overridden with a different value by the higher precedence one,
+// so that the configuration errors don't go unnoticed when strict_env is set.
+func warnEnvConflicts(logger *zap.Logger, lowerName string, lower map[string]string, higherName string, higher map[string]string) {
+	keys := make([]string, 0, len(higher))
+	for k := range higher {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		if v, ok := lower[k]; ok && v != higher[k] {
+			logger.Warn("environment variable overridden", zap.String("name", k), zap.String("overridden", lowerName), zap.String("by", higherName))
+		}
+	}
+}
+
+// workerServedBy reports whether the worker script fileName may handle the requests of a handler having the given root.
+// The paths containing placeholders, only known at runtime, are assumed to match.
+func workerServedBy(fileName, root string) bool {
+	if strings.Contains(fileName, "{") || strings.Contains(root, "{") {
+		return true
+	}
+
+	absFileName, err := filepath.Abs(fileName)
+	if err != nil {
+		return true
+	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return true
+	}
+
+	return strings.HasPrefix(absFileName, absRoot+string(filepath.Separator))
+}
+
+// splitEnv merges the layers of environment variables, the last ones having priority,
+// and separates the static values from the ones containing placeholders, which must be replaced for every request.
+func splitEnv(layers ...map[string]string) (static, dynamic map[string]string) {
+	static = make(map[string]string)
+	dynamic = make(map[string]string)
+	for _, layer := range layers {
+		for k, v := range layer {
+			if strings.Contains(v, "{") {
+				dynamic[k] = v
+				delete(static, k)
+			} else {
+				static[k] = v
+				delete(dynamic, k)
+			}
+		}
+	}
+
+	return static, dynamic
+}
+
+// envMapPool reuses the maps holding the environment variables of the requests, to save their allocation and growth.
+var envMapPool = sync.Pool{
+	New: func() any {
+		return make(map[string]string, 32)
+	},
+}
+
+func getEnvMap() map[string]string {
+	return envMapPool.Get().(map[string]string)
+}
+
+// putEnvMap must only be called once the request has been handled, the map must not be used anymore.
+func putEnvMap(env map[string]string) {
+	clear(env)
+	envMapPool.Put(env)
+}
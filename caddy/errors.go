@@ -0,0 +1,75 @@
+package caddy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// writeHandlerError renders an error returned before PHP is invoked using the configured error_format.
+// The details of the error may leak internal information (e.g. paths), only the status text is sent to the client.
+func (f FrankenPHPModule) writeHandlerError(w http.ResponseWriter, err error) error {
+	status := http.StatusInternalServerError
+	var he caddyhttp.HandlerError
+	if errors.As(err, &he) && he.StatusCode != 0 {
+		status = he.StatusCode
+	}
+
+	// as the error isn't returned to Caddy anymore, it wouldn't be logged
+	if status >= 500 {
+		f.logger.Error("unable to handle the request", zap.Int("status", status), zap.Error(err))
+	} else {
+		f.logger.Debug("unable to handle the request", zap.Int("status", status), zap.Error(err))
+	}
+
+	renderError(w, f.ErrorFormat, status, http.StatusText(status))
+
+	return nil
+}
+
+// writeError writes an error response with the given message using the configured error_format,
+// or as http.Error does when it isn't set.
+func (f FrankenPHPModule) writeError(w http.ResponseWriter, status int, message string) {
+	if f.ErrorFormat == "" {
+		http.Error(w, message, status)
+
+		return
+	}
+
+	renderError(w, f.ErrorFormat, status, message)
+}
+
+// renderError writes an error response with the given message in the given format: json, html or plain.
+func renderError(w http.ResponseWriter, format string, status int, message string) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("X-Content-Type-Options", "nosniff")
+
+	var body string
+	switch format {
+	case "json":
+		b, _ := json.Marshal(struct {
+			Status int    `json:"status"`
+			Error  string `json:"error"`
+		}{status, message})
+
+		h.Set("Content-Type", "application/json")
+		body = string(b) + "\n"
+	case "html":
+		title := html.EscapeString(fmt.Sprintf("%d %s", status, http.StatusText(status)))
+
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		body = fmt.Sprintf("<!DOCTYPE html>\n<html><head><title>%s</title></head><body><h1>%s</h1><p>%s</p></body></html>\n", title, title, html.EscapeString(message))
+	default:
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		body = fmt.Sprintf("%d %s\n", status, message)
+	}
+
+	w.WriteHeader(status)
+	fmt.Fprint(w, body)
+}
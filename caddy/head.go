@@ -0,0 +1,153 @@
+package caddy
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultHeadCacheTTL is how long the headers of a GET response answer the HEAD requests by default, with head_optimization cache.
+const defaultHeadCacheTTL = 10 * time.Second
+
+// maxHeadCacheEntries bounds the number of responses whose headers are cached.
+const maxHeadCacheEntries = 10000
+
+// headCacheKey returns the key identifying the GET and HEAD requests having the same headers,
+// as coalesceKey does, regardless of the method.
+func headCacheKey(r *http.Request, requestURI string) string {
+	return strings.TrimPrefix(coalesceKey(r, requestURI), r.Method)
+}
+
+// headWriter discards the body of the responses to HEAD requests and sends their headers once PHP is done,
+// with a Content-Length header matching the discarded body if PHP didn't set one.
+type headWriter struct {
+	responseWrapper
+	length int64
+}
+
+// WriteHeader records the status, it is sent once PHP is done.
+func (hw *headWriter) WriteHeader(status int) {
+	hw.final(status)
+}
+
+func (hw *headWriter) Write(d []byte) (int, error) {
+	hw.writeStatus()
+	hw.length += int64(len(d))
+
+	return len(d), nil
+}
+
+// FlushError is a no-op: the headers are sent once PHP is done.
+func (hw *headWriter) FlushError() error {
+	return nil
+}
+
+// finish sends the headers of the response.
+func (hw *headWriter) finish() {
+	hw.writeStatus()
+
+	h := hw.Header()
+	if h.Get("Content-Length") == "" && h.Get("Transfer-Encoding") == "" && hw.status != http.StatusNoContent && hw.status != http.StatusNotModified {
+		h.Set("Content-Length", strconv.FormatInt(hw.length, 10))
+	}
+
+	hw.ResponseWriterWrapper.WriteHeader(hw.status)
+}
+
+// headRecorder records the headers and the length of the responses to GET requests, to answer the following HEAD requests.
+type headRecorder struct {
+	responseWrapper
+	header http.Header
+	length int64
+}
+
+func (hr *headRecorder) WriteHeader(status int) {
+	if hr.final(status) {
+		hr.header = hr.Header().Clone()
+		hr.ResponseWriterWrapper.WriteHeader(status)
+	}
+}
+
+func (hr *headRecorder) Write(d []byte) (int, error) {
+	n, err := hr.responseWrapper.Write(d)
+	hr.length += int64(n)
+
+	return n, err
+}
+
+// cacheableHeader returns the headers to answer the HEAD requests with, if the response can be cached:
+// the successful responses not setting cookies and not forbidding shared caching.
+func (hr *headRecorder) cacheableHeader() (http.Header, bool) {
+	if hr.status != http.StatusOK || !isShareable(hr.header) {
+		return nil, false
+	}
+
+	h := hr.header
+	if h.Get("Content-Length") == "" {
+		h.Set("Content-Length", strconv.FormatInt(hr.length, 10))
+	}
+
+	return h, true
+}
+
+// headCache caches the headers of the GET responses to answer the HEAD requests without invoking PHP.
+type headCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]headCacheEntry
+}
+
+type headCacheEntry struct {
+	header  http.Header
+	expires time.Time
+}
+
+func newHeadCache(ttl time.Duration) *headCache {
+	return &headCache{ttl: ttl, entries: make(map[string]headCacheEntry)}
+}
+
+// get returns the cached headers for key, if they haven't expired.
+func (c *headCache) get(key string, now time.Time) (http.Header, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok || !now.Before(e.expires) {
+		return nil, false
+	}
+
+	return e.header, true
+}
+
+// set caches the headers for key, the expired entries are removed when the cache is full.
+func (c *headCache) set(key string, header http.Header, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxHeadCacheEntries {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+
+		// the new entry isn't cached until some entries expire
+		if len(c.entries) >= maxHeadCacheEntries {
+			return
+		}
+	}
+
+	c.entries[key] = headCacheEntry{header: header, expires: now.Add(c.ttl)}
+}
+
+// Interface guards
+var (
+	_ http.ResponseWriter = (*headWriter)(nil)
+	_ io.ReaderFrom       = (*headWriter)(nil)
+	_ http.ResponseWriter = (*headRecorder)(nil)
+	_ io.ReaderFrom       = (*headRecorder)(nil)
+)
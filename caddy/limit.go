@@ -0,0 +1,107 @@
+package caddy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// responseLimitWriter enforces the maximum size of the bodies of the responses not streamed.
+// When abort is set, the responses are buffered up to the limit, so that a 500 error can be returned instead
+// of the responses exceeding it; otherwise they are only logged.
+type responseLimitWriter struct {
+	responseWrapper
+	limit       int64
+	abort       bool
+	streamTypes []string
+	logger      *zap.Logger
+
+	written  int64
+	buf      bytes.Buffer
+	limited  bool
+	exceeded bool
+}
+
+func (lw *responseLimitWriter) WriteHeader(status int) {
+	if !lw.final(status) {
+		return
+	}
+
+	// the explicitly streamed responses aren't limited
+	mediaType, _, _ := mime.ParseMediaType(lw.Header().Get("Content-Type"))
+	lw.limited = !slices.Contains(lw.streamTypes, mediaType)
+	if !lw.limited || !lw.abort {
+		lw.ResponseWriterWrapper.WriteHeader(status)
+	}
+}
+
+func (lw *responseLimitWriter) Write(d []byte) (int, error) {
+	lw.writeStatus()
+	if !lw.limited {
+		return lw.ResponseWriterWrapper.Write(d)
+	}
+
+	lw.written += int64(len(d))
+	if !lw.exceeded && lw.written > lw.limit {
+		lw.exceeded = true
+		lw.logger.Warn("PHP response too large", zap.Int64("max_response_bytes", lw.limit), zap.Bool("aborted", lw.abort))
+
+		// the buffered beginning of the response is discarded
+		lw.buf = bytes.Buffer{}
+	}
+
+	if !lw.abort {
+		return lw.ResponseWriterWrapper.Write(d)
+	}
+	if lw.exceeded {
+		return len(d), nil
+	}
+
+	return lw.buf.Write(d)
+}
+
+// FlushError is a no-op while the body is buffered.
+func (lw *responseLimitWriter) FlushError() error {
+	if lw.status == 0 || (lw.limited && lw.abort) {
+		return nil
+	}
+
+	return lw.responseWrapper.FlushError()
+}
+
+// finish writes the buffered response, or returns a 500 error if it exceeded the limit.
+func (lw *responseLimitWriter) finish() error {
+	if !lw.limited || !lw.abort {
+		return nil
+	}
+
+	if lw.exceeded {
+		// the headers describing the discarded body must not be sent with the error
+		h := lw.Header()
+		for k := range h {
+			if strings.HasPrefix(k, "Content-") || k == "Trailer" {
+				h.Del(k)
+			}
+		}
+
+		return caddyhttp.Error(http.StatusInternalServerError, errors.New("the PHP response exceeds max_response_bytes"))
+	}
+
+	lw.ResponseWriterWrapper.WriteHeader(lw.status)
+	_, err := lw.ResponseWriterWrapper.Write(lw.buf.Bytes())
+
+	return err
+}
+
+// Interface guards
+var (
+	_ http.ResponseWriter = (*responseLimitWriter)(nil)
+	_ io.ReaderFrom       = (*responseLimitWriter)(nil)
+)
@@ -0,0 +1,146 @@
+package caddy
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/dunglas/frankenphp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(statsCollector{})
+}
+
+var (
+	workerFileNamesMu sync.RWMutex
+	// workerFileNames are the worker scripts started by the running app
+	workerFileNames []string
+	// daemonFileNames are the worker scripts running as daemons
+	daemonFileNames []string
+	// workerNums are the number of instances configured for the worker scripts, standby instances excluded
+	workerNums map[string]int
+)
+
+// setWorkerFileNames records the worker scripts started by the app, those running as daemons, and their number of instances, to report their statistics.
+func setWorkerFileNames(fileNames, daemons []string, nums map[string]int) {
+	workerFileNamesMu.Lock()
+	defer workerFileNamesMu.Unlock()
+
+	workerFileNames = fileNames
+	daemonFileNames = daemons
+	workerNums = nums
+}
+
+// findWorkerFileName returns the file name of the worker started by the running app matching name: its file name or, if unambiguous, its base name.
+func findWorkerFileName(name string) (string, error) {
+	workerFileNamesMu.RLock()
+	defer workerFileNamesMu.RUnlock()
+
+	var found []string
+	for _, fileName := range workerFileNames {
+		if fileName == name {
+			return fileName, nil
+		}
+		if filepath.Base(fileName) == name {
+			found = append(found, fileName)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("unknown worker %q", name)
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("ambiguous worker name %q, use the file name of the worker: %s", name, strings.Join(found, ", "))
+	}
+}
+
+// workerStats contains the statistics of a worker script.
+type workerStats struct {
+	FileName string `json:"file_name"`
+	// QueueDepth is the number of requests waiting for an instance of the worker
+	QueueDepth int `json:"queue_depth"`
+	// Standby is the number of standby instances waiting to take over from a crashed instance
+	Standby int `json:"standby"`
+	// Daemon reports whether the worker runs as a daemon, without handling requests
+	Daemon bool `json:"daemon"`
+	// Restarts is the number of times the instances of the worker have been restarted after exiting or crashing
+	Restarts int `json:"restarts"`
+}
+
+// readWorkerStats returns the statistics of the worker scripts started by the running app.
+func readWorkerStats() []workerStats {
+	workerFileNamesMu.RLock()
+	defer workerFileNamesMu.RUnlock()
+
+	stats := make([]workerStats, 0, len(workerFileNames))
+	for _, fileName := range workerFileNames {
+		stats = append(stats, workerStats{
+			FileName:   fileName,
+			QueueDepth: frankenphp.WorkerQueueDepth(fileName),
+			Standby:    frankenphp.WorkerStandby(fileName),
+			Daemon:     slices.Contains(daemonFileNames, fileName),
+			Restarts:   frankenphp.WorkerRestarts(fileName),
+		})
+	}
+
+	return stats
+}
+
+var workerQueueDepthDesc = prometheus.NewDesc(
+	"frankenphp_worker_queue_depth",
+	"Number of requests waiting for an instance of the worker to be available.",
+	[]string{"worker"},
+	nil,
+)
+
+var workerStandbyDesc = prometheus.NewDesc(
+	"frankenphp_worker_standby",
+	"Number of standby instances of the worker waiting to take over from a crashed instance.",
+	[]string{"worker"},
+	nil,
+)
+
+var workerRestartsDesc = prometheus.NewDesc(
+	"frankenphp_worker_restarts_total",
+	"Number of times the instances of the worker have been restarted after exiting or crashing.",
+	[]string{"worker"},
+	nil,
+)
+
+var totalRequestsDesc = prometheus.NewDesc(
+	"frankenphp_requests_total",
+	"Number of requests handled by PHP since the process started.",
+	nil,
+	nil,
+)
+
+// statsCollector exposes the statistics of FrankenPHP and of the workers as Prometheus metrics.
+type statsCollector struct{}
+
+func (statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- workerQueueDepthDesc
+	ch <- workerStandbyDesc
+	ch <- workerRestartsDesc
+	ch <- totalRequestsDesc
+}
+
+func (statsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range readWorkerStats() {
+		ch <- prometheus.MustNewConstMetric(workerQueueDepthDesc, prometheus.GaugeValue, float64(s.QueueDepth), s.FileName)
+		ch <- prometheus.MustNewConstMetric(workerStandbyDesc, prometheus.GaugeValue, float64(s.Standby), s.FileName)
+		ch <- prometheus.MustNewConstMetric(workerRestartsDesc, prometheus.CounterValue, float64(s.Restarts), s.FileName)
+	}
+
+	ch <- prometheus.MustNewConstMetric(totalRequestsDesc, prometheus.CounterValue, float64(frankenphp.TotalRequests()))
+}
+
+// Interface guards
+var (
+	_ prometheus.Collector = (*statsCollector)(nil)
+)
@@ -0,0 +1,71 @@
+package caddy
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// maxRateLimitedClients bounds the number of clients tracked by a rate limiter,
+// the least recently seen clients are forgotten first.
+const maxRateLimitedClients = 10000
+
+// rateLimiter is a token bucket per client: each client can make up to events requests per window,
+// the tokens being refilled continuously.
+type rateLimiter struct {
+	events     int
+	window     time.Duration
+	maxClients int
+
+	mu sync.Mutex
+	// clients are ordered from the most to the least recently seen
+	clients *list.List
+	buckets map[string]*list.Element
+}
+
+type rateLimitBucket struct {
+	client string
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(events int, window time.Duration, maxClients int) *rateLimiter {
+	return &rateLimiter{
+		events:     events,
+		window:     window,
+		maxClients: maxClients,
+		clients:    list.New(),
+		buckets:    make(map[string]*list.Element),
+	}
+}
+
+// allow reports whether the client can make a request now, and otherwise how long it must wait.
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rate := float64(l.events) / float64(l.window)
+
+	var b *rateLimitBucket
+	if e, ok := l.buckets[client]; ok {
+		l.clients.MoveToFront(e)
+		b = e.Value.(*rateLimitBucket)
+		b.tokens = min(float64(l.events), b.tokens+float64(now.Sub(b.last))*rate)
+		b.last = now
+	} else {
+		if l.clients.Len() >= l.maxClients {
+			delete(l.buckets, l.clients.Remove(l.clients.Back()).(*rateLimitBucket).client)
+		}
+
+		b = &rateLimitBucket{client: client, tokens: float64(l.events), last: now}
+		l.buckets[client] = l.clients.PushFront(b)
+	}
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate)
+	}
+
+	b.tokens--
+
+	return true, 0
+}
@@ -0,0 +1,44 @@
+package caddy
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// resolveAllowedRoots returns the absolute paths of the allowed roots, with their symbolic links evaluated.
+func resolveAllowedRoots(roots []string) ([]string, error) {
+	resolved := make([]string, 0, len(roots))
+	for _, root := range roots {
+		p, err := filepath.Abs(root)
+		if err == nil {
+			p, err = filepath.EvalSymlinks(p)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("allowed_roots: %w", err)
+		}
+
+		resolved = append(resolved, p)
+	}
+
+	return resolved, nil
+}
+
+// checkAllowedRoot returns an error if the document root, with its symbolic links evaluated,
+// isn't one of the allowed roots or inside one of them.
+func checkAllowedRoot(root string, allowed []string) error {
+	p, err := filepath.Abs(root)
+	if err == nil {
+		p, err = filepath.EvalSymlinks(p)
+	}
+	if err != nil {
+		return fmt.Errorf("root %q: %w", root, err)
+	}
+
+	for _, a := range allowed {
+		if rel, err := filepath.Rel(a, p); err == nil && filepath.IsLocal(rel) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("root %q resolves to %q, outside the allowed roots", root, p)
+}
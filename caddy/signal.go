@@ -0,0 +1,103 @@
+package caddy
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/dunglas/frankenphp"
+	"go.uber.org/zap"
+)
+
+// shutdownSignals are the signals that can be mapped to a shutdown behavior: the ones Caddy leaves unhandled.
+var shutdownSignals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// caddySignals are the signals handled by Caddy: SIGQUIT exits immediately, SIGTERM and SIGINT stop gracefully.
+// Handling them too would race with Caddy to exit the process.
+var caddySignals = []string{"SIGINT", "SIGQUIT", "SIGTERM"}
+
+// parseSignal returns the canonical name of a signal, with or without the SIG prefix (e.g. `USR2` or `SIGUSR2`).
+func parseSignal(name string) (string, error) {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+
+	if slices.Contains(caddySignals, name) {
+		return "", fmt.Errorf("signal %q is already handled by Caddy, use SIGHUP, SIGUSR1 or SIGUSR2", name)
+	}
+	if _, ok := shutdownSignals[name]; !ok {
+		return "", fmt.Errorf("unsupported signal %q, use SIGHUP, SIGUSR1 or SIGUSR2", name)
+	}
+
+	return name, nil
+}
+
+// signalHandler shuts down the process when one of the configured signals is received:
+// gracefully, waiting for the in-flight PHP requests, or immediately, aborting them.
+type signalHandler struct {
+	signals  chan os.Signal
+	graceful map[os.Signal]bool
+	stop     chan struct{}
+}
+
+func newSignalHandler(gracefulSignals, immediateSignals []string) *signalHandler {
+	sh := &signalHandler{
+		signals:  make(chan os.Signal, 1),
+		graceful: make(map[os.Signal]bool, len(gracefulSignals)+len(immediateSignals)),
+		stop:     make(chan struct{}),
+	}
+
+	for _, name := range gracefulSignals {
+		sh.graceful[shutdownSignals[name]] = true
+	}
+	for _, name := range immediateSignals {
+		sh.graceful[shutdownSignals[name]] = false
+	}
+
+	return sh
+}
+
+// start registers the signal handlers.
+func (sh *signalHandler) start(logger *zap.Logger) {
+	signals := make([]os.Signal, 0, len(sh.graceful))
+	for sig := range sh.graceful {
+		signals = append(signals, sig)
+	}
+	signal.Notify(sh.signals, signals...)
+
+	go func() {
+		var sig os.Signal
+		select {
+		case <-sh.stop:
+			return
+		case sig = <-sh.signals:
+		}
+
+		if sh.graceful[sig] {
+			logger.Info("waiting for the in-flight PHP requests, then terminating", zap.Stringer("signal", sig))
+
+			// stopping the apps drains the HTTP servers and the PHP interpreter
+			caddy.Stop()
+			os.Exit(caddy.ExitCodeSuccess)
+		}
+
+		logger.Info("aborting the in-flight PHP requests, then terminating", zap.Stringer("signal", sig))
+		frankenphp.AbortRequests()
+		os.Exit(caddy.ExitCodeForceQuit)
+	}()
+}
+
+// close removes the signal handlers.
+func (sh *signalHandler) close() {
+	signal.Stop(sh.signals)
+	close(sh.stop)
+}
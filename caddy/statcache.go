@@ -0,0 +1,80 @@
+package caddy
+
+import (
+	"container/list"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxStatCacheEntries bounds the number of paths tracked by a stat cache,
+// the least recently used paths are forgotten first.
+const maxStatCacheEntries = 10000
+
+// statCache caches the results of os.Stat for the scripts, including the missing ones,
+// so that the repeated requests to the same script don't hit a slow filesystem.
+type statCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu sync.Mutex
+	// entries are ordered from the most to the least recently used
+	entries *list.List
+	paths   map[string]*list.Element
+}
+
+type statCacheEntry struct {
+	path    string
+	fi      os.FileInfo
+	err     error
+	expires time.Time
+}
+
+func newStatCache(ttl time.Duration, maxEntries int) *statCache {
+	return &statCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    list.New(),
+		paths:      make(map[string]*list.Element),
+	}
+}
+
+// stat returns the cached result of os.Stat for path, calling it if the result is missing or expired.
+func (c *statCache) stat(path string) (os.FileInfo, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	if e, ok := c.paths[path]; ok {
+		entry := e.Value.(*statCacheEntry)
+		if now.Before(entry.expires) {
+			c.entries.MoveToFront(e)
+			c.mu.Unlock()
+
+			return entry.fi, entry.err
+		}
+	}
+	c.mu.Unlock()
+
+	// concurrent misses may stat the same path, the last result wins
+	fi, err := os.Stat(path)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &statCacheEntry{path: path, fi: fi, err: err, expires: now.Add(c.ttl)}
+	if e, ok := c.paths[path]; ok {
+		e.Value = entry
+		c.entries.MoveToFront(e)
+
+		return fi, err
+	}
+
+	c.paths[path] = c.entries.PushFront(entry)
+	if c.entries.Len() > c.maxEntries {
+		oldest := c.entries.Back()
+		c.entries.Remove(oldest)
+		delete(c.paths, oldest.Value.(*statCacheEntry).path)
+	}
+
+	return fi, err
+}
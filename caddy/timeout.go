@@ -0,0 +1,72 @@
+package caddy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// timeoutWriter discards the response once the request timeout is reached, if it hasn't been started yet,
+// so that a 504 error can be returned instead.
+type timeoutWriter struct {
+	responseWrapper
+
+	mu       sync.Mutex
+	started  bool
+	timedOut bool
+}
+
+// timeout is called when the deadline of the request is reached.
+func (tw *timeoutWriter) timeout() {
+	tw.mu.Lock()
+	tw.timedOut = !tw.started
+	tw.mu.Unlock()
+
+	// unblock the pending reads of the request body, if supported by the connection
+	_ = http.NewResponseController(tw.ResponseWriterWrapper).SetReadDeadline(time.Now())
+}
+
+// discarded reports whether the response has been discarded because the request timed out.
+func (tw *timeoutWriter) discarded() bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	return tw.timedOut
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut {
+		return
+	}
+
+	tw.responseWrapper.WriteHeader(status)
+	tw.started = tw.status != 0
+}
+
+func (tw *timeoutWriter) Write(d []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut {
+		return len(d), nil
+	}
+	tw.started = true
+
+	return tw.ResponseWriterWrapper.Write(d)
+}
+
+// FlushError starts the response, unless it has been discarded.
+func (tw *timeoutWriter) FlushError() error {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut {
+		return nil
+	}
+	tw.started = true
+
+	return tw.responseWrapper.FlushError()
+}
@@ -0,0 +1,53 @@
+package caddy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// defaultMaxTrailersBody is the default maximum size of the bodies of the requests declaring trailers, in bytes.
+const defaultMaxTrailersBody = 10 << 20
+
+// readRequestTrailers reads in memory the body of r if the client declared trailers (`Trailer` header), because they are only received after the body,
+// and returns the received trailers. The body is replaced by the buffered one, and the Content-Length header is set accordingly.
+// The bodies larger than maxSize are rejected with a 413 error.
+func readRequestTrailers(r *http.Request, maxSize int64) (http.Header, error) {
+	if len(r.Trailer) == 0 {
+		return nil, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSize+1))
+	if err != nil {
+		return nil, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("error while reading the request body: %w", err))
+	}
+	if int64(len(body)) > maxSize {
+		return nil, caddyhttp.Error(http.StatusRequestEntityTooLarge, errors.New("the body of the request declaring trailers exceeds the limit"))
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.TransferEncoding = nil
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	// the declared trailers not sent by the client have no values
+	trailers := make(http.Header, len(r.Trailer))
+	for field, values := range r.Trailer {
+		if len(values) > 0 {
+			trailers[field] = values
+		}
+	}
+
+	return trailers, nil
+}
+
+// trailerVariableName returns the name of the CGI variable exposing a request trailer.
+func trailerVariableName(field string) string {
+	return "HTTP_TRAILER_" + headerNameReplacer.Replace(strings.ToUpper(field))
+}
@@ -0,0 +1,146 @@
+package caddy
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ResponseTransformer transforms the body of a response generated by PHP, for instance to rewrite the URLs of assets.
+type ResponseTransformer func(body []byte) []byte
+
+// registeredTransformer identifies a registration, the same transformer may be registered several times.
+type registeredTransformer struct {
+	transform ResponseTransformer
+}
+
+var (
+	responseTransformersMu sync.RWMutex
+	responseTransformers   = map[string][]*registeredTransformer{}
+)
+
+// RegisterResponseTransformer registers a transformer applied to the body of the PHP responses
+// having the given media type (e.g. "text/html"). Transformers registered for the same media type
+// are applied in the order of registration. The returned function unregisters the transformer.
+//
+// Transformed responses are buffered: they are not streamed to the client,
+// and their Content-Length header is recomputed.
+func RegisterResponseTransformer(mediaType string, transformer ResponseTransformer) (unregister func()) {
+	responseTransformersMu.Lock()
+	defer responseTransformersMu.Unlock()
+
+	mediaType = strings.ToLower(mediaType)
+	rt := &registeredTransformer{transformer}
+	responseTransformers[mediaType] = append(responseTransformers[mediaType], rt)
+
+	return func() {
+		responseTransformersMu.Lock()
+		defer responseTransformersMu.Unlock()
+
+		registered := slices.DeleteFunc(slices.Clone(responseTransformers[mediaType]), func(r *registeredTransformer) bool { return r == rt })
+		if len(registered) == 0 {
+			delete(responseTransformers, mediaType)
+
+			return
+		}
+
+		responseTransformers[mediaType] = registered
+	}
+}
+
+// hasResponseTransformers reports whether at least one transformer is registered.
+func hasResponseTransformers() bool {
+	responseTransformersMu.RLock()
+	defer responseTransformersMu.RUnlock()
+
+	return len(responseTransformers) > 0
+}
+
+// responseTransformersFor returns the transformers to apply to a response with the given Content-Type header.
+func responseTransformersFor(contentType string) []ResponseTransformer {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+
+	responseTransformersMu.RLock()
+	defer responseTransformersMu.RUnlock()
+
+	var transformers []ResponseTransformer
+	for _, rt := range responseTransformers[mediaType] {
+		transformers = append(transformers, rt.transform)
+	}
+
+	return transformers
+}
+
+// transformWriter buffers the body of the responses having a registered transformer,
+// and writes the transformed body when finish is called.
+type transformWriter struct {
+	responseWrapper
+	transformers []ResponseTransformer
+	buf          bytes.Buffer
+}
+
+func (tw *transformWriter) WriteHeader(status int) {
+	if !tw.final(status) {
+		return
+	}
+
+	tw.transformers = responseTransformersFor(tw.Header().Get("Content-Type"))
+	if tw.transformers == nil {
+		tw.ResponseWriterWrapper.WriteHeader(status)
+
+		return
+	}
+
+	// the length of the body will change
+	tw.Header().Del("Content-Length")
+}
+
+func (tw *transformWriter) Write(d []byte) (int, error) {
+	tw.writeStatus()
+	if tw.transformers == nil {
+		return tw.ResponseWriterWrapper.Write(d)
+	}
+
+	return tw.buf.Write(d)
+}
+
+// FlushError is a no-op while the body is buffered.
+func (tw *transformWriter) FlushError() error {
+	if tw.transformers != nil || tw.status == 0 {
+		return nil
+	}
+
+	return tw.responseWrapper.FlushError()
+}
+
+// finish applies the transformers and writes the buffered response.
+func (tw *transformWriter) finish() error {
+	if tw.transformers == nil {
+		return nil
+	}
+
+	body := tw.buf.Bytes()
+	for _, t := range tw.transformers {
+		body = t(body)
+	}
+
+	tw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	tw.ResponseWriterWrapper.WriteHeader(tw.status)
+	_, err := tw.ResponseWriterWrapper.Write(body)
+
+	return err
+}
+
+// Interface guards
+var (
+	_ http.ResponseWriter = (*transformWriter)(nil)
+	_ io.ReaderFrom       = (*transformWriter)(nil)
+)
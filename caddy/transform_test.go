@@ -0,0 +1,47 @@
+package caddy_test
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddytest"
+	"github.com/dunglas/frankenphp/caddy"
+)
+
+func TestResponseTransformer(t *testing.T) {
+	t.Cleanup(caddy.RegisterResponseTransformer("text/html", func(body []byte) []byte {
+		return bytes.ReplaceAll(body, []byte(`src="/assets/`), []byte(`src="https://cdn.example.com/assets/`))
+	}))
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+
+			frankenphp
+		}
+
+		localhost:9080 {
+			route {
+				php {
+					root ../testdata
+				}
+			}
+		}
+		`, "caddyfile")
+
+	expected := `<img src="https://cdn.example.com/assets/logo.png">`
+	resp, _ := tester.AssertGetResponse("http://localhost:9080/transform.php", http.StatusOK, expected)
+	if resp.Header.Get("Content-Length") != strconv.Itoa(len(expected)) {
+		t.Errorf("unexpected Content-Length %q", resp.Header.Get("Content-Length"))
+	}
+
+	// unregistered transformers aren't applied anymore
+	caddy.RegisterResponseTransformer("text/html", func(body []byte) []byte { return []byte("transformed") })()
+	tester.AssertGetResponse("http://localhost:9080/transform.php", http.StatusOK, expected)
+}
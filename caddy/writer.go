@@ -0,0 +1,83 @@
+package caddy
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// isInformational reports whether status is the status of an informational (1xx) response:
+// it isn't final, the final response follows it.
+func isInformational(status int) bool {
+	return status >= 100 && status <= 199
+}
+
+// responseWrapper is embedded by the writers wrapping the responses generated by PHP, they only override the methods they need.
+// The implicit 200 status and the body copied by ReadFrom go through the methods of the embedding writer.
+type responseWrapper struct {
+	*caddyhttp.ResponseWriterWrapper
+	// self is the writer embedding the wrapper
+	self http.ResponseWriter
+	// status is the status of the final response, 0 until it is written
+	status int
+}
+
+// wrap makes self, the writer embedding rw, wrap w.
+func (rw *responseWrapper) wrap(self, w http.ResponseWriter) {
+	rw.ResponseWriterWrapper = &caddyhttp.ResponseWriterWrapper{ResponseWriter: w}
+	rw.self = self
+}
+
+// final records status and reports whether it is the status of the final response, written for the first time.
+// The informational responses are written right away, the statuses following the final one are ignored.
+func (rw *responseWrapper) final(status int) bool {
+	if rw.status != 0 {
+		return false
+	}
+	if isInformational(status) {
+		rw.ResponseWriterWrapper.WriteHeader(status)
+
+		return false
+	}
+
+	rw.status = status
+
+	return true
+}
+
+func (rw *responseWrapper) WriteHeader(status int) {
+	if rw.final(status) {
+		rw.ResponseWriterWrapper.WriteHeader(status)
+	}
+}
+
+// writeStatus writes the implicit 200 status through the embedding writer, if no status has been written yet.
+func (rw *responseWrapper) writeStatus() {
+	if rw.status == 0 {
+		rw.self.WriteHeader(http.StatusOK)
+	}
+}
+
+func (rw *responseWrapper) Write(d []byte) (int, error) {
+	rw.writeStatus()
+
+	return rw.ResponseWriterWrapper.Write(d)
+}
+
+// ReadFrom ensures the body goes through the Write method of the embedding writer instead of being copied to the underlying writer.
+func (rw *responseWrapper) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{rw.self}, r)
+}
+
+// FlushError flushes the underlying writer.
+// It is the method looked for by http.ResponseController, used to flush the PHP output.
+func (rw *responseWrapper) FlushError() error {
+	return http.NewResponseController(rw.ResponseWriterWrapper).Flush()
+}
+
+// Interface guards
+var (
+	_ http.ResponseWriter = (*responseWrapper)(nil)
+	_ io.ReaderFrom       = (*responseWrapper)(nil)
+)
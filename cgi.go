@@ -6,7 +6,9 @@ import (
 	"net"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type serverKey int
@@ -44,6 +46,14 @@ func allocServerVariable(cArr *[27]*C.char, env map[string]string, serverKey ser
 	cArr[serverKey] = C.CString(val)
 }
 
+// allocOverriddenServerVariable only allocates the variables having a static default value, interned by the C side, when they are overridden.
+func allocOverriddenServerVariable(cArr *[27]*C.char, env map[string]string, serverKey serverKey, envKey string) {
+	if val, ok := env[envKey]; ok {
+		cArr[serverKey] = C.CString(val)
+		delete(env, envKey)
+	}
+}
+
 // computeKnownVariables returns a set of CGI environment variables for the request.
 //
 // TODO: handle this case https://github.com/caddyserver/caddy/issues/3718
@@ -152,9 +162,9 @@ func computeKnownVariables(request *http.Request) (cArr [27]*C.char) {
 	// These values can not be override
 	cArr[contentLength] = C.CString(request.Header.Get("Content-Length"))
 
-	allocServerVariable(&cArr, fc.env, gatewayInterface, "GATEWAY_INTERFACE", "CGI/1.1")
+	allocOverriddenServerVariable(&cArr, fc.env, gatewayInterface, "GATEWAY_INTERFACE")
 	allocServerVariable(&cArr, fc.env, serverProtocol, "SERVER_PROTOCOL", request.Proto)
-	allocServerVariable(&cArr, fc.env, serverSoftware, "SERVER_SOFTWARE", "FrankenPHP")
+	allocOverriddenServerVariable(&cArr, fc.env, serverSoftware, "SERVER_SOFTWARE")
 	allocServerVariable(&cArr, fc.env, httpHost, "HTTP_HOST", request.Host) // added here, since not always part of headers
 
 	return
@@ -188,8 +198,96 @@ var tlsProtocolStrings = map[uint16]string{
 	tls.VersionTLS13: "TLSv1.3",
 }
 
+// tlsClientVariables returns env with the variables describing the verification of the client certificate added,
+// in a manner compatible with apache's mod_ssl: SSL_CLIENT_VERIFY is SUCCESS if the certificate has been verified,
+// FAILED if it hasn't (e.g. when client certificates are requested but not verified) and NONE without certificate,
+// SSL_CLIENT_V_REMAIN is the number of days before the certificate expires. The values set explicitly have priority.
+func tlsClientVariables(env map[string]string, state *tls.ConnectionState) map[string]string {
+	verify := "NONE"
+	var remain string
+	if len(state.PeerCertificates) > 0 {
+		verify = "FAILED"
+		if len(state.VerifiedChains) > 0 {
+			verify = "SUCCESS"
+		}
+
+		remain = strconv.Itoa(max(0, int(time.Until(state.PeerCertificates[0].NotAfter)/(24*time.Hour))))
+	}
+
+	// the map set with WithRequestEnv may be shared between requests
+	e := make(map[string]string, len(env)+2)
+	for k, v := range env {
+		e[k] = v
+	}
+	if _, ok := e["SSL_CLIENT_VERIFY"]; !ok {
+		e["SSL_CLIENT_VERIFY"] = verify
+	}
+	if _, ok := e["SSL_CLIENT_V_REMAIN"]; !ok && remain != "" {
+		e["SSL_CLIENT_V_REMAIN"] = remain
+	}
+
+	return e
+}
+
 var headerNameReplacer = strings.NewReplacer(" ", "_", "-", "_")
 
+// headerVariableName returns the name of the CGI variable of a request header, without the HTTP_ prefix.
+func headerVariableName(field string) string {
+	return headerNameReplacer.Replace(strings.ToUpper(field))
+}
+
+// headerVariableNames returns the set of the CGI variable names of the given request headers, nil if there are none.
+func headerVariableNames(fields []string) map[string]struct{} {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	names := make(map[string]struct{}, len(fields))
+	for _, f := range fields {
+		names[headerVariableName(f)] = struct{}{}
+	}
+
+	return names
+}
+
+// forwardsHeader reports whether the request header having the given CGI variable name is exposed to PHP.
+func (fc *FrankenPHPContext) forwardsHeader(name string) bool {
+	if _, ok := fc.hideHeaders[name]; ok {
+		return false
+	}
+	if fc.forwardHeaders == nil {
+		return true
+	}
+
+	_, ok := fc.forwardHeaders[name]
+
+	return ok
+}
+
+// resolveEnv returns the environment variables of the request: the ones set with WithRequestEnv,
+// overridden by the ones of the worker handling it, if any, then by the ones set with WithRequestEnvOverrides.
+func (fc *FrankenPHPContext) resolveEnv() map[string]string {
+	var workerEnv map[string]string
+	if fc.worker != "" {
+		if v, ok := workerPools.Load(fc.worker); ok {
+			workerEnv = v.(*workerPool).env
+		}
+	}
+	if len(workerEnv) == 0 && len(fc.envOverrides) == 0 {
+		return fc.env
+	}
+
+	// the maps set with the options aren't modified, they may be shared between requests
+	env := make(map[string]string, len(fc.env)+len(workerEnv)+len(fc.envOverrides))
+	for _, layer := range []map[string]string{fc.env, workerEnv, fc.envOverrides} {
+		for k, v := range layer {
+			env[k] = v
+		}
+	}
+
+	return env
+}
+
 // SanitizedPathJoin performs filepath.Join(root, reqPath) that
 // is safe against directory traversal attacks. It uses logic
 // similar to that in the Go standard library, specifically
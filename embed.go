@@ -20,6 +20,10 @@ import (
 // The path of the embedded PHP application (empty if none)
 var EmbeddedAppPath string
 
+// The paths of the named embedded PHP applications, indexed by name: every top-level directory
+// of the embedded application can be used as an application of its own, to embed several of them
+var EmbeddedAppPaths map[string]string
+
 //go:embed app.tar
 var embeddedApp []byte
 
@@ -42,6 +46,18 @@ func init() {
 	}
 
 	EmbeddedAppPath = appPath
+
+	entries, err := os.ReadDir(appPath)
+	if err != nil {
+		panic(err)
+	}
+
+	EmbeddedAppPaths = make(map[string]string, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			EmbeddedAppPaths[e.Name()] = filepath.Join(appPath, e.Name())
+		}
+	}
 }
 
 // untar reads the tar file from r and writes it into dir.
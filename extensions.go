@@ -0,0 +1,32 @@
+package frankenphp
+
+import (
+	"encoding/json"
+	"errors"
+
+	"go.uber.org/zap"
+)
+
+const loadedExtensionsCode = `echo json_encode(get_loaded_extensions());`
+
+// LoadedExtensions returns the names of the PHP extensions loaded by the embedded interpreter,
+// as reported by get_loaded_extensions(). It returns nil if FrankenPHP isn't running.
+func LoadedExtensions() []string {
+	out, err := executePHPCode(loadedExtensionsCode)
+	if err != nil {
+		if !errors.Is(err, NotRunningError) {
+			getLogger().Error("unable to list the loaded extensions", zap.Error(err))
+		}
+
+		return nil
+	}
+
+	var extensions []string
+	if err := json.Unmarshal(out, &extensions); err != nil {
+		getLogger().Error("unable to list the loaded extensions", zap.Error(err))
+
+		return nil
+	}
+
+	return extensions
+}
@@ -0,0 +1,22 @@
+package frankenphp_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dunglas/frankenphp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadedExtensions(t *testing.T) {
+	runTest(t, func(_ func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		extensions := frankenphp.LoadedExtensions()
+		assert.Contains(t, extensions, "Core")
+		assert.Contains(t, extensions, "standard")
+	}, &testOptions{nbParrallelRequests: 1})
+}
+
+func TestLoadedExtensionsNotRunning(t *testing.T) {
+	assert.Nil(t, frankenphp.LoadedExtensions())
+}
@@ -15,6 +15,7 @@
 #include <stdint.h>
 #include <stdio.h>
 #include <stdlib.h>
+#include <time.h>
 #include <unistd.h>
 
 #include "C-Thread-Pool/thpool.c"
@@ -70,8 +71,31 @@ typedef struct frankenphp_server_context {
   bool worker_ready;
   char *cookie_data;
   bool finished;
+  HashTable *ini_backup;
+  struct timespec cpu_start;
 } frankenphp_server_context;
 
+/* Starts measuring the resources used by the current request */
+static void frankenphp_start_usage(frankenphp_server_context *ctx) {
+  clock_gettime(CLOCK_THREAD_CPUTIME_ID, &ctx->cpu_start);
+  zend_memory_reset_peak_usage();
+}
+
+/* Returns the resources used by the current request so far */
+frankenphp_usage frankenphp_get_usage() {
+  frankenphp_usage usage = {0, zend_memory_peak_usage(false)};
+
+  frankenphp_server_context *ctx = SG(server_context);
+  struct timespec now;
+  if (ctx != NULL && clock_gettime(CLOCK_THREAD_CPUTIME_ID, &now) == 0) {
+    usage.cpu_time =
+        (int64_t)(now.tv_sec - ctx->cpu_start.tv_sec) * 1000000000 +
+        (now.tv_nsec - ctx->cpu_start.tv_nsec);
+  }
+
+  return usage;
+}
+
 static uintptr_t frankenphp_clean_server_context() {
   frankenphp_server_context *ctx = SG(server_context);
   if (ctx == NULL) {
@@ -115,6 +139,30 @@ static void frankenphp_request_reset() {
   zend_end_try();
 }
 
+/* Restores the INI entries changed for the current worker request, in
+ * non-worker mode they are restored by php_request_shutdown() */
+static void frankenphp_restore_request_ini(frankenphp_server_context *ctx) {
+  if (ctx->ini_backup == NULL) {
+    return;
+  }
+
+  zend_string *name;
+  zval *value;
+  ZEND_HASH_FOREACH_STR_KEY_VAL(ctx->ini_backup, name, value) {
+    if (Z_TYPE_P(value) == IS_STRING) {
+      zend_alter_ini_entry_ex(name, Z_STR_P(value), PHP_INI_SYSTEM,
+                              PHP_INI_STAGE_ACTIVATE, 0);
+    } else {
+      zend_restore_ini_entry(name, PHP_INI_STAGE_ACTIVATE);
+    }
+  }
+  ZEND_HASH_FOREACH_END();
+
+  zend_hash_destroy(ctx->ini_backup);
+  FREE_HASHTABLE(ctx->ini_backup);
+  ctx->ini_backup = NULL;
+}
+
 /* Adapted from php_request_shutdown */
 static void frankenphp_worker_request_shutdown() {
   /* Flush all output buffers */
@@ -144,6 +192,8 @@ static void frankenphp_worker_request_shutdown() {
   zend_try { sapi_deactivate(); }
   zend_end_try();
 
+  frankenphp_restore_request_ini(SG(server_context));
+
   zend_set_memory_limit(PG(memory_limit));
 }
 
@@ -290,7 +340,7 @@ PHP_FUNCTION(frankenphp_handle_request) {
     ctx->worker_ready = true;
 
     /* Mark the worker as ready to handle requests */
-    go_frankenphp_worker_ready();
+    go_frankenphp_worker_ready(ctx->main_request);
   }
 
 #ifdef ZEND_MAX_EXECUTION_TIMERS
@@ -306,6 +356,10 @@ PHP_FUNCTION(frankenphp_handle_request) {
     RETURN_FALSE;
   }
 
+  frankenphp_start_usage(ctx);
+
+  go_frankenphp_watch_abort(request, &EG(vm_interrupt));
+
 #ifdef ZEND_MAX_EXECUTION_TIMERS
   // Reset default timeout
   // TODO: add support for max_input_time
@@ -326,6 +380,7 @@ PHP_FUNCTION(frankenphp_handle_request) {
     zend_exception_error(EG(exception), E_ERROR);
   }
 
+  go_frankenphp_unwatch_abort(request);
   frankenphp_worker_request_shutdown();
   ctx->current_request = 0;
   go_frankenphp_finish_request(ctx->main_request, request, true);
@@ -437,8 +492,85 @@ int frankenphp_update_server_context(
   return SUCCESS;
 }
 
+/* Changes an INI entry for the current request only, as php_admin_value does.
+ * In worker mode, the previous value is saved to be restored when the
+ * request is finished. */
+int frankenphp_set_request_ini_entry(char *name, char *value, bool backup) {
+  frankenphp_server_context *ctx = SG(server_context);
+  zend_string *zname = zend_string_init(name, strlen(name), 0);
+  free(name);
+
+  if (backup) {
+    if (ctx->ini_backup == NULL) {
+      ALLOC_HASHTABLE(ctx->ini_backup);
+      zend_hash_init(ctx->ini_backup, 8, NULL, ZVAL_PTR_DTOR, 0);
+    }
+
+    if (!zend_hash_exists(ctx->ini_backup, zname)) {
+      zval previous;
+      zend_string *current = zend_ini_get_value(zname);
+      if (current == NULL) {
+        ZVAL_NULL(&previous);
+      } else {
+        ZVAL_STR(&previous,
+                 zend_string_init(ZSTR_VAL(current), ZSTR_LEN(current), 0));
+      }
+
+      zend_hash_add_new(ctx->ini_backup, zname, &previous);
+    }
+  }
+
+  int ret = zend_alter_ini_entry_chars(zname, value, strlen(value),
+                                       PHP_INI_SYSTEM, PHP_INI_STAGE_ACTIVATE);
+
+  zend_string_release(zname);
+  free(value);
+
+  return ret;
+}
+
+static void (*previous_interrupt_function)(zend_execute_data *execute_data);
+
+/* Called by the VM when EG(vm_interrupt) is set, which is done when the
+ * client disconnects: handles the abort even if the script produces no output,
+ * so that scripts checking connection_aborted() can bail early. It is also set
+ * when FrankenPHP shuts down, to stop the daemons */
+static void frankenphp_interrupt_function(zend_execute_data *execute_data) {
+  if (previous_interrupt_function) {
+    previous_interrupt_function(execute_data);
+  }
+
+  frankenphp_server_context *ctx = SG(server_context);
+  if (ctx != NULL && ctx->current_request == 0 && ctx->main_request != 0 &&
+      go_frankenphp_daemon_stopping(ctx->main_request)) {
+    /* FrankenPHP is shutting down: stop the daemon as if it called exit() */
+    zend_throw_unwind_exit();
+
+    return;
+  }
+
+  if (ctx != NULL && !ctx->finished && ctx->current_request != 0 &&
+      !(PG(connection_status) & PHP_CONNECTION_ABORTED) &&
+      go_client_has_closed(ctx->current_request)) {
+    php_handle_aborted_connection();
+  }
+}
+
+void frankenphp_interrupt(void *vm_interrupt) {
+  zend_atomic_bool_store((zend_atomic_bool *)vm_interrupt, true);
+}
+
 static int frankenphp_startup(sapi_module_struct *sapi_module) {
-  return php_module_startup(sapi_module, &frankenphp_module);
+  if (php_module_startup(sapi_module, &frankenphp_module) == FAILURE) {
+    return FAILURE;
+  }
+
+  /* zend_interrupt_function is reset by the engine startup, and may be set by
+   * extensions (e.g. pcntl) */
+  previous_interrupt_function = zend_interrupt_function;
+  zend_interrupt_function = frankenphp_interrupt_function;
+
+  return SUCCESS;
 }
 
 static int frankenphp_deactivate(void) {
@@ -571,8 +703,11 @@ void frankenphp_register_bulk_variables(char *known_variables[27],
                                      track_vars_array, true);
   frankenphp_register_known_variable("DOCUMENT_URI", known_variables[2],
                                      track_vars_array, true);
-  frankenphp_register_known_variable("GATEWAY_INTERFACE", known_variables[3],
-                                     track_vars_array, true);
+  /* The default values are static, only the overridden ones are freed */
+  frankenphp_register_known_variable(
+      "GATEWAY_INTERFACE",
+      known_variables[3] != NULL ? known_variables[3] : "CGI/1.1",
+      track_vars_array, known_variables[3] != NULL);
   frankenphp_register_known_variable("HTTP_HOST", known_variables[4],
                                      track_vars_array, true);
   frankenphp_register_known_variable("HTTPS", known_variables[5],
@@ -600,8 +735,10 @@ void frankenphp_register_bulk_variables(char *known_variables[27],
                                      track_vars_array, true);
   frankenphp_register_known_variable("SERVER_PROTOCOL", known_variables[16],
                                      track_vars_array, true);
-  frankenphp_register_known_variable("SERVER_SOFTWARE", known_variables[17],
-                                     track_vars_array, true);
+  frankenphp_register_known_variable(
+      "SERVER_SOFTWARE",
+      known_variables[17] != NULL ? known_variables[17] : "FrankenPHP",
+      track_vars_array, known_variables[17] != NULL);
   frankenphp_register_known_variable("SSL_PROTOCOL", known_variables[18],
                                      track_vars_array, true);
 
@@ -663,7 +800,17 @@ sapi_module_struct frankenphp_sapi_module = {
 
     STANDARD_SAPI_MODULE_PROPERTIES};
 
+typedef struct {
+  int num_threads;
+  /* -c: the path of the php.ini file to load instead of the default one */
+  char *php_ini_path;
+  /* -d: INI entries overriding the ones set in php.ini */
+  char *php_ini_entries;
+} manager_thread_args;
+
 static void *manager_thread(void *arg) {
+  manager_thread_args *args = arg;
+
 #ifdef ZTS
   // TODO: use tsrm_startup() directly as we know the number of expected threads
   php_tsrm_startup();
@@ -675,20 +822,34 @@ static void *manager_thread(void *arg) {
 
   sapi_startup(&frankenphp_sapi_module);
 
+  frankenphp_sapi_module.php_ini_path_override = args->php_ini_path;
+
+  /* the user-provided entries come last to take precedence */
 #ifndef ZEND_MAX_EXECUTION_TIMERS
-#if (PHP_VERSION_ID >= 80300)
-  frankenphp_sapi_module.ini_entries = HARDCODED_INI;
+  const char *hardcoded_ini = HARDCODED_INI;
 #else
-  frankenphp_sapi_module.ini_entries = malloc(sizeof(HARDCODED_INI));
-  memcpy(frankenphp_sapi_module.ini_entries, HARDCODED_INI,
-         sizeof(HARDCODED_INI));
-#endif
+  const char *hardcoded_ini = "";
 #endif
+  size_t hardcoded_ini_len = strlen(hardcoded_ini);
+  size_t php_ini_entries_len =
+      args->php_ini_entries == NULL ? 0 : strlen(args->php_ini_entries);
+
+  char *ini_entries = NULL;
+  if (hardcoded_ini_len + php_ini_entries_len > 0) {
+    ini_entries = malloc(hardcoded_ini_len + php_ini_entries_len + 1);
+    memcpy(ini_entries, hardcoded_ini, hardcoded_ini_len);
+    if (php_ini_entries_len > 0) {
+      memcpy(ini_entries + hardcoded_ini_len, args->php_ini_entries,
+             php_ini_entries_len);
+    }
+    ini_entries[hardcoded_ini_len + php_ini_entries_len] = '\0';
+
+    frankenphp_sapi_module.ini_entries = ini_entries;
+  }
 
   frankenphp_sapi_module.startup(&frankenphp_sapi_module);
 
-  threadpool thpool = thpool_init(*((int *)arg));
-  free(arg);
+  threadpool thpool = thpool_init(args->num_threads);
 
   uintptr_t rh;
   while ((rh = go_fetch_request())) {
@@ -706,26 +867,33 @@ static void *manager_thread(void *arg) {
   tsrm_shutdown();
 #endif
 
-#if (PHP_VERSION_ID < 80300)
-  if (frankenphp_sapi_module.ini_entries) {
-    free(frankenphp_sapi_module.ini_entries);
-    frankenphp_sapi_module.ini_entries = NULL;
-  }
-#endif
+  frankenphp_sapi_module.ini_entries = NULL;
+  free(ini_entries);
+
+  frankenphp_sapi_module.php_ini_path_override = NULL;
+  free(args->php_ini_path);
+  free(args->php_ini_entries);
+  free(args);
 
   go_shutdown();
 
   return NULL;
 }
 
-int frankenphp_init(int num_threads) {
+/* php_ini_path and php_ini_entries are freed by the manager thread */
+int frankenphp_init(int num_threads, char *php_ini_path,
+                    char *php_ini_entries) {
   pthread_t thread;
 
-  int *num_threads_ptr = calloc(1, sizeof(int));
-  *num_threads_ptr = num_threads;
+  manager_thread_args *args = calloc(1, sizeof(manager_thread_args));
+  args->num_threads = num_threads;
+  args->php_ini_path = php_ini_path;
+  args->php_ini_entries = php_ini_entries;
 
-  if (pthread_create(&thread, NULL, *manager_thread, (void *)num_threads_ptr) !=
-      0) {
+  if (pthread_create(&thread, NULL, *manager_thread, (void *)args) != 0) {
+    free(php_ini_path);
+    free(php_ini_entries);
+    free(args);
     go_shutdown();
 
     return -1;
@@ -748,9 +916,10 @@ int frankenphp_request_startup() {
   return FAILURE;
 }
 
-int frankenphp_execute_script(char *file_name) {
+int frankenphp_execute_script(char *file_name, char *shutdown_file_name) {
   if (frankenphp_request_startup() == FAILURE) {
     free(file_name);
+    free(shutdown_file_name);
 
     return FAILURE;
   }
@@ -763,6 +932,14 @@ int frankenphp_execute_script(char *file_name) {
 
   file_handle.primary_script = 1;
 
+  frankenphp_server_context *ctx = SG(server_context);
+  frankenphp_start_usage(ctx);
+  if (ctx->current_request != 0) {
+    go_frankenphp_watch_abort(ctx->current_request, &EG(vm_interrupt));
+  } else if (ctx->main_request != 0) {
+    go_frankenphp_watch_daemon(ctx->main_request, &EG(vm_interrupt));
+  }
+
   zend_first_try {
     EG(exit_status) = 0;
     php_execute_script(&file_handle);
@@ -771,8 +948,65 @@ int frankenphp_execute_script(char *file_name) {
   zend_catch { status = EG(exit_status); }
   zend_end_try();
 
+  /* The executor globals are freed with the thread resources, stop watching
+   * before (this also covers worker requests interrupted by a bailout) */
+  if (ctx->current_request != 0) {
+    go_frankenphp_unwatch_abort(ctx->current_request);
+  } else if (ctx->main_request != 0) {
+    go_frankenphp_unwatch_abort(ctx->main_request);
+  }
+
   zend_destroy_file_handle(&file_handle);
 
+  /* Run the shutdown script of the worker in the same request, so it can
+   * access the resources of the instance, its exit status is ignored */
+  if (shutdown_file_name != NULL) {
+    zend_file_handle shutdown_file_handle;
+    zend_stream_init_filename(&shutdown_file_handle, shutdown_file_name);
+    free(shutdown_file_name);
+
+    zend_try {
+      zend_execute_scripts(ZEND_REQUIRE, NULL, 1, &shutdown_file_handle);
+    }
+    zend_end_try();
+
+    zend_destroy_file_handle(&shutdown_file_handle);
+  }
+
+  /* The peak memory usage is reset by php_request_shutdown() */
+  if (ctx->current_request != 0) {
+    go_frankenphp_update_usage(ctx->current_request);
+  }
+
+  frankenphp_clean_server_context();
+  frankenphp_request_shutdown();
+
+  return status;
+}
+
+int frankenphp_execute_php_code(char *code) {
+  if (frankenphp_request_startup() == FAILURE) {
+    free(code);
+
+    return FAILURE;
+  }
+
+  frankenphp_start_usage(SG(server_context));
+
+  int status = SUCCESS;
+
+  zend_first_try {
+    EG(exit_status) = 0;
+    if (zend_eval_string(code, NULL, "FrankenPHP internal code") == FAILURE) {
+      EG(exit_status) = 255;
+    }
+    status = EG(exit_status);
+  }
+  zend_catch { status = EG(exit_status); }
+  zend_end_try();
+
+  free(code);
+
   frankenphp_clean_server_context();
   frankenphp_request_shutdown();
 
@@ -38,6 +38,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"os"
 	"runtime"
@@ -45,6 +46,8 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"go.uber.org/zap"
@@ -63,15 +66,39 @@ var (
 	AlreaydStartedError         = errors.New("FrankenPHP is already started")
 	InvalidPHPVersionError      = errors.New("FrankenPHP is only compatible with PHP 8.2+")
 	ZendSignalsError            = errors.New("Zend Signals are enabled, recompile PHP with --disable-zend-signals")
-	NotEnoughThreads            = errors.New("the number of threads must be superior to the number of workers")
+	NotEnoughThreads            = errors.New("the number of threads must be at least the number of workers plus the reserved threads")
 	MainThreadCreationError     = errors.New("error creating the main thread")
 	RequestContextCreationError = errors.New("error during request context creation")
 	RequestStartupError         = errors.New("error during PHP request startup")
 	ScriptExecutionError        = errors.New("error during PHP script execution")
-
-	requestChan chan *http.Request
-	done        chan struct{}
-	shutdownWG  sync.WaitGroup
+	NotRunningError             = errors.New("FrankenPHP is not running")
+	OpcacheNotEnabledError      = errors.New("opcache is not enabled")
+	QueueTimeoutError           = errors.New("timeout while waiting for a free PHP request slot")
+	WorkerQueueFullError        = errors.New("too many requests waiting for a worker")
+	NoRoutesError               = errors.New("the worker doesn't define the " + RoutesFunction + "() function")
+	IniNotChangeableError       = errors.New("the php.ini directive can't be changed at runtime")
+	RequestBodyTimeoutError     = errors.New("timeout while reading the request body")
+	DaemonWorkerError           = errors.New("the script is a daemon worker, it doesn't handle HTTP requests")
+	WorkerNotFoundError         = errors.New("no worker is started for the script")
+
+	requestChan    chan *http.Request
+	done           chan struct{}
+	shutdownWG     sync.WaitGroup
+	activeRequests atomic.Int64
+	// totalRequests is the number of requests handled by PHP since the process started
+	totalRequests atomic.Uint64
+	// running is true between Init and Shutdown
+	running atomic.Bool
+
+	// abortMu protects abort, which is closed by AbortRequests
+	abortMu sync.RWMutex
+	abort   chan struct{}
+
+	// numThreads is the number of PHP threads started by Init
+	numThreads int
+
+	// requestLimit limits the number of concurrent requests, nil if unlimited
+	requestLimit atomic.Pointer[requestLimiter]
 
 	loggerMu sync.RWMutex
 	logger   *zap.Logger
@@ -116,8 +143,13 @@ type FrankenPHPContext struct {
 	documentRoot string
 	splitPath    []string
 	env          map[string]string
+	envOverrides map[string]string
+	phpIni       map[string]string
 	logger       *zap.Logger
 
+	// PHP code to execute instead of a script, used internally
+	phpCode string
+
 	docURI         string
 	pathInfo       string
 	scriptName     string
@@ -131,17 +163,220 @@ type FrankenPHPContext struct {
 
 	done                 chan interface{}
 	currentWorkerRequest cgo.Handle
+	// For the main request of a worker, closed when the worker is ready to handle requests
+	workerReady chan struct{}
+	// For the main request of a worker, true if the instance has been stopped because idle
+	idleStopped bool
+	// For the main request of a worker, the credentials used to access the filesystem
+	runAs *credentials
+	// For the main request of a worker, the script executed when the instance stops
+	workerShutdownScript string
+	// For the main request of a worker, receives the requests bound to the instance, if any
+	workerInstance *workerInstance
+	// For the main request of a worker, the request handled first once the instance is ready, if any
+	workerWarmup *http.Request
+	// For the main request of a worker, true while the instance is a standby instance waiting to be promoted
+	workerStandby bool
+	// For the main request of a worker, when the instance must be recycled, if it has a max lifetime
+	workerExpiresAt time.Time
+	// For the main request of a worker, the generation of the worker pool the instance was started in, it is recycled when the pool is
+	workerGeneration int
+	// For the main request of a daemon, closed when FrankenPHP shuts down, the daemon is then stopped
+	daemonStop chan struct{}
+
+	// Whether the case of the response headers set by PHP is preserved
+	preserveHeaderCase bool
+
+	// Whether the Brotli-compressed variant of the static target of the request is served, if it exists
+	precompressed bool
+
+	// The request headers exposed to PHP, all if nil, and the ones never exposed, by variable name
+	forwardHeaders map[string]struct{}
+	hideHeaders    map[string]struct{}
+
+	// The worker script that handled the request, if any
+	worker string
+	// For worker requests, true if the instance handling the request stopped before it was handled
+	workerStopped bool
+
+	// Interrupts PHP when the client disconnects, set while the script runs
+	abortWatcher *abortWatcher
+
+	// The maximum time to wait for data from the client when PHP reads the request body, and the reader applying it
+	bodyReadTimeout time.Duration
+	bodyReader      *bodyReader
+	// Closed when reading the request body timed out, the script is then aborted and its response discarded
+	bodyTimedOut chan struct{}
+
+	// The CPU time (in nanoseconds) and the peak memory used by PHP to handle the request so far
+	cpuTime    atomic.Int64
+	memoryPeak atomic.Uint64
+}
+
+// ScriptName returns the URI path of the PHP script handling the request (the SCRIPT_NAME variable).
+func (fc *FrankenPHPContext) ScriptName() string {
+	return fc.scriptName
+}
+
+// ScriptFilename returns the absolute path of the PHP script handling the request (the SCRIPT_FILENAME variable).
+func (fc *FrankenPHPContext) ScriptFilename() string {
+	return fc.scriptFilename
+}
+
+// Worker returns the path of the worker script that handled the request, or an empty string if it wasn't handled by a worker.
+func (fc *FrankenPHPContext) Worker() string {
+	return fc.worker
+}
+
+// CPUTime returns the CPU time used by the PHP thread to handle the request.
+// It is updated when PHP sends the response headers and when the request is handled.
+func (fc *FrankenPHPContext) CPUTime() time.Duration {
+	return time.Duration(fc.cpuTime.Load())
+}
+
+// MemoryPeak returns the peak memory allocated by PHP while handling the request, in bytes, as memory_get_peak_usage() does.
+// It is updated when PHP sends the response headers and when the request is handled.
+func (fc *FrankenPHPContext) MemoryPeak() uint64 {
+	return fc.memoryPeak.Load()
+}
+
+// updateUsage records the resources used by the request so far, it must be called from the PHP thread handling it.
+func (fc *FrankenPHPContext) updateUsage() {
+	usage := C.frankenphp_get_usage()
+
+	fc.cpuTime.Store(int64(usage.cpu_time))
+	fc.memoryPeak.Store(uint64(usage.memory_peak))
+}
+
+//export go_frankenphp_update_usage
+func go_frankenphp_update_usage(rh C.uintptr_t) {
+	r := cgo.Handle(rh).Value().(*http.Request)
+	r.Context().Value(contextKey).(*FrankenPHPContext).updateUsage()
 }
 
 func clientHasClosed(r *http.Request) bool {
+	fc, _ := FromContext(r.Context())
+
 	select {
 	case <-r.Context().Done():
 		return true
+	case <-aborting():
+		return true
+	case <-fc.bodyTimedOut:
+		return true
 	default:
 		return false
 	}
 }
 
+// aborting returns a channel closed when the requests being handled must be aborted.
+func aborting() <-chan struct{} {
+	abortMu.RLock()
+	defer abortMu.RUnlock()
+
+	return abort
+}
+
+// AbortRequests aborts the PHP requests being handled, as if their clients disconnected.
+//
+// Scripts are interrupted at the next executed instruction, unless they called ignore_user_abort(),
+// in which case connection_aborted() returns true.
+// It is typically used when a graceful shutdown takes too long.
+func AbortRequests() {
+	RequestsAborter()()
+}
+
+// RequestsAborter returns a function aborting the PHP requests handled by the running PHP runtime, as AbortRequests does.
+// Once FrankenPHP has been restarted, calling it has no effect: the requests handled by the new runtime aren't aborted.
+// It is used to abort the requests exceeding the grace period of a shutdown, even if FrankenPHP is restarted meanwhile.
+func RequestsAborter() func() {
+	abortMu.RLock()
+	ch := abort
+	abortMu.RUnlock()
+
+	return func() {
+		abortChan(ch)
+	}
+}
+
+// abortChan closes ch, the abort channel of a PHP runtime, if it isn't closed yet.
+func abortChan(ch chan struct{}) {
+	abortMu.Lock()
+	defer abortMu.Unlock()
+
+	if ch == nil {
+		return
+	}
+
+	select {
+	case <-ch:
+	default:
+		close(ch)
+	}
+}
+
+// abortWatcher interrupts the PHP VM running a request when the client disconnects, when reading the request body timed out,
+// or when AbortRequests is called, so that the abort is handled even if the script doesn't produce any output.
+type abortWatcher struct {
+	mu sync.Mutex
+	// vmInterrupt points to EG(vm_interrupt) of the PHP thread, nil once the script is done
+	vmInterrupt unsafe.Pointer
+	stop        chan struct{}
+}
+
+func watchAbort(ctx context.Context, bodyTimedOut chan struct{}, vmInterrupt unsafe.Pointer) *abortWatcher {
+	w := &abortWatcher{vmInterrupt: vmInterrupt, stop: make(chan struct{})}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-aborting():
+		case <-bodyTimedOut:
+		case <-w.stop:
+			return
+		}
+
+		w.interrupt()
+	}()
+
+	return w
+}
+
+// watchDaemon interrupts the PHP VM running a daemon when stop is closed, the daemon is then stopped as if it called exit().
+func watchDaemon(stop chan struct{}, vmInterrupt unsafe.Pointer) *abortWatcher {
+	w := &abortWatcher{vmInterrupt: vmInterrupt, stop: make(chan struct{})}
+
+	go func() {
+		select {
+		case <-stop:
+		case <-w.stop:
+			return
+		}
+
+		w.interrupt()
+	}()
+
+	return w
+}
+
+func (w *abortWatcher) interrupt() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.vmInterrupt != nil {
+		C.frankenphp_interrupt(w.vmInterrupt)
+	}
+}
+
+// unwatch must be called before the PHP thread frees its globals
+func (w *abortWatcher) unwatch() {
+	w.mu.Lock()
+	w.vmInterrupt = nil
+	w.mu.Unlock()
+
+	close(w.stop)
+}
+
 // NewRequestWithContext creates a new FrankenPHP request context.
 func NewRequestWithContext(r *http.Request, opts ...RequestOption) (*http.Request, error) {
 	fc := &FrankenPHPContext{
@@ -258,6 +493,11 @@ func Init(options ...Option) error {
 			return err
 		}
 	}
+	for _, o := range opt.workerOptions {
+		if err := o(opt); err != nil {
+			return err
+		}
+	}
 
 	if opt.logger == nil {
 		l, err := zap.NewDevelopment()
@@ -274,6 +514,8 @@ func Init(options ...Option) error {
 		loggerMu.Unlock()
 	}
 
+	logMessages.Store(int32(opt.logMessages))
+
 	maxProcs := runtime.GOMAXPROCS(0)
 
 	var numWorkers int
@@ -283,17 +525,20 @@ func Init(options ...Option) error {
 			opt.workers[i].num = maxProcs * 2
 		}
 
-		numWorkers += opt.workers[i].num
+		numWorkers += opt.workers[i].num + w.standby
 	}
 
+	// the threads never assigned to workers, to handle requests in non-worker mode
+	reservedThreads := max(opt.reservedThreads, 1)
+
 	if opt.numThreads <= 0 {
-		if numWorkers >= maxProcs {
-			// Start at least as many threads as workers, and keep a free thread to handle requests in non-worker mode
-			opt.numThreads = numWorkers + 1
+		if numWorkers+reservedThreads > maxProcs {
+			// Start at least as many threads as workers, and keep the reserved threads free to handle requests in non-worker mode
+			opt.numThreads = numWorkers + reservedThreads
 		} else {
 			opt.numThreads = maxProcs
 		}
-	} else if opt.numThreads <= numWorkers {
+	} else if opt.numThreads < numWorkers+reservedThreads {
 		return NotEnoughThreads
 	}
 
@@ -312,35 +557,59 @@ func Init(options ...Option) error {
 		logger.Warn(`ZTS is not enabled, only 1 thread will be available, recompile PHP using the "--enable-zts" configuration option or performance will be degraded`)
 	}
 
+	if opt.maxConcurrentRequests > 0 {
+		requestLimit.Store(&requestLimiter{slots: make(chan struct{}, opt.maxConcurrentRequests), queueTimeout: opt.queueTimeout})
+	} else {
+		requestLimit.Store(nil)
+	}
+
+	numThreads = opt.numThreads
+
 	shutdownWG.Add(1)
 	done = make(chan struct{})
 	requestChan = make(chan *http.Request)
 
-	if C.frankenphp_init(C.int(opt.numThreads)) != 0 {
+	abortMu.Lock()
+	abort = make(chan struct{})
+	abortMu.Unlock()
+
+	// the strings are freed by the C side
+	var phpIniPath, phpIniEntries *C.char
+	if opt.iniFile != "" {
+		phpIniPath = C.CString(opt.iniFile)
+	}
+	if len(opt.phpIniEntries) > 0 {
+		phpIniEntries = C.CString(strings.Join(opt.phpIniEntries, ""))
+	}
+
+	if C.frankenphp_init(C.int(opt.numThreads), phpIniPath, phpIniEntries) != 0 {
 		return MainThreadCreationError
 	}
 
-	if err := initWorkers(opt.workers); err != nil {
+	if err := initWorkers(opt.workers, opt.warmupParallelism); err != nil {
 		return err
 	}
 
-	logger.Info("FrankenPHP started 🐘", zap.String("php_version", Version().Version))
+	running.Store(true)
+
+	LogLifecycle(logger, "start", zap.String("php_version", Version().Version))
 	if EmbeddedAppPath != "" {
-		logger.Info("embedded PHP app 📦", zap.String("path", EmbeddedAppPath))
+		LogLifecycle(logger, "embedded_app", zap.String("path", EmbeddedAppPath))
 	}
 
 	return nil
 }
 
-// Shutdown stops the workers and the PHP runtime.
-func Shutdown() {
-	stopWorkers()
-	close(done)
-	shutdownWG.Wait()
-	requestChan = nil
+// WorkersReady reports whether FrankenPHP is running and the workers are ready to handle requests.
+// It is false while Init starts the workers, for instance during a reload, and once Shutdown has been called.
+func WorkersReady() bool {
+	return running.Load()
+}
 
-	// Always reset the WaitGroup to ensure we're in a clean state
-	workersReadyWG = sync.WaitGroup{}
+// Shutdown stops the workers and the PHP runtime, and removes the installed embedded app.
+// It waits for the requests being handled to finish, new requests are not handled anymore.
+func Shutdown() {
+	stopRuntime()
 
 	// Remove the installed app
 	if EmbeddedAppPath != "" {
@@ -350,6 +619,16 @@ func Shutdown() {
 	logger.Debug("FrankenPHP shut down")
 }
 
+// stopRuntime stops the workers and the PHP runtime, the installed embedded app is kept.
+func stopRuntime() {
+	running.Store(false)
+	stopWorkers()
+	close(done)
+	shutdownWG.Wait()
+	requestChan = nil
+	runtimeIni.Store(nil)
+}
+
 //export go_shutdown
 func go_shutdown() {
 	shutdownWG.Done()
@@ -435,10 +714,30 @@ func updateServerContext(request *http.Request, create bool, mrh C.uintptr_t) er
 		return RequestContextCreationError
 	}
 
+	// in worker mode, the previous values must be restored when the request is finished
+	if ini := runtimeIni.Load(); ini != nil {
+		for k, v := range *ini {
+			if _, ok := fc.phpIni[k]; ok {
+				continue
+			}
+
+			if C.frankenphp_set_request_ini_entry(C.CString(k), C.CString(v), C.bool(!create)) != 0 {
+				fc.logger.Warn("unable to set php.ini directive", zap.String("name", k), zap.String("value", v))
+			}
+		}
+	}
+	for k, v := range fc.phpIni {
+		if C.frankenphp_set_request_ini_entry(C.CString(k), C.CString(v), C.bool(!create)) != 0 {
+			fc.logger.Warn("unable to set php.ini directive", zap.String("name", k), zap.String("value", v))
+		}
+	}
+
 	return nil
 }
 
 // ServeHTTP executes a PHP script according to the given context.
+// It returns WorkerQueueFullError if the request targets a worker having too many requests waiting for an instance,
+// DaemonWorkerError if it targets a daemon, and NotRunningError if FrankenPHP is shutting down.
 func ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) error {
 	shutdownWG.Add(1)
 	defer shutdownWG.Done()
@@ -448,23 +747,178 @@ func ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) error
 		return InvalidRequestError
 	}
 
+	if fc.precompressed && responseWriter != nil && servePrecompressed(fc, responseWriter, request) {
+		return nil
+	}
+
+	if responseWriter != nil {
+		activeRequests.Add(1)
+		defer activeRequests.Add(-1)
+
+		// The limiter is loaded once: the slot must be released into the channel it was acquired from, even if Init replaced it in the meantime
+		if limiter := requestLimit.Load(); limiter != nil {
+			if err := limiter.acquire(request.Context()); err != nil {
+				return err
+			}
+			defer limiter.release()
+		}
+	}
+
+	if err := dispatchRequest(fc, responseWriter, request); err != nil {
+		return err
+	}
+	if responseWriter != nil {
+		totalRequests.Add(1)
+	}
+
+	if isClosed(fc.bodyTimedOut) {
+		return RequestBodyTimeoutError
+	}
+
+	return nil
+}
+
+// TotalRequests returns the number of requests handled by PHP through ServeHTTP since the process started,
+// including the ones that failed. The requests rejected before reaching PHP aren't counted.
+func TotalRequests() uint64 {
+	return totalRequests.Load()
+}
+
+// dispatchRequest sends the request to a PHP thread and waits for it to be handled,
+// it returns NotRunningError if FrankenPHP is shutting down, and WorkerQueueFullError if the queue of the worker is full.
+// Unlike ServeHTTP, it doesn't count the request as in-flight nor apply the concurrency limits, the caller must hold shutdownWG.
+func dispatchRequest(fc *FrankenPHPContext, responseWriter http.ResponseWriter, request *http.Request) error {
 	fc.responseWriter = responseWriter
 
 	rc := requestChan
+	var pool *workerPool
 	// Detect if a worker is available to handle this request
 	if nil != fc.responseWriter {
 		if v, ok := workersRequestChans.Load(fc.scriptFilename); ok {
 			rc = v.(chan *http.Request)
+			fc.worker = fc.scriptFilename
+
+			if v, ok := workerPools.Load(fc.scriptFilename); ok {
+				pool = v.(*workerPool)
+			}
+		}
+	}
+
+	if pool != nil && pool.daemon {
+		return DaemonWorkerError
+	}
+
+	if pool == nil || pool.retryOnRestart == 0 || !IsIdempotent(request.Method) {
+		return sendRequest(fc, rc, pool, request)
+	}
+
+	rw := newRetryWriter(responseWriter)
+	fc.responseWriter = rw
+	// the variables are consumed when they are registered, every attempt gets its own copy
+	env := fc.env
+	for retries := 0; ; retries++ {
+		fc.env = maps.Clone(env)
+		err := sendRequest(fc, rc, pool, request)
+		if err != nil || !fc.workerStopped || rw.committed || retries >= pool.retryOnRestart {
+			if err := rw.commit(); err != nil {
+				fc.logger.Error("write error", zap.Error(err))
+			}
+
+			return err
+		}
+
+		fc.logger.Debug("worker stopped, retrying the request", zap.String("worker", fc.worker), zap.String("url", request.RequestURI), zap.Int("retry", retries+1))
+
+		rw.reset()
+		fc.workerStopped = false
+		fc.closed = sync.Once{}
+		fc.done = make(chan interface{})
+	}
+}
+
+// sendRequest sends the request to the given channel, or to the instance of the worker it is bound to or assigned to by the dispatch strategy,
+// and waits for it to be handled.
+func sendRequest(fc *FrankenPHPContext, rc chan *http.Request, pool *workerPool, request *http.Request) error {
+	if pool != nil {
+		inst := pool.stickyInstance(request)
+		if inst == nil && pool.dispatch != "" {
+			inst = pool.dispatchedInstance()
+		}
+		if inst != nil {
+			if dispatched, err := pool.dispatchTo(inst, fc, request); dispatched {
+				return err
+			}
+		}
+
+		select {
+		case rc <- request:
+			<-fc.done
+
+			return nil
+		default:
+		}
+
+		// no instance is available, restart an instance stopped because idle if any
+		if pool.idleTimeout > 0 {
+			pool.wakeIdle()
+		}
+
+		if !pool.enqueue() {
+			return WorkerQueueFullError
 		}
 	}
 
 	select {
 	case <-done:
+		if pool != nil {
+			pool.queued.Add(-1)
+		}
+
+		return NotRunningError
 	case rc <- request:
+		if pool != nil {
+			pool.queued.Add(-1)
+		}
 		<-fc.done
+
+		return nil
+	}
+}
+
+// requestLimiter holds the request slots and the queue timeout configured by Init.
+type requestLimiter struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+}
+
+// acquire waits for a free request slot, up to the configured queue timeout.
+func (l *requestLimiter) acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
 	}
 
-	return nil
+	var timeout <-chan time.Time
+	if l.queueTimeout > 0 {
+		timer := time.NewTimer(l.queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-timeout:
+		return QueueTimeoutError
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees a slot acquired with acquire.
+func (l *requestLimiter) release() {
+	<-l.slots
 }
 
 //export go_fetch_request
@@ -506,18 +960,136 @@ func go_execute_script(rh unsafe.Pointer) {
 		panic(err)
 	}
 
-	// scriptFilename is freed in frankenphp_execute_script()
-	fc.exitStatus = C.frankenphp_execute_script(C.CString(fc.scriptFilename))
+	// the script runs on the current thread, only this thread is affected
+	if fc.runAs != nil {
+		restore, err := setThreadCredentials(*fc.runAs)
+		if err != nil {
+			getLogger().Error("unable to change the credentials", zap.String("worker", fc.scriptFilename), zap.Error(err))
+			fc.exitStatus = 1
+
+			return
+		}
+		defer restore()
+	}
+
+	if fc.phpCode != "" {
+		// phpCode is freed in frankenphp_execute_php_code()
+		fc.exitStatus = C.frankenphp_execute_php_code(C.CString(fc.phpCode))
+	} else {
+		var shutdownScript *C.char
+		if fc.workerShutdownScript != "" {
+			shutdownScript = C.CString(fc.workerShutdownScript)
+		}
+
+		// scriptFilename and shutdownScript are freed in frankenphp_execute_script()
+		fc.exitStatus = C.frankenphp_execute_script(C.CString(fc.scriptFilename), shutdownScript)
+	}
 	if fc.exitStatus < 0 {
 		panic(ScriptExecutionError)
 	}
 }
 
+// bufferResponseWriter collects the output of PHP code executed internally.
+type bufferResponseWriter struct {
+	bytes.Buffer
+	header http.Header
+}
+
+func (w *bufferResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferResponseWriter) WriteHeader(int) {}
+
+func (w *bufferResponseWriter) Flush() {}
+
+// executePHPCode executes PHP code on one of the PHP threads and returns its output.
+func executePHPCode(code string) ([]byte, error) {
+	if !running.Load() {
+		return nil, NotRunningError
+	}
+
+	shutdownWG.Add(1)
+	defer shutdownWG.Done()
+
+	r, err := http.NewRequest(http.MethodGet, "/", http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err = NewRequestWithContext(r)
+	if err != nil {
+		return nil, err
+	}
+
+	fc, _ := FromContext(r.Context())
+	fc.phpCode = code
+
+	// internal code bypasses the concurrency limits
+	w := &bufferResponseWriter{header: make(http.Header)}
+	if err := dispatchRequest(fc, w, r); err != nil {
+		return nil, err
+	}
+
+	if fc.exitStatus != 0 {
+		return nil, fmt.Errorf("%w: exit status %d: %s", ScriptExecutionError, int(fc.exitStatus), w.String())
+	}
+
+	return w.Bytes(), nil
+}
+
+//export go_frankenphp_watch_abort
+func go_frankenphp_watch_abort(rh C.uintptr_t, vmInterrupt unsafe.Pointer) {
+	r := cgo.Handle(rh).Value().(*http.Request)
+	fc := r.Context().Value(contextKey).(*FrankenPHPContext)
+
+	fc.abortWatcher = watchAbort(r.Context(), fc.bodyTimedOut, vmInterrupt)
+}
+
+//export go_frankenphp_watch_daemon
+func go_frankenphp_watch_daemon(mrh C.uintptr_t, vmInterrupt unsafe.Pointer) {
+	fc := cgo.Handle(mrh).Value().(*http.Request).Context().Value(contextKey).(*FrankenPHPContext)
+
+	if fc.daemonStop == nil {
+		return
+	}
+
+	// daemons may never return nor call frankenphp_handle_request(), they are interrupted to let FrankenPHP shut down
+	fc.abortWatcher = watchDaemon(fc.daemonStop, vmInterrupt)
+}
+
+//export go_frankenphp_daemon_stopping
+func go_frankenphp_daemon_stopping(mrh C.uintptr_t) bool {
+	fc := cgo.Handle(mrh).Value().(*http.Request).Context().Value(contextKey).(*FrankenPHPContext)
+
+	return fc.daemonStop != nil && isClosed(fc.daemonStop)
+}
+
+//export go_frankenphp_unwatch_abort
+func go_frankenphp_unwatch_abort(rh C.uintptr_t) {
+	fc := cgo.Handle(rh).Value().(*http.Request).Context().Value(contextKey).(*FrankenPHPContext)
+
+	if fc.abortWatcher != nil {
+		fc.abortWatcher.unwatch()
+		fc.abortWatcher = nil
+	}
+}
+
+//export go_client_has_closed
+func go_client_has_closed(rh C.uintptr_t) bool {
+	return clientHasClosed(cgo.Handle(rh).Value().(*http.Request))
+}
+
 //export go_ub_write
 func go_ub_write(rh C.uintptr_t, cBuf *C.char, length C.int) (C.size_t, C.bool) {
 	r := cgo.Handle(rh).Value().(*http.Request)
 	fc, _ := FromContext(r.Context())
 
+	// the response is discarded, the caller responds with an error instead
+	if isClosed(fc.bodyTimedOut) {
+		return C.size_t(length), true
+	}
+
 	var writer io.Writer
 	if fc.responseWriter == nil {
 		var b bytes.Buffer
@@ -539,18 +1111,39 @@ func go_ub_write(rh C.uintptr_t, cBuf *C.char, length C.int) (C.size_t, C.bool)
 	return C.size_t(i), C.bool(clientHasClosed(r))
 }
 
+// contentVariables are the names of the request headers exposed only as the CONTENT_TYPE and CONTENT_LENGTH variables,
+// without the HTTP_ prefix (RFC 3875, section 4.1.18).
+var contentVariables = map[string]struct{}{
+	"CONTENT_TYPE":   {},
+	"CONTENT_LENGTH": {},
+}
+
 //export go_register_variables
 func go_register_variables(rh C.uintptr_t, trackVarsArray *C.zval) {
 	r := cgo.Handle(rh).Value().(*http.Request)
 	fc := r.Context().Value(contextKey).(*FrankenPHPContext)
 
+	fc.env = fc.resolveEnv()
+	if r.TLS != nil {
+		fc.env = tlsClientVariables(fc.env, r.TLS)
+	}
+
 	le := (len(fc.env) + len(r.Header)) * 2
 	dynamicVariables := make([]*C.char, le)
 
 	var i int
 	// Add all HTTP headers to env variables
 	for field, val := range r.Header {
-		k := "HTTP_" + headerNameReplacer.Replace(strings.ToUpper(field))
+		name := headerVariableName(field)
+		if !fc.forwardsHeader(name) {
+			continue
+		}
+		// as required by the CGI specification, they are only conveyed by CONTENT_TYPE and CONTENT_LENGTH
+		if _, ok := contentVariables[name]; ok {
+			continue
+		}
+
+		k := "HTTP_" + name
 		if _, ok := fc.env[k]; ok {
 			continue
 		}
@@ -570,13 +1163,14 @@ func go_register_variables(rh C.uintptr_t, trackVarsArray *C.zval) {
 		i++
 	}
 
+	// the skipped headers leave unused entries at the end
 	var dynamicVariablesPtr **C.char = nil
-	if le > 0 {
+	if i > 0 {
 		dynamicVariablesPtr = &dynamicVariables[0]
 	}
 
 	knownVariables := computeKnownVariables(r)
-	C.frankenphp_register_bulk_variables(&knownVariables[0], dynamicVariablesPtr, C.size_t(le), trackVarsArray)
+	C.frankenphp_register_bulk_variables(&knownVariables[0], dynamicVariablesPtr, C.size_t(i), trackVarsArray)
 
 	fc.env = nil
 }
@@ -585,12 +1179,20 @@ func go_register_variables(rh C.uintptr_t, trackVarsArray *C.zval) {
 func go_apache_request_headers(rh C.uintptr_t) (*C.go_string, C.size_t) {
 	r := cgo.Handle(rh).Value().(*http.Request)
 
+	fc := r.Context().Value(contextKey).(*FrankenPHPContext)
+
 	rl := len(r.Header)
 	scs := unsafe.Sizeof(C.go_string{})
 
 	headers := (*C.go_string)(unsafe.Pointer(C.malloc(C.size_t(rl*2) * (C.size_t)(scs))))
 	header := headers
 	for field, val := range r.Header {
+		if !fc.forwardsHeader(headerVariableName(field)) {
+			rl--
+
+			continue
+		}
+
 		*header = C.go_string{C.size_t(len(field)), (*C.char)(unsafe.Pointer(unsafe.StringData(field)))}
 		header = (*C.go_string)(unsafe.Add(unsafe.Pointer(header), scs))
 
@@ -610,15 +1212,33 @@ func addHeader(fc *FrankenPHPContext, cString *C.char, length C.int) {
 		return
 	}
 
+	if fc.preserveHeaderCase && !interpretedHeaders[http.CanonicalHeaderKey(parts[0])] {
+		// bypass the canonicalization, HTTP/1 responses are written with the exact keys of the map
+		h := fc.responseWriter.Header()
+		h[parts[0]] = append(h[parts[0]], parts[1])
+
+		return
+	}
+
 	fc.responseWriter.Header().Add(parts[0], parts[1])
 }
 
+// interpretedHeaders are the response headers looked up by net/http using their canonical name, their case is never preserved.
+var interpretedHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Content-Type":      true,
+	"Date":              true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+}
+
 //export go_write_headers
 func go_write_headers(rh C.uintptr_t, status C.int, headers *C.zend_llist) {
 	r := cgo.Handle(rh).Value().(*http.Request)
 	fc := r.Context().Value(contextKey).(*FrankenPHPContext)
 
-	if fc.responseWriter == nil {
+	if fc.responseWriter == nil || isClosed(fc.bodyTimedOut) {
 		return
 	}
 
@@ -630,6 +1250,11 @@ func go_write_headers(rh C.uintptr_t, status C.int, headers *C.zend_llist) {
 		current = current.next
 	}
 
+	if status >= 200 {
+		normalizeConnectionHeader(fc.responseWriter.Header())
+		fc.updateUsage()
+	}
+
 	fc.responseWriter.WriteHeader(int(status))
 
 	if status >= 100 && status < 200 {
@@ -641,6 +1266,20 @@ func go_write_headers(rh C.uintptr_t, status C.int, headers *C.zend_llist) {
 	}
 }
 
+// normalizeConnectionHeader rewrites the Connection header set by PHP if it contains the "close" option,
+// net/http only closes the connection if the header is exactly "close".
+func normalizeConnectionHeader(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, o := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(o), "close") {
+				h.Set("Connection", "close")
+
+				return
+			}
+		}
+	}
+}
+
 //export go_sapi_flush
 func go_sapi_flush(rh C.uintptr_t) bool {
 	r := cgo.Handle(rh).Value().(*http.Request)
@@ -667,18 +1306,36 @@ func go_sapi_flush(rh C.uintptr_t) bool {
 //export go_read_post
 func go_read_post(rh C.uintptr_t, cBuf *C.char, countBytes C.size_t) (readBytes C.size_t) {
 	r := cgo.Handle(rh).Value().(*http.Request)
+	fc, _ := FromContext(r.Context())
+
+	var body io.Reader = r.Body
+	if fc.bodyReadTimeout > 0 {
+		if fc.bodyReader == nil {
+			fc.bodyReader = newBodyReader(r.Body, fc.bodyReadTimeout, func() {
+				close(fc.bodyTimedOut)
+
+				// unblock the pending read, if supported by the connection
+				if fc.responseWriter != nil {
+					_ = http.NewResponseController(fc.responseWriter).SetReadDeadline(time.Now())
+				}
+			})
+		}
+		body = fc.bodyReader
+	}
 
 	p := unsafe.Slice((*byte)(unsafe.Pointer(cBuf)), countBytes)
 	var err error
 	for readBytes < countBytes && err == nil {
 		var n int
-		n, err = r.Body.Read(p[readBytes:])
+		n, err = body.Read(p[readBytes:])
 		readBytes += C.size_t(n)
 	}
 
-	if err != nil && err != io.EOF {
+	switch {
+	case errors.Is(err, RequestBodyTimeoutError):
+		fc.logger.Debug("timeout while reading the request body", zap.Duration("timeout", fc.bodyReadTimeout))
+	case err != nil && err != io.EOF:
 		// invalid Read on closed Body may happen because of https://github.com/golang/go/issues/15527
-		fc, _ := FromContext(r.Context())
 		fc.logger.Error("error while reading the request body", zap.Error(err))
 	}
 
@@ -34,7 +34,14 @@ typedef struct frankenphp_config {
 } frankenphp_config;
 frankenphp_config frankenphp_get_config();
 
-int frankenphp_init(int num_threads);
+typedef struct frankenphp_usage {
+  int64_t cpu_time;
+  size_t memory_peak;
+} frankenphp_usage;
+frankenphp_usage frankenphp_get_usage();
+
+int frankenphp_init(int num_threads, char *php_ini_path,
+                    char *php_ini_entries);
 
 int frankenphp_update_server_context(
     bool create, uintptr_t current_request, uintptr_t main_request,
@@ -42,8 +49,11 @@ int frankenphp_update_server_context(
     const char *request_method, char *query_string, zend_long content_length,
     char *path_translated, char *request_uri, const char *content_type,
     char *auth_user, char *auth_password, int proto_num);
+int frankenphp_set_request_ini_entry(char *name, char *value, bool backup);
 int frankenphp_request_startup();
-int frankenphp_execute_script(char *file_name);
+int frankenphp_execute_script(char *file_name, char *shutdown_file_name);
+int frankenphp_execute_php_code(char *code);
+void frankenphp_interrupt(void *vm_interrupt);
 void frankenphp_register_bulk_variables(char *known_variables[27],
                                         char **dynamic_variables, size_t size,
                                         zval *track_vars_array);
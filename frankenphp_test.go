@@ -1,10 +1,14 @@
 package frankenphp_test
 
 import (
+	"bufio"
 	"context"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
@@ -16,7 +20,9 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/dunglas/frankenphp"
 	"github.com/stretchr/testify/assert"
@@ -166,6 +172,80 @@ func testServerVariable(t *testing.T, opts *testOptions) {
 	}, opts)
 }
 
+func TestContentVariables_module(t *testing.T) {
+	testContentVariables(t, nil)
+}
+func TestContentVariables_worker(t *testing.T) {
+	testContentVariables(t, &testOptions{workerScript: "server-variable.php"})
+}
+func testContentVariables(t *testing.T, opts *testOptions) {
+	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		req := httptest.NewRequest("POST", fmt.Sprintf("http://example.com/server-variable.php?i=%d", i), strings.NewReader("foo"))
+		req.Header.Set("Content-Type", "application/vnd.quirky+json ; charset=UTF-8")
+		req.Header.Set("Content-Length", "3")
+		req.Header.Set("X-Hidden", "secret")
+
+		cwd, _ := os.Getwd()
+		fr, err := frankenphp.NewRequestWithContext(req,
+			frankenphp.WithRequestDocumentRoot(cwd+"/testdata/", false),
+			frankenphp.WithRequestForwardedHeaders(nil, []string{"X-Hidden"}),
+		)
+		assert.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		assert.NoError(t, frankenphp.ServeHTTP(w, fr))
+
+		body, _ := io.ReadAll(w.Result().Body)
+		strBody := string(body)
+
+		// the values are passed as is, and only without the HTTP_ prefix
+		assert.Contains(t, strBody, "[CONTENT_TYPE] => application/vnd.quirky+json ; charset=UTF-8\n")
+		assert.Contains(t, strBody, "[CONTENT_LENGTH] => 3\n")
+		assert.NotContains(t, strBody, "[HTTP_CONTENT_TYPE]")
+		assert.NotContains(t, strBody, "[HTTP_CONTENT_LENGTH]")
+		assert.NotContains(t, strBody, "[HTTP_X_HIDDEN]")
+	}, opts)
+}
+
+func TestTLSClientVerify(t *testing.T) {
+	// expiring in 10 days and a few hours
+	cert := &x509.Certificate{NotAfter: time.Now().Add(10*24*time.Hour + 5*time.Hour)}
+
+	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, _ int) {
+		for name, tc := range map[string]struct {
+			peerCertificates []*x509.Certificate
+			verifiedChains   [][]*x509.Certificate
+			expected         []string
+		}{
+			"verified":   {[]*x509.Certificate{cert}, [][]*x509.Certificate{{cert}}, []string{"[SSL_CLIENT_VERIFY] => SUCCESS", "[SSL_CLIENT_V_REMAIN] => 10\n"}},
+			"unverified": {[]*x509.Certificate{cert}, nil, []string{"[SSL_CLIENT_VERIFY] => FAILED", "[SSL_CLIENT_V_REMAIN] => 10\n"}},
+			"none":       {nil, nil, []string{"[SSL_CLIENT_VERIFY] => NONE"}},
+		} {
+			req := httptest.NewRequest("GET", "https://example.com/server-variable.php", nil)
+			req.TLS.PeerCertificates = tc.peerCertificates
+			req.TLS.VerifiedChains = tc.verifiedChains
+			w := httptest.NewRecorder()
+			handler(w, req)
+
+			body, _ := io.ReadAll(w.Result().Body)
+			for _, expected := range tc.expected {
+				assert.Contains(t, string(body), expected, name)
+			}
+			if tc.peerCertificates == nil {
+				assert.NotContains(t, string(body), "[SSL_CLIENT_V_REMAIN]", name)
+			}
+		}
+
+		// the variables aren't set for plain HTTP requests
+		req := httptest.NewRequest("GET", "http://example.com/server-variable.php", nil)
+		w := httptest.NewRecorder()
+		handler(w, req)
+
+		body, _ := io.ReadAll(w.Result().Body)
+		assert.NotContains(t, string(body), "[SSL_CLIENT_VERIFY]")
+	}, &testOptions{nbParrallelRequests: 1})
+}
+
 func TestPathInfo_module(t *testing.T) { testPathInfo(t, nil) }
 func TestPathInfo_worker(t *testing.T) {
 	testPathInfo(t, &testOptions{workerScript: "server-variable.php"})
@@ -226,6 +306,110 @@ func testHeaders(t *testing.T, opts *testOptions) {
 	}, opts)
 }
 
+func TestForwardedHeaders(t *testing.T) {
+	cwd, _ := os.Getwd()
+	testDataDir := cwd + "/testdata/"
+
+	runTest(t, func(_ func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		for _, script := range []string{"server-variable.php", "apache-request-headers.php"} {
+			r := httptest.NewRequest("GET", "http://example.com/"+script, nil)
+			r.Header.Set("X-Accel-Redirect", "/secret")
+			r.Header["X_accel_redirect"] = []string{"/secret"}
+			r.Header.Set("X-Forwarded", "foo")
+			r.Header.Set("Accept", "text/plain")
+
+			req, err := frankenphp.NewRequestWithContext(r, frankenphp.WithRequestDocumentRoot(testDataDir, false), frankenphp.WithRequestForwardedHeaders([]string{"X-Accel-Redirect", "X-Forwarded"}, []string{"x-accel-redirect"}))
+			assert.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			assert.NoError(t, frankenphp.ServeHTTP(w, req))
+
+			body, _ := io.ReadAll(w.Result().Body)
+			assert.NotContains(t, string(body), "/secret")
+			assert.NotContains(t, string(body), "text/plain")
+			assert.Contains(t, string(body), "foo")
+		}
+	}, &testOptions{nbParrallelRequests: 1})
+}
+
+func TestPreserveHeaderCase(t *testing.T) {
+	cwd, _ := os.Getwd()
+	testDataDir := cwd + "/testdata/"
+
+	runTest(t, func(_ func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		for _, preserve := range []bool{true, false} {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				req, err := frankenphp.NewRequestWithContext(r, frankenphp.WithRequestDocumentRoot(testDataDir, false), frankenphp.WithRequestPreserveHeaderCase(preserve))
+				assert.NoError(t, err)
+				assert.NoError(t, frankenphp.ServeHTTP(w, req))
+			}))
+
+			// the HTTP client canonicalizes the headers, read the raw response
+			conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+			if assert.NoError(t, err) {
+				fmt.Fprint(conn, "GET /header-case.php HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+				resp, _ := io.ReadAll(conn)
+				conn.Close()
+
+				if preserve {
+					assert.Contains(t, string(resp), "\r\nWWW-authenticate: Basic realm=\"legacy\"\r\n")
+				} else {
+					assert.Contains(t, string(resp), "\r\nWww-Authenticate: Basic realm=\"legacy\"\r\n")
+				}
+				// the headers interpreted by net/http are always canonicalized
+				assert.Contains(t, string(resp), "\r\nContent-Type: text/plain\r\n")
+			}
+
+			ts.Close()
+		}
+	}, &testOptions{nbParrallelRequests: 1})
+}
+
+func TestPrecompressed(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(root+"/index.php", []byte("<?php echo 'php';"), 0644))
+	// the content doesn't need to be valid Brotli, it is sent as is
+	require.NoError(t, os.WriteFile(root+"/page.br", []byte("compressed page"), 0644))
+	require.NoError(t, os.WriteFile(root+"/style.css.br", []byte("compressed style"), 0644))
+
+	runTest(t, func(_ func(http.ResponseWriter, *http.Request), _ *httptest.Server, _ int) {
+		serve := func(path, acceptEncoding string) *http.Response {
+			r := httptest.NewRequest("GET", "http://example.com"+path, nil)
+			if acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", acceptEncoding)
+			}
+			req, err := frankenphp.NewRequestWithContext(r, frankenphp.WithRequestDocumentRoot(root, false), frankenphp.WithRequestPrecompressed(true))
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			assert.NoError(t, frankenphp.ServeHTTP(w, req))
+
+			return w.Result()
+		}
+
+		resp := serve("/page", "gzip, br")
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "compressed page", string(body))
+		assert.Equal(t, "br", resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+
+		resp = serve("/style.css", "br;q=0.5")
+		body, _ = io.ReadAll(resp.Body)
+		assert.Equal(t, "compressed style", string(body))
+		assert.Equal(t, "text/css; charset=utf-8", resp.Header.Get("Content-Type"))
+
+		// PHP handles the requests without compressed variant, and the ones of the clients not accepting Brotli
+		for path, acceptEncoding := range map[string]string{"/index.php": "br", "/style.css": "gzip, br;q=0"} {
+			resp = serve(path, acceptEncoding)
+			assert.Empty(t, resp.Header.Get("Content-Encoding"), path)
+		}
+		resp = serve("/index.php", "br")
+		body, _ = io.ReadAll(resp.Body)
+		assert.Equal(t, "php", string(body))
+	}, &testOptions{nbParrallelRequests: 1})
+}
+
 func TestInput_module(t *testing.T) { testInput(t, nil) }
 func TestInput_worker(t *testing.T) { testInput(t, &testOptions{workerScript: "input.php"}) }
 func testInput(t *testing.T, opts *testOptions) {
@@ -418,6 +602,33 @@ func testConnectionAbort(t *testing.T, opts *testOptions) {
 	testFinish("1")
 }
 
+func TestConnectionAbortWithoutOutput_module(t *testing.T) {
+	testConnectionAbortWithoutOutput(t, &testOptions{})
+}
+func TestConnectionAbortWithoutOutput_worker(t *testing.T) {
+	testConnectionAbortWithoutOutput(t, &testOptions{workerScript: "connection-aborted.php"})
+}
+func testConnectionAbortWithoutOutput(t *testing.T, opts *testOptions) {
+	logger, logs := observer.New(zap.InfoLevel)
+	opts.logger = zap.New(logger)
+	opts.nbParrallelRequests = 10
+
+	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		req := httptest.NewRequest("GET", fmt.Sprintf("http://example.com/connection-aborted.php?i=%d", i), nil)
+		ctx, cancel := context.WithCancel(req.Context())
+		req = req.WithContext(ctx)
+
+		time.AfterFunc(100*time.Millisecond, cancel)
+
+		start := time.Now()
+		handler(httptest.NewRecorder(), req)
+
+		// The script must observe the abort and return early, freeing the thread
+		assert.Less(t, time.Since(start), 4*time.Second)
+		assert.Equal(t, 1, logs.FilterMessage(fmt.Sprintf("request %d: aborted", i)).Len())
+	}, opts)
+}
+
 func TestException_module(t *testing.T) { testException(t, &testOptions{}) }
 func TestException_worker(t *testing.T) {
 	testException(t, &testOptions{workerScript: "exception.php"})
@@ -526,6 +737,84 @@ func testLargeRequest(t *testing.T, opts *testOptions) {
 	}, opts)
 }
 
+func TestRequestBodyReadTimeout_module(t *testing.T) { testRequestBodyReadTimeout(t, &testOptions{}) }
+func TestRequestBodyReadTimeout_worker(t *testing.T) {
+	testRequestBodyReadTimeout(t, &testOptions{workerScript: "input.php"})
+}
+func testRequestBodyReadTimeout(t *testing.T, opts *testOptions) {
+	cwd, _ := os.Getwd()
+	testDataDir := cwd + "/testdata/"
+
+	opts.nbParrallelRequests = 1
+	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		// the client sends the beginning of the body, then stalls
+		body, stall := io.Pipe()
+		defer stall.Close()
+		go func() {
+			_, _ = stall.Write([]byte("foo="))
+		}()
+
+		r := httptest.NewRequest("POST", "http://example.com/input.php", body)
+		r.ContentLength = 100
+		req, err := frankenphp.NewRequestWithContext(r, frankenphp.WithRequestDocumentRoot(testDataDir, false), frankenphp.WithRequestBodyReadTimeout(100*time.Millisecond))
+		require.NoError(t, err)
+
+		start := time.Now()
+		w := httptest.NewRecorder()
+		assert.ErrorIs(t, frankenphp.ServeHTTP(w, req), frankenphp.RequestBodyTimeoutError)
+		assert.Less(t, time.Since(start), 5*time.Second)
+
+		// the response of PHP is discarded
+		assert.Empty(t, w.Header().Get("Foo"))
+		assert.Empty(t, w.Body.String())
+
+		// the thread is available for the next requests
+		w = httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "http://example.com/input.php", strings.NewReader("bar")))
+		assert.Equal(t, "bar", w.Body.String())
+	}, opts)
+}
+
+func TestTotalRequests_module(t *testing.T) { testTotalRequests(t, &testOptions{}) }
+func TestTotalRequests_worker(t *testing.T) {
+	testTotalRequests(t, &testOptions{workerScript: "index.php"})
+}
+func testTotalRequests(t *testing.T, opts *testOptions) {
+	opts.nbParrallelRequests = 1
+	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		before := frankenphp.TotalRequests()
+		for j := 0; j < 3; j++ {
+			handler(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/index.php", nil))
+		}
+
+		assert.Equal(t, before+3, frankenphp.TotalRequests())
+	}, opts)
+}
+
+func TestUsage_module(t *testing.T) { testUsage(t, &testOptions{}) }
+func TestUsage_worker(t *testing.T) {
+	testUsage(t, &testOptions{workerScript: "cpu.php"})
+}
+func testUsage(t *testing.T, opts *testOptions) {
+	cwd, _ := os.Getwd()
+	testDataDir := cwd + "/testdata/"
+
+	opts.nbParrallelRequests = 1
+	runTest(t, func(_ func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		req, err := frankenphp.NewRequestWithContext(httptest.NewRequest("GET", "http://example.com/cpu.php?ms=100&alloc=4194304", nil), frankenphp.WithRequestDocumentRoot(testDataDir, false))
+		require.NoError(t, err)
+
+		start := time.Now()
+		require.NoError(t, frankenphp.ServeHTTP(httptest.NewRecorder(), req))
+		elapsed := time.Since(start)
+
+		fc, _ := frankenphp.FromContext(req.Context())
+		assert.GreaterOrEqual(t, fc.CPUTime(), 50*time.Millisecond)
+		assert.LessOrEqual(t, fc.CPUTime(), elapsed)
+		assert.GreaterOrEqual(t, fc.MemoryPeak(), uint64(4194304))
+	}, opts)
+}
+
 func TestVersion(t *testing.T) {
 	v := frankenphp.Version()
 
@@ -574,6 +863,199 @@ func testApacheRequestHeaders(t *testing.T, opts *testOptions) {
 	}, opts)
 }
 
+func TestShutdownWithInFlightRequest_module(t *testing.T) { testShutdownWithInFlightRequest(t, "") }
+func TestShutdownWithInFlightRequest_worker(t *testing.T) {
+	testShutdownWithInFlightRequest(t, "sleep.php")
+}
+func testShutdownWithInFlightRequest(t *testing.T, workerScript string) {
+	cwd, _ := os.Getwd()
+	testDataDir := cwd + "/testdata/"
+
+	opts := []frankenphp.Option{frankenphp.WithLogger(zaptest.NewLogger(t))}
+	if workerScript != "" {
+		opts = append(opts, frankenphp.WithWorkers(testDataDir+workerScript, 1, nil))
+	}
+	require.NoError(t, frankenphp.Init(opts...))
+
+	req, err := frankenphp.NewRequestWithContext(httptest.NewRequest("GET", "http://example.com/sleep.php?sleep=500", nil), frankenphp.WithRequestDocumentRoot(testDataDir, false))
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	served := make(chan struct{})
+	go func() {
+		assert.NoError(t, frankenphp.ServeHTTP(w, req))
+		close(served)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Simulate a handoff: the interpreter is stopped while a request is in-flight
+	frankenphp.Shutdown()
+	<-served
+
+	// The in-flight request must not be aborted
+	body, _ := io.ReadAll(w.Result().Body)
+	assert.Equal(t, "slept for 500 ms", string(body))
+}
+
+func TestAbortRequests(t *testing.T) {
+	cwd, _ := os.Getwd()
+	testDataDir := cwd + "/testdata/"
+
+	logger, logs := observer.New(zap.InfoLevel)
+	require.NoError(t, frankenphp.Init(frankenphp.WithLogger(zap.New(logger))))
+	defer frankenphp.Shutdown()
+
+	req, err := frankenphp.NewRequestWithContext(httptest.NewRequest("GET", "http://example.com/connection-aborted.php?i=0", nil), frankenphp.WithRequestDocumentRoot(testDataDir, false))
+	require.NoError(t, err)
+
+	time.AfterFunc(100*time.Millisecond, frankenphp.AbortRequests)
+
+	start := time.Now()
+	assert.NoError(t, frankenphp.ServeHTTP(httptest.NewRecorder(), req))
+
+	assert.Less(t, time.Since(start), 4*time.Second)
+	assert.Equal(t, 1, logs.FilterMessage("request 0: aborted").Len())
+}
+
+func TestRequestsAborterAfterRestart(t *testing.T) {
+	cwd, _ := os.Getwd()
+	testDataDir := cwd + "/testdata/"
+
+	require.NoError(t, frankenphp.Init(frankenphp.WithLogger(zaptest.NewLogger(t))))
+	abortRequests := frankenphp.RequestsAborter()
+	frankenphp.Shutdown()
+
+	logger, logs := observer.New(zap.InfoLevel)
+	require.NoError(t, frankenphp.Init(frankenphp.WithLogger(zap.New(logger))))
+	defer frankenphp.Shutdown()
+
+	// a late abort of the stopped runtime, e.g. when its grace period is exceeded during a reload
+	abortRequests()
+
+	req, err := frankenphp.NewRequestWithContext(httptest.NewRequest("GET", "http://example.com/connection-aborted.php?i=1&timeout=0.5", nil), frankenphp.WithRequestDocumentRoot(testDataDir, false))
+	require.NoError(t, err)
+
+	assert.NoError(t, frankenphp.ServeHTTP(httptest.NewRecorder(), req))
+	assert.Equal(t, 1, logs.FilterMessage("request 1: not aborted").Len())
+}
+
+func TestConnectionClose_module(t *testing.T) { testConnectionClose(t, &testOptions{}) }
+func TestConnectionClose_worker(t *testing.T) {
+	testConnectionClose(t, &testOptions{workerScript: "connection-close.php"})
+}
+func testConnectionClose(t *testing.T, opts *testOptions) {
+	opts.realServer = true
+	runTest(t, func(_ func(http.ResponseWriter, *http.Request), ts *httptest.Server, i int) {
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		fmt.Fprintf(conn, "GET /connection-close.php?i=%d HTTP/1.1\r\nHost: example.com\r\n\r\n", i)
+
+		r := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(r, nil)
+		require.NoError(t, err)
+
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "bye", string(body))
+		assert.Equal(t, "close", resp.Header.Get("Connection"))
+
+		// The server must close the connection
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = r.ReadByte()
+		assert.True(t, errors.Is(err, io.EOF), "expected the connection to be closed, got %v", err)
+	}, opts)
+}
+
+// concurrencyRecorder tracks how many scripts are running at the same time
+type concurrencyRecorder struct {
+	*httptest.ResponseRecorder
+	running, peak *atomic.Int32
+}
+
+func (r concurrencyRecorder) Write(b []byte) (int, error) {
+	switch string(b) {
+	case "start":
+		n := r.running.Add(1)
+		for {
+			m := r.peak.Load()
+			if n <= m || r.peak.CompareAndSwap(m, n) {
+				break
+			}
+		}
+	case "end":
+		r.running.Add(-1)
+	}
+
+	return r.ResponseRecorder.Write(b)
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	var running, peak atomic.Int32
+
+	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		req := httptest.NewRequest("GET", fmt.Sprintf("http://example.com/concurrency.php?i=%d", i), nil)
+		w := concurrencyRecorder{httptest.NewRecorder(), &running, &peak}
+		handler(w, req)
+
+		body, _ := io.ReadAll(w.Result().Body)
+		assert.Equal(t, "startend", string(body))
+	}, &testOptions{nbParrallelRequests: 20, initOpts: []frankenphp.Option{frankenphp.WithMaxConcurrentRequests(3, 0)}})
+
+	assert.LessOrEqual(t, peak.Load(), int32(3))
+	assert.Greater(t, peak.Load(), int32(0))
+}
+
+func TestMaxConcurrentRequestsQueueTimeout(t *testing.T) {
+	cwd, _ := os.Getwd()
+	testDataDir := cwd + "/testdata/"
+
+	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		served := make(chan struct{})
+		go func() {
+			handler(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/sleep.php?sleep=500", nil))
+			close(served)
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		req, err := frankenphp.NewRequestWithContext(httptest.NewRequest("GET", "http://example.com/index.php", nil), frankenphp.WithRequestDocumentRoot(testDataDir, false))
+		require.NoError(t, err)
+		assert.ErrorIs(t, frankenphp.ServeHTTP(httptest.NewRecorder(), req), frankenphp.QueueTimeoutError)
+
+		<-served
+	}, &testOptions{nbParrallelRequests: 1, initOpts: []frankenphp.Option{frankenphp.WithMaxConcurrentRequests(1, 10*time.Millisecond)}})
+}
+
+func TestLogMessages(t *testing.T) {
+	for mode, expected := range map[frankenphp.LogMessages]string{
+		frankenphp.LogMessagesVerbose: "FrankenPHP started 🐘",
+		frankenphp.LogMessagesQuiet:   "FrankenPHP started",
+		frankenphp.LogMessagesJSON:    "frankenphp.start",
+	} {
+		core, logs := observer.New(zap.InfoLevel)
+		logger := zap.New(core)
+
+		require.NoError(t, frankenphp.Init(frankenphp.WithLogger(logger), frankenphp.WithLogMessages(mode)))
+		frankenphp.Shutdown()
+		frankenphp.LogLifecycle(logger, "stop")
+		frankenphp.LogLifecycle(logger, "embedded_app", zap.String("path", "/tmp/app"))
+
+		started := logs.FilterMessage(expected).All()
+		if assert.Len(t, started, 1, "mode %d", mode) {
+			assert.NotEmpty(t, started[0].ContextMap()["php_version"])
+			if mode == frankenphp.LogMessagesJSON {
+				assert.Equal(t, "start", started[0].ContextMap()["event"])
+			}
+		}
+
+		assert.Equal(t, 1, logs.FilterMessageSnippet("stopped").Len()+logs.FilterMessage("frankenphp.stop").Len(), "mode %d", mode)
+		// the decorative messages are only suppressed in quiet mode
+		assert.Equal(t, mode != frankenphp.LogMessagesQuiet, logs.FilterField(zap.String("path", "/tmp/app")).Len() == 1, "mode %d", mode)
+	}
+
+	assert.Error(t, frankenphp.Init(frankenphp.WithLogMessages(frankenphp.LogMessages(42))))
+}
+
 func TestExecuteScriptCLI(t *testing.T) {
 	if _, err := os.Stat("internal/testcli/testcli"); err != nil {
 		t.Skip("internal/testcli/testcli has not been compiled, run `cd internal/testcli/ && go build`")
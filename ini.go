@@ -0,0 +1,95 @@
+package frankenphp
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const postMaxSizeCode = `echo ini_parse_quantity(ini_get('post_max_size'));`
+
+// PostMaxSize returns the maximum size of the POST data in bytes, as set by the post_max_size php.ini directive.
+// 0 means unlimited.
+func PostMaxSize() (int64, error) {
+	out, err := executePHPCode(postMaxSizeCode)
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := strconv.ParseInt(string(out), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid post_max_size: %w", err)
+	}
+
+	return size, nil
+}
+
+// runtimeIni contains the php.ini directives changed by ApplyIni, applied to every request.
+var runtimeIni atomic.Pointer[map[string]string]
+
+// checkIniCode reports, for every directive, why it can't be set to the given value, or an empty string.
+// The values are set with ini_set(), as the app would, then restored at the end of the request.
+const checkIniCode = `$all = ini_get_all(null, true);
+$errors = [];
+foreach ([%s] as $name => $value) {
+	if (!isset($all[$name])) {
+		$errors[$name] = 'unknown directive';
+	} elseif (!($all[$name]['access'] & INI_USER)) {
+		$errors[$name] = 'not changeable at runtime';
+	} elseif (ini_set($name, $value) === false) {
+		$errors[$name] = 'invalid value';
+	} else {
+		$errors[$name] = '';
+	}
+}
+echo json_encode($errors);`
+
+// ApplyIni changes php.ini directives for all the following requests, on all the PHP threads, without restarting the workers.
+// Only the directives that can be changed at runtime with ini_set() are supported, the others are rejected with IniNotChangeableError
+// and nothing is changed. Request-level directives (see WithRequestPHPIni) and ini_set() calls take precedence.
+// The changes last until FrankenPHP is stopped.
+func ApplyIni(directives map[string]string) error {
+	if len(directives) == 0 {
+		return nil
+	}
+
+	entries := make([]string, 0, len(directives))
+	for k, v := range directives {
+		entries = append(entries, phpString(k)+" => "+phpString(v))
+	}
+
+	out, err := executePHPCode(fmt.Sprintf(checkIniCode, strings.Join(entries, ", ")))
+	if err != nil {
+		return err
+	}
+
+	var errs map[string]string
+	if err := json.Unmarshal(out, &errs); err != nil {
+		return fmt.Errorf("unable to check the php.ini directives: %w", err)
+	}
+	for k := range directives {
+		if reason, ok := errs[k]; !ok || reason != "" {
+			return fmt.Errorf("php.ini directive %q: %w: %s", k, IniNotChangeableError, reason)
+		}
+	}
+
+	for {
+		current := runtimeIni.Load()
+
+		ini := make(map[string]string, len(directives))
+		if current != nil {
+			for k, v := range *current {
+				ini[k] = v
+			}
+		}
+		for k, v := range directives {
+			ini[k] = v
+		}
+
+		if runtimeIni.CompareAndSwap(current, &ini) {
+			return nil
+		}
+	}
+}
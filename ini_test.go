@@ -0,0 +1,112 @@
+package frankenphp_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/dunglas/frankenphp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostMaxSize(t *testing.T) {
+	runTest(t, func(_ func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		size, err := frankenphp.PostMaxSize()
+		assert.NoError(t, err)
+		// the default value of post_max_size is 8M
+		assert.Equal(t, int64(8*1024*1024), size)
+	}, &testOptions{nbParrallelRequests: 1})
+}
+
+func TestPostMaxSizeNotRunning(t *testing.T) {
+	_, err := frankenphp.PostMaxSize()
+	assert.ErrorIs(t, err, frankenphp.NotRunningError)
+}
+
+func TestIniFile(t *testing.T) {
+	cwd, _ := os.Getwd()
+	initOpts := []frankenphp.Option{
+		frankenphp.WithIniFile(cwd + "/testdata/alternate.ini"),
+		frankenphp.WithPhpFlags("-d", "precision=12"),
+	}
+
+	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		size, err := frankenphp.PostMaxSize()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(16*1024*1024), size)
+
+		// -d flags take precedence over the ini file
+		assert.Equal(t, "12", iniGet(handler, "precision"))
+	}, &testOptions{nbParrallelRequests: 1, initOpts: initOpts})
+}
+
+func TestPhpFlags(t *testing.T) {
+	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		assert.Equal(t, "1", iniGet(handler, "display_errors"))
+		assert.Equal(t, "&amp;", iniGet(handler, "arg_separator.output"))
+	}, &testOptions{nbParrallelRequests: 1, initOpts: []frankenphp.Option{frankenphp.WithPhpFlags("-ddisplay_errors", "-d", "arg_separator.output=&amp;")}})
+}
+
+func TestPhpFlagsUnsupported(t *testing.T) {
+	assert.Error(t, frankenphp.Init(frankenphp.WithPhpFlags("-n")))
+	assert.Error(t, frankenphp.Init(frankenphp.WithPhpFlags("-d")))
+	assert.Error(t, frankenphp.Init(frankenphp.WithPhpFlags("-d", "foo=bar\nbaz=qux")))
+}
+
+func TestTimezone(t *testing.T) {
+	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		req := httptest.NewRequest("GET", "http://example.com/timezone.php", nil)
+		w := httptest.NewRecorder()
+		handler(w, req)
+
+		body, _ := io.ReadAll(w.Result().Body)
+		assert.Equal(t, "Europe/Paris", string(body))
+		assert.Equal(t, "Europe/Paris", iniGet(handler, "date.timezone"))
+	}, &testOptions{nbParrallelRequests: 1, initOpts: []frankenphp.Option{frankenphp.WithTimezone("Europe/Paris")}})
+}
+
+func TestTimezoneInvalid(t *testing.T) {
+	assert.Error(t, frankenphp.Init(frankenphp.WithTimezone("Mars/Olympus_Mons")))
+	assert.Error(t, frankenphp.Init(frankenphp.WithTimezone("Local")))
+}
+
+func TestApplyIni(t *testing.T) {
+	for name, opts := range map[string]*testOptions{
+		"module": {nbParrallelRequests: 1},
+		"worker": {workerScript: "ini.php", nbWorkers: 1, nbParrallelRequests: 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+				assert.Equal(t, "14", iniGet(handler, "precision"))
+
+				assert.NoError(t, frankenphp.ApplyIni(map[string]string{"precision": "10"}))
+				assert.Equal(t, "10", iniGet(handler, "precision"))
+				assert.Equal(t, "10", iniGet(handler, "precision"))
+
+				// nothing is changed if a directive is rejected
+				err := frankenphp.ApplyIni(map[string]string{"precision": "12", "extension_dir": "/tmp"})
+				assert.ErrorIs(t, err, frankenphp.IniNotChangeableError)
+				assert.ErrorContains(t, err, "extension_dir")
+				assert.Equal(t, "10", iniGet(handler, "precision"))
+
+				assert.ErrorIs(t, frankenphp.ApplyIni(map[string]string{"unknown_directive": "1"}), frankenphp.IniNotChangeableError)
+			}, opts)
+		})
+	}
+}
+
+func TestApplyIniNotRunning(t *testing.T) {
+	assert.ErrorIs(t, frankenphp.ApplyIni(map[string]string{"precision": "10"}), frankenphp.NotRunningError)
+}
+
+func iniGet(handler func(http.ResponseWriter, *http.Request), name string) string {
+	req := httptest.NewRequest("GET", "http://example.com/ini.php?name="+name, nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	body, _ := io.ReadAll(w.Result().Body)
+
+	return string(body)
+}
@@ -0,0 +1,57 @@
+package frankenphp
+
+import (
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// LogMessages controls the format and the verbosity of the lifecycle log lines of FrankenPHP (start, stop, reload).
+type LogMessages int32
+
+const (
+	// LogMessagesVerbose logs the lifecycle events with decorated messages, the default.
+	LogMessagesVerbose LogMessages = iota
+	// LogMessagesQuiet logs the lifecycle events with plain messages and doesn't log the decorative ones.
+	LogMessagesQuiet
+	// LogMessagesJSON logs the lifecycle events with stable messages and an "event" field, for log-parsing pipelines.
+	LogMessagesJSON
+)
+
+// lifecycleMessage is the message logged for a lifecycle event in each mode.
+type lifecycleMessage struct {
+	verbose, quiet string
+	// decorative messages aren't logged in quiet mode
+	decorative bool
+}
+
+var lifecycleMessages = map[string]lifecycleMessage{
+	"start":        {verbose: "FrankenPHP started 🐘", quiet: "FrankenPHP started"},
+	"stop":         {verbose: "FrankenPHP stopped 🐘", quiet: "FrankenPHP stopped"},
+	"reload":       {verbose: "FrankenPHP reloaded 🐘", quiet: "FrankenPHP reloaded"},
+	"embedded_app": {verbose: "embedded PHP app 📦", quiet: "embedded PHP app", decorative: true},
+}
+
+// logMessages is the mode of the lifecycle log lines, it outlives Shutdown so that the stop event uses it.
+var logMessages atomic.Int32
+
+// LogLifecycle logs a lifecycle event ("start", "stop", "reload" or "embedded_app") according to the mode configured with WithLogMessages.
+func LogLifecycle(l *zap.Logger, event string, fields ...zap.Field) {
+	m, ok := lifecycleMessages[event]
+	if !ok {
+		return
+	}
+
+	switch LogMessages(logMessages.Load()) {
+	case LogMessagesQuiet:
+		if m.decorative {
+			return
+		}
+
+		l.Info(m.quiet, fields...)
+	case LogMessagesJSON:
+		l.Info("frankenphp."+event, append([]zap.Field{zap.String("event", event)}, fields...)...)
+	default:
+		l.Info(m.verbose, fields...)
+	}
+}
@@ -0,0 +1,105 @@
+package frankenphp
+
+import (
+	"encoding/json"
+)
+
+// OpcacheStats contains the statistics of the opcode cache, shared by all the PHP threads.
+type OpcacheStats struct {
+	// Enabled is false if the opcache extension isn't loaded or enabled, in this case the other fields are empty.
+	Enabled bool
+	// CacheFull is true if the opcode cache is full.
+	CacheFull bool
+	// HitRate is the percentage of scripts served from the cache.
+	HitRate float64
+	// CachedScripts is the number of scripts in the cache.
+	CachedScripts int
+	// UsedMemory, FreeMemory and WastedMemory are the usage of the shared memory in bytes.
+	UsedMemory, FreeMemory, WastedMemory int
+	// InternedStringsUsedMemory and InternedStringsBufferSize are the usage of the interned strings buffer in bytes.
+	InternedStringsUsedMemory, InternedStringsBufferSize int
+}
+
+// InternedStringsSaturation returns the ratio of the interned strings buffer that is used, between 0 and 1.
+func (s OpcacheStats) InternedStringsSaturation() float64 {
+	if s.InternedStringsBufferSize == 0 {
+		return 0
+	}
+
+	return float64(s.InternedStringsUsedMemory) / float64(s.InternedStringsBufferSize)
+}
+
+const opcacheStatusCode = `echo json_encode(function_exists('opcache_get_status') ? opcache_get_status(false) : false);`
+
+// opcacheStatus mirrors the parts of the array returned by opcache_get_status() we are interested in.
+type opcacheStatus struct {
+	OpcacheEnabled bool `json:"opcache_enabled"`
+	CacheFull      bool `json:"cache_full"`
+	MemoryUsage    struct {
+		UsedMemory   int `json:"used_memory"`
+		FreeMemory   int `json:"free_memory"`
+		WastedMemory int `json:"wasted_memory"`
+	} `json:"memory_usage"`
+	InternedStringsUsage struct {
+		BufferSize int `json:"buffer_size"`
+		UsedMemory int `json:"used_memory"`
+	} `json:"interned_strings_usage"`
+	OpcacheStatistics struct {
+		NumCachedScripts int     `json:"num_cached_scripts"`
+		OpcacheHitRate   float64 `json:"opcache_hit_rate"`
+	} `json:"opcache_statistics"`
+}
+
+// ReadOpcacheStats returns the statistics of the opcode cache, as reported by opcache_get_status().
+func ReadOpcacheStats() (OpcacheStats, error) {
+	out, err := executePHPCode(opcacheStatusCode)
+	if err != nil {
+		return OpcacheStats{}, err
+	}
+
+	// opcache_get_status() returns false when opcache is disabled
+	if string(out) == "false" {
+		return OpcacheStats{}, nil
+	}
+
+	var status opcacheStatus
+	if err := json.Unmarshal(out, &status); err != nil {
+		return OpcacheStats{}, err
+	}
+	if !status.OpcacheEnabled {
+		return OpcacheStats{}, nil
+	}
+
+	return OpcacheStats{
+		Enabled:                   true,
+		CacheFull:                 status.CacheFull,
+		HitRate:                   status.OpcacheStatistics.OpcacheHitRate,
+		CachedScripts:             status.OpcacheStatistics.NumCachedScripts,
+		UsedMemory:                status.MemoryUsage.UsedMemory,
+		FreeMemory:                status.MemoryUsage.FreeMemory,
+		WastedMemory:              status.MemoryUsage.WastedMemory,
+		InternedStringsUsedMemory: status.InternedStringsUsage.UsedMemory,
+		InternedStringsBufferSize: status.InternedStringsUsage.BufferSize,
+	}, nil
+}
+
+const opcacheResetCode = `echo function_exists('opcache_reset') && opcache_reset() ? 'ok' : 'ko';`
+
+// ResetOpcache invalidates the opcode cache, for instance after a deployment, so that updated scripts are compiled again.
+//
+// The opcode cache is stored in shared memory, so resetting it from one thread resets it for all the PHP threads,
+// including the ones running workers (scripts already loaded by workers are not reloaded).
+// The reset is applied by PHP at the start of the next request.
+// It returns the number of threads using the reset cache.
+func ResetOpcache() (int, error) {
+	out, err := executePHPCode(opcacheResetCode)
+	if err != nil {
+		return 0, err
+	}
+
+	if string(out) != "ok" {
+		return 0, OpcacheNotEnabledError
+	}
+
+	return numThreads, nil
+}
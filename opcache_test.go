@@ -0,0 +1,113 @@
+package frankenphp_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dunglas/frankenphp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadOpcacheStats(t *testing.T) {
+	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/index.php", nil))
+
+		stats, err := frankenphp.ReadOpcacheStats()
+		require.NoError(t, err)
+
+		if stats.Enabled {
+			assert.Greater(t, stats.UsedMemory, 0)
+			assert.Greater(t, stats.InternedStringsBufferSize, 0)
+			assert.LessOrEqual(t, stats.InternedStringsSaturation(), 1.0)
+		}
+	}, &testOptions{nbParrallelRequests: 1})
+}
+
+func TestReadOpcacheStatsNotRunning(t *testing.T) {
+	_, err := frankenphp.ReadOpcacheStats()
+	assert.ErrorIs(t, err, frankenphp.NotRunningError)
+}
+
+func TestResetOpcache(t *testing.T) {
+	cwd, _ := os.Getwd()
+	testDataDir := cwd + "/testdata/"
+
+	script, err := os.CreateTemp(testDataDir, "opcache-reset-*.php")
+	require.NoError(t, err)
+	script.Close()
+	defer os.Remove(script.Name())
+
+	runTest(t, func(_ func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		stats, err := frankenphp.ReadOpcacheStats()
+		require.NoError(t, err)
+		if !stats.Enabled {
+			t.Log("opcache is not enabled")
+
+			return
+		}
+
+		fetch := func() string {
+			// Disable the validation of timestamps to simulate a production setup
+			req, err := frankenphp.NewRequestWithContext(
+				httptest.NewRequest("GET", "http://example.com/"+filepath.Base(script.Name()), nil),
+				frankenphp.WithRequestDocumentRoot(testDataDir, false),
+				frankenphp.WithRequestPHPIni(map[string]string{"opcache.validate_timestamps": "0", "opcache.file_update_protection": "0"}),
+			)
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			require.NoError(t, frankenphp.ServeHTTP(w, req))
+
+			body, _ := io.ReadAll(w.Result().Body)
+
+			return string(body)
+		}
+
+		require.NoError(t, os.WriteFile(script.Name(), []byte("<?php echo 'v1';"), 0644))
+		assert.Equal(t, "v1", fetch())
+
+		require.NoError(t, os.WriteFile(script.Name(), []byte("<?php echo 'v2';"), 0644))
+		assert.Equal(t, "v1", fetch())
+
+		n, err := frankenphp.ResetOpcache()
+		require.NoError(t, err)
+		assert.Greater(t, n, 0)
+
+		assert.Equal(t, "v2", fetch())
+	}, &testOptions{nbParrallelRequests: 1})
+}
+
+func TestResetOpcacheNotRunning(t *testing.T) {
+	_, err := frankenphp.ResetOpcache()
+	assert.ErrorIs(t, err, frankenphp.NotRunningError)
+}
+
+func TestReadOpcacheStatsBypassesConcurrencyLimit(t *testing.T) {
+	cwd, _ := os.Getwd()
+	testDataDir := cwd + "/testdata/"
+
+	require.NoError(t, frankenphp.Init(frankenphp.WithMaxConcurrentRequests(1, 10*time.Millisecond)))
+	defer frankenphp.Shutdown()
+
+	req, err := frankenphp.NewRequestWithContext(httptest.NewRequest("GET", "http://example.com/sleep.php?sleep=500", nil), frankenphp.WithRequestDocumentRoot(testDataDir, false))
+	require.NoError(t, err)
+
+	served := make(chan struct{})
+	go func() {
+		assert.NoError(t, frankenphp.ServeHTTP(httptest.NewRecorder(), req))
+		close(served)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// the only request slot is taken, internal code must not wait for it
+	_, err = frankenphp.ReadOpcacheStats()
+	assert.NoError(t, err)
+
+	<-served
+}
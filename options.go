@@ -1,6 +1,12 @@
 package frankenphp
 
 import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
 	"go.uber.org/zap"
 )
 
@@ -11,15 +17,49 @@ type Option func(h *opt) error
 //
 // If you change this, also update the Caddy module and the documentation.
 type opt struct {
-	numThreads int
-	workers    []workerOpt
-	logger     *zap.Logger
+	numThreads            int
+	workers               []workerOpt
+	logger                *zap.Logger
+	logMessages           LogMessages
+	maxConcurrentRequests int
+	queueTimeout          time.Duration
+	warmupParallelism     int
+	reservedThreads       int
+	iniFile               string
+	phpIniEntries         []string
+	// the options of the workers, applied once all the workers are configured
+	workerOptions []func(*opt) error
 }
 
 type workerOpt struct {
-	fileName string
-	num      int
-	env      map[string]string
+	fileName          string
+	num               int
+	env               map[string]string
+	restartBackoffMin time.Duration
+	restartBackoffMax time.Duration
+	idleTimeout       time.Duration
+	minWorkers        int
+	runAs             *credentials
+	queueSize         int
+	shutdownScript    string
+	stickyBy          stickyKey
+	dispatch          string
+	retryOnRestart    int
+	warmupRequest     string
+	warmupFatal       bool
+	standby           int
+	maxLifetime       time.Duration
+	daemon            bool
+}
+
+// stickyKey identifies the request cookie or header used to bind requests to a worker instance.
+type stickyKey struct {
+	source, name string
+}
+
+// credentials are the user and group IDs used to access the filesystem.
+type credentials struct {
+	uid, gid int
 }
 
 // WithNumThreads configures the number of PHP threads to start.
@@ -34,12 +74,224 @@ func WithNumThreads(numThreads int) Option {
 // WithWorkers configures the PHP workers to start.
 func WithWorkers(fileName string, num int, env map[string]string) Option {
 	return func(o *opt) error {
-		o.workers = append(o.workers, workerOpt{fileName, num, env})
+		o.workers = append(o.workers, workerOpt{fileName: fileName, num: num, env: env})
 
 		return nil
 	}
 }
 
+// withWorkerOption returns an Option applying f to the workers configured for fileName.
+// It is applied once all the options are, so that it doesn't depend on the order of the options.
+func withWorkerOption(fileName string, f func(w *workerOpt) error) Option {
+	return func(o *opt) error {
+		o.workerOptions = append(o.workerOptions, func(o *opt) error {
+			found := false
+			for i := range o.workers {
+				if o.workers[i].fileName == fileName {
+					if err := f(&o.workers[i]); err != nil {
+						return err
+					}
+					found = true
+				}
+			}
+
+			if !found {
+				return fmt.Errorf("workers %q: not configured", fileName)
+			}
+
+			return nil
+		})
+
+		return nil
+	}
+}
+
+// WithWorkerRestartBackoff configures the delay before restarting the crashed instances of the workers configured for fileName.
+// The delay starts at minDelay and doubles after each successive crash, up to maxDelay. It is reset when an instance runs longer than maxDelay.
+func WithWorkerRestartBackoff(fileName string, minDelay, maxDelay time.Duration) Option {
+	return withWorkerOption(fileName, func(w *workerOpt) error {
+		if minDelay < 0 || maxDelay < minDelay {
+			return fmt.Errorf("workers %q: invalid restart backoff", fileName)
+		}
+
+		w.restartBackoffMin = minDelay
+		w.restartBackoffMax = maxDelay
+
+		return nil
+	})
+}
+
+// WithWorkerIdleTimeout stops the instances of the workers configured for fileName that didn't handle
+// any request for idleTimeout, to release their resources. Stopped instances are started again when requests come in.
+// At least minWorkers instances are kept running.
+func WithWorkerIdleTimeout(fileName string, idleTimeout time.Duration, minWorkers int) Option {
+	return withWorkerOption(fileName, func(w *workerOpt) error {
+		if idleTimeout < 0 || minWorkers < 0 {
+			return fmt.Errorf("workers %q: invalid idle timeout", fileName)
+		}
+
+		w.idleTimeout = idleTimeout
+		w.minWorkers = minWorkers
+
+		return nil
+	})
+}
+
+// WithWorkerMaxLifetime gracefully recycles the instances of the workers configured for fileName once they have been running for maxLifetime,
+// e.g. to pick up rotated secrets: the instance stops after the request it is handling, if any, and is restarted.
+// The recycling of the instances is staggered over an extra 10% of maxLifetime, so that they aren't all restarted at the same time.
+func WithWorkerMaxLifetime(fileName string, maxLifetime time.Duration) Option {
+	return withWorkerOption(fileName, func(w *workerOpt) error {
+		if maxLifetime < 0 {
+			return fmt.Errorf("workers %q: invalid max lifetime", fileName)
+		}
+
+		w.maxLifetime = maxLifetime
+
+		return nil
+	})
+}
+
+// WithWorkerDaemon runs the workers configured for fileName as daemons, e.g. queue consumers:
+// they aren't dispatched any HTTP request, ServeHTTP returns DaemonWorkerError for requests targeting them,
+// and they are restarted every time they exit. In a daemon, frankenphp_handle_request() waits until FrankenPHP shuts down.
+// When FrankenPHP shuts down, the running daemons are stopped at the next executed instruction, as if they called exit().
+// They can't be used with standby instances, sticky requests, idle timeouts nor warmup requests.
+func WithWorkerDaemon(fileName string) Option {
+	return withWorkerOption(fileName, func(w *workerOpt) error {
+		w.daemon = true
+
+		return nil
+	})
+}
+
+// WithWorkerShutdownScript configures a script executed by every instance of the workers configured for fileName when it stops,
+// because it is recycled or FrankenPHP is shutting down. It is executed once per instance, after the worker script,
+// in the same PHP request: the global variables of the worker (e.g. connections to close cleanly) are available.
+func WithWorkerShutdownScript(fileName, shutdownScript string) Option {
+	return withWorkerOption(fileName, func(w *workerOpt) error {
+		w.shutdownScript = shutdownScript
+
+		return nil
+	})
+}
+
+// WithWorkerQueueSize caps the number of requests waiting for an instance of the workers configured for fileName.
+// When the queue is full, ServeHTTP returns WorkerQueueFullError. 0 means unlimited.
+func WithWorkerQueueSize(fileName string, size int) Option {
+	return withWorkerOption(fileName, func(w *workerOpt) error {
+		if size < 0 {
+			return fmt.Errorf("workers %q: invalid queue size", fileName)
+		}
+
+		w.queueSize = size
+
+		return nil
+	})
+}
+
+// WithWorkerRunAs makes the instances of the workers configured for fileName access the filesystem
+// as the given user and group IDs. Only the filesystem IDs of the threads running these workers are changed:
+// other privileges (signals, supplementary groups...) remain those of the process, which must be allowed to change them (e.g. root).
+// It is only supported on Linux (amd64 and arm64).
+func WithWorkerRunAs(fileName string, uid, gid int) Option {
+	return withWorkerOption(fileName, func(w *workerOpt) error {
+		if !runAsSupported {
+			return fmt.Errorf("workers %q: run_as is not supported on this platform", fileName)
+		}
+		if uid < 0 || gid < 0 {
+			return fmt.Errorf("workers %q: invalid user or group ID", fileName)
+		}
+
+		w.runAs = &credentials{uid: uid, gid: gid}
+
+		return nil
+	})
+}
+
+// WithWorkerRetryOnRestart retries up to maxRetries times the idempotent requests (GET and HEAD) handled by the workers configured for fileName
+// when the instance handling them stops before responding, e.g. because it is recycled: the request is sent to the next available instance.
+// Their responses are buffered until they are complete or flushed by PHP, they can't be retried anymore then. Other requests are never retried.
+func WithWorkerRetryOnRestart(fileName string, maxRetries int) Option {
+	return withWorkerOption(fileName, func(w *workerOpt) error {
+		if maxRetries < 0 {
+			return fmt.Errorf("workers %q: invalid number of retries", fileName)
+		}
+
+		w.retryOnRestart = maxRetries
+
+		return nil
+	})
+}
+
+// WithWorkerStandby starts standby instances of the workers configured for fileName in addition to the active ones.
+// Standby instances boot but don't handle requests: when an active instance crashes, a standby instance takes over,
+// and the crashed instance restarts as a standby instance, keeping the capacity stable.
+// It can't be used with WithWorkerStickyBy nor with WithWorkerDispatch: the requests bound to an instance can't be moved to the standby instance taking over.
+func WithWorkerStandby(fileName string, standby int) Option {
+	return withWorkerOption(fileName, func(w *workerOpt) error {
+		if standby < 0 {
+			return fmt.Errorf("workers %q: invalid number of standby instances", fileName)
+		}
+
+		w.standby = standby
+
+		return nil
+	})
+}
+
+// WithWorkerWarmupRequest makes every instance of the workers configured for fileName handle a synthetic GET request
+// for path (e.g. "/warmup?full=1") as soon as it is ready, before any other request, e.g. to warm the JIT and the caches of the app.
+// The response is discarded. If fatal is true, the first start of the workers fails if the warmup request fails (an error status
+// or the instance stopping), otherwise the failures are logged.
+func WithWorkerWarmupRequest(fileName, path string, fatal bool) Option {
+	return withWorkerOption(fileName, func(w *workerOpt) error {
+		if u, err := url.Parse(path); err != nil || !strings.HasPrefix(u.Path, "/") || u.Host != "" {
+			return fmt.Errorf("workers %q: invalid warmup request path %q", fileName, path)
+		}
+
+		w.warmupRequest = path
+		w.warmupFatal = fatal
+
+		return nil
+	})
+}
+
+// WithWorkerStickyBy binds the requests to the instances of the workers configured for fileName:
+// the requests having the same value for the given cookie or header (source is "cookie" or "header") are handled by the same instance,
+// as long as it is running. The requests without this cookie or header are handled by any instance.
+func WithWorkerStickyBy(fileName, source, name string) Option {
+	return withWorkerOption(fileName, func(w *workerOpt) error {
+		if source != "cookie" && source != "header" {
+			return fmt.Errorf(`workers %q: invalid sticky source %q, must be "cookie" or "header"`, fileName, source)
+		}
+		if name == "" {
+			return fmt.Errorf("workers %q: missing sticky %s name", fileName, source)
+		}
+
+		w.stickyBy = stickyKey{source: source, name: name}
+
+		return nil
+	})
+}
+
+// WithWorkerDispatch sets how the requests are assigned to the instances of the workers configured for fileName:
+// "round_robin" assigns them in turn, "random" to a random instance, and "least_busy" to the instance having the fewest requests
+// being handled or waiting for it. By default, the requests are handled by the first available instance.
+func WithWorkerDispatch(fileName, strategy string) Option {
+	return withWorkerOption(fileName, func(w *workerOpt) error {
+		switch strategy {
+		case dispatchRoundRobin, dispatchLeastBusy, dispatchRandom:
+		default:
+			return fmt.Errorf(`workers %q: invalid dispatch %q, must be "round_robin", "least_busy" or "random"`, fileName, strategy)
+		}
+
+		w.dispatch = strategy
+
+		return nil
+	})
+}
+
 // WithLogger configures the global logger to use.
 func WithLogger(l *zap.Logger) Option {
 	return func(o *opt) error {
@@ -48,3 +300,150 @@ func WithLogger(l *zap.Logger) Option {
 		return nil
 	}
 }
+
+// WithLogMessages configures the format and the verbosity of the lifecycle log lines of FrankenPHP (start, stop, reload).
+func WithLogMessages(m LogMessages) Option {
+	return func(o *opt) error {
+		if m < LogMessagesVerbose || m > LogMessagesJSON {
+			return fmt.Errorf("invalid log messages mode %d", m)
+		}
+
+		o.logMessages = m
+
+		return nil
+	}
+}
+
+// WithMaxConcurrentRequests caps the number of PHP requests handled simultaneously.
+// Requests beyond the cap wait for a free slot up to queueTimeout (0 means no timeout),
+// after that, ServeHTTP returns QueueTimeoutError.
+func WithMaxConcurrentRequests(maxRequests int, queueTimeout time.Duration) Option {
+	return func(o *opt) error {
+		o.maxConcurrentRequests = maxRequests
+		o.queueTimeout = queueTimeout
+
+		return nil
+	}
+}
+
+// WithWarmupParallelism bounds the number of worker instances booting concurrently when FrankenPHP starts.
+// 0 means all the instances boot concurrently.
+func WithWarmupParallelism(parallelism int) Option {
+	return func(o *opt) error {
+		if parallelism < 0 {
+			return fmt.Errorf("invalid warmup parallelism %d", parallelism)
+		}
+
+		o.warmupParallelism = parallelism
+
+		return nil
+	}
+}
+
+// WithReservedThreads sets the number of threads never assigned to workers, so that the requests not handled by workers always have capacity.
+// The number of threads must leave at least this number of threads once all the worker instances are started. Default: 1.
+func WithReservedThreads(reserved int) Option {
+	return func(o *opt) error {
+		if reserved < 1 {
+			return fmt.Errorf("invalid number of reserved threads %d, must be at least 1", reserved)
+		}
+
+		o.reservedThreads = reserved
+
+		return nil
+	}
+}
+
+// WithIniFile loads the given php.ini file instead of the default one.
+func WithIniFile(path string) Option {
+	return func(o *opt) error {
+		o.iniFile = path
+
+		return nil
+	}
+}
+
+// WithTimezone sets the default timezone used by PHP (the date.timezone php.ini directive), e.g. "Europe/Paris".
+// It must be a name of the tz database. The -d flags passed with WithPhpFlags take precedence.
+func WithTimezone(tz string) Option {
+	return func(o *opt) error {
+		if tz == "" || tz == "Local" {
+			return fmt.Errorf("invalid timezone %q", tz)
+		}
+		if _, err := time.LoadLocation(tz); err != nil {
+			return fmt.Errorf("invalid timezone %q: %w", tz, err)
+		}
+
+		entry, err := formatIniEntry("date.timezone=" + tz)
+		if err != nil {
+			return err
+		}
+		// prepended, so that the -d flags take precedence
+		o.phpIniEntries = append([]string{entry}, o.phpIniEntries...)
+
+		return nil
+	}
+}
+
+// WithPhpFlags configures PHP using the command line flags supported by the PHP CLI.
+//
+// Only -c <path> and -d key[=value] are supported.
+func WithPhpFlags(flags ...string) Option {
+	return func(o *opt) error {
+		for i := 0; i < len(flags); i++ {
+			flag := flags[i]
+
+			var value string
+			switch {
+			case flag == "-c" || flag == "-d":
+				if i+1 >= len(flags) {
+					return fmt.Errorf("PHP flag %q: missing value", flag)
+				}
+				i++
+				value = flags[i]
+
+			case strings.HasPrefix(flag, "-c") || strings.HasPrefix(flag, "-d"):
+				value = flag[2:]
+
+			default:
+				return fmt.Errorf("PHP flag %q: not supported", flag)
+			}
+
+			if flag[1] == 'c' {
+				o.iniFile = value
+
+				continue
+			}
+
+			entry, err := formatIniEntry(value)
+			if err != nil {
+				return err
+			}
+			o.phpIniEntries = append(o.phpIniEntries, entry)
+		}
+
+		return nil
+	}
+}
+
+// formatIniEntry converts the value of a -d flag to an INI entry, the same way as the PHP CLI does.
+func formatIniEntry(value string) (string, error) {
+	if strings.ContainsAny(value, "\r\n") {
+		return "", fmt.Errorf("PHP flag -d %q: the value must not contain new lines", value)
+	}
+
+	key, val, found := strings.Cut(value, "=")
+	if key == "" {
+		return "", fmt.Errorf("PHP flag -d %q: missing key", value)
+	}
+	if !found {
+		return key + "=1\n", nil
+	}
+
+	// quote the value if it isn't already quoted and contains special characters
+	if val != "" && !unicode.IsLetter(rune(val[0])) && !unicode.IsDigit(rune(val[0])) && val[0] != '"' && val[0] != '\'' {
+		val = `"` + val + `"`
+	}
+
+	return key + "=" + val + "\n", nil
+}
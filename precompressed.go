@@ -0,0 +1,69 @@
+package frankenphp
+
+import (
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// servePrecompressed serves the Brotli-compressed variant of the static target of the request,
+// the "<path>.br" file next to it, if it exists and the client accepts Brotli. It reports whether the response has been sent.
+func servePrecompressed(fc *FrankenPHPContext, w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if strings.HasSuffix(r.URL.Path, "/") || !acceptsBrotli(r.Header.Values("Accept-Encoding")) {
+		return false
+	}
+
+	target := sanitizedPathJoin(fc.documentRoot, r.URL.Path)
+	f, err := os.Open(target + ".br")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+
+	// the compressed content can't be sniffed, the pages cached without extension are assumed to be HTML
+	contentType := mime.TypeByExtension(filepath.Ext(target))
+	if contentType == "" {
+		contentType = "text/html; charset=utf-8"
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Encoding", "br")
+	h.Add("Vary", "Accept-Encoding")
+	http.ServeContent(w, r, target, fi.ModTime(), f)
+
+	return true
+}
+
+// acceptsBrotli reports whether the Accept-Encoding headers list Brotli with a non-zero quality.
+func acceptsBrotli(values []string) bool {
+	for _, v := range values {
+		for _, coding := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "br") {
+				continue
+			}
+
+			q, found := strings.CutPrefix(strings.TrimSpace(params), "q=")
+			if !found {
+				return true
+			}
+			if quality, err := strconv.ParseFloat(q, 64); err == nil && quality > 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -2,6 +2,7 @@ package frankenphp
 
 import (
 	"path/filepath"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -54,6 +55,7 @@ func WithRequestSplitPath(splitPath []string) RequestOption {
 
 // WithEnv set CGI-like environment variables that will be available in $_SERVER.
 // Values set with WithEnv always have priority over automatically populated values.
+// The environment variables of the worker handling the request, if any, and the ones set with WithRequestEnvOverrides have priority over them.
 func WithRequestEnv(env map[string]string) RequestOption {
 	return func(o *FrankenPHPContext) error {
 		o.env = env
@@ -62,6 +64,75 @@ func WithRequestEnv(env map[string]string) RequestOption {
 	}
 }
 
+// WithRequestEnvOverrides sets CGI-like environment variables that will be available in $_SERVER for the current request only.
+// They have priority over the values set with WithRequestEnv and over the environment variables of the worker handling the request.
+func WithRequestEnvOverrides(env map[string]string) RequestOption {
+	return func(o *FrankenPHPContext) error {
+		o.envOverrides = env
+
+		return nil
+	}
+}
+
+// WithRequestPHPIni sets php.ini directives for the current request only, as php_admin_value does.
+// All directives can be changed, including the ones that can only be set in php.ini.
+// The previous values are restored when the request is finished, including in worker mode.
+func WithRequestPHPIni(phpIni map[string]string) RequestOption {
+	return func(o *FrankenPHPContext) error {
+		o.phpIni = phpIni
+
+		return nil
+	}
+}
+
+// WithRequestPreserveHeaderCase preserves the exact case of the names of the response headers set by PHP (e.g. "WWW-authenticate"),
+// instead of canonicalizing them, for legacy clients sensitive to it. This is non-standard: only HTTP/1 responses are affected,
+// and the headers with a preserved case can't be looked up using http.Header.Get() by the other handlers.
+func WithRequestPreserveHeaderCase(preserve bool) RequestOption {
+	return func(o *FrankenPHPContext) error {
+		o.preserveHeaderCase = preserve
+
+		return nil
+	}
+}
+
+// WithRequestPrecompressed serves the Brotli-compressed "<path>.br" file next to the static target of GET and HEAD requests,
+// the path of the request in the document root, instead of executing PHP when it exists and the client accepts Brotli.
+// It allows workers to cache the pages they generate, already compressed. Extension-less targets are served as HTML.
+func WithRequestPrecompressed(enabled bool) RequestOption {
+	return func(o *FrankenPHPContext) error {
+		o.precompressed = enabled
+
+		return nil
+	}
+}
+
+// WithRequestForwardedHeaders restricts the request headers exposed to PHP as HTTP_* variables and by apache_request_headers().
+// If forward isn't empty, only the listed headers are exposed. The headers listed in hide are never exposed.
+// Headers are matched by their variable name: "X-Foo" also matches "X_Foo", as both become HTTP_X_FOO.
+func WithRequestForwardedHeaders(forward, hide []string) RequestOption {
+	return func(o *FrankenPHPContext) error {
+		o.forwardHeaders = headerVariableNames(forward)
+		o.hideHeaders = headerVariableNames(hide)
+
+		return nil
+	}
+}
+
+// WithRequestBodyReadTimeout sets the maximum time to wait for data from the client when PHP reads the request body.
+// When it is reached, the script is aborted as if the client disconnected, its response is discarded,
+// and ServeHTTP returns RequestBodyTimeoutError, typically to respond with a 408 error. 0 means no timeout.
+func WithRequestBodyReadTimeout(timeout time.Duration) RequestOption {
+	return func(o *FrankenPHPContext) error {
+		o.bodyReadTimeout = timeout
+		if timeout > 0 {
+			o.bodyTimedOut = make(chan struct{})
+		}
+
+		return nil
+	}
+}
+
 // WithLogger sets the logger associated with the current request
 func WithRequestLogger(logger *zap.Logger) RequestOption {
 	return func(o *FrankenPHPContext) error {
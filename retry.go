@@ -0,0 +1,127 @@
+package frankenphp
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// IsIdempotent reports whether the requests with the given method are safe to handle again or to share the response of,
+// e.g. to retry them when the worker instance handling them stops.
+func IsIdempotent(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+// retryWriter buffers the response of a request that may be retried, so that a response partially written
+// by an instance stopping before handling it (e.g. the headers sent when the script exits) is never sent.
+// The response is committed, and the request can't be retried anymore, once it is handled or when PHP flushes output.
+type retryWriter struct {
+	rw        http.ResponseWriter
+	header    http.Header
+	status    int
+	body      bytes.Buffer
+	committed bool
+}
+
+func newRetryWriter(rw http.ResponseWriter) *retryWriter {
+	return &retryWriter{rw: rw, header: rw.Header().Clone()}
+}
+
+func (w *retryWriter) Header() http.Header {
+	if w.committed {
+		return w.rw.Header()
+	}
+
+	return w.header
+}
+
+func (w *retryWriter) WriteHeader(status int) {
+	if w.committed {
+		w.rw.WriteHeader(status)
+
+		return
+	}
+
+	// 1xx responses aren't final, they are sent right away
+	if status >= 100 && status < 200 {
+		w.copyHeader()
+		w.rw.WriteHeader(status)
+
+		h := w.rw.Header()
+		for k := range h {
+			delete(h, k)
+		}
+
+		return
+	}
+
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *retryWriter) Write(b []byte) (int, error) {
+	if w.committed {
+		return w.rw.Write(b)
+	}
+
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.body.Write(b)
+}
+
+// FlushError commits the response before flushing it, unless nothing has been written yet.
+func (w *retryWriter) FlushError() error {
+	if !w.committed && w.body.Len() == 0 {
+		return nil
+	}
+
+	if err := w.commit(); err != nil {
+		return err
+	}
+
+	return http.NewResponseController(w.rw).Flush()
+}
+
+func (w *retryWriter) Unwrap() http.ResponseWriter {
+	return w.rw
+}
+
+// commit sends the buffered response, then writes directly to the underlying writer.
+func (w *retryWriter) commit() error {
+	if w.committed {
+		return nil
+	}
+	w.committed = true
+
+	w.copyHeader()
+	if w.status != 0 {
+		w.rw.WriteHeader(w.status)
+	}
+	if w.body.Len() == 0 {
+		return nil
+	}
+
+	_, err := w.rw.Write(w.body.Bytes())
+
+	return err
+}
+
+// reset discards the buffered response before retrying the request.
+func (w *retryWriter) reset() {
+	w.header = w.rw.Header().Clone()
+	w.status = 0
+	w.body.Reset()
+}
+
+// copyHeader replaces the headers of the underlying writer by the buffered ones.
+func (w *retryWriter) copyHeader() {
+	h := w.rw.Header()
+	for k := range h {
+		delete(h, k)
+	}
+	for k, v := range w.header {
+		h[k] = v
+	}
+}
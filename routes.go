@@ -0,0 +1,79 @@
+package frankenphp
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// RoutesFunction is the name of the PHP function returning the routes of a worker.
+const RoutesFunction = "frankenphp_routes"
+
+// exportRoutesCode loads the worker and prints the routes it exports as JSON.
+// The worker isn't executed as a worker: frankenphp_handle_request() throws, and the output is discarded.
+// The routes are printed in a shutdown function to support the scripts calling exit().
+const exportRoutesCode = `$_SERVER['SCRIPT_FILENAME'] = %s;
+ob_start();
+register_shutdown_function(static function () {
+	while (ob_get_level() > 0) {
+		ob_end_clean();
+	}
+
+	echo function_exists('%[2]s') ? json_encode(%[2]s(), JSON_THROW_ON_ERROR) : 'null';
+});
+
+try {
+	require $_SERVER['SCRIPT_FILENAME'];
+} catch (\RuntimeException $e) {
+}`
+
+// Route is a route handled by a worker.
+type Route struct {
+	// Path is the path pattern of the route, e.g. "/users/{id}" or "/assets/*"
+	Path string `json:"path"`
+	// Methods are the HTTP methods allowed by the route, all if empty
+	Methods []string `json:"methods,omitempty"`
+}
+
+// ExportRoutes returns the routes handled by a worker script, as returned by its frankenphp_routes() function:
+//
+//	function frankenphp_routes(): array
+//	{
+//	    return [
+//	        ['path' => '/users/{id}', 'methods' => ['GET']],
+//	    ];
+//	}
+//
+// The script is executed once as a regular script, not as a worker, to define the function.
+// If FrankenPHP isn't running, the PHP runtime is started for the export then stopped,
+// without removing the installed embedded app: the export happens before the app is served.
+func ExportRoutes(worker string) ([]Route, error) {
+	if !running.Load() {
+		if err := Init(WithNumThreads(1), WithLogger(zap.NewNop())); err != nil {
+			return nil, err
+		}
+		defer stopRuntime()
+	}
+
+	out, err := executePHPCode(fmt.Sprintf(exportRoutesCode, phpString(worker), RoutesFunction))
+	if err != nil {
+		return nil, fmt.Errorf("workers %q: %w", worker, err)
+	}
+
+	var routes []Route
+	if err := json.Unmarshal(out, &routes); err != nil {
+		return nil, fmt.Errorf("workers %q: invalid routes: %w", worker, err)
+	}
+	if routes == nil {
+		return nil, fmt.Errorf("workers %q: %w", worker, NoRoutesError)
+	}
+
+	return routes, nil
+}
+
+// phpString returns a PHP single-quoted string literal for s.
+func phpString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
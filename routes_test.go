@@ -0,0 +1,58 @@
+package frankenphp_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/dunglas/frankenphp"
+	"github.com/stretchr/testify/assert"
+)
+
+var expectedRoutes = []frankenphp.Route{
+	{Path: "/users/{id}", Methods: []string{"GET"}},
+	{Path: "/login", Methods: []string{"GET", "POST"}},
+	{Path: "/assets/*"},
+}
+
+func TestExportRoutes(t *testing.T) {
+	cwd, _ := os.Getwd()
+	testDataDir := cwd + "/testdata/"
+
+	runTest(t, func(_ func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		routes, err := frankenphp.ExportRoutes(testDataDir + "routes.php")
+		assert.NoError(t, err)
+		assert.Equal(t, expectedRoutes, routes)
+
+		// the script calls exit()
+		_, err = frankenphp.ExportRoutes(testDataDir + "sleep.php")
+		assert.ErrorIs(t, err, frankenphp.NoRoutesError)
+	}, &testOptions{nbParrallelRequests: 1})
+}
+
+func TestExportRoutesNotRunning(t *testing.T) {
+	cwd, _ := os.Getwd()
+
+	routes, err := frankenphp.ExportRoutes(cwd + "/testdata/routes.php")
+	assert.NoError(t, err)
+	assert.Equal(t, expectedRoutes, routes)
+
+	// the runtime started for the export is stopped
+	_, err = frankenphp.PostMaxSize()
+	assert.ErrorIs(t, err, frankenphp.NotRunningError)
+}
+
+func TestExportRoutesKeepsEmbeddedApp(t *testing.T) {
+	cwd, _ := os.Getwd()
+
+	embeddedAppPath := frankenphp.EmbeddedAppPath
+	frankenphp.EmbeddedAppPath = t.TempDir()
+	t.Cleanup(func() { frankenphp.EmbeddedAppPath = embeddedAppPath })
+
+	_, err := frankenphp.ExportRoutes(cwd + "/testdata/routes.php")
+	assert.NoError(t, err)
+
+	// the embedded app must still be installed to be served once FrankenPHP starts
+	assert.DirExists(t, frankenphp.EmbeddedAppPath)
+}
@@ -0,0 +1,44 @@
+//go:build amd64 || arm64
+
+package frankenphp
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const runAsSupported = true
+
+// setThreadCredentials changes the filesystem user and group IDs of the calling thread,
+// which must be locked to its OS thread (it is the case in cgo callbacks).
+// Unlike setuid(), setfsuid() only affects the calling thread, not the whole process.
+func setThreadCredentials(c credentials) (restore func(), err error) {
+	prevGid := setfsgid(c.gid)
+	prevUid := setfsuid(c.uid)
+
+	restore = func() {
+		setfsuid(prevUid)
+		setfsgid(prevGid)
+	}
+
+	// setfsuid() and setfsgid() don't report errors, passing an invalid ID returns the current one
+	if setfsuid(-1) != c.uid || setfsgid(-1) != c.gid {
+		restore()
+
+		return nil, fmt.Errorf("unable to switch to uid %d and gid %d: operation not permitted", c.uid, c.gid)
+	}
+
+	return restore, nil
+}
+
+func setfsuid(uid int) int {
+	prev, _, _ := syscall.RawSyscall(syscall.SYS_SETFSUID, uintptr(uid), 0, 0)
+
+	return int(uint32(prev))
+}
+
+func setfsgid(gid int) int {
+	prev, _, _ := syscall.RawSyscall(syscall.SYS_SETFSGID, uintptr(gid), 0, 0)
+
+	return int(uint32(prev))
+}
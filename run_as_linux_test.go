@@ -0,0 +1,64 @@
+//go:build amd64 || arm64
+
+package frankenphp_test
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dunglas/frankenphp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestWorkerRunAs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the credentials requires root privileges")
+	}
+	const nobody = 65534
+
+	// the scripts must be readable by the unprivileged user
+	dir := t.TempDir()
+	require.NoError(t, os.Chmod(dir, 0755))
+	for _, script := range []string{"_executor.php", "file-contents.php"} {
+		content, err := os.ReadFile("testdata/" + script)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, script), content, 0644))
+	}
+	require.NoError(t, os.Link(filepath.Join(dir, "file-contents.php"), filepath.Join(dir, "worker.php")))
+
+	publicFile, privateFile := filepath.Join(dir, "public"), filepath.Join(dir, "private")
+	require.NoError(t, os.WriteFile(publicFile, nil, 0644))
+	require.NoError(t, os.WriteFile(privateFile, nil, 0600))
+
+	workerFile := filepath.Join(dir, "worker.php")
+	require.NoError(t, frankenphp.Init(
+		frankenphp.WithWorkers(workerFile, 1, nil),
+		frankenphp.WithWorkerRunAs(workerFile, nobody, nobody),
+		frankenphp.WithLogger(zaptest.NewLogger(t)),
+	))
+	defer frankenphp.Shutdown()
+
+	fetch := func(script, file string) string {
+		req, err := frankenphp.NewRequestWithContext(
+			httptest.NewRequest("GET", "http://example.com/"+script+"?file="+url.QueryEscape(file), nil),
+			frankenphp.WithRequestDocumentRoot(dir, false),
+		)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		require.NoError(t, frankenphp.ServeHTTP(w, req))
+
+		return w.Body.String()
+	}
+
+	assert.Equal(t, "allowed", fetch("worker.php", publicFile))
+	assert.Equal(t, "denied", fetch("worker.php", privateFile))
+
+	// the threads not running the worker keep the privileges of the process
+	assert.Equal(t, "allowed", fetch("file-contents.php", privateFile))
+}
@@ -0,0 +1,11 @@
+//go:build !linux || !(amd64 || arm64)
+
+package frankenphp
+
+import "errors"
+
+const runAsSupported = false
+
+func setThreadCredentials(credentials) (func(), error) {
+	return nil, errors.New("not supported on this platform")
+}
@@ -0,0 +1,4 @@
+<?php
+
+// Not using _executor.php because auto_append_file isn't included when exit() is called
+echo $GLOBALS['prepended'] ?? 'not prepended';
@@ -0,0 +1,9 @@
+<?php
+
+require_once __DIR__.'/_executor.php';
+
+return function () {
+    echo ($_SERVER['FRANKENPHP_VERSION'] ?? '') === '' ? 'no version' : 'has version';
+    echo "\n";
+    echo $_SERVER['APP_VERSION'] ?? '';
+};
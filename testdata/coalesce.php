@@ -0,0 +1,14 @@
+<?php
+
+require_once __DIR__.'/_executor.php';
+
+return function () {
+    // count the executions
+    file_put_contents($_GET['file'], 'x', FILE_APPEND);
+    if (isset($_GET['session'])) {
+        session_start();
+    }
+    usleep(500000);
+
+    echo 'executed';
+};
@@ -0,0 +1,8 @@
+<?php
+
+require_once __DIR__.'/_executor.php';
+
+return function () {
+    header('Content-Encoding: gzip');
+    echo gzencode(str_repeat("Hey\n", 1024));
+};
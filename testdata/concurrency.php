@@ -0,0 +1,12 @@
+<?php
+
+require_once __DIR__.'/_executor.php';
+
+return function () {
+    echo 'start';
+    flush();
+
+    usleep(50000);
+
+    echo 'end';
+};
@@ -0,0 +1,15 @@
+<?php
+
+ignore_user_abort(true);
+
+require_once __DIR__.'/_executor.php';
+
+return function () {
+    $start = microtime(true);
+    $timeout = (float) ($_GET['timeout'] ?? 5);
+    while (!connection_aborted() && microtime(true) - $start < $timeout) {
+        usleep(10000);
+    }
+
+    error_log(sprintf('request %s: %s', $_GET['i'], connection_aborted() ? 'aborted' : 'not aborted'));
+};
@@ -0,0 +1,9 @@
+<?php
+
+require_once __DIR__.'/_executor.php';
+
+return function () {
+    header('Connection: Close');
+
+    echo 'bye';
+};
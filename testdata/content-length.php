@@ -0,0 +1,8 @@
+<?php
+
+require_once __DIR__.'/_executor.php';
+
+return function () {
+    header('Content-Length: ' . $_GET['length']);
+    echo 'hello world';
+};
@@ -0,0 +1,16 @@
+<?php
+
+require_once __DIR__.'/_executor.php';
+
+return function () {
+    // keep the CPU busy for the given number of milliseconds
+    $end = hrtime(true) + (int) ($_GET['ms'] ?? 0) * 1_000_000;
+    $i = 0;
+    while (hrtime(true) < $end) {
+        $i++;
+    }
+
+    $data = str_repeat('a', (int) ($_GET['alloc'] ?? 0));
+
+    echo sprintf('%d iterations, %d bytes allocated', $i, strlen($data));
+};
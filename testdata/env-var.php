@@ -0,0 +1,7 @@
+<?php
+
+require_once __DIR__.'/_executor.php';
+
+return function () {
+    echo $_SERVER[$_GET['name']] ?? 'missing';
+};
@@ -0,0 +1,7 @@
+<?php
+
+require_once __DIR__.'/_executor.php';
+
+return function () {
+    echo @file_get_contents($_GET['file']) === false ? 'denied' : 'allowed';
+};
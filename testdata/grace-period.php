@@ -0,0 +1,19 @@
+<?php
+
+ignore_user_abort(true);
+
+require_once __DIR__.'/_executor.php';
+
+return function () {
+    // lets the client know that the request is being handled
+    echo "started\n";
+    flush();
+
+    $start = microtime(true);
+    $timeout = (float) ($_GET['timeout'] ?? 5);
+    while (!connection_aborted() && microtime(true) - $start < $timeout) {
+        usleep(10000);
+    }
+
+    echo connection_aborted() ? 'aborted' : 'not aborted';
+};
@@ -0,0 +1,8 @@
+<?php
+
+require_once __DIR__.'/_executor.php';
+
+return function () {
+    header('X-Generation: ' . bin2hex(random_bytes(8)));
+    echo 'hello world';
+};
@@ -0,0 +1,10 @@
+<?php
+
+require_once __DIR__.'/_executor.php';
+
+return function () {
+    header('WWW-authenticate: Basic realm="legacy"');
+    header('content-type: text/plain');
+
+    echo 'Hello';
+};
@@ -0,0 +1,4 @@
+<?php
+
+// Proves that the request has been passed to PHP, even if the primary script doesn't exist
+echo 'handled by PHP';
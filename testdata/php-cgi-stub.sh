@@ -0,0 +1,8 @@
+#!/bin/sh
+# Stub of an external PHP interpreter speaking the CGI protocol, used by the tests of the php_binary option
+
+printf 'Content-Type: text/plain\r\n'
+printf 'X-Interpreter: stub\r\n'
+printf 'X-Powered-By: PHP/stub\r\n'
+printf '\r\n'
+printf '%s executed by the stub (path info: %s, env: %s)' "$SCRIPT_NAME" "$PATH_INFO" "$FOO"
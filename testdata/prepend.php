@@ -0,0 +1,3 @@
+<?php
+
+$GLOBALS['prepended'] = 'prepended';
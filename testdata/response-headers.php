@@ -0,0 +1,10 @@
+<?php
+
+require_once __DIR__.'/_executor.php';
+
+return function () {
+    header('X-Powered-By: PHP');
+    header('X-Frame-Options: ALLOW');
+
+    echo 'Hello';
+};
@@ -0,0 +1,17 @@
+<?php
+
+function frankenphp_routes(): array
+{
+    return [
+        ['path' => '/users/{id}', 'methods' => ['GET']],
+        ['path' => '/login', 'methods' => ['GET', 'POST']],
+        ['path' => '/assets/*'],
+    ];
+}
+
+echo 'this output is discarded';
+
+while (frankenphp_handle_request(function () {
+    echo 'routes';
+})) {
+}
@@ -0,0 +1,9 @@
+<?php
+
+require_once __DIR__.'/_executor.php';
+
+return function () {
+    echo $_SERVER['SCRIPT_MTIME'] ?? '';
+    echo "\n";
+    echo $_SERVER['SCRIPT_ETAG'] ?? '';
+};
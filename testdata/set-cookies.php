@@ -0,0 +1,11 @@
+<?php
+
+require_once __DIR__.'/_executor.php';
+
+return function () {
+    setcookie('plain', 'a');
+    setcookie('explicit', 'b', ['secure' => false, 'samesite' => 'Strict']);
+    header('Set-Cookie: raw=c; path=/; httponly', false);
+
+    echo 'Cookies set';
+};
@@ -0,0 +1,10 @@
+<?php
+
+require_once __DIR__.'/_executor.php';
+
+return function () {
+    $sleep = (int) ($_GET['sleep'] ?? 0);
+    usleep($sleep * 1000);
+
+    echo sprintf('slept for %d ms', $sleep);
+};
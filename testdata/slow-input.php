@@ -0,0 +1,11 @@
+<?php
+
+require_once __DIR__.'/_executor.php';
+
+return function () {
+    $input = file_get_contents('php://input');
+    usleep((int) ($_GET['sleep'] ?? 0) * 1000);
+
+    header('Foo: bar');
+    echo $input;
+};
@@ -0,0 +1,16 @@
+<?php
+
+require_once __DIR__.'/_executor.php';
+
+return function () {
+    header('Content-Type: application/x-ndjson');
+    echo "first\n";
+
+    // wait for the client to receive the first line
+    for ($i = 0; $i < 100 && !file_exists($_GET['file']); $i++) {
+        usleep(50000);
+        clearstatcache();
+    }
+
+    echo file_exists($_GET['file']) ? "second\n" : "timeout\n";
+};
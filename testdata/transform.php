@@ -0,0 +1,11 @@
+<?php
+
+require_once __DIR__.'/_executor.php';
+
+return function () {
+    header('Content-Type: text/html; charset=utf-8');
+    echo '<img src="/assets/';
+    // the response must not be sent before being transformed
+    flush();
+    echo 'logo.png">';
+};
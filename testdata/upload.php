@@ -0,0 +1,9 @@
+<?php
+
+require_once __DIR__.'/_executor.php';
+
+return function () {
+    $tmpName = $_FILES['file']['tmp_name'] ?? '';
+
+    echo dirname($tmpName), ' ', file_exists($tmpName) ? 'exists' : 'missing';
+};
@@ -0,0 +1,17 @@
+<?php
+
+// Waits for BOOT_BARRIER instances to boot at the same time, exits if they don't within 2 seconds
+touch($_SERVER['BOOT_DIR'] . '/' . bin2hex(random_bytes(8)));
+
+$deadline = microtime(true) + 2;
+while (count(glob($_SERVER['BOOT_DIR'] . '/*')) < (int) $_SERVER['BOOT_BARRIER']) {
+    if (microtime(true) > $deadline) {
+        exit(1);
+    }
+
+    usleep(1000);
+}
+
+while (frankenphp_handle_request(function (): void {
+    echo 'booted';
+})) {}
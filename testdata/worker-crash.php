@@ -0,0 +1,14 @@
+<?php
+
+// Crash on startup while the crash file exists
+if (file_exists($_SERVER['CRASH_FILE'])) {
+    exit(1);
+}
+
+while (frankenphp_handle_request(function (): void {
+    if (isset($_GET['crash'])) {
+        exit(1);
+    }
+
+    echo 'ok';
+})) {}
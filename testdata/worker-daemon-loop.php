@@ -0,0 +1,7 @@
+<?php
+
+// A daemon looping forever, it is stopped when FrankenPHP shuts down
+file_put_contents($_SERVER['DAEMON_FILE'], "run\n", FILE_APPEND);
+while (true) {
+    usleep(1000);
+}
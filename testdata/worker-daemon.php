@@ -0,0 +1,5 @@
+<?php
+
+// A daemon runs without handling requests, it is restarted when it returns
+file_put_contents($_SERVER['DAEMON_FILE'], "run\n", FILE_APPEND);
+usleep(10000);
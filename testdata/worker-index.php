@@ -0,0 +1,13 @@
+<?php
+
+// identifies the instance handling the requests
+$index = $_SERVER['FRANKENPHP_WORKER_INDEX'];
+$name = basename($_SERVER['FRANKENPHP_WORKER_NAME']);
+
+while (frankenphp_handle_request(function () use ($index, $name) {
+    // keep the instance busy, so that the concurrent requests are handled by different instances
+    usleep((int) ($_GET['sleep'] ?? 200000));
+
+    echo "$name:$index";
+})) {
+}
@@ -0,0 +1,9 @@
+<?php
+
+// identifies the instance handling the requests
+$instance = bin2hex(random_bytes(8));
+
+while (frankenphp_handle_request(function () use ($instance) {
+    echo $instance;
+})) {
+}
@@ -0,0 +1,8 @@
+<?php
+
+$resource = 'connection';
+
+// handle a single request, then the instance is recycled
+frankenphp_handle_request(function () {
+    echo 'handled';
+});
@@ -0,0 +1,18 @@
+<?php
+
+$restartFile = $_SERVER['RESTART_FILE'];
+
+// Stop the instance while it handles a request when the restart file exists, as if it was recycled
+while (frankenphp_handle_request(function () use ($restartFile): void {
+    if (@unlink($restartFile)) {
+        exit(0);
+    }
+
+    if (isset($_GET['vars'])) {
+        echo $_SERVER['REQUEST_URI'].' '.$_SERVER['FOO'].' '.$_SERVER['DOCUMENT_ROOT'];
+
+        return;
+    }
+
+    echo 'ok';
+})) {}
@@ -0,0 +1,4 @@
+<?php
+
+// the global variables of the worker are available
+file_put_contents($_SERVER['SHUTDOWN_LOG'], "closing $resource\n", FILE_APPEND);
@@ -0,0 +1,8 @@
+<?php
+
+// Simulates a worker with an expensive bootstrap (e.g. a framework kernel)
+usleep(200000);
+
+while (frankenphp_handle_request(function (): void {
+    echo 'booted';
+})) {}
@@ -0,0 +1,18 @@
+<?php
+
+$warmups = 0;
+
+while (frankenphp_handle_request(function () use (&$warmups): void {
+    if (str_starts_with($_SERVER['REQUEST_URI'], '/warmup')) {
+        $warmups++;
+
+        if (isset($_GET['fail'])) {
+            http_response_code(500);
+        }
+
+        return;
+    }
+
+    // the number of warmup requests handled by this instance
+    echo $warmups;
+})) {}
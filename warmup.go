@@ -0,0 +1,87 @@
+package frankenphp
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+)
+
+// warmupRequest is the synthetic request handled by a worker instance as soon as it is ready,
+// e.g. to warm the JIT and the caches of the app before handling real requests. Its response is discarded.
+type warmupRequest struct {
+	path   string
+	r      *http.Request
+	fc     *FrankenPHPContext
+	header http.Header
+	status int
+}
+
+// newWarmupRequest creates a warmup request for the given path, handled by the worker script absFileName as a front controller.
+func newWarmupRequest(absFileName, path string) (*warmupRequest, error) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := http.NewRequest(http.MethodGet, "/"+filepath.Base(absFileName)+"?"+u.RawQuery, nil)
+	if err != nil {
+		return nil, err
+	}
+	r, err = NewRequestWithContext(
+		r,
+		WithRequestDocumentRoot(filepath.Dir(absFileName), false),
+		WithRequestEnv(map[string]string{"REQUEST_URI": u.RequestURI()}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &warmupRequest{path: path, r: r, fc: r.Context().Value(contextKey).(*FrankenPHPContext), header: make(http.Header)}
+	w.fc.responseWriter = w
+	w.fc.worker = absFileName
+
+	return w, nil
+}
+
+func (w *warmupRequest) Header() http.Header {
+	return w.header
+}
+
+func (w *warmupRequest) WriteHeader(status int) {
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+}
+
+func (w *warmupRequest) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return len(b), nil
+}
+
+// wait waits for the request to be handled, exited is closed when the instance stops.
+// It returns an error if the instance stopped before handling it or if the response is an error.
+func (w *warmupRequest) wait(exited chan struct{}) error {
+	stopped := fmt.Errorf("warmup request %q: the instance stopped before handling it", w.path)
+	select {
+	case <-w.fc.done:
+	case <-exited:
+		select {
+		case <-w.fc.done:
+		default:
+			return stopped
+		}
+	}
+
+	if w.fc.workerStopped {
+		return stopped
+	}
+	if w.status >= http.StatusBadRequest {
+		return fmt.Errorf("warmup request %q: status %d", w.path, w.status)
+	}
+
+	return nil
+}
@@ -4,62 +4,429 @@ package frankenphp
 // #include "frankenphp.h"
 import "C"
 import (
+	"context"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"math/rand"
 	"net/http"
 	"path/filepath"
 	"runtime/cgo"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.uber.org/zap"
 )
 
 var (
 	workersRequestChans sync.Map // map[fileName]chan *http.Request
-	workersReadyWG      sync.WaitGroup
+	workerPools         sync.Map // map[fileName]*workerPool
 )
 
-// TODO: start all the worker in parallell to reduce the boot time
-func initWorkers(opt []workerOpt) error {
-	for _, w := range opt {
-		if err := startWorkers(w.fileName, w.num, w.env); err != nil {
-			return err
+// workerPool tracks the instances of a worker script, and the requests waiting for one of them.
+type workerPool struct {
+	idleTimeout time.Duration
+	minWorkers  int32
+	// running is the number of instances not stopped because idle
+	running atomic.Int32
+	// wake restarts an idle instance
+	wake chan struct{}
+	// queueSize caps the number of queued requests, 0 means unlimited
+	queueSize int32
+	// queued is the number of requests waiting for an instance
+	queued atomic.Int32
+	// stickyBy binds the requests to instances, if set
+	stickyBy stickyKey
+	// instances are the instances requests can be bound to, only set when stickyBy or dispatch is
+	instances []*workerInstance
+	// dispatch is the strategy assigning the requests to the instances, if set
+	dispatch string
+	// next is the number of requests assigned by the round_robin and least_busy strategies
+	next atomic.Uint32
+	// retryOnRestart is the number of times an idempotent request is retried when the instance handling it stops
+	retryOnRestart int
+	// promote receives a value when an active instance crashes, a standby instance takes over, only set when there are standby instances
+	promote chan struct{}
+	// standby is the number of standby instances waiting to be promoted
+	standby atomic.Int32
+	// daemon instances run without handling requests
+	daemon bool
+	// restarts is the number of times an instance has been restarted after exiting or crashing
+	restarts atomic.Int64
+	// env are the environment variables of the worker, they are also set for the requests it handles
+	env map[string]string
+
+	mu sync.Mutex
+	// generation is incremented every time the pool is recycled, the instances started in a previous generation are recycled
+	generation int
+	// recycled is closed when the pool is recycled
+	recycled chan struct{}
+	// ready is the number of instances of the current generation ready to handle requests
+	ready int
+}
+
+// current returns the current generation of the pool, and a channel closed when it is recycled.
+func (p *workerPool) current() (int, chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.generation, p.recycled
+}
+
+// recycle starts a new generation: the running instances are recycled once they are done with their current request.
+func (p *workerPool) recycle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.generation++
+	close(p.recycled)
+	p.recycled = make(chan struct{})
+	p.ready = 0
+}
+
+// addReady accounts for an instance of the given generation getting ready (delta 1) or exiting after being ready (delta -1).
+func (p *workerPool) addReady(generation, delta int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if generation == p.generation {
+		p.ready += delta
+	}
+}
+
+// readiness returns the number of instances of the current generation ready to handle requests, and the number of instances expected to be.
+func (p *workerPool) readiness() (ready, instances int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.ready, int(p.running.Load()) + cap(p.promote)
+}
+
+// The strategies assigning the requests to the instances of a worker.
+const (
+	dispatchRoundRobin = "round_robin"
+	dispatchLeastBusy  = "least_busy"
+	dispatchRandom     = "random"
+)
+
+// workerInstance receives the requests bound to an instance of a worker.
+type workerInstance struct {
+	requests chan *http.Request
+	// busy is the number of requests bound to the instance, being handled or waiting for it
+	busy atomic.Int32
+
+	mu sync.Mutex
+	// exited is closed when the instance isn't running
+	exited chan struct{}
+}
+
+func newWorkerInstance() *workerInstance {
+	exited := make(chan struct{})
+	close(exited)
+
+	return &workerInstance{requests: make(chan *http.Request), exited: exited}
+}
+
+func (i *workerInstance) start() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.exited = make(chan struct{})
+}
+
+func (i *workerInstance) stop() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	close(i.exited)
+}
+
+func (i *workerInstance) exitedChan() chan struct{} {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.exited
+}
+
+// stickyInstance returns the instance the request is bound to, or nil if the request can be handled by any instance.
+func (p *workerPool) stickyInstance(r *http.Request) *workerInstance {
+	if len(p.instances) == 0 {
+		return nil
+	}
+
+	var key string
+	switch p.stickyBy.source {
+	case "cookie":
+		if c, err := r.Cookie(p.stickyBy.name); err == nil {
+			key = c.Value
+		}
+	case "header":
+		key = r.Header.Get(p.stickyBy.name)
+	}
+	if key == "" {
+		return nil
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	return p.instances[h.Sum32()%uint32(len(p.instances))]
+}
+
+// dispatchedInstance returns the instance the request is assigned to by the dispatch strategy, or nil if it can be handled by any instance.
+// The exited and restarting instances are skipped, whatever the strategy.
+func (p *workerPool) dispatchedInstance() *workerInstance {
+	var start int
+	switch p.dispatch {
+	case dispatchRoundRobin, dispatchLeastBusy:
+		// with least_busy, the search starts at a different instance every time, to spread the ties
+		start = int((p.next.Add(1) - 1) % uint32(len(p.instances)))
+	case dispatchRandom:
+		start = rand.Intn(len(p.instances))
+	default:
+		return nil
+	}
+
+	var least *workerInstance
+	var leastBusy int32
+	for j := range p.instances {
+		inst := p.instances[(start+j)%len(p.instances)]
+		if isClosed(inst.exitedChan()) {
+			continue
+		}
+		if p.dispatch != dispatchLeastBusy {
+			return inst
+		}
+		if busy := inst.busy.Load(); least == nil || busy < leastBusy {
+			least, leastBusy = inst, busy
+		}
+	}
+
+	return least
+}
+
+// dispatchTo sends the request to the instance it is bound to and waits for it to be handled.
+// It reports false if the instance isn't running, the request must then be handled by any instance.
+func (p *workerPool) dispatchTo(inst *workerInstance, fc *FrankenPHPContext, r *http.Request) (bool, error) {
+	exited := inst.exitedChan()
+	if isClosed(exited) {
+		return false, nil
+	}
+
+	inst.busy.Add(1)
+	defer inst.busy.Add(-1)
+
+	select {
+	case inst.requests <- r:
+		<-fc.done
+
+		return true, nil
+	default:
+	}
+
+	if !p.enqueue() {
+		return true, WorkerQueueFullError
+	}
+
+	select {
+	case <-done:
+		p.queued.Add(-1)
+
+		return true, NotRunningError
+	case <-exited:
+		p.queued.Add(-1)
+
+		return false, nil
+	case inst.requests <- r:
+		p.queued.Add(-1)
+		<-fc.done
+
+		return true, nil
+	}
+}
+
+// enqueue reports whether a request can wait for an instance, and accounts for it if so.
+func (p *workerPool) enqueue() bool {
+	for {
+		n := p.queued.Load()
+		if p.queueSize > 0 && n >= p.queueSize {
+			return false
+		}
+		if p.queued.CompareAndSwap(n, n+1) {
+			return true
 		}
 	}
+}
+
+// stopIdle reports whether an idle instance can be stopped, and accounts for it if so.
+func (p *workerPool) stopIdle() bool {
+	for {
+		n := p.running.Load()
+		if n <= p.minWorkers {
+			return false
+		}
+		if p.running.CompareAndSwap(n, n-1) {
+			return true
+		}
+	}
+}
+
+// wakeIdle restarts an instance stopped because idle, if any.
+func (p *workerPool) wakeIdle() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// initWorkers starts the workers of all the worker scripts concurrently.
+// When warmupParallelism is positive, it bounds the number of instances booting at the same time.
+func initWorkers(opt []workerOpt, warmupParallelism int) error {
+	var warmupSlots chan struct{}
+	if warmupParallelism > 0 {
+		warmupSlots = make(chan struct{}, warmupParallelism)
+	}
+
+	errs := make([]error, len(opt))
+
+	var wg sync.WaitGroup
+	wg.Add(len(opt))
+	for i, w := range opt {
+		go func(i int, w workerOpt) {
+			defer wg.Done()
+			errs[i] = startWorkers(w, workerBackoff{min: w.restartBackoffMin, max: w.restartBackoffMax}, warmupSlots)
+		}(i, w)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// workerBackoff computes the delay before restarting a crashed worker instance:
+// it starts at min and doubles after each successive crash, up to max.
+// An instance running longer than max resets the delay.
+type workerBackoff struct {
+	min, max time.Duration
+	delay    time.Duration
+}
+
+func (b *workerBackoff) next(runDuration time.Duration) time.Duration {
+	if b.min <= 0 {
+		return 0
+	}
+
+	if b.delay == 0 || runDuration > b.max {
+		b.delay = b.min
+	} else {
+		b.delay = min(b.delay*2, b.max)
+	}
+
+	return b.delay
+}
+
+func (b *workerBackoff) reset() {
+	b.delay = 0
+}
+
+// WorkerFeatures are the options of a worker restricting the ones it can be combined with.
+type WorkerFeatures struct {
+	// Standby is the number of standby instances
+	Standby int
+	// StickyBy is the source of the key binding the requests to instances ("cookie" or "header"), if any
+	StickyBy string
+	// Dispatch is the strategy assigning the requests to instances, if any
+	Dispatch string
+	// Daemon is true if the worker runs as a daemon
+	Daemon bool
+	// IdleTimeout is the duration after which the idle instances are stopped, if any
+	IdleTimeout time.Duration
+	// WarmupRequest is the URI of the request handled by the instances once ready, if any
+	WarmupRequest string
+}
+
+// Validate returns an error if the features can't be used together:
+// standby instances can't be used with sticky_by or dispatch, as the requests can't be bound to the instances taking over,
+// and daemons can't be used with the features related to requests handling.
+func (f WorkerFeatures) Validate() error {
+	if f.Standby > 0 && (f.StickyBy != "" || f.Dispatch != "") {
+		return errors.New("standby instances can't be used with sticky_by or dispatch")
+	}
+	if f.Daemon && (f.Standby > 0 || f.StickyBy != "" || f.Dispatch != "" || f.IdleTimeout > 0 || f.WarmupRequest != "") {
+		return errors.New("daemons can't be used with standby instances, sticky_by, dispatch, idle_timeout or warmup_request")
+	}
 
 	return nil
 }
 
-func startWorkers(fileName string, nbWorkers int, env map[string]string) error {
+func startWorkers(w workerOpt, backoff workerBackoff, warmupSlots chan struct{}) error {
+	fileName, nbWorkers := w.fileName, w.num
+
 	absFileName, err := filepath.Abs(fileName)
 	if err != nil {
 		return fmt.Errorf("workers %q: %w", fileName, err)
 	}
 
-	if _, ok := workersRequestChans.Load(absFileName); ok {
-		return fmt.Errorf("workers %q: already started", absFileName)
+	var absShutdownScript string
+	if w.shutdownScript != "" {
+		if absShutdownScript, err = filepath.Abs(w.shutdownScript); err != nil {
+			return fmt.Errorf("workers %q: %w", fileName, err)
+		}
 	}
 
-	workersRequestChans.Store(absFileName, make(chan *http.Request))
-	shutdownWG.Add(nbWorkers)
-	workersReadyWG.Add(nbWorkers)
+	features := WorkerFeatures{Standby: w.standby, StickyBy: w.stickyBy.source, Dispatch: w.dispatch, Daemon: w.daemon, IdleTimeout: w.idleTimeout, WarmupRequest: w.warmupRequest}
+	if err := features.Validate(); err != nil {
+		return fmt.Errorf("workers %q: %w", fileName, err)
+	}
 
-	var (
-		m    sync.RWMutex
-		errs []error
-	)
+	if _, loaded := workersRequestChans.LoadOrStore(absFileName, make(chan *http.Request)); loaded {
+		return fmt.Errorf("workers %q: already started", absFileName)
+	}
 
-	if env == nil {
-		env = make(map[string]string, 1)
+	pool := &workerPool{idleTimeout: w.idleTimeout, minWorkers: int32(w.minWorkers), wake: make(chan struct{}, 1), queueSize: int32(w.queueSize), stickyBy: w.stickyBy, retryOnRestart: w.retryOnRestart, daemon: w.daemon, recycled: make(chan struct{}), env: w.env, dispatch: w.dispatch}
+	if w.stickyBy.source != "" || w.dispatch != "" {
+		pool.instances = make([]*workerInstance, nbWorkers)
+		for i := range pool.instances {
+			pool.instances[i] = newWorkerInstance()
+		}
+	}
+	if w.standby > 0 {
+		pool.promote = make(chan struct{}, w.standby)
 	}
+	pool.running.Store(int32(nbWorkers))
+	workerPools.Store(absFileName, pool)
 
-	env["FRANKENPHP_WORKER"] = "1"
+	// standby instances are started after the active ones
+	nbInstances := nbWorkers + w.standby
+	shutdownWG.Add(nbInstances)
+
+	// the result of the first boot of every instance
+	booted := make(chan error, nbInstances)
 
 	l := getLogger()
-	for i := 0; i < nbWorkers; i++ {
-		go func() {
+	for i := 0; i < nbInstances; i++ {
+		var inst *workerInstance
+		if pool.instances != nil {
+			inst = pool.instances[i]
+		}
+
+		// the variables of the worker script itself, they aren't set for the requests,
+		// the index of the instance is kept when it restarts, standby instances come after the active ones
+		env := make(map[string]string, len(pool.env)+3)
+		for k, v := range pool.env {
+			env[k] = v
+		}
+		env["FRANKENPHP_WORKER"] = "1"
+		env["FRANKENPHP_WORKER_INDEX"] = strconv.Itoa(i)
+		env["FRANKENPHP_WORKER_NAME"] = fileName
+
+		// the instances are recycled at different times
+		lifetime := w.maxLifetime + w.maxLifetime*time.Duration(i)/time.Duration(10*nbInstances)
+
+		go func(backoff workerBackoff, standby bool) {
 			defer shutdownWG.Done()
-			for {
+			for first := true; ; first = false {
 				// Create main dummy request
 				r, err := http.NewRequest(http.MethodGet, filepath.Base(absFileName), nil)
 				if err != nil {
@@ -74,40 +441,174 @@ func startWorkers(fileName string, nbWorkers int, env map[string]string) error {
 					panic(err)
 				}
 
+				fc := r.Context().Value(contextKey).(*FrankenPHPContext)
+				fc.workerReady = make(chan struct{})
+				fc.runAs = w.runAs
+				fc.workerShutdownScript = absShutdownScript
+				fc.workerInstance = inst
+				fc.workerStandby = standby
+				fc.workerGeneration, _ = pool.current()
+				if w.daemon {
+					fc.daemonStop = done
+				}
+
+				var warmup *warmupRequest
+				if w.warmupRequest != "" {
+					if warmup, err = newWarmupRequest(absFileName, w.warmupRequest); err != nil {
+						panic(err)
+					}
+					fc.workerWarmup = warmup.r
+				}
+
+				exited := make(chan struct{})
+				if first && w.daemon {
+					// daemons never get ready, they are considered booted as soon as they start
+					booted <- nil
+				} else if first {
+					if warmupSlots != nil {
+						warmupSlots <- struct{}{}
+					}
+
+					go func() {
+						select {
+						case <-fc.workerReady:
+						case <-exited:
+						}
+
+						var err error
+						if !isClosed(fc.workerReady) {
+							err = fmt.Errorf("exited with status %d before being ready", int(fc.exitStatus))
+						} else if warmup != nil {
+							if err = warmup.wait(exited); err != nil && !w.warmupFatal {
+								l.Error("warmup failed", zap.String("worker", absFileName), zap.Error(err))
+								err = nil
+							}
+						}
+
+						if warmupSlots != nil {
+							<-warmupSlots
+						}
+
+						booted <- err
+					}()
+				} else if warmup != nil {
+					go func() {
+						if err := warmup.wait(exited); err != nil {
+							l.Error("warmup failed", zap.String("worker", absFileName), zap.Error(err))
+						}
+					}()
+				}
+
 				l.Debug("starting", zap.String("worker", absFileName))
-				if err := ServeHTTP(nil, r); err != nil {
+				startedAt := time.Now()
+				if w.maxLifetime > 0 {
+					fc.workerExpiresAt = startedAt.Add(lifetime)
+				}
+				if inst != nil {
+					inst.start()
+				}
+				err = ServeHTTP(nil, r)
+				if inst != nil {
+					inst.stop()
+				}
+				close(exited)
+				if errors.Is(err, NotRunningError) {
+					// FrankenPHP shut down before the instance started
+					break
+				}
+				if err != nil {
 					panic(err)
 				}
+				if isClosed(fc.workerReady) {
+					pool.addReady(fc.workerGeneration, -1)
+				}
+
+				// the instance may have been promoted while running
+				standby = fc.workerStandby
 
-				fc := r.Context().Value(contextKey).(*FrankenPHPContext)
 				if fc.currentWorkerRequest != 0 {
-					// Terminate the pending HTTP request handled by the worker
-					maybeCloseContext(fc.currentWorkerRequest.Value().(*http.Request).Context().Value(contextKey).(*FrankenPHPContext))
-					fc.currentWorkerRequest.Delete()
+					// Terminate the pending HTTP request handled by the worker, it may be retried by another instance
+					req := fc.currentWorkerRequest.Value().(*http.Request)
+					rfc := req.Context().Value(contextKey).(*FrankenPHPContext)
+					rfc.workerStopped = true
+
+					hl := req.Context().Value(handleKey).(*handleList)
+					hl.FreeAll()
+					hl.Handles = nil
 					fc.currentWorkerRequest = 0
+
+					maybeCloseContext(rfc)
+				}
+
+				// The instance failed to boot, the error is reported by Init instead of restarting it
+				if first && !w.daemon && !isClosed(fc.workerReady) {
+					break
 				}
 
 				// TODO: make the max restart configurable
-				if _, ok := workersRequestChans.Load(absFileName); ok {
-					workersReadyWG.Add(1)
-					if fc.exitStatus == 0 {
-						l.Info("restarting", zap.String("worker", absFileName))
-					} else {
-						l.Error("unexpected termination, restarting", zap.String("worker", absFileName), zap.Int("exit_status", int(fc.exitStatus)))
+				if _, ok := workersRequestChans.Load(absFileName); !ok {
+					break
+				}
+
+				// The instance has been stopped because idle, restart it on demand
+				if fc.idleStopped {
+					select {
+					case <-done:
+					case <-pool.wake:
 					}
+
+					if _, ok := workersRequestChans.Load(absFileName); !ok {
+						break
+					}
+
+					pool.running.Add(1)
+					l.Info("restarting idle worker on demand", zap.String("worker", absFileName))
+
+					continue
+				}
+
+				pool.restarts.Add(1)
+				if fc.exitStatus == 0 {
+					backoff.reset()
+					l.Info("restarting", zap.String("worker", absFileName))
 				} else {
-					break
+					if pool.promote != nil && !standby {
+						// keep the capacity stable: a standby instance takes over, this one restarts as a standby instance.
+						// If all the standby instances are already being promoted, this one restarts as an active instance.
+						select {
+						case pool.promote <- struct{}{}:
+							standby = true
+						default:
+						}
+					}
+
+					delay := backoff.next(time.Since(startedAt))
+					l.Error("unexpected termination, restarting", zap.String("worker", absFileName), zap.Int("exit_status", int(fc.exitStatus)), zap.Duration("delay", delay))
+
+					if delay > 0 {
+						select {
+						case <-done:
+						case <-time.After(delay):
+						}
+
+						if _, ok := workersRequestChans.Load(absFileName); !ok {
+							break
+						}
+					}
 				}
 			}
 
 			// TODO: check if the termination is expected
 			l.Debug("terminated", zap.String("worker", absFileName))
-		}()
+		}(backoff, i >= nbWorkers)
 	}
 
-	workersReadyWG.Wait()
-	m.Lock()
-	defer m.Unlock()
+	var errs []error
+	for i := 0; i < nbInstances; i++ {
+		if err := <-booted; err != nil {
+			errs = append(errs, err)
+		}
+	}
 
 	if len(errs) == 0 {
 		return nil
@@ -116,17 +617,132 @@ func startWorkers(fileName string, nbWorkers int, env map[string]string) error {
 	return fmt.Errorf("workers %q: error while starting: %w", fileName, errors.Join(errs...))
 }
 
+// WorkerQueueDepth returns the number of requests waiting for an instance of the worker script fileName to be available.
+func WorkerQueueDepth(fileName string) int {
+	absFileName, err := filepath.Abs(fileName)
+	if err != nil {
+		return 0
+	}
+
+	v, ok := workerPools.Load(absFileName)
+	if !ok {
+		return 0
+	}
+
+	return int(v.(*workerPool).queued.Load())
+}
+
+// WorkerStandby returns the number of standby instances of the worker script fileName waiting to take over from a crashed instance.
+func WorkerStandby(fileName string) int {
+	absFileName, err := filepath.Abs(fileName)
+	if err != nil {
+		return 0
+	}
+
+	v, ok := workerPools.Load(absFileName)
+	if !ok {
+		return 0
+	}
+
+	return int(v.(*workerPool).standby.Load())
+}
+
+// WorkerRestarts returns the number of times the instances of the worker script fileName have been restarted after exiting or crashing,
+// not counting the instances recycled because idle.
+func WorkerRestarts(fileName string) int {
+	absFileName, err := filepath.Abs(fileName)
+	if err != nil {
+		return 0
+	}
+
+	v, ok := workerPools.Load(absFileName)
+	if !ok {
+		return 0
+	}
+
+	return int(v.(*workerPool).restarts.Load())
+}
+
+// RecycleWorker gracefully recycles the instances of the worker script fileName, e.g. after its code has been updated, without affecting the other workers:
+// every instance is restarted once it is done with the request it is handling, if any. RecycleWorker waits until the new instances are ready
+// to handle requests, or until ctx is done. The daemons are restarted when they return, RecycleWorker doesn't wait for them.
+func RecycleWorker(ctx context.Context, fileName string) error {
+	absFileName, err := filepath.Abs(fileName)
+	if err != nil {
+		return err
+	}
+
+	v, ok := workerPools.Load(absFileName)
+	if !ok {
+		return fmt.Errorf("workers %q: %w", fileName, WorkerNotFoundError)
+	}
+	pool := v.(*workerPool)
+
+	pool.recycle()
+	getLogger().Info("recycling worker", zap.String("worker", absFileName))
+	if pool.daemon {
+		return nil
+	}
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if ready, instances := pool.readiness(); ready >= instances {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// WorkerReadiness returns the number of instances of the worker script fileName ready to handle requests since it was last recycled,
+// and the number of instances expected to be, including the standby instances but not the instances stopped because idle.
+func WorkerReadiness(fileName string) (ready, instances int) {
+	absFileName, err := filepath.Abs(fileName)
+	if err != nil {
+		return 0, 0
+	}
+
+	v, ok := workerPools.Load(absFileName)
+	if !ok {
+		return 0, 0
+	}
+
+	return v.(*workerPool).readiness()
+}
+
+// isClosed reports whether ch is closed, without blocking.
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
 func stopWorkers() {
 	workersRequestChans.Range(func(k, v any) bool {
 		workersRequestChans.Delete(k)
+		workerPools.Delete(k)
 
 		return true
 	})
 }
 
 //export go_frankenphp_worker_ready
-func go_frankenphp_worker_ready() {
-	workersReadyWG.Done()
+func go_frankenphp_worker_ready(mrh C.uintptr_t) {
+	fc := cgo.Handle(mrh).Value().(*http.Request).Context().Value(contextKey).(*FrankenPHPContext)
+
+	close(fc.workerReady)
+
+	if v, ok := workerPools.Load(fc.scriptFilename); ok {
+		v.(*workerPool).addReady(fc.workerGeneration, 1)
+	}
 }
 
 //export go_frankenphp_worker_handle_request_start
@@ -146,13 +762,120 @@ func go_frankenphp_worker_handle_request_start(mrh C.uintptr_t) C.uintptr_t {
 
 	l.Debug("waiting for request", zap.String("worker", fc.scriptFilename))
 
-	var r *http.Request
-	select {
-	case <-done:
-		l.Debug("shutting down", zap.String("worker", fc.scriptFilename))
+	v, _ = workerPools.Load(fc.scriptFilename)
+	pool, _ := v.(*workerPool)
+
+	// the warmup request is handled first
+	r := fc.workerWarmup
+	fc.workerWarmup = nil
+
+	// the instance is recycled once its max lifetime is reached, after the request it was handling
+	var expired <-chan time.Time
+	if !fc.workerExpiresAt.IsZero() {
+		ttl := time.Until(fc.workerExpiresAt)
+		if r == nil && ttl <= 0 {
+			l.Info("recycling worker after max lifetime", zap.String("worker", fc.scriptFilename))
+
+			return 0
+		}
+
+		timer := time.NewTimer(ttl)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	// the instance is recycled with its pool, after the request it was handling
+	var recycled chan struct{}
+	if pool != nil {
+		var generation int
+		if generation, recycled = pool.current(); r == nil && generation != fc.workerGeneration {
+			l.Debug("recycling worker", zap.String("worker", fc.scriptFilename))
+
+			return 0
+		}
+	}
+
+	// daemons don't handle requests, they wait for the shutdown
+	if pool != nil && pool.daemon {
+		select {
+		case <-done:
+			l.Debug("shutting down", zap.String("worker", fc.scriptFilename))
+		case <-expired:
+			l.Info("recycling worker after max lifetime", zap.String("worker", fc.scriptFilename))
+		case <-recycled:
+			l.Debug("recycling worker", zap.String("worker", fc.scriptFilename))
+		}
 
 		return 0
-	case r = <-rc:
+	}
+
+	// standby instances don't handle requests until an active instance crashes
+	if r == nil && fc.workerStandby {
+		l.Debug("waiting for promotion", zap.String("worker", fc.scriptFilename))
+
+		pool.standby.Add(1)
+		select {
+		case <-done:
+			pool.standby.Add(-1)
+			l.Debug("shutting down", zap.String("worker", fc.scriptFilename))
+
+			return 0
+		case <-expired:
+			pool.standby.Add(-1)
+			l.Info("recycling worker after max lifetime", zap.String("worker", fc.scriptFilename))
+
+			return 0
+		case <-recycled:
+			pool.standby.Add(-1)
+			l.Debug("recycling worker", zap.String("worker", fc.scriptFilename))
+
+			return 0
+		case <-pool.promote:
+			pool.standby.Add(-1)
+			fc.workerStandby = false
+			l.Info("promoting standby worker", zap.String("worker", fc.scriptFilename))
+		}
+	}
+
+	var idle <-chan time.Time
+	if pool != nil && pool.idleTimeout > 0 {
+		timer := time.NewTimer(pool.idleTimeout)
+		defer timer.Stop()
+		idle = timer.C
+	}
+
+	// the requests bound to this instance
+	var sticky chan *http.Request
+	if fc.workerInstance != nil {
+		sticky = fc.workerInstance.requests
+	}
+
+	for r == nil {
+		select {
+		case <-done:
+			l.Debug("shutting down", zap.String("worker", fc.scriptFilename))
+
+			return 0
+		case r = <-rc:
+		case r = <-sticky:
+		case <-expired:
+			l.Info("recycling worker after max lifetime", zap.String("worker", fc.scriptFilename))
+
+			return 0
+		case <-recycled:
+			l.Debug("recycling worker", zap.String("worker", fc.scriptFilename))
+
+			return 0
+		case <-idle:
+			if pool.stopIdle() {
+				l.Info("stopping idle worker", zap.String("worker", fc.scriptFilename), zap.Duration("idle_timeout", pool.idleTimeout))
+				fc.idleStopped = true
+
+				return 0
+			}
+
+			idle = time.After(pool.idleTimeout)
+		}
 	}
 
 	fc.currentWorkerRequest = cgo.NewHandle(r)
@@ -180,6 +903,13 @@ func go_frankenphp_finish_request(mrh, rh C.uintptr_t, deleteHandle bool) {
 		cgo.Handle(mrh).Value().(*http.Request).Context().Value(contextKey).(*FrankenPHPContext).currentWorkerRequest = 0
 	}
 
+	// the usage after frankenphp_finish_request() isn't accounted to the request
+	select {
+	case <-fc.done:
+	default:
+		fc.updateUsage()
+	}
+
 	maybeCloseContext(fc)
 
 	var fields []zap.Field
@@ -1,17 +1,27 @@
 package frankenphp_test
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/dunglas/frankenphp"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func TestWorker(t *testing.T) {
@@ -49,6 +59,693 @@ func TestWorkerDie(t *testing.T) {
 	}, &testOptions{workerScript: "die.php", nbWorkers: 1, nbParrallelRequests: 10})
 }
 
+func TestWorkerRestartBackoff(t *testing.T) {
+	const minDelay, maxDelay = 10 * time.Millisecond, 80 * time.Millisecond
+
+	cwd, _ := os.Getwd()
+	crashFile := filepath.Join(t.TempDir(), "crash")
+	logger, logs := observer.New(zap.InfoLevel)
+
+	crashes := func() []time.Duration {
+		var delays []time.Duration
+		for _, e := range logs.FilterMessage("unexpected termination, restarting").All() {
+			delays = append(delays, e.ContextMap()["delay"].(time.Duration))
+		}
+
+		return delays
+	}
+
+	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		// Crash repeatedly
+		assert.NoError(t, os.WriteFile(crashFile, nil, 0644))
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/worker-crash.php?crash=1", nil))
+
+		if assert.Eventually(t, func() bool { return len(crashes()) >= 5 }, 5*time.Second, 10*time.Millisecond) {
+			assert.Equal(t, []time.Duration{minDelay, 2 * minDelay, 4 * minDelay, maxDelay, maxDelay}, crashes()[:5])
+		}
+
+		// Stable operation
+		assert.NoError(t, os.Remove(crashFile))
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "http://example.com/worker-crash.php", nil))
+		assert.Equal(t, "ok", w.Body.String())
+		time.Sleep(2 * maxDelay)
+
+		// The delay is reset
+		n := len(crashes())
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/worker-crash.php?crash=1", nil))
+		if assert.Eventually(t, func() bool { return len(crashes()) > n }, 5*time.Second, 10*time.Millisecond) {
+			assert.Equal(t, minDelay, crashes()[n])
+		}
+	}, &testOptions{
+		workerScript:        "worker-crash.php",
+		nbWorkers:           1,
+		nbParrallelRequests: 1,
+		env:                 map[string]string{"CRASH_FILE": crashFile},
+		logger:              zap.New(logger),
+		initOpts:            []frankenphp.Option{frankenphp.WithWorkerRestartBackoff(cwd+"/testdata/worker-crash.php", minDelay, maxDelay)},
+	})
+}
+
+func TestWorkerWarmupParallelism(t *testing.T) {
+	const nbWorkers = 4
+
+	cwd, _ := os.Getwd()
+	// the instances wait for barrier instances to be booting at the same time, instead of relying on the boot duration
+	boot := func(parallelism, barrier int) error {
+		env := map[string]string{"BOOT_DIR": t.TempDir(), "BOOT_BARRIER": strconv.Itoa(barrier)}
+		defer frankenphp.Shutdown()
+
+		return frankenphp.Init(
+			frankenphp.WithNumThreads(nbWorkers*2),
+			frankenphp.WithWorkers(cwd+"/testdata/worker-boot-barrier.php", nbWorkers, env),
+			frankenphp.WithWarmupParallelism(parallelism),
+			frankenphp.WithLogger(zaptest.NewLogger(t)),
+		)
+	}
+
+	// all the instances boot concurrently
+	assert.NoError(t, boot(0, nbWorkers))
+	assert.NoError(t, boot(nbWorkers, nbWorkers))
+
+	// no more than parallelism instances boot at the same time
+	assert.NoError(t, boot(2, 2))
+	assert.Error(t, boot(2, 3))
+}
+
+func TestWorkersReady(t *testing.T) {
+	cwd, _ := os.Getwd()
+
+	assert.False(t, frankenphp.WorkersReady())
+
+	initialized := make(chan error)
+	go func() {
+		initialized <- frankenphp.Init(
+			frankenphp.WithWorkers(cwd+"/testdata/worker-slow-boot.php", 1, nil),
+			frankenphp.WithLogger(zaptest.NewLogger(t)),
+		)
+	}()
+
+	// the worker takes 200ms to boot
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, frankenphp.WorkersReady())
+
+	require.NoError(t, <-initialized)
+	assert.True(t, frankenphp.WorkersReady())
+
+	frankenphp.Shutdown()
+	assert.False(t, frankenphp.WorkersReady())
+}
+
+func TestWorkerWarmupFailure(t *testing.T) {
+	cwd, _ := os.Getwd()
+	crashFile := filepath.Join(t.TempDir(), "crash")
+	require.NoError(t, os.WriteFile(crashFile, nil, 0644))
+
+	err := frankenphp.Init(
+		frankenphp.WithWorkers(cwd+"/testdata/index.php", 2, nil),
+		frankenphp.WithWorkers(cwd+"/testdata/worker-crash.php", 1, map[string]string{"CRASH_FILE": crashFile}),
+		frankenphp.WithLogger(zaptest.NewLogger(t)),
+	)
+	defer frankenphp.Shutdown()
+
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "worker-crash.php")
+		assert.Contains(t, err.Error(), "exited with status 1 before being ready")
+		assert.NotContains(t, err.Error(), "index.php")
+	}
+}
+
+func TestWorkerIdleTimeout(t *testing.T) {
+	const idleTimeout = 100 * time.Millisecond
+
+	cwd, _ := os.Getwd()
+	logger, logs := observer.New(zap.InfoLevel)
+
+	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		fetch := func() string {
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest("GET", "http://example.com/worker.php", nil))
+
+			return w.Body.String()
+		}
+
+		assert.Contains(t, fetch(), "Requests handled: 0")
+		assert.Contains(t, fetch(), "Requests handled: 1")
+
+		// The idle instance is torn down
+		assert.Eventually(t, func() bool { return logs.FilterMessage("stopping idle worker").Len() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+		// A new instance is created on demand, its state is fresh
+		assert.Contains(t, fetch(), "Requests handled: 0")
+		assert.Equal(t, 1, logs.FilterMessage("restarting idle worker on demand").Len())
+	}, &testOptions{
+		workerScript:        "worker.php",
+		nbWorkers:           1,
+		nbParrallelRequests: 1,
+		logger:              zap.New(logger),
+		initOpts:            []frankenphp.Option{frankenphp.WithWorkerIdleTimeout(cwd+"/testdata/worker.php", idleTimeout, 0)},
+	})
+}
+
+func TestWorkerIdleTimeoutMinWorkers(t *testing.T) {
+	cwd, _ := os.Getwd()
+	logger, logs := observer.New(zap.InfoLevel)
+
+	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		time.Sleep(500 * time.Millisecond)
+
+		// Only the instances above the minimum are stopped
+		assert.Equal(t, 1, logs.FilterMessage("stopping idle worker").Len())
+
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "http://example.com/worker.php", nil))
+		assert.Contains(t, w.Body.String(), "Requests handled: 0")
+	}, &testOptions{
+		workerScript:        "worker.php",
+		nbWorkers:           2,
+		nbParrallelRequests: 1,
+		logger:              zap.New(logger),
+		initOpts:            []frankenphp.Option{frankenphp.WithWorkerIdleTimeout(cwd+"/testdata/worker.php", 50*time.Millisecond, 1)},
+	})
+}
+
+func TestWorkerQueueDepth(t *testing.T) {
+	cwd, _ := os.Getwd()
+	testDataDir := cwd + "/testdata/"
+	workerFile := testDataDir + "sleep.php"
+
+	require.NoError(t, frankenphp.Init(
+		frankenphp.WithWorkers(workerFile, 1, nil),
+		frankenphp.WithWorkerQueueSize(workerFile, 2),
+		frankenphp.WithLogger(zaptest.NewLogger(t)),
+	))
+	defer frankenphp.Shutdown()
+
+	serve := func() error {
+		req, err := frankenphp.NewRequestWithContext(httptest.NewRequest("GET", "http://example.com/sleep.php?sleep=500", nil), frankenphp.WithRequestDocumentRoot(testDataDir, false))
+		if err != nil {
+			return err
+		}
+
+		return frankenphp.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	assert.Equal(t, 0, frankenphp.WorkerQueueDepth(workerFile))
+
+	// The first request is handled by the only instance, the next ones are queued
+	errs := make(chan error, 3)
+	go func() { errs <- serve() }()
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- serve() }()
+	}
+	assert.Eventually(t, func() bool { return frankenphp.WorkerQueueDepth(workerFile) == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	// The queue is full
+	assert.ErrorIs(t, serve(), frankenphp.WorkerQueueFullError)
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, <-errs)
+	}
+	assert.Equal(t, 0, frankenphp.WorkerQueueDepth(workerFile))
+}
+
+func TestWorkerMaxLifetime(t *testing.T) {
+	const maxLifetime = 200 * time.Millisecond
+
+	cwd, _ := os.Getwd()
+	logger, logs := observer.New(zap.InfoLevel)
+
+	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		start := time.Now()
+		recycled := func() bool { return logs.FilterMessage("recycling worker after max lifetime").Len() > 0 }
+
+		// the instance is recycled once its lifetime, staggered by at most 10%, is reached
+		if assert.Eventually(t, recycled, 5*time.Second, 5*time.Millisecond) {
+			elapsed := time.Since(start)
+			assert.GreaterOrEqual(t, elapsed, maxLifetime-50*time.Millisecond)
+			assert.Less(t, elapsed, 3*maxLifetime)
+		}
+
+		// the recycled instance is restarted
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "http://example.com/index.php?i=1", nil))
+		assert.Equal(t, "I am by birth a Genevese (1)", w.Body.String())
+	}, &testOptions{
+		workerScript:        "index.php",
+		nbWorkers:           1,
+		nbParrallelRequests: 1,
+		logger:              zap.New(logger),
+		initOpts:            []frankenphp.Option{frankenphp.WithWorkerMaxLifetime(cwd+"/testdata/index.php", maxLifetime)},
+	})
+}
+
+func TestWorkerMaxLifetimeInvalid(t *testing.T) {
+	cwd, _ := os.Getwd()
+	workerFile := cwd + "/testdata/index.php"
+
+	assert.Error(t, frankenphp.Init(frankenphp.WithWorkers(workerFile, 1, nil), frankenphp.WithWorkerMaxLifetime(workerFile, -time.Second)))
+	assert.Error(t, frankenphp.Init(frankenphp.WithWorkerMaxLifetime(workerFile, time.Second)))
+}
+
+func TestWorkerShutdownScript(t *testing.T) {
+	cwd, _ := os.Getwd()
+	testDataDir := cwd + "/testdata/"
+	workerFile := testDataDir + "worker-recycle.php"
+	shutdownLog := filepath.Join(t.TempDir(), "shutdown.log")
+
+	require.NoError(t, frankenphp.Init(
+		frankenphp.WithWorkers(workerFile, 1, map[string]string{"SHUTDOWN_LOG": shutdownLog}),
+		frankenphp.WithWorkerShutdownScript(workerFile, testDataDir+"worker-shutdown.php"),
+		frankenphp.WithLogger(zaptest.NewLogger(t)),
+	))
+
+	readLog := func() string {
+		b, _ := os.ReadFile(shutdownLog)
+
+		return string(b)
+	}
+
+	req, err := frankenphp.NewRequestWithContext(httptest.NewRequest("GET", "http://example.com/worker-recycle.php", nil), frankenphp.WithRequestDocumentRoot(testDataDir, false))
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	require.NoError(t, frankenphp.ServeHTTP(w, req))
+	assert.Equal(t, "handled", w.Body.String())
+
+	// The instance is recycled after the request
+	assert.Eventually(t, func() bool { return readLog() == "closing connection\n" }, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "closing connection\n", readLog())
+
+	// The new instance runs the script when stopped
+	frankenphp.Shutdown()
+	assert.Equal(t, "closing connection\nclosing connection\n", readLog())
+}
+
+func TestWorkerShutdownScriptNotConfigured(t *testing.T) {
+	assert.Error(t, frankenphp.Init(frankenphp.WithWorkerShutdownScript("unknown.php", "shutdown.php")))
+}
+
+func TestWorkerStickyBy(t *testing.T) {
+	cwd, _ := os.Getwd()
+	workerFile := cwd + "/testdata/worker-instance.php"
+
+	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		fetch := func(session string) string {
+			req := httptest.NewRequest("GET", "http://example.com/worker-instance.php", nil)
+			if session != "" {
+				req.AddCookie(&http.Cookie{Name: "session", Value: session})
+			}
+
+			w := httptest.NewRecorder()
+			handler(w, req)
+
+			return w.Body.String()
+		}
+
+		instances := make(map[string]bool)
+		for _, session := range []string{"a", "b", "c", "d", "e", "f"} {
+			instance := fetch(session)
+			assert.NotEmpty(t, instance)
+			instances[instance] = true
+
+			for j := 0; j < 10; j++ {
+				assert.Equal(t, instance, fetch(session), "session %q", session)
+			}
+		}
+		// the sessions are spread across the instances
+		assert.Greater(t, len(instances), 1)
+
+		// the requests without a session are handled by any instance
+		assert.NotEmpty(t, fetch(""))
+	}, &testOptions{
+		workerScript:        "worker-instance.php",
+		nbWorkers:           4,
+		nbParrallelRequests: 1,
+		initOpts:            []frankenphp.Option{frankenphp.WithWorkerStickyBy(workerFile, "cookie", "session")},
+	})
+}
+
+func TestWorkerStickyByInvalid(t *testing.T) {
+	cwd, _ := os.Getwd()
+	workerFile := cwd + "/testdata/worker-instance.php"
+
+	assert.Error(t, frankenphp.Init(frankenphp.WithWorkers(workerFile, 1, nil), frankenphp.WithWorkerStickyBy(workerFile, "query", "session")))
+	assert.Error(t, frankenphp.Init(frankenphp.WithWorkers(workerFile, 1, nil), frankenphp.WithWorkerStickyBy(workerFile, "header", "")))
+}
+
+func TestWorkerRetryOnRestart(t *testing.T) {
+	cwd, _ := os.Getwd()
+	workerFile := cwd + "/testdata/worker-restart.php"
+	restartFile := filepath.Join(t.TempDir(), "restart")
+
+	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		// the instance stops while handling the request, the request is retried by the next available instance
+		require.NoError(t, os.WriteFile(restartFile, nil, 0644))
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "http://example.com/worker-restart.php", nil))
+		assert.NoFileExists(t, restartFile)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "ok", w.Body.String())
+
+		// non-idempotent requests are never retried
+		require.NoError(t, os.WriteFile(restartFile, nil, 0644))
+		w = httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "http://example.com/worker-restart.php", strings.NewReader("foo")))
+		assert.NoFileExists(t, restartFile)
+		assert.Empty(t, w.Body.String())
+
+		w = httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "http://example.com/worker-restart.php", strings.NewReader("foo")))
+		assert.Equal(t, "ok", w.Body.String())
+	}, &testOptions{
+		workerScript:        "worker-restart.php",
+		nbWorkers:           1,
+		nbParrallelRequests: 1,
+		env:                 map[string]string{"RESTART_FILE": restartFile},
+		initOpts:            []frankenphp.Option{frankenphp.WithWorkerRetryOnRestart(workerFile, 2)},
+	})
+}
+
+func TestWorkerRetryOnRestartVariables(t *testing.T) {
+	cwd, _ := os.Getwd()
+	workerFile := cwd + "/testdata/worker-restart.php"
+	restartFile := filepath.Join(t.TempDir(), "restart")
+
+	runTest(t, func(_ func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		// the retried request gets the same variables as the first attempt
+		require.NoError(t, os.WriteFile(restartFile, nil, 0644))
+		req, err := frankenphp.NewRequestWithContext(
+			httptest.NewRequest("GET", "http://example.com/worker-restart.php?vars=1", nil),
+			frankenphp.WithRequestDocumentRoot(cwd+"/testdata/", false),
+			frankenphp.WithRequestEnv(map[string]string{"REQUEST_URI": "/original?vars=1", "FOO": "bar", "DOCUMENT_ROOT": "/custom"}),
+		)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		require.NoError(t, frankenphp.ServeHTTP(w, req))
+		assert.NoFileExists(t, restartFile)
+		assert.Equal(t, "/original?vars=1 bar /custom", w.Body.String())
+	}, &testOptions{
+		workerScript:        "worker-restart.php",
+		nbWorkers:           1,
+		nbParrallelRequests: 1,
+		env:                 map[string]string{"RESTART_FILE": restartFile},
+		initOpts:            []frankenphp.Option{frankenphp.WithWorkerRetryOnRestart(workerFile, 2)},
+	})
+}
+
+func TestWorkerRetryOnRestartDisabled(t *testing.T) {
+	restartFile := filepath.Join(t.TempDir(), "restart")
+
+	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		require.NoError(t, os.WriteFile(restartFile, nil, 0644))
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "http://example.com/worker-restart.php", nil))
+		assert.NoFileExists(t, restartFile)
+		assert.Empty(t, w.Body.String())
+	}, &testOptions{
+		workerScript:        "worker-restart.php",
+		nbWorkers:           1,
+		nbParrallelRequests: 1,
+		env:                 map[string]string{"RESTART_FILE": restartFile},
+	})
+}
+
+func TestWorkerOptionsOrder(t *testing.T) {
+	cwd, _ := os.Getwd()
+	workerFile := cwd + "/testdata/index.php"
+
+	// the options of a worker can be passed before it is configured
+	require.NoError(t, frankenphp.Init(
+		frankenphp.WithLogger(zaptest.NewLogger(t)),
+		frankenphp.WithWorkerQueueSize(workerFile, 1),
+		frankenphp.WithWorkers(workerFile, 1, nil),
+	))
+	frankenphp.Shutdown()
+}
+
+func TestWorkerRetryOnRestartInvalid(t *testing.T) {
+	cwd, _ := os.Getwd()
+	workerFile := cwd + "/testdata/worker-restart.php"
+
+	assert.Error(t, frankenphp.Init(frankenphp.WithWorkers(workerFile, 1, nil), frankenphp.WithWorkerRetryOnRestart(workerFile, -1)))
+	assert.Error(t, frankenphp.Init(frankenphp.WithWorkerRetryOnRestart(workerFile, 1)))
+}
+
+func TestWorkerStandby(t *testing.T) {
+	cwd, _ := os.Getwd()
+	workerFile := cwd + "/testdata/worker-crash.php"
+
+	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		assert.Eventually(t, func() bool { return frankenphp.WorkerStandby(workerFile) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+		// the active instance crashes, it is restarted after a long delay
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/worker-crash.php?crash=1", nil))
+
+		// the standby instance handles the requests meanwhile
+		for j := 0; j < 3; j++ {
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest("GET", "http://example.com/worker-crash.php", nil))
+			assert.Equal(t, "ok", w.Body.String())
+		}
+		assert.Equal(t, 0, frankenphp.WorkerStandby(workerFile))
+	}, &testOptions{
+		workerScript:        "worker-crash.php",
+		nbWorkers:           1,
+		nbParrallelRequests: 1,
+		env:                 map[string]string{"CRASH_FILE": filepath.Join(t.TempDir(), "crash")},
+		initOpts: []frankenphp.Option{
+			frankenphp.WithWorkerStandby(workerFile, 1),
+			frankenphp.WithWorkerRestartBackoff(workerFile, time.Minute, time.Minute),
+		},
+	})
+}
+
+func TestWorkerStandbyInvalid(t *testing.T) {
+	cwd, _ := os.Getwd()
+	workerFile := cwd + "/testdata/worker-crash.php"
+
+	assert.Error(t, frankenphp.Init(frankenphp.WithWorkers(workerFile, 1, nil), frankenphp.WithWorkerStandby(workerFile, -1)))
+	assert.Error(t, frankenphp.Init(frankenphp.WithWorkerStandby(workerFile, 1)))
+}
+
+func TestWorkerDaemon(t *testing.T) {
+	cwd, _ := os.Getwd()
+	workerFile := cwd + "/testdata/worker-daemon.php"
+	daemonFile := filepath.Join(t.TempDir(), "daemon")
+
+	runTest(t, func(_ func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		// the daemon is restarted every time it returns
+		assert.Eventually(t, func() bool { return frankenphp.WorkerRestarts(workerFile) >= 2 }, 5*time.Second, 10*time.Millisecond)
+		runs, err := os.ReadFile(daemonFile)
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, strings.Count(string(runs), "run\n"), 3)
+
+		// it doesn't receive HTTP requests
+		req, err := frankenphp.NewRequestWithContext(httptest.NewRequest("GET", "http://example.com/worker-daemon.php", nil), frankenphp.WithRequestDocumentRoot(cwd+"/testdata/", false))
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		assert.ErrorIs(t, frankenphp.ServeHTTP(w, req), frankenphp.DaemonWorkerError)
+		assert.Empty(t, w.Body.String())
+	}, &testOptions{
+		workerScript:        "worker-daemon.php",
+		nbWorkers:           1,
+		nbParrallelRequests: 1,
+		env:                 map[string]string{"DAEMON_FILE": daemonFile},
+		initOpts:            []frankenphp.Option{frankenphp.WithWorkerDaemon(workerFile)},
+	})
+}
+
+func TestWorkerDaemonShutdown(t *testing.T) {
+	cwd, _ := os.Getwd()
+	workerFile := cwd + "/testdata/worker-daemon-loop.php"
+	daemonFile := filepath.Join(t.TempDir(), "daemon")
+
+	require.NoError(t, frankenphp.Init(
+		frankenphp.WithLogger(zaptest.NewLogger(t)),
+		frankenphp.WithWorkers(workerFile, 1, map[string]string{"DAEMON_FILE": daemonFile}),
+		frankenphp.WithWorkerDaemon(workerFile),
+	))
+
+	// the daemon is looping
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(daemonFile)
+
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		frankenphp.Shutdown()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the daemon prevents FrankenPHP from shutting down")
+	}
+}
+
+func TestWorkerDaemonInvalid(t *testing.T) {
+	cwd, _ := os.Getwd()
+	workerFile := cwd + "/testdata/worker-daemon.php"
+
+	assert.Error(t, frankenphp.Init(frankenphp.WithWorkerDaemon(workerFile)))
+
+	err := frankenphp.Init(frankenphp.WithWorkers(workerFile, 1, nil), frankenphp.WithWorkerDaemon(workerFile), frankenphp.WithWorkerStandby(workerFile, 1))
+	defer frankenphp.Shutdown()
+	assert.Error(t, err)
+}
+
+func TestRecycleWorker(t *testing.T) {
+	cwd, _ := os.Getwd()
+	workerFile := cwd + "/testdata/worker-instance.php"
+
+	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		get := func(url string) string {
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest("GET", url, nil))
+
+			return w.Body.String()
+		}
+
+		instance := get("http://example.com/worker-instance.php")
+		assert.Contains(t, get("http://example.com/worker.php"), "Requests handled: 0")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, frankenphp.RecycleWorker(ctx, workerFile))
+
+		ready, instances := frankenphp.WorkerReadiness(workerFile)
+		assert.Equal(t, 1, ready)
+		assert.Equal(t, 1, instances)
+
+		// only the recycled worker loses its state
+		assert.NotEqual(t, instance, get("http://example.com/worker-instance.php"))
+		assert.Contains(t, get("http://example.com/worker.php"), "Requests handled: 1")
+
+		assert.ErrorIs(t, frankenphp.RecycleWorker(ctx, cwd+"/testdata/unknown.php"), frankenphp.WorkerNotFoundError)
+	}, &testOptions{
+		workerScript:        "worker-instance.php",
+		nbWorkers:           1,
+		nbParrallelRequests: 1,
+		initOpts:            []frankenphp.Option{frankenphp.WithWorkers(cwd+"/testdata/worker.php", 1, nil)},
+	})
+}
+
+func TestWorkerWarmupRequest(t *testing.T) {
+	cwd, _ := os.Getwd()
+	workerFile := cwd + "/testdata/worker-warmup.php"
+
+	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "http://example.com/worker-warmup.php", nil))
+
+		// every instance handled the warmup request once, before the other requests
+		assert.Equal(t, "1", w.Body.String())
+	}, &testOptions{
+		workerScript:        "worker-warmup.php",
+		nbWorkers:           2,
+		nbParrallelRequests: 10,
+		initOpts:            []frankenphp.Option{frankenphp.WithWorkerWarmupRequest(workerFile, "/warmup?full=1", true)},
+	})
+}
+
+func TestWorkerWarmupRequestFailure(t *testing.T) {
+	cwd, _ := os.Getwd()
+	workerFile := cwd + "/testdata/worker-warmup.php"
+
+	t.Run("fatal", func(t *testing.T) {
+		err := frankenphp.Init(
+			frankenphp.WithWorkers(workerFile, 1, nil),
+			frankenphp.WithWorkerWarmupRequest(workerFile, "/warmup?fail=1", true),
+			frankenphp.WithLogger(zaptest.NewLogger(t)),
+		)
+		defer frankenphp.Shutdown()
+
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), `warmup request "/warmup?fail=1": status 500`)
+		}
+	})
+
+	t.Run("logged", func(t *testing.T) {
+		logger, logs := observer.New(zap.ErrorLevel)
+		err := frankenphp.Init(
+			frankenphp.WithWorkers(workerFile, 1, nil),
+			frankenphp.WithWorkerWarmupRequest(workerFile, "/warmup?fail=1", false),
+			frankenphp.WithLogger(zap.New(logger)),
+		)
+		defer frankenphp.Shutdown()
+
+		assert.NoError(t, err)
+		assert.Equal(t, 1, logs.FilterMessage("warmup failed").Len())
+	})
+
+	assert.Error(t, frankenphp.Init(frankenphp.WithWorkers(workerFile, 1, nil), frankenphp.WithWorkerWarmupRequest(workerFile, "warmup", false)))
+}
+
+func TestReservedThreads(t *testing.T) {
+	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		// all the worker instances are busy
+		busy := make(chan struct{})
+		for j := 0; j < 2; j++ {
+			go func() {
+				w := httptest.NewRecorder()
+				handler(w, httptest.NewRequest("GET", "http://example.com/sleep.php?sleep=1000", nil))
+				assert.Equal(t, "slept for 1000 ms", w.Body.String())
+				busy <- struct{}{}
+			}()
+		}
+		time.Sleep(100 * time.Millisecond)
+
+		// the requests not handled by workers still get a thread
+		start := time.Now()
+		for j := 0; j < 2; j++ {
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest("GET", "http://example.com/index.php?i=0", nil))
+			assert.Equal(t, "I am by birth a Genevese (0)", w.Body.String())
+		}
+		assert.Less(t, time.Since(start), 500*time.Millisecond)
+
+		<-busy
+		<-busy
+	}, &testOptions{
+		workerScript:        "sleep.php",
+		nbWorkers:           2,
+		nbParrallelRequests: 1,
+		initOpts:            []frankenphp.Option{frankenphp.WithNumThreads(4), frankenphp.WithReservedThreads(2)},
+	})
+}
+
+func TestReservedThreadsInvalid(t *testing.T) {
+	cwd, _ := os.Getwd()
+	workerFile := cwd + "/testdata/index.php"
+
+	assert.ErrorIs(t, frankenphp.Init(frankenphp.WithNumThreads(3), frankenphp.WithWorkers(workerFile, 2, nil), frankenphp.WithReservedThreads(2)), frankenphp.NotEnoughThreads)
+	assert.Error(t, frankenphp.Init(frankenphp.WithReservedThreads(0)))
+}
+
+func TestRequestWorker(t *testing.T) {
+	cwd, _ := os.Getwd()
+	testDataDir := cwd + "/testdata/"
+
+	runTest(t, func(_ func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		for script, worker := range map[string]string{"index.php": testDataDir + "index.php", "echo.php": ""} {
+			req, err := frankenphp.NewRequestWithContext(httptest.NewRequest("GET", "http://example.com/"+script+"/path", nil), frankenphp.WithRequestDocumentRoot(testDataDir, false))
+			assert.NoError(t, err)
+			assert.NoError(t, frankenphp.ServeHTTP(httptest.NewRecorder(), req))
+
+			fc, _ := frankenphp.FromContext(req.Context())
+			assert.Equal(t, "/"+script, fc.ScriptName())
+			assert.Equal(t, testDataDir+script, fc.ScriptFilename())
+			assert.Equal(t, worker, fc.Worker())
+		}
+	}, &testOptions{workerScript: "index.php", nbWorkers: 1, nbParrallelRequests: 1})
+}
+
 func TestNonWorkerModeAlwaysWorks(t *testing.T) {
 	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
 		req := httptest.NewRequest("GET", "http://example.com/index.php", nil)
@@ -88,6 +785,162 @@ func TestWorkerEnv(t *testing.T) {
 	}, &testOptions{workerScript: "env.php", nbWorkers: 1, env: map[string]string{"FOO": "bar"}, nbParrallelRequests: 10})
 }
 
+func TestWorkerEnvPrecedence(t *testing.T) {
+	runTest(t, func(_ func(http.ResponseWriter, *http.Request), _ *httptest.Server, _ int) {
+		cwd, _ := os.Getwd()
+		testDataDir := cwd + "/testdata/"
+
+		for _, tc := range []struct {
+			opts     []frankenphp.RequestOption
+			expected string
+		}{
+			// the worker env has priority over the request env
+			{[]frankenphp.RequestOption{frankenphp.WithRequestEnv(map[string]string{"FOO": "request"})}, "barbar"},
+			// the overrides have priority over both
+			{[]frankenphp.RequestOption{
+				frankenphp.WithRequestEnv(map[string]string{"FOO": "request"}),
+				frankenphp.WithRequestEnvOverrides(map[string]string{"FOO": "override"}),
+			}, "overridebar"},
+		} {
+			r := httptest.NewRequest("GET", "http://example.com/env.php", nil)
+			req, err := frankenphp.NewRequestWithContext(r, append([]frankenphp.RequestOption{frankenphp.WithRequestDocumentRoot(testDataDir, false)}, tc.opts...)...)
+			assert.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			assert.NoError(t, frankenphp.ServeHTTP(w, req))
+
+			body, _ := io.ReadAll(w.Result().Body)
+			assert.Equal(t, tc.expected, string(body))
+		}
+	}, &testOptions{workerScript: "env.php", nbWorkers: 1, env: map[string]string{"FOO": "bar"}, nbParrallelRequests: 1})
+}
+
+func TestWorkerIndex(t *testing.T) {
+	const nbWorkers = 4
+
+	var (
+		mu   sync.Mutex
+		seen = make(map[string]bool)
+	)
+	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, i int) {
+		req := httptest.NewRequest("GET", "http://example.com/worker-index.php", nil)
+		w := httptest.NewRecorder()
+		handler(w, req)
+
+		body, _ := io.ReadAll(w.Result().Body)
+
+		mu.Lock()
+		seen[string(body)] = true
+		mu.Unlock()
+	}, &testOptions{workerScript: "worker-index.php", nbWorkers: nbWorkers, nbParrallelRequests: nbWorkers})
+
+	expected := make(map[string]bool, nbWorkers)
+	for i := 0; i < nbWorkers; i++ {
+		expected[fmt.Sprintf("worker-index.php:%d", i)] = true
+	}
+	assert.Equal(t, expected, seen)
+}
+
+func TestWorkerDispatchLeastBusy(t *testing.T) {
+	cwd, _ := os.Getwd()
+
+	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, _ int) {
+		busy := make(chan string)
+		go func() {
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest("GET", "http://example.com/worker-index.php?sleep=500000", nil))
+			busy <- w.Body.String()
+		}()
+
+		// wait for the slow request to be handled by an instance
+		time.Sleep(100 * time.Millisecond)
+
+		// the requests are routed to the idle instance instead of waiting for the busy one
+		var handledBy []string
+		for i := 0; i < 4; i++ {
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest("GET", "http://example.com/worker-index.php?sleep=0", nil))
+			handledBy = append(handledBy, w.Body.String())
+		}
+
+		busyInstance := <-busy
+		for _, instance := range handledBy {
+			assert.NotEqual(t, busyInstance, instance)
+		}
+	}, &testOptions{
+		workerScript:        "worker-index.php",
+		nbWorkers:           2,
+		nbParrallelRequests: 1,
+		initOpts:            []frankenphp.Option{frankenphp.WithWorkerDispatch(cwd+"/testdata/worker-index.php", "least_busy")},
+	})
+}
+
+func TestWorkerDispatchCrashedInstance_roundRobin(t *testing.T) {
+	testWorkerDispatchCrashedInstance(t, "round_robin")
+}
+func TestWorkerDispatchCrashedInstance_random(t *testing.T) {
+	testWorkerDispatchCrashedInstance(t, "random")
+}
+func testWorkerDispatchCrashedInstance(t *testing.T, dispatch string) {
+	cwd, _ := os.Getwd()
+	workerFile := cwd + "/testdata/worker-crash.php"
+
+	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, _ int) {
+		// an instance crashes, it is restarted after a long delay
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/worker-crash.php?crash=1", nil))
+
+		// the requests are assigned to the running instance
+		for i := 0; i < 6; i++ {
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest("GET", "http://example.com/worker-crash.php", nil))
+			assert.Equal(t, "ok", w.Body.String())
+		}
+	}, &testOptions{
+		workerScript:        "worker-crash.php",
+		nbWorkers:           2,
+		nbParrallelRequests: 1,
+		env:                 map[string]string{"CRASH_FILE": filepath.Join(t.TempDir(), "crash")},
+		initOpts: []frankenphp.Option{
+			frankenphp.WithWorkerDispatch(workerFile, dispatch),
+			frankenphp.WithWorkerRestartBackoff(workerFile, time.Minute, time.Minute),
+		},
+	})
+}
+
+func TestWorkerStickyByCrashedInstance(t *testing.T) {
+	cwd, _ := os.Getwd()
+	workerFile := cwd + "/testdata/worker-crash.php"
+
+	runTest(t, func(handler func(http.ResponseWriter, *http.Request), _ *httptest.Server, _ int) {
+		fetch := func(query string) string {
+			req := httptest.NewRequest("GET", "http://example.com/worker-crash.php"+query, nil)
+			req.AddCookie(&http.Cookie{Name: "session", Value: "a"})
+
+			w := httptest.NewRecorder()
+			handler(w, req)
+
+			return w.Body.String()
+		}
+
+		// the instance the session is bound to crashes, it is restarted after a long delay
+		fetch("?crash=1")
+
+		// the requests of the session are handled by the running instance in the meantime
+		for i := 0; i < 6; i++ {
+			assert.Equal(t, "ok", fetch(""))
+		}
+	}, &testOptions{
+		workerScript:        "worker-crash.php",
+		nbWorkers:           2,
+		nbParrallelRequests: 1,
+		env:                 map[string]string{"CRASH_FILE": filepath.Join(t.TempDir(), "crash")},
+		initOpts: []frankenphp.Option{
+			frankenphp.WithWorkerStickyBy(workerFile, "cookie", "session"),
+			frankenphp.WithWorkerRestartBackoff(workerFile, time.Minute, time.Minute),
+		},
+	})
+}
+
 func ExampleServeHTTP_workers() {
 	if err := frankenphp.Init(
 		frankenphp.WithWorkers("worker1.php", 4, map[string]string{"ENV1": "foo"}),